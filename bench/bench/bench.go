@@ -98,7 +98,7 @@ func runPublisher(messages int, config *Config, wg *sync.WaitGroup, pubSamples c
 
 	acked := 0
 	for i := 0; i != messages; i++ {
-		conn.Publish(config.Topic, message, func() {
+		conn.Publish(config.Topic, message, func(offset uint64) {
 			acked++
 
 			if acked == 1 {
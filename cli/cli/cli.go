@@ -21,5 +21,12 @@ func (c *CLI) addCommands() {
 	figgCommand.AddCommand(NewSubscribeCommand(figgCommand.Config))
 	figgCommand.AddCommand(NewStreamCommand(figgCommand.Config))
 
+	logCommand := NewLogCommand()
+	logCommand.AddCommand(NewLogDumpCommand())
+	logCommand.AddCommand(NewLogVerifyCommand())
+	logCommand.AddCommand(NewLogStatsCommand())
+	logCommand.AddCommand(NewLogTruncateCommand())
+	figgCommand.AddCommand(logCommand)
+
 	c.command = figgCommand
 }
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"os"
+
+	"github.com/andydunstall/figg/server/pkg/commitlog"
+	"github.com/spf13/cobra"
+)
+
+// LogCommand groups the commands that inspect and repair commit log segments
+// directly from disk, without a running server.
+type LogCommand struct {
+	cobraCmd *cobra.Command
+}
+
+func NewLogCommand() *LogCommand {
+	cobraCmd := &cobra.Command{
+		Use:   "log",
+		Short: "Inspect and repair commit log segments offline",
+		Long: `Inspect and repair commit log segments offline.
+
+Each command takes either a segment file (such as ./data/<topic>/<offset>.data)
+or a topic directory (such as ./data/<topic>), in which case all segment files
+in the directory are used in offset order.`,
+	}
+	return &LogCommand{
+		cobraCmd: cobraCmd,
+	}
+}
+
+func (c *LogCommand) Run() error {
+	return c.cobraCmd.Execute()
+}
+
+func (c *LogCommand) CobraCommand() *cobra.Command {
+	return c.cobraCmd
+}
+
+func (c *LogCommand) AddCommand(command Command) {
+	c.cobraCmd.AddCommand(command.CobraCommand())
+}
+
+// segmentPaths returns the segment files at the given path. If the path is a
+// directory returns the segment files in the directory in offset order,
+// otherwise the path itself.
+func segmentPaths(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	return commitlog.ListSegmentFiles(path)
+}
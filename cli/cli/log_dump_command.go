@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/andydunstall/figg/server/pkg/commitlog"
+	"github.com/spf13/cobra"
+)
+
+type LogDumpCommand struct {
+	Format   string
+	cobraCmd *cobra.Command
+}
+
+func NewLogDumpCommand() *LogDumpCommand {
+	command := &LogDumpCommand{}
+	cobraCmd := &cobra.Command{
+		Use:   "dump <path>",
+		Short: "Print the records in a segment file or topic directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return command.run(args[0])
+		},
+	}
+
+	cobraCmd.Flags().StringVar(&command.Format, "format", "text", "output format, either 'text' or 'json' (where keys and values are base64 encoded)")
+
+	command.cobraCmd = cobraCmd
+	return command
+}
+
+func (c *LogDumpCommand) Run() error {
+	return c.cobraCmd.Execute()
+}
+
+func (c *LogDumpCommand) CobraCommand() *cobra.Command {
+	return c.cobraCmd
+}
+
+// dumpRecord is the JSON format of a dumped record.
+type dumpRecord struct {
+	Offset     uint64 `json:"offset"`
+	NextOffset uint64 `json:"next_offset"`
+	Key        []byte `json:"key,omitempty"`
+	Value      []byte `json:"value,omitempty"`
+	Corrupt    bool   `json:"corrupt,omitempty"`
+}
+
+func (c *LogDumpCommand) run(path string) error {
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("unknown format: %s", c.Format)
+	}
+
+	paths, err := segmentPaths(path)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, path := range paths {
+		f, err := commitlog.OpenSegmentFile(path)
+		if err != nil {
+			return err
+		}
+
+		scan, err := f.Scan(func(r commitlog.SegmentFileRecord) error {
+			if c.Format == "json" {
+				return encoder.Encode(dumpRecord{
+					Offset:     r.Offset,
+					NextOffset: r.NextOffset,
+					Key:        r.Key,
+					Value:      r.Value,
+					Corrupt:    r.Err != nil,
+				})
+			}
+
+			if r.Err != nil {
+				fmt.Printf("offset=%d next-offset=%d corrupt\n", r.Offset, r.NextOffset)
+			} else if r.Key != nil {
+				fmt.Printf("offset=%d next-offset=%d key=%q value=%q\n", r.Offset, r.NextOffset, r.Key, r.Value)
+			} else {
+				fmt.Printf("offset=%d next-offset=%d value=%q\n", r.Offset, r.NextOffset, r.Value)
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		// Note warnings are written to stderr so the output is still valid
+		// JSON.
+		if scan.CorruptBlock {
+			fmt.Fprintf(os.Stderr, "%s: stopped at corrupt block\n", path)
+		}
+		if scan.TrailingBytes > 0 {
+			fmt.Fprintf(os.Stderr, "%s: %d unreadable trailing bytes\n", path, scan.TrailingBytes)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/andydunstall/figg/server/pkg/commitlog"
+	"github.com/spf13/cobra"
+)
+
+type LogStatsCommand struct {
+	cobraCmd *cobra.Command
+}
+
+func NewLogStatsCommand() *LogStatsCommand {
+	command := &LogStatsCommand{}
+	cobraCmd := &cobra.Command{
+		Use:   "stats <path>",
+		Short: "Print record counts and sizes of a segment file or topic directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return command.run(args[0])
+		},
+	}
+	command.cobraCmd = cobraCmd
+	return command
+}
+
+func (c *LogStatsCommand) Run() error {
+	return c.cobraCmd.Execute()
+}
+
+func (c *LogStatsCommand) CobraCommand() *cobra.Command {
+	return c.cobraCmd
+}
+
+// segmentStats contains the stats of one or more segments.
+type segmentStats struct {
+	Records        int
+	KeyedRecords   int
+	CorruptRecords int
+	// FileBytes is the size of the segment files.
+	FileBytes uint64
+	// DataBytes is the size of the records, which if compressed is the
+	// uncompressed size.
+	DataBytes uint64
+	// ValueBytes is the size of the record values.
+	ValueBytes    uint64
+	MaxValueBytes uint64
+}
+
+func (s *segmentStats) Add(o segmentStats) {
+	s.Records += o.Records
+	s.KeyedRecords += o.KeyedRecords
+	s.CorruptRecords += o.CorruptRecords
+	s.FileBytes += o.FileBytes
+	s.DataBytes += o.DataBytes
+	s.ValueBytes += o.ValueBytes
+	if o.MaxValueBytes > s.MaxValueBytes {
+		s.MaxValueBytes = o.MaxValueBytes
+	}
+}
+
+func (c *LogStatsCommand) run(path string) error {
+	paths, err := segmentPaths(path)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tCOMPRESSION\tCOMPACTED\tRECORDS\tKEYED\tCORRUPT\tFILE BYTES\tDATA BYTES\tAVG VALUE\tMAX VALUE")
+
+	total := segmentStats{}
+	for _, path := range paths {
+		f, err := commitlog.OpenSegmentFile(path)
+		if err != nil {
+			return err
+		}
+
+		stats := segmentStats{
+			FileBytes: f.FileSize,
+			DataBytes: f.DataSize,
+		}
+		_, err = f.Scan(func(r commitlog.SegmentFileRecord) error {
+			stats.Records++
+			if r.Err != nil {
+				stats.CorruptRecords++
+				return nil
+			}
+			if r.Key != nil {
+				stats.KeyedRecords++
+			}
+			valueBytes := uint64(len(r.Value))
+			stats.ValueBytes += valueBytes
+			if valueBytes > stats.MaxValueBytes {
+				stats.MaxValueBytes = valueBytes
+			}
+			return nil
+		})
+		compression := f.Compression
+		compacted := f.Compacted
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(
+			w, "%s\t%s\t%t\t%s\n",
+			path, compression, compacted, formatStats(stats),
+		)
+		total.Add(stats)
+	}
+
+	if len(paths) > 1 {
+		fmt.Fprintf(w, "total\t\t\t%s\n", formatStats(total))
+	}
+	return w.Flush()
+}
+
+func formatStats(s segmentStats) string {
+	avgValueBytes := uint64(0)
+	if valid := s.Records - s.CorruptRecords; valid > 0 {
+		avgValueBytes = s.ValueBytes / uint64(valid)
+	}
+	return fmt.Sprintf(
+		"%d\t%d\t%d\t%d\t%d\t%d\t%d",
+		s.Records, s.KeyedRecords, s.CorruptRecords,
+		s.FileBytes, s.DataBytes, avgValueBytes, s.MaxValueBytes,
+	)
+}
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/andydunstall/figg/server/pkg/commitlog"
+	"github.com/spf13/cobra"
+)
+
+type LogTruncateCommand struct {
+	cobraCmd *cobra.Command
+}
+
+func NewLogTruncateCommand() *LogTruncateCommand {
+	command := &LogTruncateCommand{}
+	cobraCmd := &cobra.Command{
+		Use:   "truncate <path>",
+		Short: "Cut a segment file after its last valid record",
+		Long: `Cut a segment file after its last valid record.
+
+Removes the first corrupt or partial record and all records following it, in
+each segment file at the given path. Segments that are already valid are left
+unchanged.
+
+The server must not be running when truncating its segments.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return command.run(args[0])
+		},
+	}
+	command.cobraCmd = cobraCmd
+	return command
+}
+
+func (c *LogTruncateCommand) Run() error {
+	return c.cobraCmd.Execute()
+}
+
+func (c *LogTruncateCommand) CobraCommand() *cobra.Command {
+	return c.cobraCmd
+}
+
+func (c *LogTruncateCommand) run(path string) error {
+	paths, err := segmentPaths(path)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		removed, err := commitlog.TruncateSegmentFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if removed > 0 {
+			fmt.Printf("%s: truncated %d bytes\n", path, removed)
+		} else {
+			fmt.Printf("%s: ok\n", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/andydunstall/figg/server/pkg/commitlog"
+	"github.com/spf13/cobra"
+)
+
+type LogVerifyCommand struct {
+	cobraCmd *cobra.Command
+}
+
+func NewLogVerifyCommand() *LogVerifyCommand {
+	command := &LogVerifyCommand{}
+	cobraCmd := &cobra.Command{
+		Use:   "verify <path>",
+		Short: "Check the records in a segment file or topic directory are valid",
+		Long: `Check the records in a segment file or topic directory are valid.
+
+Checks each segment has a valid header, each record matches its checksum and
+the segment doesn't end with a partial record. If the segment is compressed,
+also checks each block matches its checksum. Exits with an error if any segment
+is invalid.`,
+		Args: cobra.ExactArgs(1),
+		// Invalid segments are reported as an error, which isn't a usage
+		// error.
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return command.run(args[0])
+		},
+	}
+	command.cobraCmd = cobraCmd
+	return command
+}
+
+func (c *LogVerifyCommand) Run() error {
+	return c.cobraCmd.Execute()
+}
+
+func (c *LogVerifyCommand) CobraCommand() *cobra.Command {
+	return c.cobraCmd
+}
+
+func (c *LogVerifyCommand) run(path string) error {
+	paths, err := segmentPaths(path)
+	if err != nil {
+		return err
+	}
+
+	invalid := 0
+	for _, path := range paths {
+		f, err := commitlog.OpenSegmentFile(path)
+		if err != nil {
+			fmt.Printf("%s: %s\n", path, err)
+			invalid++
+			continue
+		}
+
+		scan, err := f.Scan(func(r commitlog.SegmentFileRecord) error {
+			if r.Err != nil {
+				fmt.Printf("%s: corrupt record at offset %d\n", path, r.Offset)
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		if scan.Valid() {
+			fmt.Printf("%s: ok (%d records)\n", path, scan.Records)
+			continue
+		}
+
+		invalid++
+		if scan.CorruptBlock {
+			fmt.Printf("%s: corrupt compressed block after %d records\n", path, scan.Records)
+		}
+		if scan.TrailingBytes > 0 {
+			fmt.Printf("%s: %d unreadable trailing bytes\n", path, scan.TrailingBytes)
+		}
+		fmt.Printf(
+			"%s: invalid (%d records, %d corrupt)\n",
+			path, scan.Records, scan.CorruptRecords,
+		)
+	}
+
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d segments invalid", invalid, len(paths))
+	}
+	return nil
+}
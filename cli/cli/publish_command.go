@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"fmt"
+
 	figg "github.com/andydunstall/figg/sdk/go"
 	"github.com/spf13/cobra"
 )
@@ -41,6 +43,10 @@ func (c *PublishCommand) run(topic string, message []byte) error {
 		return err
 	}
 
-	client.PublishWaitForACK(topic, message)
+	offset, err := client.PublishWaitForACK(topic, message)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("offset=%d\n", offset)
 	return nil
 }
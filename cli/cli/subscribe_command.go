@@ -44,10 +44,15 @@ func (c *SubscribeCommand) run(topic string) error {
 	if err != nil {
 		return err
 	}
-	client.Subscribe(topic, func(m *figg.Message) {
+	// Subscribe until the server detaches the subscription, such as if the
+	// topic is deleted.
+	detached := make(chan error, 1)
+	if err := client.Subscribe(topic, func(m *figg.Message) {
 		fmt.Println("<-", string(m.Data))
-	})
-
-	select {}
-	return nil
+	}, figg.WithOnDetached(func(reason error) {
+		detached <- reason
+	})); err != nil {
+		return err
+	}
+	return <-detached
 }
@@ -6,14 +6,21 @@ require github.com/spf13/cobra v1.6.1
 
 require (
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
+	github.com/klauspost/compress v1.17.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
-	go.uber.org/zap v1.23.0 // indirect
+	go.uber.org/zap v1.23.0
 )
 
 require github.com/andydunstall/figg/sdk/go v0.0.0
+
 replace github.com/andydunstall/figg/sdk/go v0.0.0 => ../sdk/go
 
 require github.com/andydunstall/figg/utils v0.0.0 // indirect
+
 replace github.com/andydunstall/figg/utils v0.0.0 => ../utils
+
+require github.com/andydunstall/figg/server v0.0.0
+
+replace github.com/andydunstall/figg/server v0.0.0 => ../server
@@ -36,9 +36,12 @@ func NewNode(logger *zap.Logger) (*Node, error) {
 	proxyAddr := proxyListener.Addr().String()
 
 	config := config.Config{
-		Addr:                 "127.0.0.1:0",
-		CommitLogDir:         "./data",
-		CommitLogSegmentSize: 4194304,
+		Addr:                          "127.0.0.1:0",
+		MessagingSlowSubscriberPolicy: "demote",
+		CommitLogDir:                  "./data",
+		CommitLogSegmentSize:          4194304,
+		CommitLogDurability:           "none",
+		CommitLogCompression:          "none",
 	}
 
 	procLogger, err := newLogger(id)
@@ -19,7 +19,10 @@ require github.com/andydunstall/figg/server v0.0.0
 
 replace github.com/andydunstall/figg/server v0.0.0 => ../../server
 
-require github.com/andydunstall/figg/utils v0.0.0 // indirect
+require (
+	github.com/andydunstall/figg/utils v0.0.0 // indirect
+	github.com/klauspost/compress v1.17.0 // indirect
+)
 
 replace github.com/andydunstall/figg/utils v0.0.0 => ../../utils
 
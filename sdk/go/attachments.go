@@ -2,20 +2,43 @@ package figg
 
 import (
 	"sync"
+	"time"
+
+	"github.com/andydunstall/figg/utils"
 )
 
 type attachingAttachment struct {
 	Name       string
 	FromOffset bool
 	Offset     uint64
+	FromTime   bool
+	Timestamp  time.Time
+	FromLastN  bool
+	LastN      uint64
 	OnAttached func()
 	OnMessage  MessageCB
+	// OnDetached is called if the server detaches the topic, with the
+	// reason why. May be nil.
+	OnDetached func(reason error)
+}
+
+// EncodeAttachMessage returns the ATTACH message to request the attachment.
+func (a attachingAttachment) EncodeAttachMessage() []byte {
+	if a.FromOffset {
+		return utils.EncodeAttachFromOffsetMessage(a.Name, a.Offset)
+	} else if a.FromTime {
+		return utils.EncodeAttachFromTimestampMessage(a.Name, uint64(a.Timestamp.UnixMilli()))
+	} else if a.FromLastN {
+		return utils.EncodeAttachLastNMessage(a.Name, a.LastN)
+	}
+	return utils.EncodeAttachMessage(a.Name)
 }
 
 type attachedAttachment struct {
-	Name      string
-	Offset    uint64
-	OnMessage MessageCB
+	Name       string
+	Offset     uint64
+	OnMessage  MessageCB
+	OnDetached func(reason error)
 }
 
 type attachments struct {
@@ -37,36 +60,60 @@ func newAttachments() *attachments {
 }
 
 // AddAttaching adds a new attaching attachment for the topic with the given name.
-// When the topic becomes attached the onAttached callback is called.
-func (a *attachments) AddAttaching(name string, onAttached func(), onMessage MessageCB) error {
-	// Don't allow attaching multiple times.
-	if a.isAttaching(name) || a.isAttached(name) {
-		return ErrAlreadySubscribed
-	}
-
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// When the topic becomes attached the onAttached callback is called. If the
+// server detaches the topic, either while attaching or once attached, the
+// onDetached callback is called with the reason.
+func (a *attachments) AddAttaching(name string, onAttached func(), onMessage MessageCB, onDetached func(reason error)) error {
+	return a.addAttaching(attachingAttachment{
+		Name:       name,
+		OnAttached: onAttached,
+		OnMessage:  onMessage,
+		OnDetached: onDetached,
+	})
+}
 
-	// If we are trying to detach the topic stop. Otherwise may attach then
-	// immediately detach.
-	delete(a.detaching, name)
+// AddAttachingFromOffset is the same as AddAttaching except it requests an offset
+// to attach from.
+func (a *attachments) AddAttachingFromOffset(name string, offset uint64, onAttached func(), onMessage MessageCB, onDetached func(reason error)) error {
+	return a.addAttaching(attachingAttachment{
+		Name:       name,
+		FromOffset: true,
+		Offset:     offset,
+		OnAttached: onAttached,
+		OnMessage:  onMessage,
+		OnDetached: onDetached,
+	})
+}
 
-	a.attaching[name] = attachingAttachment{
+// AddAttachingFromTime is the same as AddAttaching except it requests to attach
+// from the messages published at or after the given time.
+func (a *attachments) AddAttachingFromTime(name string, timestamp time.Time, onAttached func(), onMessage MessageCB, onDetached func(reason error)) error {
+	return a.addAttaching(attachingAttachment{
 		Name:       name,
-		FromOffset: false,
-		Offset:     0,
+		FromTime:   true,
+		Timestamp:  timestamp,
 		OnAttached: onAttached,
 		OnMessage:  onMessage,
-	}
+		OnDetached: onDetached,
+	})
+}
 
-	return nil
+// AddAttachingLastN is the same as AddAttaching except it requests to attach
+// from the last n messages published to the topic.
+func (a *attachments) AddAttachingLastN(name string, n uint64, onAttached func(), onMessage MessageCB, onDetached func(reason error)) error {
+	return a.addAttaching(attachingAttachment{
+		Name:       name,
+		FromLastN:  true,
+		LastN:      n,
+		OnAttached: onAttached,
+		OnMessage:  onMessage,
+		OnDetached: onDetached,
+	})
 }
 
-// AddAttachingFromOffset is the same as AddAttaching except it requests an offset
-// to attach from.
-func (a *attachments) AddAttachingFromOffset(name string, offset uint64, onAttached func(), onMessage MessageCB) error {
+func (a *attachments) addAttaching(attachment attachingAttachment) error {
 	// Don't allow attaching multiple times.
-	if a.isAttaching(name) || a.isAttached(name) {
+	if a.isAttaching(attachment.Name) || a.isAttached(attachment.Name) {
 		return ErrAlreadySubscribed
 	}
 
@@ -75,15 +122,9 @@ func (a *attachments) AddAttachingFromOffset(name string, offset uint64, onAttac
 
 	// If we are trying to detach the topic stop. Otherwise may attach then
 	// immediately detach.
-	delete(a.detaching, name)
+	delete(a.detaching, attachment.Name)
 
-	a.attaching[name] = attachingAttachment{
-		Name:       name,
-		FromOffset: true,
-		Offset:     offset,
-		OnAttached: onAttached,
-		OnMessage:  onMessage,
-	}
+	a.attaching[attachment.Name] = attachment
 
 	return nil
 }
@@ -157,17 +198,42 @@ func (a *attachments) OnAttached(name string, offset uint64) {
 	delete(a.attaching, name)
 
 	a.attached[name] = attachedAttachment{
-		Name:      name,
-		Offset:    offset,
-		OnMessage: attaching.OnMessage,
+		Name:       name,
+		Offset:     offset,
+		OnMessage:  attaching.OnMessage,
+		OnDetached: attaching.OnDetached,
 	}
 }
 
-func (a *attachments) OnDetached(name string) {
+// OnDetached updates the attachments with a DETACHED response.
+//
+// If the reason is nil the client requested to detach, so this just removes
+// the detaching topic. Otherwise the server detached the topic, so it is
+// removed (and won't be reattached on reconnect) and the registered onDetached
+// callback is called with the reason.
+func (a *attachments) OnDetached(name string, reason error) {
 	a.mu.Lock()
-	defer a.mu.Unlock()
 
 	delete(a.detaching, name)
+	if reason == nil {
+		a.mu.Unlock()
+		return
+	}
+
+	var onDetached func(reason error)
+	if attaching, ok := a.attaching[name]; ok {
+		onDetached = attaching.OnDetached
+		delete(a.attaching, name)
+	} else if attached, ok := a.attached[name]; ok {
+		onDetached = attached.OnDetached
+		delete(a.attached, name)
+	}
+	a.mu.Unlock()
+
+	// Call without holding the lock in case the callback resubscribes.
+	if onDetached != nil {
+		onDetached(reason)
+	}
 }
 
 func (a *attachments) OnMessage(name string, m *Message) {
@@ -4,6 +4,7 @@ import (
 	"sort"
 	"testing"
 
+	"github.com/andydunstall/figg/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,9 +12,9 @@ func TestAttachments_Attaching(t *testing.T) {
 	attachments := newAttachments()
 
 	onAttach := func() {}
-	attachments.AddAttaching("foo", onAttach, nil)
-	attachments.AddAttachingFromOffset("bar", 10, onAttach, nil)
-	attachments.AddAttaching("car", onAttach, nil)
+	attachments.AddAttaching("foo", onAttach, nil, nil)
+	attachments.AddAttachingFromOffset("bar", 10, onAttach, nil, nil)
+	attachments.AddAttaching("car", onAttach, nil, nil)
 
 	// After becoming attached the topic 'car' should no longer be Attaching.
 	attachments.OnAttached("car", 20)
@@ -42,12 +43,12 @@ func TestAttachments_OnAttached(t *testing.T) {
 	fooAttached := false
 	attachments.AddAttaching("foo", func() {
 		fooAttached = true
-	}, nil)
+	}, nil, nil)
 
 	barAttached := false
 	attachments.AddAttachingFromOffset("bar", 10, func() {
 		barAttached = true
-	}, nil)
+	}, nil, nil)
 
 	attachments.OnAttached("foo", 20)
 	attachments.OnAttached("bar", 10)
@@ -77,10 +78,10 @@ func TestAttachments_AttachingAndAttachedClearedWhenDetaching(t *testing.T) {
 	attachments := newAttachments()
 
 	// Add attaching topic.
-	attachments.AddAttaching("foo", func() {}, nil)
+	attachments.AddAttaching("foo", func() {}, nil, nil)
 
 	// Add attached topic.
-	attachments.AddAttaching("bar", func() {}, nil)
+	attachments.AddAttaching("bar", func() {}, nil, nil)
 	attachments.OnAttached("bar", 10)
 
 	// Make both the above topics detaching. This should remove from attaching
@@ -96,16 +97,16 @@ func TestAttachments_AttachToDetachingChannel(t *testing.T) {
 	attachments := newAttachments()
 
 	// Add attaching topics.
-	attachments.AddAttaching("foo", func() {}, nil)
-	attachments.AddAttachingFromOffset("bar", 10, func() {}, nil)
+	attachments.AddAttaching("foo", func() {}, nil, nil)
+	attachments.AddAttachingFromOffset("bar", 10, func() {}, nil, nil)
 
 	// Replace with detaching topic.
 	attachments.AddDetaching("foo")
 	attachments.AddDetaching("bar")
 
 	// Attach again before becoming detached.
-	attachments.AddAttaching("foo", func() {}, nil)
-	attachments.AddAttachingFromOffset("bar", 10, func() {}, nil)
+	attachments.AddAttaching("foo", func() {}, nil, nil)
+	attachments.AddAttachingFromOffset("bar", 10, func() {}, nil, nil)
 
 	// Check its not attaching not detaching
 	attaching := attachments.Attaching()
@@ -123,8 +124,8 @@ func TestAttachments_Detaching(t *testing.T) {
 	attachments := newAttachments()
 
 	// Add attaching topics.
-	attachments.AddAttaching("foo", func() {}, nil)
-	attachments.AddAttachingFromOffset("bar", 10, func() {}, nil)
+	attachments.AddAttaching("foo", func() {}, nil, nil)
+	attachments.AddAttachingFromOffset("bar", 10, func() {}, nil, nil)
 
 	// Replace with detaching topic.
 	attachments.AddDetaching("foo")
@@ -140,20 +141,48 @@ func TestAttachments_OnDetached(t *testing.T) {
 	attachments := newAttachments()
 
 	// Add attaching topics.
-	attachments.AddAttaching("foo", func() {}, nil)
-	attachments.AddAttachingFromOffset("bar", 10, func() {}, nil)
+	attachments.AddAttaching("foo", func() {}, nil, nil)
+	attachments.AddAttachingFromOffset("bar", 10, func() {}, nil, nil)
 
 	// Replace with detaching topic.
 	attachments.AddDetaching("foo")
 	attachments.AddDetaching("bar")
 
 	// Detach one of the topics.
-	attachments.OnDetached("foo")
+	attachments.OnDetached("foo", nil)
 
 	detaching := attachments.Detaching()
 	assert.Equal(t, []string{"bar"}, detaching)
 }
 
+func TestAttachments_OnDetachedByServer(t *testing.T) {
+	attachments := newAttachments()
+
+	reasons := make(map[string]error)
+	onDetached := func(name string) func(reason error) {
+		return func(reason error) {
+			reasons[name] = reason
+		}
+	}
+	attachments.AddAttaching("foo", func() {}, nil, onDetached("foo"))
+	attachments.AddAttaching("bar", func() {}, nil, onDetached("bar"))
+	attachments.OnAttached("bar", 10)
+
+	reason := &DetachedError{
+		Code:    utils.ErrorCodeTopicDeleted,
+		Message: "topic deleted",
+	}
+	attachments.OnDetached("foo", reason)
+	attachments.OnDetached("bar", reason)
+
+	// Both the attaching and attached topics should be removed so they
+	// aren't reattached on reconnect.
+	assert.Equal(t, 0, len(attachments.Attaching()))
+	assert.Equal(t, 0, len(attachments.Attached()))
+	assert.Equal(t, reason, reasons["foo"])
+	assert.Equal(t, reason, reasons["bar"])
+}
+
 func TestAttachments_OnMessage(t *testing.T) {
 	messages := []*Message{}
 	attachments := newAttachments()
@@ -161,7 +190,7 @@ func TestAttachments_OnMessage(t *testing.T) {
 	// Add attached topic.
 	attachments.AddAttaching("foo", func() {}, func(m *Message) {
 		messages = append(messages, m)
-	})
+	}, nil)
 	attachments.OnAttached("foo", 10)
 
 	attachments.OnMessage("foo", &Message{
@@ -0,0 +1,122 @@
+package figg
+
+import (
+	"sync"
+	"time"
+
+	"github.com/andydunstall/figg/utils"
+)
+
+// pendingBatch contains the messages waiting to be published to a topic in a
+// batch.
+type pendingBatch struct {
+	messages []utils.BatchMessage
+	// onACKs and onErrors contain the callbacks of each message.
+	onACKs   []func(offset uint64)
+	onErrors []func(err error)
+	// size is the number of bytes of keys and data in the batch.
+	size int
+	// timer flushes the batch once the linger duration has passed.
+	timer *time.Timer
+}
+
+// batcher batches messages published to each topic, so publishing many small
+// messages is sent as a few large batches.
+//
+// Messages are added to a pending batch for their topic. The batch is flushed
+// either once the linger duration has passed since the first message was
+// added, or once the batch reaches the maximum size, whichever is first.
+type batcher struct {
+	linger  time.Duration
+	maxSize int
+	// flush publishes the batch to the topic. This is called with the mutex
+	// held so batches are published in order.
+	flush func(topic string, batch *pendingBatch)
+
+	// mu is a mutex protecting the below fields.
+	mu      sync.Mutex
+	batches map[string]*pendingBatch
+	closed  bool
+}
+
+func newBatcher(linger time.Duration, maxSize int, flush func(topic string, batch *pendingBatch)) *batcher {
+	return &batcher{
+		linger:  linger,
+		maxSize: maxSize,
+		flush:   flush,
+		mu:      sync.Mutex{},
+		batches: make(map[string]*pendingBatch),
+		closed:  false,
+	}
+}
+
+// Add adds the message to the pending batch for the topic. If the batch is
+// full it is flushed immediately.
+func (b *batcher) Add(topic string, key []byte, data []byte, onACK func(offset uint64), onError func(err error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batch, ok := b.batches[topic]
+	if !ok {
+		batch = &pendingBatch{}
+		b.batches[topic] = batch
+		if !b.closed {
+			batch.timer = time.AfterFunc(b.linger, func() {
+				b.flushIfPending(topic, batch)
+			})
+		}
+	}
+	batch.messages = append(batch.messages, utils.BatchMessage{
+		Key:  key,
+		Data: data,
+	})
+	batch.onACKs = append(batch.onACKs, onACK)
+	batch.onErrors = append(batch.onErrors, onError)
+	batch.size += len(key) + len(data)
+
+	if batch.size >= b.maxSize || b.closed {
+		b.flushLocked(topic, batch)
+	}
+}
+
+// Flush flushes the pending batch for the topic, if any.
+func (b *batcher) Flush(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if batch, ok := b.batches[topic]; ok {
+		b.flushLocked(topic, batch)
+	}
+}
+
+// Close flushes all pending batches. Any messages added after closing are
+// flushed immediately.
+func (b *batcher) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for topic, batch := range b.batches {
+		b.flushLocked(topic, batch)
+	}
+}
+
+// flushIfPending flushes the given batch unless it has already been flushed.
+func (b *batcher) flushIfPending(topic string, batch *pendingBatch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.batches[topic] == batch {
+		b.flushLocked(topic, batch)
+	}
+}
+
+// flushLocked removes the pending batch and flushes it. The mutex must be
+// held.
+func (b *batcher) flushLocked(topic string, batch *pendingBatch) {
+	if batch.timer != nil {
+		batch.timer.Stop()
+	}
+	delete(b.batches, topic)
+	b.flush(topic, batch)
+}
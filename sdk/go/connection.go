@@ -2,6 +2,8 @@ package figg
 
 import (
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -11,16 +13,82 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	sdkName    = "figg-go"
+	sdkVersion = "0.1.0"
+
+	// handshakeTimeout is the maximum time to wait for the server to respond
+	// to CONNECT.
+	handshakeTimeout = time.Second * 5
+)
+
 var (
 	ErrNotConnected = errors.New("not connected")
+	// ErrUnsupportedFeature is returned when subscribing with an option or
+	// publishing a batch the server doesn't support.
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+	// ErrEmptyBatch is returned when publishing a batch with no messages.
+	ErrEmptyBatch = errors.New("empty batch")
 )
 
+// ConnectError is returned when the server rejects the connection, such as
+// if the client and server don't support a common protocol version.
+type ConnectError struct {
+	// Code identifies why the connection was rejected.
+	Code utils.ErrorCode
+	// Message describes why the connection was rejected.
+	Message string
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connect rejected: %s: %s", e.Code, e.Message)
+}
+
+// PublishError is returned when the server rejects a published message.
+type PublishError struct {
+	// Code identifies why the message was rejected.
+	Code utils.ErrorCode
+	// Message describes why the message was rejected.
+	Message string
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("publish rejected: %s: %s", e.Code, e.Message)
+}
+
+// DetachedError is the reason the server detached a subscription, such as if
+// the topic was deleted.
+type DetachedError struct {
+	// Code identifies why the subscription was detached.
+	Code utils.ErrorCode
+	// Message describes why the subscription was detached.
+	Message string
+}
+
+func (e *DetachedError) Error() string {
+	return fmt.Sprintf("detached: %s: %s", e.Code, e.Message)
+}
+
 type connection struct {
 	onStateChange func(state ConnState)
 	opts          *Options
 
 	attachments *attachments
 	window      *slidingWindow
+	// producerID identifies the connection to the server when publishing
+	// idempotently. Since the sequence numbers of unacknowledged messages
+	// are kept across reconnects, the server uses the producer ID and
+	// sequence number to discard messages that are resent after
+	// reconnecting but were already added. Note this must not be reused by
+	// another connection as its sequence numbers start from 0.
+	//
+	// The producer ID is generated randomly for each client and can't be
+	// configured, so messages are only deduplicated while the same client
+	// is resending them, not across client restarts.
+	producerID string
+	// batcher batches published messages if the Linger option is set, or is
+	// nil otherwise.
+	batcher *batcher
 
 	// shutdown is an atomic flag indicating if the client has been shutdown.
 	shutdown int32
@@ -37,6 +105,9 @@ type connection struct {
 	reader *utils.BufferedReader
 	// writer writes messages to the connection.
 	writer *utils.BufferedWriter
+	// features are the optional protocol features agreed with the server
+	// when connecting. Kept after disconnecting until the client reconnects.
+	features utils.Features
 
 	// outstandingPings is the number of pings that have been sent but not
 	// acknowledged with a pong.
@@ -44,22 +115,30 @@ type connection struct {
 }
 
 func newConnection(onStateChange func(state ConnState), opts *Options) *connection {
-	return &connection{
+	c := &connection{
 		onStateChange: onStateChange,
 		opts:          opts,
 		attachments:   newAttachments(),
-		window:        newSlidingWindow(opts.WindowSize),
+		producerID:    fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64()),
 		shutdown:      0,
 		done:          make(chan interface{}),
 		mu:            sync.Mutex{},
 		conn:          nil,
 		reader:        nil,
 		writer:        nil,
+		features:      0,
+	}
+	c.window = newSlidingWindow(opts.WindowSize, c.sendPublish)
+	if opts.Linger > 0 {
+		c.batcher = newBatcher(opts.Linger, opts.BatchSize, c.publishPendingBatch)
 	}
+	return c
 }
 
+// Connect connects to the server. If the server rejects the connection
+// returns a *ConnectError.
 func (c *connection) Connect() error {
-	conn, err := c.opts.Dialer.Dial("tcp", c.opts.Addr)
+	conn, reader, features, err := c.dial()
 	if err != nil {
 		c.opts.Logger.Error(
 			"connection failed",
@@ -69,13 +148,50 @@ func (c *connection) Connect() error {
 		return err
 	}
 
-	c.onConnect(conn)
+	c.onConnect(conn, reader, features)
+
+	return nil
+}
+
+// Publish publishes the data to the topic. onACK is called with the topic
+// offset of the message once the server acknowledges the message, or onError
+// if the server rejects the message.
+//
+// If the Linger option is set, the message is added to a batch that is
+// published once the linger duration has passed or the batch is full.
+func (c *connection) Publish(name string, key []byte, data []byte, onACK func(offset uint64), onError func(err error)) {
+	if c.batcher != nil {
+		c.batcher.Add(name, key, data, onACK, onError)
+		return
+	}
+	c.publish(name, key, data, onACK, onError)
+}
 
+// PublishBatch publishes the messages to the topic in a single batch, which
+// the server adds to the topic atomically. onACK is called with the topic
+// offset of each message once the server acknowledges the batch, or onError if
+// the server rejects the batch.
+//
+// Returns ErrUnsupportedFeature if the server doesn't support batches.
+func (c *connection) PublishBatch(name string, messages []utils.BatchMessage, onACK func(offsets []uint64), onError func(err error)) error {
+	if len(messages) == 0 {
+		return ErrEmptyBatch
+	}
+	if !c.hasFeatures(utils.FeaturePublishBatch) {
+		return ErrUnsupportedFeature
+	}
+	// Publish any messages waiting to be batched first so they stay in
+	// order.
+	if c.batcher != nil {
+		c.batcher.Flush(name)
+	}
+	c.publishBatch(name, messages, onACK, onError)
 	return nil
 }
 
-func (c *connection) Publish(name string, data []byte, onACK func()) {
-	seqNum := c.window.Push(name, data, onACK)
+func (c *connection) publish(name string, key []byte, data []byte, onACK func(offset uint64), onError func(err error)) {
+	// Note the window sends the message.
+	seqNum := c.window.Push(name, key, data, onACK, onError)
 
 	c.opts.Logger.Debug(
 		"publish",
@@ -83,23 +199,74 @@ func (c *connection) Publish(name string, data []byte, onACK func()) {
 		zap.Int("data-len", len(data)),
 		zap.Uint64("seqNum", seqNum),
 	)
+}
+
+func (c *connection) publishBatch(name string, messages []utils.BatchMessage, onACK func(offsets []uint64), onError func(err error)) {
+	// Note the window sends the batch.
+	seqNum := c.window.PushBatch(name, messages, onACK, onError)
 
+	c.opts.Logger.Debug(
+		"publish batch",
+		zap.String("topic", name),
+		zap.Int("messages", len(messages)),
+		zap.Uint64("seqNum", seqNum),
+	)
+}
+
+// sendPublish sends a PUBLISH, or PUBLISH_BATCH if the message is a batch.
+// This is called by the window with it locked, so messages are sent in
+// sequence number order.
+func (c *connection) sendPublish(m unackedMessage) {
 	// Ignore any errors as we'll resend on reconnect.
-	// Look at using net.Buffers when data large to avoid copying into
+	if m.Batch != nil {
+		c.send(utils.EncodePublishBatchMessage(m.Topic, m.SeqNum, m.Batch))
+		return
+	}
+	// Send the data as a separate buffer to avoid copying it into the
 	// message buffer.
-	c.send(
-		utils.EncodePublishMessagePrefix(name, seqNum, data),
-		data,
-	)
+	bufs := [][]byte{
+		utils.EncodePublishMessagePrefix(m.Topic, m.SeqNum, m.Key, m.Data),
+		m.Data,
+	}
+	if m.Key != nil {
+		bufs = append(bufs, utils.EncodePublishMessageSuffix(m.Key))
+	}
+	c.send(bufs...)
+}
+
+// publishPendingBatch publishes a batch from the batcher. If the batch only
+// contains one message, or the server doesn't support batches, the messages
+// are published individually instead.
+func (c *connection) publishPendingBatch(name string, batch *pendingBatch) {
+	if len(batch.messages) == 1 || !c.hasFeatures(utils.FeaturePublishBatch) {
+		for i, m := range batch.messages {
+			c.publish(name, m.Key, m.Data, batch.onACKs[i], batch.onErrors[i])
+		}
+		return
+	}
+
+	c.publishBatch(name, batch.messages, func(offsets []uint64) {
+		for i, onACK := range batch.onACKs {
+			if onACK != nil {
+				onACK(offsets[i])
+			}
+		}
+	}, func(err error) {
+		for _, onError := range batch.onErrors {
+			if onError != nil {
+				onError(err)
+			}
+		}
+	})
 }
 
-func (c *connection) Attach(name string, onAttached func(), onMessage MessageCB) error {
+func (c *connection) Attach(name string, onAttached func(), onMessage MessageCB, onDetached func(reason error)) error {
 	c.opts.Logger.Debug("attach", zap.String("topic", name))
 
 	// Register for an ATTACHED response. Note if sending the ATTACH message
 	// fails (eg due to disconnecting), we'll retry all registed attaching
 	// attachments.
-	if err := c.attachments.AddAttaching(name, onAttached, onMessage); err != nil {
+	if err := c.attachments.AddAttaching(name, onAttached, onMessage, onDetached); err != nil {
 		return err
 	}
 
@@ -108,7 +275,7 @@ func (c *connection) Attach(name string, onAttached func(), onMessage MessageCB)
 	return nil
 }
 
-func (c *connection) AttachFromOffset(name string, offset uint64, onAttached func(), onMessage MessageCB) error {
+func (c *connection) AttachFromOffset(name string, offset uint64, onAttached func(), onMessage MessageCB, onDetached func(reason error)) error {
 	c.opts.Logger.Debug(
 		"attach from offset",
 		zap.String("topic", name),
@@ -118,7 +285,7 @@ func (c *connection) AttachFromOffset(name string, offset uint64, onAttached fun
 	// Register for an ATTACHED response. Note if sending the ATTACH message
 	// fails (eg due to disconnecting), we'll retry all registed attaching
 	// attachments.
-	if err := c.attachments.AddAttachingFromOffset(name, offset, onAttached, onMessage); err != nil {
+	if err := c.attachments.AddAttachingFromOffset(name, offset, onAttached, onMessage, onDetached); err != nil {
 		return err
 	}
 
@@ -127,6 +294,52 @@ func (c *connection) AttachFromOffset(name string, offset uint64, onAttached fun
 	return nil
 }
 
+func (c *connection) AttachFromTime(name string, timestamp time.Time, onAttached func(), onMessage MessageCB, onDetached func(reason error)) error {
+	c.opts.Logger.Debug(
+		"attach from time",
+		zap.String("topic", name),
+		zap.Time("timestamp", timestamp),
+	)
+
+	if !c.hasFeatures(utils.FeatureAttachFromTime) {
+		return ErrUnsupportedFeature
+	}
+
+	// Register for an ATTACHED response. Note if sending the ATTACH message
+	// fails (eg due to disconnecting), we'll retry all registed attaching
+	// attachments.
+	if err := c.attachments.AddAttachingFromTime(name, timestamp, onAttached, onMessage, onDetached); err != nil {
+		return err
+	}
+
+	// Ignore any errors as we'll resend on reconnect.
+	c.send(utils.EncodeAttachFromTimestampMessage(name, uint64(timestamp.UnixMilli())))
+	return nil
+}
+
+func (c *connection) AttachLastN(name string, n uint64, onAttached func(), onMessage MessageCB, onDetached func(reason error)) error {
+	c.opts.Logger.Debug(
+		"attach last n",
+		zap.String("topic", name),
+		zap.Uint64("n", n),
+	)
+
+	if !c.hasFeatures(utils.FeatureAttachLastN) {
+		return ErrUnsupportedFeature
+	}
+
+	// Register for an ATTACHED response. Note if sending the ATTACH message
+	// fails (eg due to disconnecting), we'll retry all registed attaching
+	// attachments.
+	if err := c.attachments.AddAttachingLastN(name, n, onAttached, onMessage, onDetached); err != nil {
+		return err
+	}
+
+	// Ignore any errors as we'll resend on reconnect.
+	c.send(utils.EncodeAttachLastNMessage(name, n))
+	return nil
+}
+
 func (c *connection) Detach(name string) {
 	c.opts.Logger.Debug(
 		"detach",
@@ -196,7 +409,17 @@ func (c *connection) Recv() error {
 		return err
 	}
 
-	c.onMessage(messageType, payload)
+	if err := c.onMessage(messageType, payload); err != nil {
+		// If the server sends a malformed message we can't trust the
+		// connection so reconnect.
+		c.opts.Logger.Warn(
+			"failed to decode message",
+			zap.String("message-type", messageType.String()),
+			zap.Error(err),
+		)
+		c.onDisconnect()
+		return err
+	}
 
 	return nil
 }
@@ -213,10 +436,10 @@ func (c *connection) Reconnect() {
 			return
 		}
 
-		conn, err := c.opts.Dialer.Dial("tcp", c.opts.Addr)
+		conn, reader, features, err := c.dial()
 		if err == nil {
 			c.opts.Logger.Debug("reconnect ok", zap.String("addr", c.opts.Addr))
-			c.onConnect(conn)
+			c.onConnect(conn, reader, features)
 			return
 		}
 
@@ -245,12 +468,105 @@ func (c *connection) Close() error {
 	// This will avoid log spam about errors when we shut down.
 	atomic.StoreInt32(&c.shutdown, 1)
 
+	if c.batcher != nil {
+		c.batcher.Close()
+	}
+
 	close(c.done)
 
 	c.onDisconnect()
 	return nil
 }
 
+// dial connects to the server and sends CONNECT, then waits for the server
+// to respond with CONNECTED. Returns the connection, a reader to read the
+// connection (which may have already buffered messages following CONNECTED)
+// and the features agreed with the server.
+func (c *connection) dial() (net.Conn, *utils.BufferedReader, utils.Features, error) {
+	conn, err := c.opts.Dialer.Dial("tcp", c.opts.Addr)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	reader := utils.NewBufferedReader(conn, c.opts.ReadBufLen, c.opts.MaxPayloadLen)
+	connected, err := c.handshake(conn, reader)
+	if err != nil {
+		conn.Close()
+		return nil, nil, 0, err
+	}
+
+	c.opts.Logger.Debug(
+		"connected",
+		zap.String("addr", c.opts.Addr),
+		zap.String("node-id", connected.NodeID),
+		zap.Uint16("version", connected.Version),
+		zap.String("features", connected.Features.String()),
+	)
+
+	return conn, reader, connected.Features, nil
+}
+
+func (c *connection) handshake(conn net.Conn, reader *utils.BufferedReader) (utils.ConnectedMessage, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion,
+		Features:   utils.SupportedFeatures,
+		ClientID:   c.opts.ClientID,
+		SDKName:    sdkName,
+		SDKVersion: sdkVersion,
+		ProducerID: c.producerID,
+	})); err != nil {
+		return utils.ConnectedMessage{}, err
+	}
+
+	messageType, payload, err := reader.Read()
+	if err != nil {
+		return utils.ConnectedMessage{}, err
+	}
+
+	switch messageType {
+	case utils.TypeConnected:
+		m, err := utils.DecodeConnectedMessage(payload)
+		if err != nil {
+			return utils.ConnectedMessage{}, err
+		}
+		if m.Version < utils.MinProtocolVersion || m.Version > utils.ProtocolVersion {
+			return utils.ConnectedMessage{}, &ConnectError{
+				Code: utils.ErrorCodeUnsupportedVersion,
+				Message: fmt.Sprintf(
+					"server selected protocol version %d, client supports %d-%d",
+					m.Version, utils.MinProtocolVersion, utils.ProtocolVersion,
+				),
+			}
+		}
+		return m, nil
+	case utils.TypeError:
+		m, err := utils.DecodeErrorMessage(payload)
+		if err != nil {
+			return utils.ConnectedMessage{}, err
+		}
+		return utils.ConnectedMessage{}, &ConnectError{
+			Code:    m.Code,
+			Message: m.Message,
+		}
+	default:
+		return utils.ConnectedMessage{}, fmt.Errorf(
+			"unexpected message: %s", messageType,
+		)
+	}
+}
+
+// hasFeatures returns whether the server supports the given features.
+func (c *connection) hasFeatures(features utils.Features) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.features.Has(features)
+}
+
 func (c *connection) send(bufs ...[]byte) error {
 	// Copy to avoid locking during IO.
 	c.mu.Lock()
@@ -263,99 +579,177 @@ func (c *connection) send(bufs ...[]byte) error {
 	return writer.Write(bufs...)
 }
 
-func (c *connection) onMessage(messageType utils.MessageType, b []byte) int {
-	offset := 0
+func (c *connection) onMessage(messageType utils.MessageType, b []byte) error {
 	switch messageType {
 	case utils.TypeAttached:
-		topicLen, offset := utils.DecodeUint32(b, offset)
-		topicName := string(b[offset : offset+int(topicLen)])
-		offset += int(topicLen)
-		topicOffset, offset := utils.DecodeUint64(b, offset)
+		m, err := utils.DecodeAttachedMessage(b)
+		if err != nil {
+			return err
+		}
 
 		c.opts.Logger.Debug(
 			"on message",
 			zap.String("message-type", messageType.String()),
-			zap.String("topic", topicName),
-			zap.Uint64("offset", topicOffset),
+			zap.String("topic", m.Topic),
+			zap.Uint64("offset", m.Offset),
 		)
 
-		c.attachments.OnAttached(topicName, topicOffset)
-		return offset
+		c.attachments.OnAttached(m.Topic, m.Offset)
 	case utils.TypeDetached:
-		topicLen, offset := utils.DecodeUint32(b, offset)
-		topicName := string(b[offset : offset+int(topicLen)])
-		offset += int(topicLen)
+		m, err := utils.DecodeDetachedMessage(b)
+		if err != nil {
+			return err
+		}
+
+		// If the server detached the topic without the client requesting
+		// it, DETACHED includes the reason.
+		if m.Code == 0 {
+			c.opts.Logger.Debug(
+				"on message",
+				zap.String("message-type", messageType.String()),
+				zap.String("topic", m.Topic),
+			)
+
+			c.attachments.OnDetached(m.Topic, nil)
+			return nil
+		}
+
+		c.opts.Logger.Warn(
+			"detached by server",
+			zap.String("topic", m.Topic),
+			zap.String("code", m.Code.String()),
+			zap.String("message", m.Message),
+		)
+
+		c.attachments.OnDetached(m.Topic, &DetachedError{
+			Code:    m.Code,
+			Message: m.Message,
+		})
+	case utils.TypeACK:
+		m, err := utils.DecodeACKMessage(b)
+		if err != nil {
+			return err
+		}
 
 		c.opts.Logger.Debug(
 			"on message",
 			zap.String("message-type", messageType.String()),
-			zap.String("topic", topicName),
+			zap.Uint64("seq-num", m.SeqNum),
+			zap.Uint64("offset", m.Offset),
+			zap.Int("offsets", len(m.Offsets)),
 		)
 
-		c.attachments.OnDetached(topicName)
-		return offset
-	case utils.TypeACK:
-		seqNum, offset := utils.DecodeUint64(b, offset)
+		// Without ACK_OFFSET the server doesn't include the offset.
+		offset := m.Offset
+		if !c.hasFeatures(utils.FeatureACKOffset) {
+			offset = OffsetUnknown
+		}
+		c.window.Acknowledge(m.SeqNum, offset, m.Offsets)
+	case utils.TypeNACK:
+		m, err := utils.DecodeNACKMessage(b)
+		if err != nil {
+			return err
+		}
 
 		c.opts.Logger.Debug(
 			"on message",
 			zap.String("message-type", messageType.String()),
-			zap.Uint64("seq-num", seqNum),
+			zap.Uint64("seq-num", m.SeqNum),
+			zap.String("code", m.Code.String()),
+			zap.String("message", m.Message),
 		)
 
-		c.window.Acknowledge(seqNum)
-		return offset
+		// The message was a duplicate of one already published, so it
+		// must be acknowledged rather than rejected, otherwise the caller
+		// may publish it again.
+		if m.Code == utils.ErrorCodeDuplicateOffsetUnknown {
+			c.window.Acknowledge(m.SeqNum, OffsetUnknown, nil)
+			return nil
+		}
+
+		c.window.Reject(m.SeqNum, &PublishError{
+			Code:    m.Code,
+			Message: m.Message,
+		})
 	case utils.TypeData:
-		topicLen, offset := utils.DecodeUint32(b, offset)
-		topicName := string(b[offset : offset+int(topicLen)])
-		offset += int(topicLen)
-		topicOffset, offset := utils.DecodeUint64(b, offset)
-		dataLen, offset := utils.DecodeUint32(b, offset)
-		data := make([]byte, dataLen)
-		copy(data, b[offset:offset+int(dataLen)])
-		offset += int(dataLen)
+		m, err := utils.DecodeDataMessage(b)
+		if err != nil {
+			return err
+		}
+		// Copy the data since the read buffer is reused.
+		data := make([]byte, len(m.Data))
+		copy(data, m.Data)
 
 		c.opts.Logger.Debug(
 			"on message",
 			zap.String("message-type", messageType.String()),
-			zap.String("topic", topicName),
-			zap.Uint64("offset", topicOffset),
+			zap.String("topic", m.Topic),
+			zap.Uint64("offset", m.Offset),
 			zap.Int("data-len", len(data)),
 		)
 
-		c.attachments.OnMessage(topicName, &Message{
-			Offset: topicOffset,
+		c.attachments.OnMessage(m.Topic, &Message{
+			Offset: m.Offset,
 			Data:   data,
 		})
-		return offset
 	case utils.TypePong:
-		timestamp, _ := utils.DecodeUint64(b, offset)
+		m, err := utils.DecodePongMessage(b)
+		if err != nil {
+			return err
+		}
 
 		c.opts.Logger.Debug(
 			"on message",
 			zap.String("message-type", messageType.String()),
-			zap.Duration("rtt", time.Duration(uint64(time.Now().UnixNano())-timestamp)),
+			zap.Duration("rtt", time.Duration(uint64(time.Now().UnixNano())-m.Timestamp)),
 		)
 
 		c.mu.Lock()
 		c.outstandingPings--
 		c.mu.Unlock()
+	case utils.TypeError:
+		m, err := utils.DecodeErrorMessage(b)
+		if err != nil {
+			return err
+		}
 
-		return offset
+		// The server closes the connection after sending ERROR, so the
+		// client will reconnect.
+		c.opts.Logger.Error(
+			"server error",
+			zap.String("code", m.Code.String()),
+			zap.String("message", m.Message),
+		)
 	}
 
-	return 0
+	return nil
 }
 
-func (c *connection) onConnect(conn net.Conn) {
-	c.setNetConn(conn)
+func (c *connection) onConnect(conn net.Conn, reader *utils.BufferedReader, features utils.Features) {
+	// Resend unacknowledged messages before any new messages are published,
+	// so the server receives messages in sequence number order. The window
+	// is locked while setting the connection and resending, which blocks
+	// new publishes until the resend completes.
+	c.window.Resend(func() {
+		c.setNetConn(conn, reader, features)
+	}, func(m unackedMessage) error {
+		return c.resendPublish(m, features)
+	})
 
 	for _, att := range c.attachments.Attaching() {
-		if att.FromOffset {
-			c.send(utils.EncodeAttachFromOffsetMessage(att.Name, att.Offset))
-		} else {
-			c.send(utils.EncodeAttachMessage(att.Name))
+		// If the server no longer supports the attachments options, such as
+		// if it was downgraded, detach instead.
+		if (att.FromTime && !features.Has(utils.FeatureAttachFromTime)) ||
+			(att.FromLastN && !features.Has(utils.FeatureAttachLastN)) {
+			c.opts.Logger.Warn(
+				"server doesn't support attachment",
+				zap.String("topic", att.Name),
+			)
+			c.attachments.OnDetached(att.Name, ErrUnsupportedFeature)
+			continue
 		}
+
+		c.send(att.EncodeAttachMessage())
 	}
 
 	for _, att := range c.attachments.Attached() {
@@ -376,35 +770,57 @@ func (c *connection) onConnect(conn net.Conn) {
 
 		c.send(utils.EncodeDetachMessage(topic))
 	}
+}
 
-	for _, m := range c.window.Messages() {
+// resendPublish resends an unacknowledged message after reconnecting. Returns
+// an error if the message can't be resent, so must fail.
+func (c *connection) resendPublish(m unackedMessage, features utils.Features) error {
+	if m.Batch != nil {
+		// If the server no longer supports batches, such as if it was
+		// downgraded, the batch can't be resent.
+		if !features.Has(utils.FeaturePublishBatch) {
+			c.opts.Logger.Warn(
+				"server doesn't support batches",
+				zap.String("topic", m.Topic),
+				zap.Uint64("seqNum", m.SeqNum),
+			)
+			return &PublishError{
+				Code:    utils.ErrorCodeUnexpectedMessage,
+				Message: "server doesn't support PUBLISH_BATCH",
+			}
+		}
+
+		c.opts.Logger.Debug(
+			"re-publish batch",
+			zap.String("topic", m.Topic),
+			zap.Int("messages", len(m.Batch)),
+			zap.Uint64("seqNum", m.SeqNum),
+		)
+	} else {
 		c.opts.Logger.Debug(
 			"re-publish",
 			zap.String("topic", m.Topic),
 			zap.Int("data-len", len(m.Data)),
 			zap.Uint64("seqNum", m.SeqNum),
 		)
-
-		// Look at using net.Buffers when data large to avoid copying into
-		// message buffer.
-		c.send(
-			utils.EncodePublishMessagePrefix(m.Topic, m.SeqNum, m.Data),
-			m.Data,
-		)
 	}
+
+	c.sendPublish(m)
+	return nil
 }
 
 func (c *connection) onDisconnect() {
 	c.unsetNetConn()
 }
 
-func (c *connection) setNetConn(conn net.Conn) {
+func (c *connection) setNetConn(conn net.Conn, reader *utils.BufferedReader, features utils.Features) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	c.conn = conn
-	c.reader = utils.NewBufferedReader(conn, c.opts.ReadBufLen)
-	c.writer = utils.NewBufferedWriter(conn)
+	c.reader = reader
+	c.writer = utils.NewBufferedWriter(conn, 0)
+	c.features = features
 
 	// Note emit events holding mu to ensure events are ordered. Also check
 	// if we we're disconnected to avoid duplicate CONNECTED events.
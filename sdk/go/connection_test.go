@@ -1,13 +1,91 @@
 package figg
 
 import (
+	"fmt"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/andydunstall/figg/utils"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestConnection_Connect(t *testing.T) {
+	fakeConn := utils.NewFakeConn()
+	opts := defaultOptions("1.2.3.4:123")
+	opts.Dialer = &fakeDialer{
+		conn: fakeConn,
+	}
+	opts.ClientID = "test-client"
+	conn := newConnection(nil, opts)
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodeConnectedMessage(
+		utils.ProtocolVersion, utils.FeatureDetachReason, "test-node",
+	))
+	assert.Nil(t, conn.Connect())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion,
+		Features:   utils.SupportedFeatures,
+		ClientID:   "test-client",
+		SDKName:    sdkName,
+		SDKVersion: sdkVersion,
+		ProducerID: conn.producerID,
+	}))
+	assert.True(t, conn.hasFeatures(utils.FeatureDetachReason))
+	assert.False(t, conn.hasFeatures(utils.FeatureAttachFromTime))
+
+	// The producer ID must be the same after reconnecting so the server can
+	// detect resent publishes.
+	fakeConn.Push(utils.EncodeConnectedMessage(
+		utils.ProtocolVersion, utils.FeatureDetachReason, "test-node",
+	))
+	conn.Reconnect()
+	connect, err := utils.DecodeConnectMessage(fakeConn.NextWritten()[utils.HeaderLen:])
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", connect.ProducerID)
+	assert.Equal(t, conn.producerID, connect.ProducerID)
+}
+
+func TestConnection_ConnectRejected(t *testing.T) {
+	fakeConn := utils.NewFakeConn()
+	opts := defaultOptions("1.2.3.4:123")
+	opts.Dialer = &fakeDialer{
+		conn: fakeConn,
+	}
+	conn := newConnection(nil, opts)
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodeErrorMessage(
+		utils.ErrorCodeUnsupportedVersion, "server supports protocol versions 2-3",
+	))
+	assert.Equal(t, &ConnectError{
+		Code:    utils.ErrorCodeUnsupportedVersion,
+		Message: "server supports protocol versions 2-3",
+	}, conn.Connect())
+}
+
+func TestConnection_ConnectUnsupportedVersion(t *testing.T) {
+	fakeConn := utils.NewFakeConn()
+	opts := defaultOptions("1.2.3.4:123")
+	opts.Dialer = &fakeDialer{
+		conn: fakeConn,
+	}
+	conn := newConnection(nil, opts)
+	defer conn.Close()
+
+	// The server selects a version the client doesn't support.
+	fakeConn.Push(utils.EncodeConnectedMessage(
+		utils.ProtocolVersion+1, utils.SupportedFeatures, "test-node",
+	))
+	err := conn.Connect()
+	connectErr, ok := err.(*ConnectError)
+	assert.True(t, ok)
+	assert.Equal(t, utils.ErrorCodeUnsupportedVersion, connectErr.Code)
+}
+
 func TestConnection_Attach(t *testing.T) {
 	conn, fakeConn := newFakeConnection()
 	defer conn.Close()
@@ -15,7 +93,7 @@ func TestConnection_Attach(t *testing.T) {
 	attached := false
 	conn.Attach("foo", func() {
 		attached = true
-	}, func(m *Message) {})
+	}, func(m *Message) {}, nil)
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachMessage("foo"))
 	fakeConn.Push(utils.EncodeAttachedMessage("foo", 10))
@@ -31,7 +109,7 @@ func TestConnection_AttachFromOffset(t *testing.T) {
 	attached := false
 	conn.AttachFromOffset("foo", 0xff, func() {
 		attached = true
-	}, func(m *Message) {})
+	}, func(m *Message) {}, nil)
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachFromOffsetMessage("foo", 0xff))
 	fakeConn.Push(utils.EncodeAttachedMessage("foo", 0xff))
@@ -40,6 +118,57 @@ func TestConnection_AttachFromOffset(t *testing.T) {
 	assert.True(t, attached)
 }
 
+func TestConnection_AttachFromTime(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	timestamp := time.UnixMilli(1000000)
+	attached := false
+	conn.AttachFromTime("foo", timestamp, func() {
+		attached = true
+	}, func(m *Message) {}, nil)
+
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachFromTimestampMessage("foo", 1000000))
+	fakeConn.Push(utils.EncodeAttachedMessage("foo", 0xff))
+
+	assert.Nil(t, conn.Recv())
+	assert.True(t, attached)
+}
+
+func TestConnection_AttachLastN(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	attached := false
+	conn.AttachLastN("foo", 100, func() {
+		attached = true
+	}, func(m *Message) {}, nil)
+
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachLastNMessage("foo", 100))
+
+	// Reconnect before responding. This should cause the client to resend
+	// the same ATTACH message.
+	reconnectFakeConnection(conn, fakeConn)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachLastNMessage("foo", 100))
+
+	fakeConn.Push(utils.EncodeAttachedMessage("foo", 0xff))
+
+	assert.Nil(t, conn.Recv())
+	assert.True(t, attached)
+
+	// Once attached, reconnecting should resume from the resolved offset.
+	reconnectFakeConnection(conn, fakeConn)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachFromOffsetMessage("foo", 0xff))
+}
+
+func TestConnection_AttachLastNUnsupported(t *testing.T) {
+	// Servers may support attaching from a time without supporting last N.
+	conn, _ := newFakeConnectionWithFeatures(utils.FeatureDetachReason | utils.FeatureAttachFromTime)
+	defer conn.Close()
+
+	assert.Equal(t, ErrUnsupportedFeature, conn.AttachLastN("foo", 100, func() {}, func(m *Message) {}, nil))
+}
+
 // Tests when the connection reconnects it resends ATTACH for all pending
 // attachment.
 func TestConnection_ReattachPendingAttachmentOnReconnect(t *testing.T) {
@@ -49,13 +178,13 @@ func TestConnection_ReattachPendingAttachmentOnReconnect(t *testing.T) {
 	attached := false
 	conn.Attach("foo", func() {
 		attached = true
-	}, func(m *Message) {})
+	}, func(m *Message) {}, nil)
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachMessage("foo"))
 
 	// Reconnect before responding. This should cause the client to resend
 	// the ATTACH message.
-	conn.Reconnect()
+	reconnectFakeConnection(conn, fakeConn)
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachMessage("foo"))
 	fakeConn.Push(utils.EncodeAttachedMessage("foo", 0xff))
@@ -71,13 +200,13 @@ func TestConnection_ReattachPendingAttachmentFromOffsetOnReconnect(t *testing.T)
 	attached := false
 	conn.AttachFromOffset("foo", 0xff, func() {
 		attached = true
-	}, func(m *Message) {})
+	}, func(m *Message) {}, nil)
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachFromOffsetMessage("foo", 0xff))
 
 	// Reconnect before responding. This should cause the client to resend
 	// the ATTACH message.
-	conn.Reconnect()
+	reconnectFakeConnection(conn, fakeConn)
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachFromOffsetMessage("foo", 0xff))
 	fakeConn.Push(utils.EncodeAttachedMessage("foo", 0xff))
@@ -93,7 +222,7 @@ func TestConnection_ReattachActiveAttachmentOnReconnect(t *testing.T) {
 	attached := false
 	conn.Attach("foo", func() {
 		attached = true
-	}, func(m *Message) {})
+	}, func(m *Message) {}, nil)
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachMessage("foo"))
 
@@ -104,7 +233,7 @@ func TestConnection_ReattachActiveAttachmentOnReconnect(t *testing.T) {
 
 	// Reconnect and expect all active topics to be reattached from the returned
 	// offset.
-	conn.Reconnect()
+	reconnectFakeConnection(conn, fakeConn)
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachFromOffsetMessage("foo", 0xff))
 	fakeConn.Push(utils.EncodeAttachedMessage("foo", 0xff))
@@ -117,7 +246,7 @@ func TestConnection_Detach(t *testing.T) {
 	conn, fakeConn := newFakeConnection()
 	defer conn.Close()
 
-	conn.Attach("foo", func() {}, func(m *Message) {})
+	conn.Attach("foo", func() {}, func(m *Message) {}, nil)
 	conn.Detach("foo")
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachMessage("foo"))
@@ -128,11 +257,32 @@ func TestConnection_Detach(t *testing.T) {
 	assert.Equal(t, 0, len(conn.attachments.Detaching()))
 }
 
+func TestConnection_DetachedByServer(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	var reason error
+	conn.Attach("foo", func() {}, func(m *Message) {}, func(err error) {
+		reason = err
+	})
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachMessage("foo"))
+	fakeConn.Push(utils.EncodeAttachedMessage("foo", 10))
+	assert.Nil(t, conn.Recv())
+
+	fakeConn.Push(utils.EncodeDetachedMessageWithReason("foo", utils.ErrorCodeTopicDeleted, "topic deleted"))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, &DetachedError{
+		Code:    utils.ErrorCodeTopicDeleted,
+		Message: "topic deleted",
+	}, reason)
+	assert.Equal(t, 0, len(conn.attachments.Attached()))
+}
+
 func TestConnection_ResendDetachingOnReconnect(t *testing.T) {
 	conn, fakeConn := newFakeConnection()
 	defer conn.Close()
 
-	conn.Attach("foo", func() {}, func(m *Message) {})
+	conn.Attach("foo", func() {}, func(m *Message) {}, nil)
 	conn.Detach("foo")
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachMessage("foo"))
@@ -140,7 +290,7 @@ func TestConnection_ResendDetachingOnReconnect(t *testing.T) {
 
 	// Reconnect before responding. This should cause the client to resend
 	// the DETACH message.
-	conn.Reconnect()
+	reconnectFakeConnection(conn, fakeConn)
 
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeDetachMessage("foo"))
 
@@ -154,40 +304,258 @@ func TestConnection_Publish(t *testing.T) {
 	conn, fakeConn := newFakeConnection()
 	defer conn.Close()
 
-	conn.Publish("foo", []byte("A"), func() {})
-	conn.Publish("foo", []byte("B"), func() {})
-	conn.Publish("bar", []byte("C"), func() {})
+	conn.Publish("foo", nil, []byte("A"), func(offset uint64) {}, nil)
+	conn.Publish("foo", nil, []byte("B"), func(offset uint64) {}, nil)
+	conn.Publish("bar", nil, []byte("C"), func(offset uint64) {}, nil)
 
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 0, []byte("A")))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 0, nil, []byte("A")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("A"))
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 1, []byte("B")))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 1, nil, []byte("B")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("B"))
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("bar", 2, []byte("C")))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("bar", 2, nil, []byte("C")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("C"))
 }
 
+func TestConnection_PublishACKWithOffset(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	offsets := []uint64{}
+	onACK := func(offset uint64) {
+		offsets = append(offsets, offset)
+	}
+	conn.Publish("foo", nil, []byte("A"), onACK, nil)
+	conn.Publish("foo", nil, []byte("B"), onACK, nil)
+
+	fakeConn.Push(utils.EncodeACKMessageWithOffset(0, 10))
+	assert.Nil(t, conn.Recv())
+	fakeConn.Push(utils.EncodeACKMessageWithOffset(1, 20))
+	assert.Nil(t, conn.Recv())
+
+	assert.Equal(t, []uint64{10, 20}, offsets)
+}
+
+func TestConnection_PublishWithKey(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	conn.Publish("foo", []byte("k"), []byte("A"), func(offset uint64) {}, nil)
+
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 0, []byte("k"), []byte("A")))
+	assert.Equal(t, fakeConn.NextWritten(), []byte("A"))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessageSuffix([]byte("k")))
+
+	// Reconnect before ACK'ing. Expect to resend the message with the key.
+	reconnectFakeConnection(conn, fakeConn)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 0, []byte("k"), []byte("A")))
+	assert.Equal(t, fakeConn.NextWritten(), []byte("A"))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessageSuffix([]byte("k")))
+}
+
+func TestConnection_PublishBatch(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	batch := []utils.BatchMessage{
+		{Key: nil, Data: []byte("A")},
+		{Key: []byte("k"), Data: []byte("B")},
+	}
+	var acked []uint64
+	assert.Nil(t, conn.PublishBatch("foo", batch, func(offsets []uint64) {
+		acked = offsets
+	}, nil))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishBatchMessage("foo", 0, batch))
+
+	// Reconnect before ACK'ing. Expect to resend the batch.
+	reconnectFakeConnection(conn, fakeConn)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishBatchMessage("foo", 0, batch))
+
+	fakeConn.Push(utils.EncodeACKMessageWithOffsets(0, []uint64{10, 20}))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, []uint64{10, 20}, acked)
+}
+
+func TestConnection_PublishBatchUnsupported(t *testing.T) {
+	conn, _ := newFakeConnectionWithFeatures(utils.FeatureACKOffset)
+	defer conn.Close()
+
+	assert.Equal(t, ErrEmptyBatch, conn.PublishBatch("foo", nil, nil, nil))
+	assert.Equal(t, ErrUnsupportedFeature, conn.PublishBatch("foo", []utils.BatchMessage{
+		{Key: nil, Data: []byte("A")},
+	}, nil, nil))
+}
+
+// Tests if the server no longer supports batches after reconnecting, pending
+// batches fail rather than being resent.
+func TestConnection_PublishBatchFailsIfUnsupportedOnReconnect(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	var publishErr error
+	assert.Nil(t, conn.PublishBatch("foo", []utils.BatchMessage{
+		{Key: nil, Data: []byte("A")},
+	}, nil, func(err error) {
+		publishErr = err
+	}))
+	fakeConn.NextWritten()
+
+	fakeConn.Push(utils.EncodeConnectedMessage(utils.ProtocolVersion, utils.FeatureACKOffset, "test-node"))
+	conn.Reconnect()
+	// Discard CONNECT.
+	fakeConn.NextWritten()
+
+	assert.Equal(t, &PublishError{
+		Code:    utils.ErrorCodeUnexpectedMessage,
+		Message: "server doesn't support PUBLISH_BATCH",
+	}, publishErr)
+
+	// The next write should be a new publish rather than the batch.
+	conn.Publish("foo", nil, []byte("B"), nil, nil)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 1, nil, []byte("B")))
+}
+
+func TestConnection_PublishLinger(t *testing.T) {
+	opts := defaultOptions("1.2.3.4:123")
+	opts.Linger = time.Millisecond * 10
+	conn, fakeConn := newFakeConnectionWithOptions(utils.SupportedFeatures, opts)
+	defer conn.Close()
+
+	offsets := []uint64{}
+	onACK := func(offset uint64) {
+		offsets = append(offsets, offset)
+	}
+	conn.Publish("foo", nil, []byte("A"), onACK, nil)
+	conn.Publish("foo", []byte("k"), []byte("B"), onACK, nil)
+
+	// Once the linger duration passes the messages are published in a
+	// single batch.
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishBatchMessage("foo", 0, []utils.BatchMessage{
+		{Key: nil, Data: []byte("A")},
+		{Key: []byte("k"), Data: []byte("B")},
+	}))
+
+	fakeConn.Push(utils.EncodeACKMessageWithOffsets(0, []uint64{10, 20}))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, []uint64{10, 20}, offsets)
+
+	// A single message is published without a batch.
+	conn.Publish("foo", nil, []byte("C"), onACK, nil)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 1, nil, []byte("C")))
+}
+
+func TestConnection_PublishLingerBatchFull(t *testing.T) {
+	opts := defaultOptions("1.2.3.4:123")
+	opts.Linger = time.Hour
+	opts.BatchSize = 2
+	conn, fakeConn := newFakeConnectionWithOptions(utils.SupportedFeatures, opts)
+	defer conn.Close()
+
+	// Once the batch is full it is published without waiting for the linger
+	// duration.
+	conn.Publish("foo", nil, []byte("A"), nil, nil)
+	conn.Publish("foo", nil, []byte("B"), nil, nil)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishBatchMessage("foo", 0, []utils.BatchMessage{
+		{Key: nil, Data: []byte("A")},
+		{Key: nil, Data: []byte("B")},
+	}))
+}
+
+func TestConnection_PublishLingerWithoutBatchFeature(t *testing.T) {
+	opts := defaultOptions("1.2.3.4:123")
+	opts.Linger = time.Hour
+	opts.BatchSize = 2
+	conn, fakeConn := newFakeConnectionWithOptions(utils.FeatureACKOffset, opts)
+	defer conn.Close()
+
+	// If the server doesn't support batches, the messages are published
+	// individually.
+	conn.Publish("foo", nil, []byte("A"), nil, nil)
+	conn.Publish("foo", nil, []byte("B"), nil, nil)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 0, nil, []byte("A")))
+	assert.Equal(t, fakeConn.NextWritten(), []byte("A"))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 1, nil, []byte("B")))
+	assert.Equal(t, fakeConn.NextWritten(), []byte("B"))
+}
+
+// Tests concurrent publishes are sent in sequence number order, otherwise the
+// server would discard a message received after a later message as a
+// duplicate.
+func TestConnection_PublishConcurrent(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i != 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j != 20; j++ {
+				conn.Publish("foo", nil, []byte(fmt.Sprintf("%d-%d", i, j)), nil, nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for seqNum := 0; seqNum != 200; seqNum++ {
+		assert.Equal(t, uint64(seqNum), nextWrittenPublish(t, fakeConn).SeqNum)
+	}
+}
+
+// Tests messages published while reconnecting are only sent after the
+// unacknowledged messages are resent, so the server receives messages in
+// sequence number order.
+func TestConnection_PublishDuringReconnect(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	for i := 0; i != 10; i++ {
+		conn.Publish("foo", nil, []byte("A"), nil, nil)
+		nextWrittenPublish(t, fakeConn)
+	}
+
+	conn.onDisconnect()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i != 100; i++ {
+			conn.Publish("foo", nil, []byte("B"), nil, nil)
+		}
+	}()
+	reconnectFakeConnection(conn, fakeConn)
+	wg.Wait()
+
+	// Messages published while disconnected are only sent once resending,
+	// and messages published after reconnecting are sent after the resent
+	// messages, so every message is sent once in order.
+	for seqNum := 0; seqNum != 110; seqNum++ {
+		assert.Equal(t, uint64(seqNum), nextWrittenPublish(t, fakeConn).SeqNum)
+	}
+}
+
 func TestConnection_PublishRetryOnReconnect(t *testing.T) {
 	conn, fakeConn := newFakeConnection()
 	defer conn.Close()
 
-	conn.Publish("foo", []byte("A"), func() {})
-	conn.Publish("foo", []byte("B"), func() {})
-	conn.Publish("bar", []byte("C"), func() {})
+	conn.Publish("foo", nil, []byte("A"), func(offset uint64) {}, nil)
+	conn.Publish("foo", nil, []byte("B"), func(offset uint64) {}, nil)
+	conn.Publish("bar", nil, []byte("C"), func(offset uint64) {}, nil)
 
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 0, []byte("A")))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 0, nil, []byte("A")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("A"))
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 1, []byte("B")))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 1, nil, []byte("B")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("B"))
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("bar", 2, []byte("C")))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("bar", 2, nil, []byte("C")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("C"))
 
 	// Reconnect before ACK'ing. Expect to receive the messages again.
-	conn.Reconnect()
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 0, []byte("A")))
+	reconnectFakeConnection(conn, fakeConn)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 0, nil, []byte("A")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("A"))
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 1, []byte("B")))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("foo", 1, nil, []byte("B")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("B"))
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("bar", 2, []byte("C")))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("bar", 2, nil, []byte("C")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("C"))
 
 	// ACK the first 2 messages only.
@@ -195,18 +563,66 @@ func TestConnection_PublishRetryOnReconnect(t *testing.T) {
 	assert.Nil(t, conn.Recv())
 
 	// Reconnect again and now should only get the only unACK'ed message resent.
-	conn.Reconnect()
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("bar", 2, []byte("C")))
+	reconnectFakeConnection(conn, fakeConn)
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePublishMessagePrefix("bar", 2, nil, []byte("C")))
 	assert.Equal(t, fakeConn.NextWritten(), []byte("C"))
 
 	// ACK the final message. Now when reconnecting no publishes should be
 	// retried.
 	fakeConn.Push(utils.EncodeACKMessage(2))
 	assert.Nil(t, conn.Recv())
-	conn.Reconnect()
+	reconnectFakeConnection(conn, fakeConn)
 	// assert.True(t, fakeConn.NextWritten() == nil) TODO(AD)
 }
 
+func TestConnection_PublishRejected(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	acked := false
+	var rejectErr error
+	conn.Publish("foo", nil, []byte("A"), func(offset uint64) {
+		acked = true
+	}, nil)
+	conn.Publish("foo", nil, []byte("B"), func(offset uint64) {}, func(err error) {
+		rejectErr = err
+	})
+
+	fakeConn.Push(utils.EncodeNACKMessage(1, utils.ErrorCodeUnavailable, "topic degraded"))
+	assert.Nil(t, conn.Recv())
+
+	// The earlier message should be acknowledged and the rejected message
+	// should not be retried.
+	assert.True(t, acked)
+	assert.Equal(t, &PublishError{
+		Code:    utils.ErrorCodeUnavailable,
+		Message: "topic degraded",
+	}, rejectErr)
+	assert.Equal(t, 0, len(conn.window.Messages()))
+}
+
+func TestConnection_PublishDuplicateOffsetUnknown(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	var ackOffset uint64
+	var rejectErr error
+	conn.Publish("foo", nil, []byte("A"), func(offset uint64) {
+		ackOffset = offset
+	}, func(err error) {
+		rejectErr = err
+	})
+
+	fakeConn.Push(utils.EncodeNACKMessage(0, utils.ErrorCodeDuplicateOffsetUnknown, "duplicate"))
+	assert.Nil(t, conn.Recv())
+
+	// The message was already published so should be acknowledged with an
+	// unknown offset rather than rejected.
+	assert.Equal(t, OffsetUnknown, ackOffset)
+	assert.Nil(t, rejectErr)
+	assert.Equal(t, 0, len(conn.window.Messages()))
+}
+
 func TestConnection_OnMessage(t *testing.T) {
 	conn, fakeConn := newFakeConnection()
 	defer conn.Close()
@@ -224,7 +640,7 @@ func TestConnection_OnMessage(t *testing.T) {
 			Data:   data,
 			Offset: m.Offset,
 		})
-	})
+	}, nil)
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachMessage("foo"))
 	fakeConn.Push(utils.EncodeAttachedMessage("foo", 0xff))
 	assert.Nil(t, conn.Recv())
@@ -255,6 +671,20 @@ func TestConnection_OnMessage(t *testing.T) {
 	}, messages)
 }
 
+func TestConnection_MalformedMessage(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	// Set the topic length to exceed the payload.
+	b := utils.EncodeDataMessage("foo", 0x105, []byte("A"))
+	utils.EncodeUint32(b, utils.HeaderLen, 0xffff)
+	fakeConn.Push(b)
+
+	assert.Equal(t, utils.ErrMalformedMessage, conn.Recv())
+	// The client should have disconnected.
+	assert.Equal(t, ErrNotConnected, conn.Recv())
+}
+
 type fakeDialer struct {
 	conn net.Conn
 }
@@ -264,14 +694,42 @@ func (d *fakeDialer) Dial(network string, address string) (net.Conn, error) {
 }
 
 func newFakeConnection() (*connection, *utils.FakeConn) {
+	return newFakeConnectionWithFeatures(utils.SupportedFeatures)
+}
+
+// newFakeConnectionWithFeatures returns a connection where the server
+// agreed the given features.
+func newFakeConnectionWithFeatures(features utils.Features) (*connection, *utils.FakeConn) {
+	return newFakeConnectionWithOptions(features, defaultOptions("1.2.3.4:123"))
+}
+
+func newFakeConnectionWithOptions(features utils.Features, opts *Options) (*connection, *utils.FakeConn) {
 	fakeConn := utils.NewFakeConn()
 	dialer := &fakeDialer{
 		conn: fakeConn,
 	}
-	opts := defaultOptions("1.2.3.4:123")
 	opts.Dialer = dialer
 
 	conn := newConnection(nil, opts)
+	fakeConn.Push(utils.EncodeConnectedMessage(utils.ProtocolVersion, features, "test-node"))
 	conn.Connect()
+	// Discard CONNECT.
+	fakeConn.NextWritten()
 	return conn, fakeConn
 }
+
+func reconnectFakeConnection(conn *connection, fakeConn *utils.FakeConn) {
+	fakeConn.Push(utils.EncodeConnectedMessage(utils.ProtocolVersion, utils.SupportedFeatures, "test-node"))
+	conn.Reconnect()
+	// Discard CONNECT.
+	fakeConn.NextWritten()
+}
+
+// nextWrittenPublish returns the next PUBLISH written to the connection.
+func nextWrittenPublish(t *testing.T, fakeConn *utils.FakeConn) utils.PublishMessage {
+	b := fakeConn.NextWritten()
+	b = append(b, fakeConn.NextWritten()...)
+	m, err := utils.DecodePublishMessage(b[utils.HeaderLen:])
+	assert.Nil(t, err)
+	return m
+}
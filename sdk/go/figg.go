@@ -7,6 +7,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/andydunstall/figg/utils"
 	"go.uber.org/zap"
 )
 
@@ -28,6 +29,9 @@ type Figg struct {
 }
 
 // Connect will attempt to connect to the given Figg node.
+//
+// If the node rejects the connection, such as if the client and node don't
+// support a common protocol version, returns a *ConnectError.
 func Connect(addr string, options ...Option) (*Figg, error) {
 	opts := defaultOptions(addr)
 	for _, opt := range options {
@@ -53,53 +57,126 @@ func Connect(addr string, options ...Option) (*Figg, error) {
 }
 
 // Publish publishes the data to the given topic. When the server acknowledges
-// the message onACK is called.
-func (f *Figg) Publish(name string, data []byte, onACK func()) {
-	f.conn.Publish(name, data, onACK)
+// the message onACK is called with the topic offset of the message, which
+// matches the Offset of the Message received by subscribers. If the server
+// rejects the message the PublishErrorCB option is called instead.
+//
+// If the offset is unknown, such as if the server doesn't support returning
+// the offset, or the message was resent after reconnecting and the server no
+// longer knows the offset of the original, the offset is OffsetUnknown.
+//
+// If the Linger option is set, the message may wait up to the linger duration
+// to be published in a batch with other messages to the same topic.
+func (f *Figg) Publish(name string, data []byte, onACK func(offset uint64)) {
+	f.conn.Publish(name, nil, data, onACK, f.onPublishError(name))
+}
+
+// PublishWithKey is the same as Publish except the message has the given key.
+// If the topic is compacted the server only retains the latest message with
+// each key.
+func (f *Figg) PublishWithKey(name string, key []byte, data []byte, onACK func(offset uint64)) {
+	f.conn.Publish(name, key, data, onACK, f.onPublishError(name))
+}
+
+// PublishBatch publishes the messages to the given topic in a single batch,
+// which the server adds to the topic atomically, so either all messages are
+// published or none are. When the server acknowledges the batch onACK is
+// called with the topic offset of each message. If the server rejects the
+// batch the PublishErrorCB option is called instead.
+//
+// If the server doesn't know the offsets of the messages, such as if the batch
+// was resent after reconnecting, only the offset of the last message is
+// included and the others are OffsetUnknown.
+//
+// Returns ErrUnsupportedFeature if the server doesn't support batches, or
+// ErrEmptyBatch if there are no messages.
+func (f *Figg) PublishBatch(name string, messages []BatchMessage, onACK func(offsets []uint64)) error {
+	batch := make([]utils.BatchMessage, 0, len(messages))
+	for _, m := range messages {
+		batch = append(batch, utils.BatchMessage{
+			Key:  m.Key,
+			Data: m.Data,
+		})
+	}
+	return f.conn.PublishBatch(name, batch, onACK, f.onPublishError(name))
 }
 
 // PublishBlocking is similar to Publish except it will block waiting for the
 // message is acknowledged. Note this will seriously limit thoughput so if
 // high thoughput is needed use Publish and don't wait for messages to be
 // acknowledged before sending the next.
-func (f *Figg) PublishWaitForACK(name string, data []byte) {
-	ch := make(chan interface{}, 1)
-	f.conn.Publish(name, data, func() {
-		ch <- struct{}{}
+//
+// Returns the topic offset of the message, such as to subscribe from the
+// message, or OffsetUnknown if the server doesn't know the offset. If the
+// server rejects the message returns a *PublishError.
+func (f *Figg) PublishWaitForACK(name string, data []byte) (uint64, error) {
+	type result struct {
+		offset uint64
+		err    error
+	}
+	ch := make(chan result, 1)
+	f.conn.Publish(name, nil, data, func(offset uint64) {
+		ch <- result{offset: offset}
+	}, func(err error) {
+		ch <- result{err: err}
 	})
-	<-ch
+	r := <-ch
+	return r.offset, r.err
 }
 
 // PublishNoACK is the same as Publish except it doesn't wait for the message
 // to be acknowledged
 func (f *Figg) PublishNoACK(name string, data []byte) {
-	f.conn.Publish(name, data, nil)
+	f.conn.Publish(name, nil, data, nil, f.onPublishError(name))
 }
 
 // Subscribe to the given topic.
 //
 // Note only one subscriber is allowed per topic.
+//
+// If the server detaches the subscription while subscribing, such as if the
+// topic is deleted, returns a *DetachedError.
 func (f *Figg) Subscribe(name string, onMessage MessageCB, options ...TopicOption) error {
 	opts := defaultTopicOptions()
 	for _, opt := range options {
 		opt(opts)
 	}
 
-	ch := make(chan interface{}, 1)
+	// Note the callbacks are only called from the read loop so attached
+	// doesn't need to be synchronized.
+	attached := false
+	ch := make(chan error, 1)
 	onAttached := func() {
-		ch <- struct{}{}
+		attached = true
+		ch <- nil
+	}
+	onDetached := func(reason error) {
+		if !attached {
+			ch <- reason
+			return
+		}
+		if opts.OnDetached != nil {
+			opts.OnDetached(reason)
+		}
 	}
 	if opts.FromOffset {
-		if err := f.conn.AttachFromOffset(name, opts.Offset, onAttached, onMessage); err != nil {
+		if err := f.conn.AttachFromOffset(name, opts.Offset, onAttached, onMessage, onDetached); err != nil {
+			return err
+		}
+	} else if opts.FromTime {
+		if err := f.conn.AttachFromTime(name, opts.Timestamp, onAttached, onMessage, onDetached); err != nil {
+			return err
+		}
+	} else if opts.FromLastN {
+		if err := f.conn.AttachLastN(name, opts.LastN, onAttached, onMessage, onDetached); err != nil {
 			return err
 		}
 	} else {
-		if err := f.conn.Attach(name, onAttached, onMessage); err != nil {
+		if err := f.conn.Attach(name, onAttached, onMessage, onDetached); err != nil {
 			return err
 		}
 	}
-	<-ch
-	return nil
+	return <-ch
 }
 
 func (f *Figg) Unsubscribe(topic string) {
@@ -150,6 +227,22 @@ func (f *Figg) pingLoop() {
 	}
 }
 
+// onPublishError returns a callback to handle the server rejecting a message
+// published to the given topic.
+func (f *Figg) onPublishError(name string) func(err error) {
+	return func(err error) {
+		f.opts.Logger.Warn(
+			"publish rejected",
+			zap.String("topic", name),
+			zap.Error(err),
+		)
+
+		if f.opts.PublishErrorCB != nil {
+			f.opts.PublishErrorCB(name, err.(*PublishError))
+		}
+	}
+}
+
 func (f *Figg) onConnStateChange(state ConnState) {
 	// Avoid logging if we've been shutdown.
 	if s := atomic.LoadInt32(&f.shutdown); s == 1 {
@@ -7,11 +7,14 @@ require go.uber.org/zap v1.23.0
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.1 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
-require github.com/andydunstall/figg/utils v0.0.0
+require (
+	github.com/andydunstall/figg/utils v0.0.0
+	github.com/stretchr/testify v1.8.1
+)
+
 replace github.com/andydunstall/figg/utils v0.0.0 => ../../utils
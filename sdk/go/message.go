@@ -1,5 +1,14 @@
 package figg
 
+import (
+	"math"
+)
+
+// OffsetUnknown is the offset passed to publish ACK callbacks when the message
+// was published but the server no longer knows its offset, such as if a
+// message resent after reconnecting was a duplicate of an old message.
+const OffsetUnknown = uint64(math.MaxUint64)
+
 type Message struct {
 	// Data contains the published payload.
 	Data []byte
@@ -10,3 +19,11 @@ type Message struct {
 }
 
 type MessageCB func(m *Message)
+
+// BatchMessage is a message published in a batch with PublishBatch.
+type BatchMessage struct {
+	// Key is the optional message key, or nil if the message has no key.
+	Key []byte
+	// Data contains the payload to publish.
+	Data []byte
+}
@@ -1,6 +1,7 @@
 package figg
 
 import (
+	"fmt"
 	"math/rand"
 	"net"
 	"time"
@@ -13,6 +14,7 @@ const (
 	DefaultWindowSize   = 256
 	DefaultPingInterval = 2 * time.Second
 	DefaultMaxPingOut   = 2
+	DefaultBatchSize    = 1 << 16 // 64 KB
 )
 
 type Dialer interface {
@@ -23,13 +25,23 @@ type ReconnectBackoffCB func(attempts int) time.Duration
 
 type ConnStateChangeCB func(state ConnState)
 
+type PublishErrorCB func(topic string, err *PublishError)
+
 type Options struct {
 	// Addr is the address of the Figg node.
 	Addr string
 
+	// ClientID identifies the client to the server, such as in the servers
+	// logs. Defaults to a random ID.
+	ClientID string
+
 	// ReadBufLen is the size of the read buffer ontop of the socket.
 	ReadBufLen int
 
+	// MaxPayloadLen is the maximum payload size of a message from the
+	// server, after which the client reconnects. Defaults to 0 (unlimited).
+	MaxPayloadLen int
+
 	// Dialer is a custom dialer to connect to the server. If nil uses
 	// net.Dialer with a 5 second timeout.
 	Dialer Dialer
@@ -45,10 +57,25 @@ type Options struct {
 	// connection state changes. Note this must not block.
 	ConnStateChangeCB ConnStateChangeCB
 
+	// PublishErrorCB is an optional callback called when the server rejects
+	// a message published with Publish, such as if the topic is degraded.
+	// Rejected messages are not retried. Note this must not block.
+	PublishErrorCB PublishErrorCB
+
 	// WindowSize is the number of unacknowledged in-flight messages are allowed
 	// before Publish blocking. Defaults to 256.
 	WindowSize int
 
+	// Linger is the maximum time Publish waits for more messages to the same
+	// topic, so the messages can be published in a single batch. Defaults to
+	// 0, which publishes each message immediately.
+	Linger time.Duration
+
+	// BatchSize is the number of bytes of message keys and data in a batch
+	// after which the batch is published without waiting for Linger.
+	// Defaults to 64 KB. Only used if Linger is set.
+	BatchSize int
+
 	// PingInterval is the time between sending pings. Defaults to 2 seconds.
 	PingInterval time.Duration
 
@@ -63,6 +90,12 @@ type Options struct {
 
 type Option func(*Options)
 
+func WithClientID(clientID string) Option {
+	return func(opts *Options) {
+		opts.ClientID = clientID
+	}
+}
+
 func WithDialer(dialer Dialer) Option {
 	return func(opts *Options) {
 		opts.Dialer = dialer
@@ -75,6 +108,12 @@ func WithReadBufLen(readBufLen int) Option {
 	}
 }
 
+func WithMaxPayloadLen(maxPayloadLen int) Option {
+	return func(opts *Options) {
+		opts.MaxPayloadLen = maxPayloadLen
+	}
+}
+
 func WithReconnectBackoffCB(cb ReconnectBackoffCB) Option {
 	return func(opts *Options) {
 		opts.ReconnectBackoffCB = cb
@@ -87,12 +126,30 @@ func WithConnStateChangeCB(cb ConnStateChangeCB) Option {
 	}
 }
 
+func WithPublishErrorCB(cb PublishErrorCB) Option {
+	return func(opts *Options) {
+		opts.PublishErrorCB = cb
+	}
+}
+
 func WithWindowSize(windowSize int) Option {
 	return func(opts *Options) {
 		opts.WindowSize = windowSize
 	}
 }
 
+func WithLinger(linger time.Duration) Option {
+	return func(opts *Options) {
+		opts.Linger = linger
+	}
+}
+
+func WithBatchSize(batchSize int) Option {
+	return func(opts *Options) {
+		opts.BatchSize = batchSize
+	}
+}
+
 func WithPingInterval(pingInterval time.Duration) Option {
 	return func(opts *Options) {
 		opts.PingInterval = pingInterval
@@ -113,14 +170,19 @@ func WithLogger(logger *zap.Logger) Option {
 
 func defaultOptions(addr string) *Options {
 	return &Options{
-		Addr:       addr,
-		ReadBufLen: DefaultReadBufLen,
+		Addr:          addr,
+		ClientID:      fmt.Sprintf("%016x", rand.Uint64()),
+		ReadBufLen:    DefaultReadBufLen,
+		MaxPayloadLen: 0,
 		Dialer: &net.Dialer{
 			Timeout: time.Second * 5,
 		},
 		ReconnectBackoffCB: defaultReconnectBackoffCB,
 		ConnStateChangeCB:  nil,
+		PublishErrorCB:     nil,
 		WindowSize:         DefaultWindowSize,
+		Linger:             0,
+		BatchSize:          DefaultBatchSize,
 		PingInterval:       DefaultPingInterval,
 		MaxPingOut:         DefaultMaxPingOut,
 		Logger:             zap.NewNop(),
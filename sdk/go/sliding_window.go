@@ -2,18 +2,70 @@ package figg
 
 import (
 	"sync"
+
+	"github.com/andydunstall/figg/utils"
 )
 
 type unackedMessage struct {
-	Topic  string
-	Data   []byte
+	Topic string
+	// Key is the optional message key, or nil if the message has no key.
+	Key  []byte
+	Data []byte
+	// Batch contains the messages if publishing a batch, in which case Key
+	// and Data are unused. nil if not a batch.
+	Batch  []utils.BatchMessage
 	SeqNum uint64
-	OnACK  func()
+	// OnACK is called with the topic offset of the message once the server
+	// acknowledges the message.
+	OnACK func(offset uint64)
+	// OnBatchACK is called with the topic offset of each message in the batch
+	// once the server acknowledges the batch.
+	OnBatchACK func(offsets []uint64)
+	// OnError is called if the server rejects the message.
+	OnError func(err error)
+	// Failed is true if the message failed before being acknowledged, so
+	// must not be resent or acknowledged.
+	Failed bool
+}
+
+// ack calls the ACK callback with the given offset, and the offsets of each
+// message if a batch. If the offsets of the batch are unknown, the last
+// message has the given offset and the others OffsetUnknown.
+func (m *unackedMessage) ack(offset uint64, offsets []uint64) {
+	if m.Failed {
+		return
+	}
+	if m.Batch == nil {
+		if m.OnACK != nil {
+			m.OnACK(offset)
+		}
+		return
+	}
+	if m.OnBatchACK == nil {
+		return
+	}
+	if len(offsets) != len(m.Batch) {
+		offsets = make([]uint64, len(m.Batch))
+		for i := range offsets {
+			offsets[i] = OffsetUnknown
+		}
+		offsets[len(offsets)-1] = offset
+	}
+	m.OnBatchACK(offsets)
 }
 
 // slidingWindow stores the unacknowledged messages in a circular buffer. When
 // full adding new messages will block as a way of controlling Publish.
+//
+// Messages are sent with the window locked as they are added, so they are
+// always sent in sequence number order. Otherwise the server would discard a
+// message that arrives after a message with a greater sequence number as a
+// duplicate.
 type slidingWindow struct {
+	// send sends a message added to the window. Called with the window
+	// locked so must not block. May be nil.
+	send func(m unackedMessage)
+
 	cv *sync.Cond
 
 	buf  []unackedMessage
@@ -27,9 +79,11 @@ type slidingWindow struct {
 }
 
 // newSlidingWindow is the maximum number of unacknowledged messages can be
-// in-flight before blocking.
-func newSlidingWindow(maxSize int) *slidingWindow {
+// in-flight before blocking. send is called to send each message added to the
+// window.
+func newSlidingWindow(maxSize int, send func(m unackedMessage)) *slidingWindow {
 	return &slidingWindow{
+		send:   send,
 		cv:     sync.NewCond(&sync.Mutex{}),
 		buf:    make([]unackedMessage, maxSize),
 		size:   0,
@@ -39,39 +93,83 @@ func newSlidingWindow(maxSize int) *slidingWindow {
 	}
 }
 
-// Push adds a new message to the window and returns the assigned sequence
+// Push adds a new message to the window, sends it, and returns the assigned
+// sequence number. If the window is full this will block.
+func (w *slidingWindow) Push(topic string, key []byte, data []byte, onACK func(offset uint64), onError func(err error)) uint64 {
+	return w.push(unackedMessage{
+		Topic:   topic,
+		Key:     key,
+		Data:    data,
+		OnACK:   onACK,
+		OnError: onError,
+	})
+}
+
+// PushBatch adds a batch of messages to the window, which uses a single
+// sequence number and space in the window, and returns the assigned sequence
 // number. If the window is full this will block.
-func (w *slidingWindow) Push(topic string, data []byte, onACK func()) uint64 {
+func (w *slidingWindow) PushBatch(topic string, messages []utils.BatchMessage, onACK func(offsets []uint64), onError func(err error)) uint64 {
+	return w.push(unackedMessage{
+		Topic:      topic,
+		Batch:      messages,
+		OnBatchACK: onACK,
+		OnError:    onError,
+	})
+}
+
+func (w *slidingWindow) push(m unackedMessage) uint64 {
 	w.cv.L.Lock()
 	defer w.cv.L.Unlock()
 
-	seqNum := w.seqNum
-	w.seqNum++
-
-	m := unackedMessage{
-		Topic:  topic,
-		Data:   data,
-		SeqNum: seqNum,
-		OnACK:  onACK,
-	}
-
-	// Block until the window is no longer empty.
+	// Block until the window is no longer full.
 	for w.size == len(w.buf) {
 		w.cv.Wait()
 	}
 
+	// Only assign the sequence number once there is room, so messages are
+	// added to the window in sequence number order even if multiple
+	// publishers are waiting.
+	m.SeqNum = w.seqNum
+	w.seqNum++
+
 	// We now know there is room for another element so add.
 	w.buf[w.tail] = m
 	// Update tail to point to the new item.
 	w.tail = (w.tail + 1) % len(w.buf)
 	w.size++
 
-	return seqNum
+	if w.send != nil {
+		w.send(m)
+	}
+
+	return m.SeqNum
 }
 
-// Messages returns all messages in the window in order. This is used to resend
-// any unacknowledged messages on reconnect. Note must not modify the returned
-// messages.
+// Resend calls connect then resend with each unacknowledged message in order,
+// excluding failed messages, such as after reconnecting. The window is locked
+// throughout, so messages added concurrently are only sent once all earlier
+// messages have been resent. If resend returns an error the message fails with
+// the error, as with Fail.
+func (w *slidingWindow) Resend(connect func(), resend func(m unackedMessage) error) {
+	w.cv.L.Lock()
+	defer w.cv.L.Unlock()
+
+	connect()
+
+	idx := w.head
+	for count := 0; count < w.size; count++ {
+		if !w.buf[idx].Failed {
+			if err := resend(w.buf[idx]); err != nil {
+				w.failLocked(idx, err)
+			}
+		}
+		idx = (idx + 1) % len(w.buf)
+	}
+}
+
+// Messages returns all messages in the window in order, excluding failed
+// messages. This is used to resend any unacknowledged messages on reconnect.
+// Note must not modify the returned messages.
 func (w *slidingWindow) Messages() []unackedMessage {
 	w.cv.L.Lock()
 	defer w.cv.L.Unlock()
@@ -81,7 +179,9 @@ func (w *slidingWindow) Messages() []unackedMessage {
 
 	messages := make([]unackedMessage, 0, w.size)
 	for count < w.size {
-		messages = append(messages, w.buf[idx])
+		if !w.buf[idx].Failed {
+			messages = append(messages, w.buf[idx])
+		}
 		count++
 		idx = (idx + 1) % len(w.buf)
 	}
@@ -90,19 +190,78 @@ func (w *slidingWindow) Messages() []unackedMessage {
 }
 
 // Acknowledge acknowledges all messages with a sequence number less than or
-// equal to the given sequence number.
-func (w *slidingWindow) Acknowledge(seqNum uint64) {
+// equal to the given sequence number. The message with the given sequence
+// number was published at the given topic offset, and if a batch its messages
+// were published at the given offsets. The offsets of any earlier messages are
+// unknown so are acknowledged with OffsetUnknown.
+func (w *slidingWindow) Acknowledge(seqNum uint64, offset uint64, offsets []uint64) {
+	w.cv.L.Lock()
+	defer w.cv.L.Unlock()
+
+	for w.size > 0 && w.buf[w.head].SeqNum <= seqNum {
+		if w.buf[w.head].SeqNum == seqNum {
+			w.buf[w.head].ack(offset, offsets)
+		} else {
+			w.buf[w.head].ack(OffsetUnknown, nil)
+		}
+
+		w.head = (w.head + 1) % len(w.buf)
+		w.size--
+	}
+
+	// Wake all waiting publishers since multiple messages may have been
+	// removed.
+	w.cv.Broadcast()
+}
+
+// Reject acknowledges all messages with a sequence number less than the given
+// sequence number, then removes the message with the given sequence number
+// and calls its error callback with the given error.
+func (w *slidingWindow) Reject(seqNum uint64, err error) {
 	w.cv.L.Lock()
 	defer w.cv.L.Unlock()
 
 	for w.size > 0 && w.buf[w.head].SeqNum <= seqNum {
-		if w.buf[w.head].OnACK != nil {
-			w.buf[w.head].OnACK()
+		if w.buf[w.head].SeqNum == seqNum {
+			if w.buf[w.head].OnError != nil && !w.buf[w.head].Failed {
+				w.buf[w.head].OnError(err)
+			}
+		} else {
+			w.buf[w.head].ack(OffsetUnknown, nil)
 		}
 
 		w.head = (w.head + 1) % len(w.buf)
 		w.size--
 	}
 
-	w.cv.Signal()
+	// Wake all waiting publishers since multiple messages may have been
+	// removed.
+	w.cv.Broadcast()
+}
+
+// Fail calls the error callback of the message with the given sequence number
+// with the given error, such as if the message can't be resent. The message
+// isn't resent and is removed from the window once a later message is
+// acknowledged, without calling its ACK callback.
+func (w *slidingWindow) Fail(seqNum uint64, err error) {
+	w.cv.L.Lock()
+	defer w.cv.L.Unlock()
+
+	idx := w.head
+	for count := 0; count < w.size; count++ {
+		if w.buf[idx].SeqNum == seqNum {
+			w.failLocked(idx, err)
+			return
+		}
+		idx = (idx + 1) % len(w.buf)
+	}
+}
+
+// failLocked fails the message at the given index in the buffer. The window
+// must be locked.
+func (w *slidingWindow) failLocked(idx int, err error) {
+	if w.buf[idx].OnError != nil && !w.buf[idx].Failed {
+		w.buf[idx].OnError(err)
+	}
+	w.buf[idx].Failed = true
 }
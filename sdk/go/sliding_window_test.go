@@ -1,16 +1,18 @@
 package figg
 
 import (
+	"errors"
 	"testing"
 
+	"github.com/andydunstall/figg/utils"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestSlidingWindow_AddOneMessageThenACK(t *testing.T) {
-	w := newSlidingWindow(3)
+	w := newSlidingWindow(3, nil)
 
 	// Add a message and check returned.
-	assert.Equal(t, uint64(0), w.Push("A", []byte("1"), nil))
+	assert.Equal(t, uint64(0), w.Push("A", nil, []byte("1"), nil, nil))
 	assert.Equal(t, []unackedMessage{
 		{
 			Topic:  "A",
@@ -21,11 +23,11 @@ func TestSlidingWindow_AddOneMessageThenACK(t *testing.T) {
 	}, w.Messages())
 
 	// Acknowledge the message and check removed.
-	w.Acknowledge(0)
+	w.Acknowledge(0, 10, nil)
 	assert.Equal(t, []unackedMessage{}, w.Messages())
 
 	// Add another message and check returned.
-	assert.Equal(t, uint64(1), w.Push("B", []byte("2"), nil))
+	assert.Equal(t, uint64(1), w.Push("B", nil, []byte("2"), nil, nil))
 	assert.Equal(t, []unackedMessage{
 		{
 			Topic:  "B",
@@ -38,11 +40,11 @@ func TestSlidingWindow_AddOneMessageThenACK(t *testing.T) {
 
 func TestSlidingWindow_AddTwoMessageThenACK(t *testing.T) {
 	// Use a window size of 3 so the indicies wrap around.
-	w := newSlidingWindow(3)
+	w := newSlidingWindow(3, nil)
 
 	// Add two messages message and check returned.
-	assert.Equal(t, uint64(0), w.Push("A", []byte("1"), nil))
-	assert.Equal(t, uint64(1), w.Push("B", []byte("2"), nil))
+	assert.Equal(t, uint64(0), w.Push("A", nil, []byte("1"), nil, nil))
+	assert.Equal(t, uint64(1), w.Push("B", nil, []byte("2"), nil, nil))
 	assert.Equal(t, []unackedMessage{
 		{
 			Topic:  "A",
@@ -59,7 +61,7 @@ func TestSlidingWindow_AddTwoMessageThenACK(t *testing.T) {
 	}, w.Messages())
 
 	// Acknowledge the first message message and check removed.
-	w.Acknowledge(0)
+	w.Acknowledge(0, 10, nil)
 	assert.Equal(t, []unackedMessage{
 		{
 			Topic:  "B",
@@ -70,8 +72,8 @@ func TestSlidingWindow_AddTwoMessageThenACK(t *testing.T) {
 	}, w.Messages())
 
 	// Add two more messages to fill the buffer and check returned.
-	assert.Equal(t, uint64(2), w.Push("C", []byte("3"), nil))
-	assert.Equal(t, uint64(3), w.Push("D", []byte("4"), nil))
+	assert.Equal(t, uint64(2), w.Push("C", nil, []byte("3"), nil, nil))
+	assert.Equal(t, uint64(3), w.Push("D", nil, []byte("4"), nil, nil))
 
 	assert.Equal(t, []unackedMessage{
 		{
@@ -95,7 +97,7 @@ func TestSlidingWindow_AddTwoMessageThenACK(t *testing.T) {
 	}, w.Messages())
 
 	// Ack all but the last and check returned.
-	w.Acknowledge(2)
+	w.Acknowledge(2, 30, nil)
 	assert.Equal(t, []unackedMessage{
 		{
 			Topic:  "D",
@@ -107,25 +109,139 @@ func TestSlidingWindow_AddTwoMessageThenACK(t *testing.T) {
 }
 
 func TestSlidingWindow_AckMessages(t *testing.T) {
-	w := newSlidingWindow(3)
+	w := newSlidingWindow(3, nil)
 
 	// Add a message and check returned.
 	firstAcked := false
-	w.Push("A", []byte("1"), func() {
+	w.Push("A", nil, []byte("1"), func(offset uint64) {
 		firstAcked = true
-	})
+	}, nil)
 	secondAcked := false
-	w.Push("B", []byte("2"), func() {
+	w.Push("B", nil, []byte("2"), func(offset uint64) {
 		secondAcked = true
-	})
+	}, nil)
 	thirdAcked := false
-	w.Push("B", []byte("2"), func() {
+	w.Push("B", nil, []byte("2"), func(offset uint64) {
 		secondAcked = true
-	})
+	}, nil)
 
-	w.Acknowledge(2)
+	w.Acknowledge(2, 30, nil)
 
 	assert.Equal(t, true, firstAcked)
 	assert.Equal(t, true, secondAcked)
 	assert.Equal(t, false, thirdAcked)
 }
+
+func TestSlidingWindow_AckMessagesWithOffset(t *testing.T) {
+	w := newSlidingWindow(3, nil)
+
+	offsets := []uint64{}
+	for i := 0; i != 3; i++ {
+		w.Push("A", nil, []byte("1"), func(offset uint64) {
+			offsets = append(offsets, offset)
+		}, nil)
+	}
+
+	w.Acknowledge(0, 10, nil)
+	w.Acknowledge(1, 20, nil)
+	assert.Equal(t, []uint64{10, 20}, offsets)
+
+	// If the server acknowledges multiple messages at once, the earlier
+	// offsets are unknown.
+	w.Push("A", nil, []byte("1"), func(offset uint64) {
+		offsets = append(offsets, offset)
+	}, nil)
+	w.Acknowledge(3, 40, nil)
+	assert.Equal(t, []uint64{10, 20, OffsetUnknown, 40}, offsets)
+}
+
+func TestSlidingWindow_RejectMessage(t *testing.T) {
+	w := newSlidingWindow(3, nil)
+
+	acked := []uint64{}
+	rejected := []uint64{}
+	for i := uint64(0); i != 3; i++ {
+		seqNum := i
+		w.Push("A", nil, []byte("1"), func(offset uint64) {
+			acked = append(acked, seqNum)
+		}, func(err error) {
+			rejected = append(rejected, seqNum)
+		})
+	}
+
+	// Rejecting a message should acknowledge the earlier messages.
+	w.Reject(1, errors.New("rejected"))
+	assert.Equal(t, []uint64{0}, acked)
+	assert.Equal(t, []uint64{1}, rejected)
+	assert.Equal(t, 1, len(w.Messages()))
+	assert.Equal(t, uint64(2), w.Messages()[0].SeqNum)
+}
+
+func TestSlidingWindow_AckBatch(t *testing.T) {
+	w := newSlidingWindow(3, nil)
+
+	batch := []utils.BatchMessage{
+		{Data: []byte("1")},
+		{Data: []byte("2")},
+	}
+	acked := [][]uint64{}
+	w.PushBatch("A", batch, func(offsets []uint64) {
+		acked = append(acked, offsets)
+	}, nil)
+	w.PushBatch("A", batch, func(offsets []uint64) {
+		acked = append(acked, offsets)
+	}, nil)
+	w.PushBatch("A", batch, func(offsets []uint64) {
+		acked = append(acked, offsets)
+	}, nil)
+
+	w.Acknowledge(0, 20, []uint64{10, 20})
+	// If the offsets of the batch are unknown, only the offset of the last
+	// message is included.
+	w.Acknowledge(1, 40, nil)
+	// If the server acknowledges multiple batches at once, the earlier
+	// offsets are unknown.
+	w.Acknowledge(2, 60, []uint64{50, 60})
+	assert.Equal(t, [][]uint64{{10, 20}, {OffsetUnknown, 40}, {50, 60}}, acked)
+
+	// If the server acknowledges multiple batches at once, the offsets of
+	// the earlier batches are unknown.
+	w.PushBatch("A", batch, func(offsets []uint64) {
+		acked = append(acked, offsets)
+	}, nil)
+	w.PushBatch("A", batch, func(offsets []uint64) {
+		acked = append(acked, offsets)
+	}, nil)
+	w.Acknowledge(4, 80, []uint64{70, 80})
+	assert.Equal(t, []uint64{OffsetUnknown, OffsetUnknown}, acked[3])
+	assert.Equal(t, []uint64{70, 80}, acked[4])
+}
+
+func TestSlidingWindow_FailMessage(t *testing.T) {
+	w := newSlidingWindow(3, nil)
+
+	acked := []uint64{}
+	errs := []error{}
+	for i := 0; i != 3; i++ {
+		w.Push("A", nil, []byte("1"), func(offset uint64) {
+			acked = append(acked, offset)
+		}, func(err error) {
+			errs = append(errs, err)
+		})
+	}
+
+	w.Fail(1, errors.New("failed"))
+	assert.Equal(t, []error{errors.New("failed")}, errs)
+
+	// The failed message isn't resent.
+	messages := w.Messages()
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, uint64(0), messages[0].SeqNum)
+	assert.Equal(t, uint64(2), messages[1].SeqNum)
+
+	// Acknowledging later messages removes the failed message without
+	// acknowledging it.
+	w.Acknowledge(2, 30, nil)
+	assert.Equal(t, []uint64{OffsetUnknown, 30}, acked)
+	assert.Equal(t, []unackedMessage{}, w.Messages())
+}
@@ -1,10 +1,37 @@
 package figg
 
+import (
+	"time"
+)
+
+// TopicOptions configures where a subscription starts from. By default
+// subscribers receive messages published after subscribing. If multiple
+// starting points are set, the offset takes precedence, followed by the time,
+// followed by the last N.
 type TopicOptions struct {
 	// Offset is an offset of an old message to subscribe from without missing
 	// messages. This is only used if FromOffset is true, otherwise is ignored.
 	Offset     uint64
 	FromOffset bool
+
+	// Timestamp is the time to subscribe from, so the subscriber receives all
+	// messages published at or after this time (and may receive some
+	// published shortly before). This is only used if FromTime is true,
+	// otherwise is ignored.
+	Timestamp time.Time
+	FromTime  bool
+
+	// LastN is the number of the most recent messages to receive when
+	// subscribing. This is only used if FromLastN is true, otherwise is
+	// ignored.
+	LastN     uint64
+	FromLastN bool
+
+	// OnDetached is called if the server detaches the subscription, such as
+	// if the topic is deleted, with a *DetachedError describing why. The
+	// subscriber receives no more messages on the topic unless it
+	// resubscribes. May be nil.
+	OnDetached func(reason error)
 }
 
 type TopicOption func(*TopicOptions)
@@ -16,9 +43,37 @@ func WithOffset(offset uint64) TopicOption {
 	}
 }
 
+// WithFromTime subscribes from the messages published at or after the given
+// time.
+func WithFromTime(t time.Time) TopicOption {
+	return func(opts *TopicOptions) {
+		opts.Timestamp = t
+		opts.FromTime = true
+	}
+}
+
+// WithLastN subscribes from the last n messages published to the topic.
+func WithLastN(n uint64) TopicOption {
+	return func(opts *TopicOptions) {
+		opts.LastN = n
+		opts.FromLastN = true
+	}
+}
+
+// WithOnDetached registers a callback called if the server detaches the
+// subscription, such as if the topic is deleted.
+func WithOnDetached(cb func(reason error)) TopicOption {
+	return func(opts *TopicOptions) {
+		opts.OnDetached = cb
+	}
+}
+
 func defaultTopicOptions() *TopicOptions {
 	return &TopicOptions{
 		Offset:     0,
 		FromOffset: false,
+		FromTime:   false,
+		LastN:      0,
+		FromLastN:  false,
 	}
 }
@@ -49,7 +49,7 @@ func main() {
 	}
 	defer messagingService.Close()
 
-	adminService := adminService.NewAdminService(config, logger)
+	adminService := adminService.NewAdminService(config, messagingService.Broker(), logger)
 	_, err = adminService.Serve()
 	if err != nil {
 		logger.Fatal("failed to start admin service", zap.Error(err))
@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/google/uuid v1.3.0
 	github.com/jessevdk/go-flags v1.5.0
+	github.com/klauspost/compress v1.17.0
 	github.com/stretchr/testify v1.8.1
 	go.uber.org/zap v1.23.0
 )
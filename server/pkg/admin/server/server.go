@@ -1,19 +1,61 @@
 package server
 
 import (
+	"encoding/json"
+	// Import so expvar registers the /debug/vars handler to the server, which
+	// exposes the servers metrics.
+	_ "expvar"
 	"net"
 	"net/http"
 
 	// Import so pprof registers HTTP handles to the server.
 	_ "net/http/pprof"
+
+	"github.com/andydunstall/figg/server/pkg/topic"
 )
 
-type Server struct{}
+type Server struct {
+	broker *topic.Broker
+}
 
-func NewServer() *Server {
-	return &Server{}
+func NewServer(broker *topic.Broker) *Server {
+	return &Server{
+		broker: broker,
+	}
 }
 
 func (s *Server) Serve(lis net.Listener) error {
-	return http.Serve(lis, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.health)
+	// Fallback to the default mux which has the expvar and pprof handlers.
+	mux.Handle("/", http.DefaultServeMux)
+	return http.Serve(lis, mux)
+}
+
+type healthResponse struct {
+	// Status is either 'ok' or 'degraded'.
+	Status string `json:"status"`
+	// DegradedTopics maps each degraded topic to the reason its degraded.
+	DegradedTopics map[string]string `json:"degraded_topics,omitempty"`
+}
+
+// health responds with the health of the node. If any topics are degraded
+// responds with status 503.
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{
+		Status: "ok",
+	}
+	for name, err := range s.broker.DegradedTopics() {
+		if resp.DegradedTopics == nil {
+			resp.DegradedTopics = map[string]string{}
+		}
+		resp.DegradedTopics[name] = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(resp.DegradedTopics) > 0 {
+		resp.Status = "degraded"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
 }
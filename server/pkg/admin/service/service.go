@@ -6,19 +6,24 @@ import (
 
 	"github.com/andydunstall/figg/server/pkg/admin/server"
 	"github.com/andydunstall/figg/server/pkg/config"
+	"github.com/andydunstall/figg/server/pkg/topic"
 	"go.uber.org/zap"
 )
 
 type AdminService struct {
 	config config.Config
+	broker *topic.Broker
 	logger *zap.Logger
 	lis    net.Listener
 	wg     sync.WaitGroup
 }
 
-func NewAdminService(config config.Config, logger *zap.Logger) *AdminService {
+// NewAdminService creates the admin service, which reports the health of the
+// topics managed by the given broker.
+func NewAdminService(config config.Config, broker *topic.Broker, logger *zap.Logger) *AdminService {
 	return &AdminService{
 		config: config,
+		broker: broker,
 		logger: logger,
 		wg:     sync.WaitGroup{},
 	}
@@ -31,7 +36,7 @@ func NewAdminService(config config.Config, logger *zap.Logger) *AdminService {
 func (s *AdminService) Serve() (string, error) {
 	s.logger.Info("starting admin service")
 
-	server := server.NewServer()
+	server := server.NewServer(s.broker)
 
 	lis, err := net.Listen("tcp", s.config.AdminAddr)
 	if err != nil {
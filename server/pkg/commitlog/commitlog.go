@@ -2,6 +2,25 @@ package commitlog
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// minPersistBackoff is the initial backoff between attempts to persist a
+	// segment after a failure.
+	minPersistBackoff = time.Millisecond * 100
+	// maxPersistBackoff is the maximum backoff between attempts to persist a
+	// segment.
+	maxPersistBackoff = time.Second * 30
 )
 
 var (
@@ -13,55 +32,540 @@ var (
 // The full design of the commit logs is described in the docs.
 type CommitLog struct {
 	segments *Segments
-	// persisted indicates the commit log segments should be persisted to disk.
-	persisted bool
-	// segmentSize contains the configured size of each segment in the log.
-	segmentSize uint64
+	options  Options
 	// dir is the directory to persist messages to.
 	dir string
+
+	// appendMu serializes appends, so the returned offsets match the order
+	// entries are added to the log.
+	appendMu sync.Mutex
+
+	// compactMu serializes compaction, retention and offloading, since each
+	// replace persisted segments.
+	compactMu sync.Mutex
+
+	// cache tracks the remote segments fetched from tiered storage.
+	cache *remoteCache
+
+	// syncer syncs the log to disk according to the durability policy. nil if
+	// the log is not persisted or the durability is DurabilityNone.
+	syncer *syncer
+
+	// healthMu protects persistErrs.
+	healthMu sync.Mutex
+	// persistErrs contains the last error of each segment that failed to
+	// persist and is being retried, keyed by the segment offset. The log is
+	// degraded while any segment is failing.
+	persistErrs map[uint64]error
+
+	// persistWG waits for segments being persisted in the background.
+	persistWG sync.WaitGroup
+	// done is closed to stop retrying failed persists.
+	done      chan interface{}
+	closeOnce sync.Once
+
+	logger *zap.Logger
 }
 
 // NewCommitLog creates an empty commit log in the given directory.
-func NewCommitLog(persisted bool, segmentSize uint64, dir string) *CommitLog {
-	return &CommitLog{
-		segments:    NewSegments(),
-		persisted:   persisted,
-		segmentSize: segmentSize,
+func NewCommitLog(dir string, options Options, logger *zap.Logger) *CommitLog {
+	return newCommitLog(dir, options, NewSegments(), newRemoteCache(remoteCacheSize), logger)
+}
+
+// LoadCommitLog creates a persisted commit log in the given directory, loading
+// any segments already persisted to the directory (such as following a
+// restart). If the directory doesn't exist the commit log is empty.
+//
+// Any write-ahead logs in the directory are recovered as persisted segments.
+// A new in-memory segment is added after the loaded segments so new appends
+// continue from the end of the recovered log.
+//
+// Segments offloaded to tiered storage are loaded from their stubs, so
+// options.Storage must be set if any segments have been offloaded.
+//
+// Segments that can't be loaded, such as with an unsupported version, are
+// renamed to '<offset>.corrupt' and skipped rather than failing to load the
+// whole log. Their offsets are left as a gap so aren't reused.
+func LoadCommitLog(dir string, options Options, logger *zap.Logger) (*CommitLog, error) {
+	options.Persisted = true
+
+	if err := recoverFiles(dir); err != nil {
+		return nil, err
+	}
+
+	offsets, err := listFileOffsets(dir, ".data")
+	if err != nil {
+		return nil, err
+	}
+	remoteOffsets, err := listFileOffsets(dir, ".remote")
+	if err != nil {
+		return nil, err
+	}
+
+	cache := newRemoteCache(remoteCacheSize)
+	loaded := map[uint64]Segment{}
+	for _, offset := range remoteOffsets {
+		segment, err := loadRemoteSegment(dir, offset, options.Storage, cache, logger)
+		if err != nil {
+			return nil, err
+		}
+		loaded[offset] = segment
+	}
+
+	segments := NewSegments()
+	// quarantinedEnd is the end offset of the last quarantined segment.
+	quarantinedEnd := uint64(0)
+	for _, offset := range mergeOffsets(offsets, remoteOffsets) {
+		if segment, ok := loaded[offset]; ok {
+			segments.Add(offset, segment)
+			continue
+		}
+
+		segment, err := LoadFileSegment(dir, offset, logger)
+		if err != nil {
+			corruptSegments.Add(1)
+			logger.Error(
+				"failed to load segment; quarantining",
+				zap.String("dir", dir),
+				zap.Uint64("segment", offset),
+				zap.Error(err),
+			)
+			size, err := quarantineSegment(dir, offset)
+			if err != nil {
+				return nil, err
+			}
+			if offset+size > quarantinedEnd {
+				quarantinedEnd = offset + size
+			}
+			continue
+		}
+		// Remove empty segments, such as the write-ahead log of an empty
+		// in-memory segment, otherwise the next segment would have the
+		// same offset.
+		if segment.Size() == 0 {
+			if err := segment.(*FileSegment).Remove(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segments.Add(offset, segment)
+	}
+
+	c := newCommitLog(dir, options, segments, cache, logger)
+	if segments.Last() != nil || quarantinedEnd > 0 {
+		offset := c.Offset()
+		if quarantinedEnd > offset {
+			offset = quarantinedEnd
+		}
+		if _, err := c.newSegment(offset); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func newCommitLog(dir string, options Options, segments *Segments, cache *remoteCache, logger *zap.Logger) *CommitLog {
+	c := &CommitLog{
+		segments:    segments,
+		options:     options,
 		dir:         dir,
+		appendMu:    sync.Mutex{},
+		cache:       cache,
+		healthMu:    sync.Mutex{},
+		persistErrs: map[uint64]error{},
+		persistWG:   sync.WaitGroup{},
+		done:        make(chan interface{}),
+		logger:      logger,
+	}
+	if options.Persisted && options.Durability != DurabilityNone {
+		// Any existing segments have been loaded from disk so are already
+		// synced.
+		c.syncer = newSyncer(options.Durability, options.SyncInterval, c.Offset(), c.sync)
 	}
+	return c
 }
 
-// Append adds new data to the commit log. This will be appended to the most
-// recent segment, which is in memory so this should be fast.
-func (c *CommitLog) Append(b []byte) {
+// Offset returns the offset of the end of the commit log, which is the offset
+// the next appended entry will be written to.
+func (c *CommitLog) Offset() uint64 {
 	segment := c.segments.Last()
 	if segment == nil {
-		segment = NewInMemorySegment(c.segmentSize, 0)
-		c.segments.Add(0, segment)
+		return 0
 	}
+	return segment.Offset() + segment.Size()
+}
 
-	segment.Append(b)
+// EarliestOffset returns the offset of the earliest entry retained by the
+// commit log. Any offsets less than this have been removed by retention.
+func (c *CommitLog) EarliestOffset() uint64 {
+	segment := c.segments.First()
+	if segment == nil {
+		return 0
+	}
+	return segment.Offset()
+}
+
+// Append adds a new record with the given key and value to the commit log and
+// returns the offset of the end of the log after the append. The key is
+// optional (nil if the record has no key) and used for compaction. This will
+// be appended to the most recent segment, which is in memory so this should be
+// fast.
+//
+// Note the entry may not be durable when Append returns, so use OnDurable to
+// wait for the entry to be synced.
+func (c *CommitLog) Append(key []byte, value []byte) (uint64, error) {
+	return c.append(func(segment Segment) error {
+		return segment.Append(key, value)
+	})
+}
+
+// AppendBatch adds the given records to the commit log atomically, so either
+// all records are added or none are, and returns the offset of the end of the
+// log after the append. Only the Key and Value of each record are used. Once
+// appended the Offset and NextOffset of each record are set.
+//
+// Since the batch is added to a single segment, the segment may exceed the
+// segment size.
+func (c *CommitLog) AppendBatch(records []Record) (uint64, error) {
+	return c.append(func(segment Segment) error {
+		if err := segment.AppendBatch(records); err != nil {
+			return err
+		}
 
-	if segment.Size() > c.segmentSize {
-		go func() {
-			if err := c.persist(segment); err != nil {
-				panic(err)
+		offset := segment.Offset() + segment.Size()
+		for i := len(records) - 1; i >= 0; i-- {
+			size := recordSize(records[i].Key, records[i].Value)
+			records[i].NextOffset = offset
+			records[i].Offset = offset - size
+			offset -= size
+		}
+		return nil
+	})
+}
+
+// append adds entries to the last segment using the given append function,
+// then rolls the segment if its full.
+func (c *CommitLog) append(appendFn func(segment Segment) error) (uint64, error) {
+	c.appendMu.Lock()
+	defer c.appendMu.Unlock()
+
+	segment := c.segments.Last()
+	if segment == nil {
+		var err error
+		segment, err = c.newSegment(0)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := appendFn(segment); err != nil {
+		return 0, err
+	}
+	offset := segment.Offset() + segment.Size()
+
+	full := segment.Size() > c.options.SegmentSize
+	// If the memory budget is exceeded roll the segment early, so its
+	// persisted sooner and the next segment starts small.
+	if !full && segment.Size() >= minSegmentSize && c.options.Memory.Exceeded() {
+		full = true
+	}
+	if full {
+		c.persistInBackground(segment)
+		if _, err := c.newSegment(offset); err != nil {
+			return 0, err
+		}
+		if !c.options.Persisted {
+			c.dropSegments()
+		}
+	}
+
+	return offset, nil
+}
+
+// OnDurable calls cb once all entries up to the given offset are durable
+// according to the durability policy. If the log is not persisted or uses
+// DurabilityNone, cb is called immediately.
+//
+// If syncing fails, cb is called with the error.
+func (c *CommitLog) OnDurable(offset uint64, cb func(err error)) {
+	if c.syncer == nil {
+		cb(nil)
+		return
+	}
+	c.syncer.Wait(offset, cb)
+}
+
+// PersistErr returns the error of a segment that is failing to persist, or nil
+// if the log is healthy. While failing the segment is retried in the
+// background.
+func (c *CommitLog) PersistErr() error {
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+
+	for _, err := range c.persistErrs {
+		return err
+	}
+	return nil
+}
+
+// Close stops syncing the commit log and retrying any failed persists. Any
+// entries waiting to be synced are synced, and any segments being persisted in
+// the background are written, before returning.
+func (c *CommitLog) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.syncer != nil {
+			c.syncer.Close()
+		}
+	})
+	c.persistWG.Wait()
+}
+
+// Unload persists the in-memory segments and closes the commit log, so it can
+// later be reloaded with LoadCommitLog. Empty in-memory segments are discarded
+// rather than persisted. If the log isn't persisted the in-memory segments are
+// dropped.
+//
+// The log must not be used after unloading.
+func (c *CommitLog) Unload() error {
+	c.Close()
+
+	c.appendMu.Lock()
+	defer c.appendMu.Unlock()
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+
+	// Wait for any segments being persisted in the background. Since the log
+	// is closed, segments that failed to persist are no longer retried so are
+	// persisted below.
+	c.persistWG.Wait()
+
+	for _, segment := range c.segments.All() {
+		segment, ok := segment.(*InMemorySegment)
+		if !ok {
+			continue
+		}
+		if segment.Size() == 0 || !c.options.Persisted {
+			if err := segment.discard(); err != nil {
+				return err
+			}
+			c.segments.Remove(segment.Offset())
+			segment.release()
+		} else if err := c.persist(segment); err != nil {
+			return err
+		}
+	}
+
+	return c.closeSegments()
+}
+
+// Remove closes the commit log and deletes all its segments, including any
+// segments offloaded to tiered storage.
+//
+// The log must not be used after removing.
+func (c *CommitLog) Remove() error {
+	c.Close()
+
+	c.appendMu.Lock()
+	defer c.appendMu.Unlock()
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+
+	c.persistWG.Wait()
+
+	for _, segment := range c.segments.All() {
+		if s, ok := segment.(*RemoteSegment); ok {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.closeSegments(); err != nil {
+		return err
+	}
+
+	if !c.options.Persisted {
+		return nil
+	}
+	return os.RemoveAll(c.dir)
+}
+
+// closeSegments closes the files of all segments and removes the segments from
+// the log. Any lookups in progress will fail with ErrNotFound.
+func (c *CommitLog) closeSegments() error {
+	for _, segment := range c.segments.All() {
+		c.segments.Remove(segment.Offset())
+
+		var err error
+		switch s := segment.(type) {
+		case *FileSegment:
+			err = s.Close()
+		case *InMemorySegment:
+			s.release()
+			err = s.Close()
+		case *RemoteSegment:
+			c.cache.Remove(s)
+			err = s.evict()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup returns the record at the given offset in the commit log. If the
+// record has been removed by compaction, returns the next retained record. If
+// not found returns ErrNotFound. If the record is corrupt returns ErrCorrupt.
+func (c *CommitLog) Lookup(offset uint64) (Record, error) {
+	records, err := c.read(offset, 0)
+	if err != nil {
+		return Record{}, err
+	}
+	return records[0], nil
+}
+
+// NewReader returns a reader that reads the commit log sequentially starting
+// at the given offset.
+func (c *CommitLog) NewReader(offset uint64) *Reader {
+	return newReader(c, offset)
+}
+
+// read returns the records starting at the given offset, up to roughly
+// maxBytes of records from the same segment. At least one record is always
+// returned, so if maxBytes is 0 returns a single record.
+//
+// If the record at the offset has been removed by compaction, starts from the
+// next retained record. If not found returns ErrNotFound. If the record at the
+// offset is corrupt returns ErrCorrupt.
+func (c *CommitLog) read(offset uint64, maxBytes uint64) ([]Record, error) {
+	for {
+		segment := c.segments.Get(offset)
+		if segment == nil {
+			return nil, ErrNotFound
+		}
+
+		records, err := readSegment(segment, offset-segment.Offset(), maxBytes)
+		if err == ErrNotFound {
+			// If the segment has been replaced while looking up, such
+			// as by compaction, retry with the new segment.
+			if c.segments.Get(offset) != segment {
+				continue
+			}
+			// If the remaining records in a compacted segment have been
+			// removed, skip to the next segment.
+			if end := segment.Offset() + segment.Size(); offset < end && segment != c.segments.Last() {
+				offset = end
+				continue
+			}
+			// If the offset is in a gap left by a quarantined segment,
+			// skip to the next segment.
+			if next := c.segments.Next(offset); next != nil {
+				offset = next.Offset()
+				continue
 			}
-		}()
-		c.newSegment()
+			return nil, ErrNotFound
+		}
+		if err == ErrCorrupt {
+			corruptRecords.Add(1)
+			c.logger.Error(
+				"corrupt record",
+				zap.String("dir", c.dir),
+				zap.Uint64("segment", segment.Offset()),
+				zap.Uint64("offset", offset),
+			)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range records {
+			records[i].Offset += segment.Offset()
+			records[i].NextOffset += segment.Offset()
+		}
+		return records, nil
+	}
+}
+
+// LookupByTime returns the offset to read from to get all entries appended at
+// or after the given time.
+//
+// Since only a sparse set of entries are indexed by time, the returned offset
+// is the offset of the last indexed entry appended before the given time, so
+// may include some entries appended shortly before (up to the index interval).
+// If no entries were appended before the given time returns the earliest
+// offset, and if all entries were appended before returns an offset near the
+// end of the log.
+func (c *CommitLog) LookupByTime(timestamp time.Time) uint64 {
+	segments := c.segments.All()
+	for i := len(segments) - 1; i >= 0; i-- {
+		if offset, ok := segments[i].LookupTime(timestamp); ok {
+			return segments[i].Offset() + offset
+		}
+	}
+	return c.EarliestOffset()
+}
+
+// LookupLastN returns the offset of the nth last entry in the commit log, so
+// reading from the offset returns the last n entries. If the log has fewer
+// than n entries returns the earliest offset.
+func (c *CommitLog) LookupLastN(n uint64) (uint64, error) {
+	if n == 0 {
+		return c.Offset(), nil
+	}
+
+	segments := c.segments.All()
+	found := uint64(0)
+	for i := len(segments) - 1; i >= 0; i-- {
+		offset, count, err := segments[i].LookupLastN(n - found)
+		if err != nil {
+			return 0, err
+		}
+		found += count
+		if found == n {
+			return segments[i].Offset() + offset, nil
+		}
 	}
+	return c.EarliestOffset(), nil
 }
 
-// Lookup returns the entry at the given offset in the commit log. If not found
-// returns ErrNotFound.
-func (c *CommitLog) Lookup(offset uint64) ([]byte, error) {
+// ValidateOffset checks the given offset is the start of an entry in the
+// commit log, or the end of the log. Returns ErrInvalidOffset if the offset
+// is beyond the end of the log or in the middle of an entry, and ErrNotFound
+// if the offset has been removed by retention.
+func (c *CommitLog) ValidateOffset(offset uint64) error {
+	end := c.Offset()
+	if offset == end {
+		return nil
+	}
+	if offset > end {
+		return ErrInvalidOffset
+	}
+	if offset < c.EarliestOffset() {
+		return ErrNotFound
+	}
+
 	segment := c.segments.Get(offset)
 	if segment == nil {
-		return nil, ErrNotFound
+		return ErrNotFound
 	}
+	return segment.ValidateOffset(offset - segment.Offset())
+}
 
-	segmentOffset := offset - segment.Offset()
-	return segment.Lookup(segmentOffset)
+// NextSegmentOffset returns the offset of the segment following the segment
+// containing the given offset. If the offset is in the last segment returns
+// the end of the commit log.
+//
+// This is used to skip past corrupt records, since once a record is corrupt
+// the following record boundaries in the segment can't be trusted.
+func (c *CommitLog) NextSegmentOffset(offset uint64) uint64 {
+	for _, segment := range c.segments.All() {
+		if segment.Offset() > offset {
+			return segment.Offset()
+		}
+	}
+	return c.Offset()
 }
 
 // Flush persists the latest segment to disk (syncrously) and creates a new in-
@@ -70,6 +574,9 @@ func (c *CommitLog) Lookup(offset uint64) ([]byte, error) {
 // Note this will typically occur in the background when the latest segment
 // is full, though adding an explicit method for testing.
 func (c *CommitLog) Flush() error {
+	c.appendMu.Lock()
+	defer c.appendMu.Unlock()
+
 	segment := c.segments.Last()
 	if segment == nil {
 		// No segments exist so nothing to do.
@@ -79,34 +586,471 @@ func (c *CommitLog) Flush() error {
 	if err := c.persist(segment); err != nil {
 		return err
 	}
-	c.newSegment()
-	return nil
+	_, err := c.newSegment(segment.Offset() + segment.Size())
+	return err
+}
+
+// Retain removes the oldest persisted segments that exceed the given retention
+// limits, deleting their files, and returns the number of segments removed.
+//
+// A segment is expired if it was last written to more than maxAge ago, or the
+// total size of the commit log exceeds maxSize. Only whole persisted segments
+// are removed, so the in-memory segment is always retained. A zero limit is
+// unlimited. Segments offloaded to tiered storage are also removed from
+// storage.
+func (c *CommitLog) Retain(maxAge time.Duration, maxSize uint64) (int, error) {
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+
+	segments := c.segments.All()
+
+	size := uint64(0)
+	for _, segment := range segments {
+		size += segment.Size()
+	}
+
+	removed := 0
+	now := time.Now()
+	// Never remove the last segment, which is the active segment.
+	for i := 0; i < len(segments)-1; i++ {
+		// Segments are persisted in order so once we find a segment that
+		// isn't persisted, all following segments are also not persisted.
+		segment, ok := segments[i].(persistedSegment)
+		if !ok {
+			break
+		}
+
+		expired := maxAge != 0 && now.Sub(segment.ModTime()) > maxAge
+		oversized := maxSize != 0 && size > maxSize
+		if !expired && !oversized {
+			break
+		}
+
+		c.segments.Remove(segment.Offset())
+		if err := segment.Remove(); err != nil {
+			return removed, err
+		}
+		size -= segment.Size()
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Compact rewrites the persisted segments to keep only the latest record for
+// each key, and returns the number of records removed. Records without a key
+// are always retained.
+//
+// Each compacted segment is swapped in to replace the existing segment, so
+// readers continue from the same offsets, where lookups of removed records
+// return the next retained record. The in-memory segment is never compacted,
+// though its keys are considered when finding the latest record for each key.
+//
+// Segments offloaded to tiered storage are never compacted, so their keys are
+// not considered either.
+func (c *CommitLog) Compact() (int, error) {
+	// If not persisted nothing to do.
+	if !c.options.Persisted {
+		return 0, nil
+	}
+
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+
+	segments := c.segments.All()
+
+	// Find the offset of the latest record for each key.
+	latest := make(map[string]uint64)
+	for _, segment := range segments {
+		if _, ok := segment.(*RemoteSegment); ok {
+			continue
+		}
+
+		size := segment.Size()
+		offset := uint64(0)
+		for offset < size {
+			r, err := segment.Lookup(offset)
+			if err == ErrNotFound {
+				break
+			}
+			if err != nil {
+				return 0, fmt.Errorf("segment %d: %w", segment.Offset(), err)
+			}
+			if r.Key != nil {
+				latest[string(r.Key)] = segment.Offset() + r.Offset
+			}
+			offset = r.NextOffset
+		}
+	}
+
+	removed := 0
+	// Never compact the last segment, which is the active segment.
+	for i := 0; i < len(segments)-1; i++ {
+		if _, ok := segments[i].(*RemoteSegment); ok {
+			continue
+		}
+		// Segments are persisted in order so once we find a segment that
+		// isn't persisted, all following segments are also not persisted.
+		segment, ok := segments[i].(*FileSegment)
+		if !ok {
+			break
+		}
+
+		compacted, segmentRemoved, err := segment.Compact(c.dir, func(r Record) bool {
+			return r.Key == nil || latest[string(r.Key)] == segment.Offset()+r.Offset
+		})
+		if err != nil {
+			return removed, err
+		}
+		// If nothing was removed the segment is unchanged.
+		if compacted == nil {
+			continue
+		}
+
+		c.segments.Swap(compacted)
+		// Any lookups in progress on the existing segment will fail and
+		// be retried with the compacted segment.
+		if err := segment.Close(); err != nil {
+			return removed, err
+		}
+		removed += segmentRemoved
+	}
+
+	return removed, nil
+}
+
+// Offload moves the persisted segments last written to more than maxAge ago to
+// tiered storage, and returns the number of segments offloaded. If no storage
+// is configured does nothing.
+//
+// Each offloaded segment is swapped with a remote segment, which fetches the
+// segment back from storage on demand, then the local segment is removed.
+func (c *CommitLog) Offload(maxAge time.Duration) (int, error) {
+	if !c.options.Persisted || c.options.Storage == nil {
+		return 0, nil
+	}
+
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+
+	segments := c.segments.All()
+
+	offloaded := 0
+	now := time.Now()
+	// Never offload the last segment, which is the active segment.
+	for i := 0; i < len(segments)-1; i++ {
+		if _, ok := segments[i].(*RemoteSegment); ok {
+			continue
+		}
+		// Segments are persisted in order so once we find a segment that
+		// isn't persisted, all following segments are also not persisted.
+		segment, ok := segments[i].(*FileSegment)
+		if !ok {
+			break
+		}
+		// Segments are also written in order so once we find a segment
+		// that is too recent, all following segments are too recent.
+		if now.Sub(segment.ModTime()) <= maxAge {
+			break
+		}
+
+		remote, err := offloadSegment(c.dir, segment, c.options.Storage, c.cache, c.logger)
+		if err != nil {
+			return offloaded, err
+		}
+		c.segments.Swap(remote)
+		// Any lookups in progress on the local segment will fail and be
+		// retried with the remote segment.
+		if err := segment.Remove(); err != nil {
+			return offloaded, err
+		}
+		offloaded++
+	}
+
+	return offloaded, nil
 }
 
 // persist swaps the given segment with a persisted file segment.
 func (c *CommitLog) persist(s Segment) error {
 	// If not persisted nothing to do.
-	if !c.persisted {
+	if !c.options.Persisted {
 		return nil
 	}
 
-	fileSegment, err := s.Persist(c.dir)
+	fileSegment, err := s.Persist(c.dir, c.options.Compression)
 	if err != nil {
 		return err
 	}
 	c.segments.Swap(fileSegment)
+	if s, ok := s.(*InMemorySegment); ok {
+		s.release()
+	}
 	return nil
 }
 
-// newSegment adds a new empty in-memory segment to the log.
-func (c *CommitLog) newSegment() {
-	segment := c.segments.Last()
-	if segment == nil {
-		// First segment so offset is 0.
-		c.segments.Add(0, segment)
-		return
+// persistInBackground persists the given full segment in a background
+// goroutine, so appends aren't blocked.
+//
+// If persisting fails, such as if the disk is full, the segment is retried
+// with exponential backoff until it succeeds or the log is closed. The log is
+// degraded while the segment is failing.
+func (c *CommitLog) persistInBackground(segment Segment) {
+	c.persistWG.Add(1)
+	go func() {
+		defer c.persistWG.Done()
+
+		backoff := minPersistBackoff
+		for attempts := 1; ; attempts++ {
+			err := c.persist(segment)
+			c.setPersistErr(segment.Offset(), err)
+			if err == nil {
+				return
+			}
+
+			persistFailures.Add(1)
+			c.logger.Error(
+				"failed to persist segment; retrying",
+				zap.String("dir", c.dir),
+				zap.Uint64("segment", segment.Offset()),
+				zap.Int("attempts", attempts),
+				zap.Duration("backoff", backoff),
+				zap.Error(err),
+			)
+
+			select {
+			case <-time.After(backoff):
+			case <-c.done:
+				return
+			}
+
+			backoff *= 2
+			if backoff > maxPersistBackoff {
+				backoff = maxPersistBackoff
+			}
+		}
+	}()
+}
+
+// setPersistErr records the result of persisting the segment with the given
+// offset, where a nil error means the segment was persisted. Logs when the
+// log becomes degraded or recovers.
+func (c *CommitLog) setPersistErr(offset uint64, err error) {
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+
+	wasDegraded := len(c.persistErrs) > 0
+	if err != nil {
+		c.persistErrs[offset] = err
+	} else {
+		delete(c.persistErrs, offset)
+	}
+	degraded := len(c.persistErrs) > 0
+
+	if !wasDegraded && degraded {
+		c.logger.Warn(
+			"commit log degraded",
+			zap.String("dir", c.dir),
+			zap.Error(err),
+		)
+	} else if wasDegraded && !degraded {
+		c.logger.Info(
+			"commit log recovered",
+			zap.String("dir", c.dir),
+		)
+	}
+}
+
+// dropSegments removes the oldest segments while the memory budget is
+// exceeded, so a log that isn't persisted acts as a ring buffer rather than
+// growing without bound. The last segment is never removed.
+//
+// Note each log only drops its own segments, so a busy topic can't remove the
+// messages of other topics.
+func (c *CommitLog) dropSegments() {
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+
+	segments := c.segments.All()
+	for i := 0; i < len(segments)-1 && c.options.Memory.Exceeded(); i++ {
+		c.segments.Remove(segments[i].Offset())
+		if s, ok := segments[i].(*InMemorySegment); ok {
+			s.release()
+		}
+		droppedSegments.Add(1)
+	}
+}
+
+// newSegment adds a new empty in-memory segment to the log at the given
+// offset. If the log is durable the segment has a write-ahead log. The
+// segment buffer is reserved from the memory budget.
+func (c *CommitLog) newSegment(offset uint64) (Segment, error) {
+	var wal *os.File
+	if c.syncer != nil {
+		var err error
+		wal, err = openWAL(c.dir, offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	segment := newInMemorySegment(c.options.SegmentSize, offset, wal, c.options.Memory)
+	c.segments.Add(offset, segment)
+	return segment, nil
+}
+
+// sync syncs all segments containing entries after the given offset, and
+// returns the offset of the end of the log that has been synced.
+func (c *CommitLog) sync(from uint64) (uint64, error) {
+	// Take the offset while holding the append lock so it matches the
+	// segments being synced.
+	c.appendMu.Lock()
+	offset := c.Offset()
+	segments := c.segments.All()
+	c.appendMu.Unlock()
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		// Segments before from have already been synced.
+		if segment.Offset()+segment.Size() <= from {
+			break
+		}
+		if err := segment.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// listFileOffsets returns the offsets of the segment files in the given
+// directory with the given extension in ascending order. Each file is named
+// '<offset><ext>', such as '<offset>.data' for persisted segments. If the
+// directory doesn't exist returns no offsets.
+func listFileOffsets(dir string, ext string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	offsets := []uint64{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ext {
+			continue
+		}
+		offset, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ext), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid segment file: %s", entry.Name())
+		}
+		offsets = append(offsets, offset)
+	}
+
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+	return offsets, nil
+}
+
+// mergeOffsets merges the given sorted offsets into a single sorted slice
+// without duplicates.
+func mergeOffsets(a []uint64, b []uint64) []uint64 {
+	offsets := append(append([]uint64{}, a...), b...)
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+
+	merged := []uint64{}
+	for _, offset := range offsets {
+		if len(merged) == 0 || merged[len(merged)-1] != offset {
+			merged = append(merged, offset)
+		}
 	}
+	return merged
+}
+
+// recoverFiles recovers the write-ahead logs in the given directory. Since the
+// write-ahead log has the same format as a persisted segment, its just renamed
+// to replace the persisted segment (which may be partially written if the
+// server crashed while persisting).
+//
+// This also removes any partially written compacted or truncated segments,
+// where the original segment is still intact, and the local cache of remote
+// segments.
+//
+// If the server crashed while offloading a segment there may be both a remote
+// stub and local segment, in which case the stub is removed and the local
+// segment kept, so the segment will be offloaded again.
+func recoverFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, remoteCacheDir)); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if filepath.Ext(entry.Name()) == ".tmp" {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if filepath.Ext(entry.Name()) == ".remote" {
+			stubPath := filepath.Join(dir, entry.Name())
+			dataPath := strings.TrimSuffix(stubPath, ".remote") + ".data"
+			walPath := strings.TrimSuffix(stubPath, ".remote") + ".wal"
+			if fileExists(dataPath) || fileExists(walPath) {
+				if err := os.Remove(stubPath); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if ext := filepath.Ext(entry.Name()); ext == ".compacting" || ext == ".truncating" {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if filepath.Ext(entry.Name()) != ".wal" {
+			continue
+		}
+		walPath := filepath.Join(dir, entry.Name())
+		dataPath := strings.TrimSuffix(walPath, ".wal") + ".data"
+		if err := os.Rename(walPath, dataPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantineSegment renames the data file of the segment at the given offset
+// to '<offset>.corrupt' and removes its index, so the segment is kept for
+// inspection but not loaded again. Returns the size of the data file.
+func quarantineSegment(dir string, offset uint64) (uint64, error) {
+	dataPath := fmt.Sprintf("%s/%d.data", dir, offset)
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(dataPath, strings.TrimSuffix(dataPath, ".data")+".corrupt"); err != nil {
+		return 0, err
+	}
+	if err := removeIndexFile(strings.TrimSuffix(dataPath, ".data") + ".index"); err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()), nil
+}
 
-	segmentOffset := segment.Offset() + segment.Size()
-	c.segments.Add(segmentOffset, NewInMemorySegment(c.segmentSize, segmentOffset))
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
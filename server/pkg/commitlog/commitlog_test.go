@@ -1,125 +1,1070 @@
 package commitlog
 
 import (
+	"encoding/binary"
+	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func TestCommitLog_AppendThenLookupOneSegment(t *testing.T) {
 	// Use a large segment size so all messages fit in the same segment.
-	log := NewCommitLog(false, 100, "")
-	log.Append([]byte("foo"))
-	log.Append([]byte("bar"))
-	log.Append([]byte("car"))
+	log := NewCommitLog("", Options{
+		Persisted:   false,
+		SegmentSize: 100,
+	}, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	log.Append(nil, []byte("bar"))
+	log.Append(nil, []byte("car"))
 
-	b, err := log.Lookup(0)
+	r, err := log.Lookup(0)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("foo"), b)
+	assert.Equal(t, []byte("foo"), r.Value)
 
-	b, err = log.Lookup(7)
+	r, err = log.Lookup(11)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("bar"), b)
+	assert.Equal(t, []byte("bar"), r.Value)
 
-	b, err = log.Lookup(14)
+	r, err = log.Lookup(22)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("car"), b)
+	assert.Equal(t, []byte("car"), r.Value)
 
-	b, err = log.Lookup(21)
+	r, err = log.Lookup(33)
 	assert.Equal(t, ErrNotFound, err)
 }
 
 func TestCommitLog_AppendThenLookupMultiSegment(t *testing.T) {
 	// Use a small segment size so each message has its own segment.
-	log := NewCommitLog(false, 5, "")
-	log.Append([]byte("foo"))
-	log.Append([]byte("bar"))
-	log.Append([]byte("car"))
+	log := NewCommitLog("", Options{
+		Persisted:   false,
+		SegmentSize: 5,
+	}, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	log.Append(nil, []byte("bar"))
+	log.Append(nil, []byte("car"))
 
-	b, err := log.Lookup(0)
+	r, err := log.Lookup(0)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("foo"), b)
+	assert.Equal(t, []byte("foo"), r.Value)
 
-	b, err = log.Lookup(7)
+	r, err = log.Lookup(11)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("bar"), b)
+	assert.Equal(t, []byte("bar"), r.Value)
 
-	b, err = log.Lookup(14)
+	r, err = log.Lookup(22)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("car"), b)
+	assert.Equal(t, []byte("car"), r.Value)
 
-	b, err = log.Lookup(21)
+	r, err = log.Lookup(33)
 	assert.Equal(t, ErrNotFound, err)
 }
 
 func TestCommitLog_AppendThenLookupPersistedSegment(t *testing.T) {
-	dir := "data/" + uuid.New().String()
-	defer os.RemoveAll(dir)
+	dir := t.TempDir()
 
 	// Use a small segment size so each message has its own segment. Flush
 	// each to disk so lookup goes to disk.
-	log := NewCommitLog(false, 5, dir)
-	log.Append([]byte("foo"))
+	log := NewCommitLog(dir, Options{
+		Persisted:   false,
+		SegmentSize: 5,
+	}, zap.NewNop())
+	defer log.Close()
+	log.Append(nil, []byte("foo"))
 	assert.Nil(t, log.Flush())
-	log.Append([]byte("bar"))
+	log.Append(nil, []byte("bar"))
 	assert.Nil(t, log.Flush())
-	log.Append([]byte("car"))
+	log.Append(nil, []byte("car"))
 	assert.Nil(t, log.Flush())
 
-	b, err := log.Lookup(0)
+	r, err := log.Lookup(0)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("foo"), b)
+	assert.Equal(t, []byte("foo"), r.Value)
 
-	b, err = log.Lookup(7)
+	r, err = log.Lookup(11)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("bar"), b)
+	assert.Equal(t, []byte("bar"), r.Value)
 
-	b, err = log.Lookup(14)
+	r, err = log.Lookup(22)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("car"), b)
+	assert.Equal(t, []byte("car"), r.Value)
 
-	b, err = log.Lookup(21)
+	r, err = log.Lookup(33)
 	assert.Equal(t, ErrNotFound, err)
 }
 
-func benchmarkCommitLog(appends int, messageLen int) {
-	dir := "data/" + uuid.New().String()
-	defer os.RemoveAll(dir)
+func TestCommitLog_AppendBatch(t *testing.T) {
+	dir := t.TempDir()
 
-	log := NewCommitLog(true, 1<<24, dir)
+	options := Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Durability:  DurabilityAlways,
+	}
+
+	log := NewCommitLog(dir, options, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	records := []Record{
+		{Key: nil, Value: []byte("bar")},
+		{Key: []byte("k"), Value: []byte("car")},
+		{Key: nil, Value: []byte("dar")},
+	}
+	offset, err := log.AppendBatch(records)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(49), offset)
+
+	assert.Equal(t, uint64(11), records[0].Offset)
+	assert.Equal(t, uint64(22), records[0].NextOffset)
+	assert.Equal(t, uint64(22), records[1].Offset)
+	assert.Equal(t, uint64(38), records[1].NextOffset)
+	assert.Equal(t, uint64(38), records[2].Offset)
+	assert.Equal(t, uint64(49), records[2].NextOffset)
+
+	errCh := make(chan error, 1)
+	log.OnDurable(offset, func(err error) {
+		errCh <- err
+	})
+	assert.Nil(t, <-errCh)
+
+	// Load the commit log without flushing the in-memory segment so the
+	// batch is recovered from the write-ahead log.
+	log.Close()
+	log, err = LoadCommitLog(dir, options, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+
+	assert.Equal(t, offset, log.Offset())
+	for _, record := range records {
+		r, err := log.Lookup(record.Offset)
+		assert.Nil(t, err)
+		assert.Equal(t, record.Value, r.Value)
+		assert.Equal(t, record.Key, r.Key)
+		assert.Equal(t, record.NextOffset, r.NextOffset)
+	}
+}
+
+func TestCommitLog_LoadPersistedSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	// Use a large segment size so segments are only persisted when flushed.
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+
+	// Load the commit log from the persisted segments, as if the node
+	// restarted.
+	log.Close()
+	log, err := LoadCommitLog(dir, Options{
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+	assert.Equal(t, uint64(22), log.Offset())
+
+	r, err := log.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+
+	r, err = log.Lookup(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+
+	// New appends should continue from the end of the loaded log.
+	log.Append(nil, []byte("car"))
+	assert.Equal(t, uint64(33), log.Offset())
+
+	r, err = log.Lookup(22)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("car"), r.Value)
+}
+
+func TestCommitLog_LoadLegacySegment(t *testing.T) {
+	dir := t.TempDir()
+
+	// Write a segment in the legacy format, with no header and each record
+	// prefixed with a 4 byte size.
+	legacy := []byte{}
+	for _, v := range []string{"foo", "bar"} {
+		legacy = binary.BigEndian.AppendUint32(legacy, uint32(len(v)))
+		legacy = append(legacy, v...)
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "0.data"), legacy, 0644))
+
+	log, err := LoadCommitLog(dir, Options{
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+	assert.Equal(t, uint64(14), log.Offset())
+
+	r, err := log.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+	assert.Equal(t, uint64(7), r.NextOffset)
+
+	r, err = log.Lookup(7)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+
+	// New appends should continue from the end of the legacy segment.
+	log.Append(nil, []byte("car"))
+	assert.Equal(t, uint64(25), log.Offset())
+
+	r, err = log.Lookup(14)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("car"), r.Value)
+
+	records, err := log.NewReader(0).NextBatch()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, []byte("bar"), records[1].Value)
+	assert.Equal(t, uint64(14), records[1].NextOffset)
+}
+
+func TestCommitLog_LoadQuarantinesUnreadableSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("car"))
+	assert.Nil(t, log.Flush())
+	log.Close()
+
+	// Overwrite the version of the second segment with an unsupported
+	// version.
+	f, err := os.OpenFile(filepath.Join(dir, "11.data"), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, 6)
+	assert.Nil(t, err)
+	f.Close()
+
+	log, err = LoadCommitLog(dir, Options{
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+	assert.Equal(t, uint64(33), log.Offset())
+	assert.FileExists(t, filepath.Join(dir, "11.corrupt"))
+
+	reader := log.NewReader(0)
+	r, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+
+	// Reading from the quarantined segment should skip to the next
+	// segment.
+	r, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("car"), r.Value)
+	assert.Equal(t, uint64(22), r.Offset)
+}
+
+func TestCommitLog_LoadMissingDir(t *testing.T) {
+	log, err := LoadCommitLog(t.TempDir()+"/missing", Options{
+		SegmentSize: 5,
+	}, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+	assert.Equal(t, uint64(0), log.Offset())
+
+	_, err = log.Lookup(0)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestCommitLog_RetainMaxSize(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	defer log.Close()
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("car"))
+	assert.Nil(t, log.Flush())
+
+	// Limiting to 22 bytes should remove the first segment only.
+	removed, err := log.Retain(0, 22)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, uint64(11), log.EarliestOffset())
+
+	_, err = log.Lookup(0)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = os.Stat(dir + "/0.data")
+	assert.True(t, os.IsNotExist(err))
+
+	r, err := log.Lookup(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+}
+
+func TestCommitLog_RetainMaxAge(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+
+	// Mark the first segment as an hour old and reload.
+	expired := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(dir+"/0.data", expired, expired))
+	log.Close()
+	log, err := LoadCommitLog(dir, Options{
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+
+	removed, err := log.Retain(time.Minute, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, uint64(11), log.EarliestOffset())
+
+	r, err := log.Lookup(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+}
+
+func TestCommitLog_RetainKeepsInMemorySegment(t *testing.T) {
+	log := NewCommitLog("", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+
+	removed, err := log.Retain(time.Nanosecond, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+
+	r, err := log.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+}
+
+func TestCommitLog_OnDurable(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, durability := range []Durability{DurabilityInterval, DurabilityAlways} {
+		log := NewCommitLog(dir+"/"+durability.String(), Options{
+			Persisted:    true,
+			SegmentSize:  1000,
+			Durability:   durability,
+			SyncInterval: time.Millisecond,
+		}, zap.NewNop())
+
+		offset, err := log.Append(nil, []byte("foo"))
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(11), offset)
+
+		errCh := make(chan error, 1)
+		log.OnDurable(offset, func(err error) {
+			errCh <- err
+		})
+		assert.Nil(t, <-errCh)
+
+		log.Close()
+	}
+}
+
+func TestCommitLog_RecoverWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	options := Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Durability:  DurabilityAlways,
+	}
+
+	log := NewCommitLog(dir, options, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	offset, err := log.Append(nil, []byte("bar"))
+	assert.Nil(t, err)
+
+	errCh := make(chan error, 1)
+	log.OnDurable(offset, func(err error) {
+		errCh <- err
+	})
+	assert.Nil(t, <-errCh)
+
+	// Load the commit log without flushing the in-memory segment, as if the
+	// node crashed. The segment should be recovered from the write-ahead log.
+	log.Close()
+	log, err = LoadCommitLog(dir, options, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+
+	assert.Equal(t, uint64(22), log.Offset())
+
+	r, err := log.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+
+	r, err = log.Lookup(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+}
+
+func TestCommitLog_LookupByTime(t *testing.T) {
+	log := NewCommitLog("", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	before := time.Now().Add(-time.Minute)
+	log.Append(nil, []byte("foo"))
+	log.Append(nil, []byte("bar"))
+
+	// If no entries were appended before the time, read from the start.
+	assert.Equal(t, uint64(0), log.LookupByTime(before))
+	// Otherwise read from the last indexed entry before the time.
+	assert.Equal(t, uint64(0), log.LookupByTime(time.Now().Add(time.Minute)))
+}
+
+func TestCommitLog_LookupLastN(t *testing.T) {
+	// Use a small segment size so the messages span multiple segments.
+	log := NewCommitLog("", Options{
+		Persisted:   false,
+		SegmentSize: 15,
+	}, zap.NewNop())
+
+	log.Append(nil, []byte("foo"))
+	log.Append(nil, []byte("bar"))
+	log.Append(nil, []byte("car"))
+	log.Append(nil, []byte("baz"))
+
+	for n, expected := range []uint64{44, 33, 22, 11, 0, 0} {
+		offset, err := log.LookupLastN(uint64(n))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, offset)
+	}
+}
+
+func TestCommitLog_ValidateOffset(t *testing.T) {
+	log := NewCommitLog("", Options{
+		Persisted:   false,
+		SegmentSize: 15,
+	}, zap.NewNop())
+
+	log.Append(nil, []byte("foo"))
+	log.Append(nil, []byte("bar"))
+	log.Append(nil, []byte("car"))
+
+	assert.Nil(t, log.ValidateOffset(0))
+	assert.Nil(t, log.ValidateOffset(22))
+	assert.Nil(t, log.ValidateOffset(33))
+	assert.Equal(t, ErrInvalidOffset, log.ValidateOffset(5))
+	assert.Equal(t, ErrInvalidOffset, log.ValidateOffset(25))
+	assert.Equal(t, ErrInvalidOffset, log.ValidateOffset(34))
+}
+
+func benchmarkCommitLog(b *testing.B, appends int, messageLen int) {
+	log := NewCommitLog(b.TempDir(), Options{
+		Persisted:   true,
+		SegmentSize: 1 << 24,
+	}, zap.NewNop())
+	defer log.Close()
 
 	message := make([]byte, messageLen)
 	rand.Read(message)
 
 	for i := 0; i != appends; i++ {
-		log.Append(message)
+		log.Append(nil, message)
 	}
 
 	offset := uint64(0)
 	for i := 0; i != appends; i++ {
-		b, err := log.Lookup(offset)
+		r, err := log.Lookup(offset)
 		if err != nil {
 			panic(err)
 		}
-		if len(b) != messageLen {
+		if len(r.Value) != messageLen {
 			panic("invalid message")
 		}
-		offset += PrefixSize
-		offset += uint64(messageLen)
+		offset = r.NextOffset
 	}
 }
 
 func BenchmarkCommitLog_Append1000_M10(b *testing.B) {
 	for n := 0; n < b.N; n++ {
-		benchmarkCommitLog(1000, 10)
+		benchmarkCommitLog(b, 1000, 10)
 	}
 }
 
 func BenchmarkCommitLog_Append1000_M256KB(b *testing.B) {
 	for n := 0; n < b.N; n++ {
-		benchmarkCommitLog(1000, 256000)
+		benchmarkCommitLog(b, 1000, 256000)
+	}
+}
+
+func TestCommitLog_ConcurrentLookupPersisted(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1 << 20,
+	}, zap.NewNop())
+	defer log.Close()
+	for i := 0; i != 1000; i++ {
+		log.Append(nil, []byte(fmt.Sprintf("message-%04d", i)))
+	}
+	assert.Nil(t, log.Flush())
+
+	// Read the persisted segment from many goroutines at once. Each should
+	// read every message in order without interfering with the others.
+	var wg sync.WaitGroup
+	for i := 0; i != 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			offset := uint64(0)
+			for i := 0; i != 1000; i++ {
+				r, err := log.Lookup(offset)
+				assert.Nil(t, err)
+				assert.Equal(t, []byte(fmt.Sprintf("message-%04d", i)), r.Value)
+				offset = r.NextOffset
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// benchmarkCommitLogParallelResumers benchmarks reading a persisted commit log
+// from the start with many concurrent readers, such as subscribers resuming
+// from an old offset.
+func benchmarkCommitLogParallelResumers(b *testing.B, resumers int, appends int, messageLen int) {
+	dir := b.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1 << 24,
+	}, zap.NewNop())
+	defer log.Close()
+
+	message := make([]byte, messageLen)
+	rand.Read(message)
+
+	for i := 0; i != appends; i++ {
+		log.Append(nil, message)
+	}
+	if err := log.Flush(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(resumers * appends * messageLen))
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		var wg sync.WaitGroup
+		for i := 0; i != resumers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				offset := uint64(0)
+				for i := 0; i != appends; i++ {
+					r, err := log.Lookup(offset)
+					if err != nil {
+						panic(err)
+					}
+					if len(r.Value) != messageLen {
+						panic("invalid message")
+					}
+					offset = r.NextOffset
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkCommitLog_ParallelResumers1_Append10000_M1000(b *testing.B) {
+	benchmarkCommitLogParallelResumers(b, 1, 10000, 1000)
+}
+
+func BenchmarkCommitLog_ParallelResumers50_Append10000_M1000(b *testing.B) {
+	benchmarkCommitLogParallelResumers(b, 50, 10000, 1000)
+}
+
+func TestCommitLog_Compact(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	// Keyed records are 14 bytes and records without a key are 9 bytes.
+	log.Append([]byte("a"), []byte("1"))
+	log.Append([]byte("b"), []byte("2"))
+	assert.Nil(t, log.Flush())
+	log.Append([]byte("a"), []byte("3"))
+	log.Append(nil, []byte("4"))
+	assert.Nil(t, log.Flush())
+	// The in-memory segment isn't compacted but its keys replace earlier
+	// records.
+	log.Append([]byte("b"), []byte("5"))
+
+	removed, err := log.Compact()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+
+	// Reading from the start of the log should skip the removed records
+	// while keeping the same offsets.
+	var values []string
+	var offsets []uint64
+	offset := log.EarliestOffset()
+	for {
+		r, err := log.Lookup(offset)
+		if err == ErrNotFound {
+			break
+		}
+		assert.Nil(t, err)
+		values = append(values, string(r.Value))
+		offsets = append(offsets, r.Offset)
+		offset = r.NextOffset
+	}
+	assert.Equal(t, []string{"3", "4", "5"}, values)
+	assert.Equal(t, []uint64{28, 42, 51}, offsets)
+	assert.Equal(t, uint64(65), offset)
+	assert.Nil(t, log.ValidateOffset(0))
+
+	// Compacting again should remove nothing.
+	removed, err = log.Compact()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+
+	// Reload and check the compacted segments are recovered.
+	assert.Nil(t, log.Flush())
+	log.Close()
+	log, err = LoadCommitLog(dir, Options{
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+	assert.Equal(t, uint64(65), log.Offset())
+
+	r, err := log.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), r.Key)
+	assert.Equal(t, []byte("3"), r.Value)
+
+	offset, err = log.LookupLastN(3)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(28), offset)
+}
+
+func TestCommitLog_LoadMixedCompression(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Compression: CompressionNone,
+	}, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Close()
+
+	// Reload with compression enabled, where new segments are compressed
+	// but the existing segment is unchanged.
+	log, err := LoadCommitLog(dir, Options{
+		SegmentSize: 1000,
+		Durability:  DurabilityAlways,
+		Compression: CompressionZstd,
+	}, zap.NewNop())
+	assert.Nil(t, err)
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+	log.Close()
+
+	// The write-ahead log should be removed once the compressed segment is
+	// persisted.
+	_, err = os.Stat(dir + "/11.wal")
+	assert.True(t, os.IsNotExist(err))
+
+	log, err = LoadCommitLog(dir, Options{
+		SegmentSize: 1000,
+		Compression: CompressionSnappy,
+	}, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+
+	r, err := log.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+
+	r, err = log.Lookup(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+}
+
+func TestCommitLog_Offload(t *testing.T) {
+	dir := t.TempDir()
+	storageDir := t.TempDir()
+
+	options := Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Storage:     NewLocalStorage(storageDir),
+	}
+	log := NewCommitLog(dir, options, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("car"))
+
+	// Offloading with a max age of 0 should offload all persisted segments
+	// but not the in-memory segment.
+	offloaded, err := log.Offload(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, offloaded)
+
+	_, err = os.Stat(dir + "/0.data")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + "/0.remote")
+	assert.Nil(t, err)
+
+	// Lookups should fetch the remote segments on demand.
+	for i, value := range []string{"foo", "bar", "car"} {
+		r, err := log.Lookup(uint64(i * 11))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(value), r.Value)
+	}
+	offset, err := log.LookupLastN(3)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), offset)
+
+	// Offloading again should do nothing.
+	offloaded, err = log.Offload(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, offloaded)
+
+	// Reloading should load the remote segments from their stubs.
+	assert.Nil(t, log.Flush())
+	log.Close()
+	log, err = LoadCommitLog(dir, options, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+
+	reader := log.NewReader(0)
+	for _, value := range []string{"foo", "bar", "car"} {
+		r, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(value), r.Value)
+	}
+}
+
+func TestCommitLog_OffloadMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	storageDir := t.TempDir()
+
+	options := Options{
+		SegmentSize: 1000,
+		Storage:     NewLocalStorage(storageDir),
+	}
+	log, err := LoadCommitLog(dir, options, zap.NewNop())
+	assert.Nil(t, err)
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+
+	// Mark the first segment as an hour old and reload.
+	old := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(dir+"/0.data", old, old))
+	log.Close()
+	log, err = LoadCommitLog(dir, options, zap.NewNop())
+	assert.Nil(t, err)
+	defer log.Close()
+
+	offloaded, err := log.Offload(time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, offloaded)
+
+	// The remote segment should keep the modification time of the local
+	// segment, so retention removes it from storage.
+	removed, err := log.Retain(time.Minute, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, uint64(11), log.EarliestOffset())
+
+	_, err = os.Stat(dir + "/0.remote")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(storageDir + "/" + filepath.Base(dir) + "/0.data")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = log.Lookup(0)
+	assert.Equal(t, ErrNotFound, err)
+	r, err := log.Lookup(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+}
+
+func TestCommitLog_OffloadEvictsCache(t *testing.T) {
+	dir := t.TempDir()
+	storageDir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Compression: CompressionSnappy,
+		Storage:     NewLocalStorage(storageDir),
+	}, zap.NewNop())
+	defer log.Close()
+	segments := remoteCacheSize * 2
+	for i := 0; i != segments; i++ {
+		log.Append(nil, []byte(fmt.Sprintf("%d", i)))
+		assert.Nil(t, log.Flush())
 	}
+
+	offloaded, err := log.Offload(0)
+	assert.Nil(t, err)
+	assert.Equal(t, segments, offloaded)
+
+	// Reading every segment should keep at most remoteCacheSize segments
+	// in the local cache.
+	reader := log.NewReader(0)
+	for i := 0; i != segments; i++ {
+		r, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("%d", i)), r.Value)
+	}
+
+	cached, err := listFileOffsets(dir+"/"+remoteCacheDir, ".data")
+	assert.Nil(t, err)
+	assert.Equal(t, remoteCacheSize, len(cached))
+}
+
+func TestCommitLog_LoadRemoteWithoutStorage(t *testing.T) {
+	dir := t.TempDir()
+	storageDir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Storage:     NewLocalStorage(storageDir),
+	}, zap.NewNop())
+	defer log.Close()
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	_, err := log.Offload(0)
+	assert.Nil(t, err)
+
+	// Loading offloaded segments without storage should fail rather than
+	// silently dropping the segments.
+	_, err = LoadCommitLog(dir, Options{
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	assert.NotNil(t, err)
+}
+
+func TestCommitLog_UnloadThenLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	options := Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Durability:  DurabilityAlways,
+	}
+	log := NewCommitLog(dir, options, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("bar"))
+
+	// Unloading should persist the in-memory segment.
+	assert.Nil(t, log.Unload())
+	_, err := os.Stat(dir + "/11.data")
+	assert.Nil(t, err)
+	_, err = os.Stat(dir + "/11.wal")
+	assert.True(t, os.IsNotExist(err))
+
+	log, err = LoadCommitLog(dir, options, zap.NewNop())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(22), log.Offset())
+	r, err := log.Lookup(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+
+	// Unloading with an empty in-memory segment should discard the
+	// segment.
+	assert.Nil(t, log.Unload())
+	_, err = os.Stat(dir + "/22.data")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + "/22.wal")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCommitLog_Remove(t *testing.T) {
+	dir := t.TempDir()
+	storageDir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Storage:     NewLocalStorage(storageDir),
+	}, zap.NewNop())
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("car"))
+
+	// Offload the first segment so remove must delete it from storage.
+	_, err := log.Offload(0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, log.Remove())
+
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(storageDir + "/" + filepath.Base(dir) + "/0.data")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = log.Lookup(0)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestCommitLog_MemoryBudgetRollsSegmentsEarly(t *testing.T) {
+	dir := t.TempDir()
+
+	memory := NewMemoryBudget(1)
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1 << 20,
+		Memory:      memory,
+	}, zap.NewNop())
+
+	// Since the budget is exceeded, segments are rolled once they reach the
+	// minimum segment size rather than the configured segment size.
+	value := make([]byte, 1000)
+	for i := 0; i != 200; i++ {
+		_, err := log.Append(nil, value)
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(log.segments.All()), 2)
+	for _, segment := range log.segments.All() {
+		assert.Less(t, segment.Size(), uint64(minSegmentSize+len(value)+PrefixSize))
+	}
+
+	// Once unloaded all in-memory segments should be released.
+	assert.Nil(t, log.Unload())
+	assert.Equal(t, uint64(0), memory.Used())
+}
+
+func TestCommitLog_MemoryBudgetInMemoryRingBuffer(t *testing.T) {
+	memory := NewMemoryBudget(4000)
+	log := NewCommitLog("", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+		Memory:      memory,
+	}, zap.NewNop())
+
+	value := make([]byte, 100)
+	var offset uint64
+	for i := 0; i != 100; i++ {
+		var err error
+		offset, err = log.Append(nil, value)
+		assert.Nil(t, err)
+	}
+
+	// The oldest segments should have been dropped to stay within the
+	// budget, though the latest messages are retained.
+	assert.LessOrEqual(t, memory.Used(), memory.Limit())
+	assert.Greater(t, log.EarliestOffset(), uint64(0))
+	_, err := log.Lookup(0)
+	assert.Equal(t, ErrNotFound, err)
+	r, err := log.Lookup(offset - 108)
+	assert.Nil(t, err)
+	assert.Equal(t, value, r.Value)
+}
+
+func TestCommitLog_PersistRetry(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 10,
+	}, zap.NewNop())
+	defer log.Close()
+
+	// Create a directory at the segment file path so persisting fails.
+	assert.Nil(t, os.MkdirAll(dir+"/0.data", os.ModePerm))
+
+	// Append a record that fills the segment so its persisted.
+	_, err := log.Append(nil, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return log.PersistErr() != nil
+	}, time.Second, time.Millisecond*10)
+
+	// The segment should still be readable while failing.
+	r, err := log.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+
+	// Once the failure is resolved the segment should be persisted on the
+	// next retry.
+	assert.Nil(t, os.Remove(dir+"/0.data"))
+	assert.Eventually(t, func() bool {
+		return log.PersistErr() == nil
+	}, time.Second*2, time.Millisecond*10)
+	_, ok := log.segments.Get(0).(*FileSegment)
+	assert.True(t, ok)
+}
+
+func TestCommitLog_UnloadPersistsFailedSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 10,
+	}, zap.NewNop())
+
+	assert.Nil(t, os.MkdirAll(dir+"/0.data", os.ModePerm))
+	_, err := log.Append(nil, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return log.PersistErr() != nil
+	}, time.Second, time.Millisecond*10)
+	assert.Nil(t, os.Remove(dir+"/0.data"))
+
+	// Unloading should persist the failed segment rather than waiting for
+	// the next retry.
+	assert.Nil(t, log.Unload())
+
+	loaded, err := LoadCommitLog(dir, Options{
+		SegmentSize: 10,
+	}, zap.NewNop())
+	assert.Nil(t, err)
+	defer loaded.Close()
+	r, err := loaded.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
 }
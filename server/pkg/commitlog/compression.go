@@ -0,0 +1,301 @@
+package commitlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// compressionBlockSize is the number of bytes of records compressed into
+	// each block. Records may span multiple blocks.
+	compressionBlockSize = 64 * 1024
+
+	// blockHeaderSize is the size of the header prefixing each compressed
+	// block, containing the compressed size, uncompressed size and CRC32C
+	// checksum of the compressed block.
+	blockHeaderSize = 12
+
+	// blockCacheSize is the number of decompressed blocks cached by each
+	// segment. Since subscribers mostly read sequentially, only a few blocks
+	// are needed to avoid decompressing the same block for every record.
+	blockCacheSize = 4
+)
+
+var (
+	// Note the zstd encoder and decoder are safe to use concurrently when
+	// using EncodeAll and DecodeAll.
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// block describes a compressed block in a segment file.
+type block struct {
+	// Position is the position of the start of the block in the uncompressed
+	// records.
+	Position uint64
+	// Size is the uncompressed size of the block.
+	Size uint64
+	// FilePosition is the position of the block header in the segment file.
+	FilePosition uint64
+	// CompressedSize is the size of the compressed block, excluding the
+	// block header.
+	CompressedSize uint64
+}
+
+// segmentWriter writes the records of a persisted segment, compressing the
+// records if needed.
+type segmentWriter interface {
+	io.Writer
+	// Flush writes any buffered records to the underlying writer.
+	Flush() error
+}
+
+// blockWriter is a segmentWriter that splits the written records into blocks
+// of compressionBlockSize, which are compressed and written with a block
+// header.
+type blockWriter struct {
+	w           segmentWriter
+	compression Compression
+	buf         []byte
+
+	// filePosition is the position in the file of the next block.
+	filePosition uint64
+	// position is the position in the uncompressed records of the next
+	// block.
+	position uint64
+	blocks   []block
+}
+
+// newBlockWriter returns a writer that writes compressed blocks to w, where
+// filePosition is the position in the file the first block is written to.
+func newBlockWriter(w segmentWriter, compression Compression, filePosition uint64) *blockWriter {
+	return &blockWriter{
+		w:            w,
+		compression:  compression,
+		buf:          make([]byte, 0, compressionBlockSize),
+		filePosition: filePosition,
+		position:     0,
+		blocks:       []block{},
+	}
+}
+
+func (w *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := compressionBlockSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(w.buf) == compressionBlockSize {
+			if err := w.writeBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *blockWriter) Flush() error {
+	if len(w.buf) > 0 {
+		if err := w.writeBlock(); err != nil {
+			return err
+		}
+	}
+	return w.w.Flush()
+}
+
+// Blocks returns the blocks written.
+func (w *blockWriter) Blocks() []block {
+	return w.blocks
+}
+
+func (w *blockWriter) writeBlock() error {
+	compressed := compress(w.compression, w.buf)
+
+	header := make([]byte, blockHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(compressed)))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(w.buf)))
+	binary.BigEndian.PutUint32(header[8:12], crc32.Checksum(compressed, crcTable))
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(compressed); err != nil {
+		return err
+	}
+
+	w.blocks = append(w.blocks, block{
+		Position:       w.position,
+		Size:           uint64(len(w.buf)),
+		FilePosition:   w.filePosition,
+		CompressedSize: uint64(len(compressed)),
+	})
+	w.position += uint64(len(w.buf))
+	w.filePosition += blockHeaderSize + uint64(len(compressed))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// newSegmentWriter returns a writer for the records of a segment written to w,
+// where filePosition is the position in the file of the first record.
+func newSegmentWriter(w segmentWriter, compression Compression, filePosition uint64) segmentWriter {
+	if compression == CompressionNone {
+		return w
+	}
+	return newBlockWriter(w, compression, filePosition)
+}
+
+// loadBlocks reads the block headers of a compressed segment file, and returns
+// the blocks and the position in the file following the last complete block.
+func loadBlocks(file *os.File, headerSize uint64, fileSize uint64) ([]block, uint64, error) {
+	blocks := []block{}
+	position := uint64(0)
+	filePosition := headerSize
+	header := make([]byte, blockHeaderSize)
+	for filePosition+blockHeaderSize <= fileSize {
+		if _, err := file.ReadAt(header, int64(filePosition)); err != nil {
+			return nil, 0, err
+		}
+		compressedSize := uint64(binary.BigEndian.Uint32(header[0:4]))
+		size := uint64(binary.BigEndian.Uint32(header[4:8]))
+		if filePosition+blockHeaderSize+compressedSize > fileSize {
+			break
+		}
+
+		blocks = append(blocks, block{
+			Position:       position,
+			Size:           size,
+			FilePosition:   filePosition,
+			CompressedSize: compressedSize,
+		})
+		position += size
+		filePosition += blockHeaderSize + compressedSize
+	}
+	return blocks, filePosition, nil
+}
+
+// readBlock reads and decompresses the given block from the segment file.
+// Returns ErrCorrupt if the block doesn't match its checksum or can't be
+// decompressed.
+func readBlock(file *os.File, b block, compression Compression) ([]byte, error) {
+	buf := make([]byte, blockHeaderSize+b.CompressedSize)
+	if _, err := file.ReadAt(buf, int64(b.FilePosition)); err != nil {
+		return nil, err
+	}
+
+	checksum := binary.BigEndian.Uint32(buf[8:12])
+	compressed := buf[blockHeaderSize:]
+	if crc32.Checksum(compressed, crcTable) != checksum {
+		return nil, ErrCorrupt
+	}
+	return decompress(compression, compressed, b.Size)
+}
+
+// findBlock returns the index of the block containing the given position in
+// the uncompressed records, or false if the position is beyond the last block.
+func findBlock(blocks []block, position uint64) (int, bool) {
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].Position+blocks[i].Size > position
+	})
+	return i, i < len(blocks)
+}
+
+func compress(compression Compression, b []byte) []byte {
+	switch compression {
+	case CompressionSnappy:
+		return s2.EncodeSnappy(nil, b)
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(b, make([]byte, 0, len(b)))
+	default:
+		return b
+	}
+}
+
+// decompress decompresses b, which must have the given uncompressed size.
+func decompress(compression Compression, b []byte, size uint64) ([]byte, error) {
+	var decompressed []byte
+	var err error
+	switch compression {
+	case CompressionSnappy:
+		decompressed, err = s2.Decode(make([]byte, size), b)
+	case CompressionZstd:
+		decompressed, err = zstdDecoder.DecodeAll(b, make([]byte, 0, size))
+	default:
+		return nil, errors.New("unsupported compression")
+	}
+	if err != nil || uint64(len(decompressed)) != size {
+		return nil, ErrCorrupt
+	}
+	return decompressed, nil
+}
+
+type cachedBlock struct {
+	index int
+	buf   []byte
+}
+
+// blockCache is a small least recently used cache of decompressed blocks.
+type blockCache struct {
+	// Protects the below fields.
+	mu sync.Mutex
+	// entries contains the cached blocks, ordered from most to least recently
+	// used.
+	entries []cachedBlock
+}
+
+func newBlockCache() *blockCache {
+	return &blockCache{
+		mu:      sync.Mutex{},
+		entries: make([]cachedBlock, 0, blockCacheSize),
+	}
+}
+
+// Get returns the decompressed block with the given index, or false if not
+// cached.
+func (c *blockCache) Get(index int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, entry := range c.entries {
+		if entry.index == index {
+			// Move to the front as most recently used.
+			copy(c.entries[1:i+1], c.entries[:i])
+			c.entries[0] = entry
+			return entry.buf, true
+		}
+	}
+	return nil, false
+}
+
+// Add adds the decompressed block with the given index, evicting the least
+// recently used block if the cache is full.
+func (c *blockCache) Add(index int, buf []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range c.entries {
+		if entry.index == index {
+			return
+		}
+	}
+
+	if len(c.entries) < blockCacheSize {
+		c.entries = append(c.entries, cachedBlock{})
+	}
+	copy(c.entries[1:], c.entries[:len(c.entries)-1])
+	c.entries[0] = cachedBlock{
+		index: index,
+		buf:   buf,
+	}
+}
@@ -1,67 +1,332 @@
 package commitlog
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
 )
 
 type FileSegment struct {
 	offset uint64
 	file   *os.File
+	index  *index
+
+	// compacted indicates the segment has been compacted. Compacted segments
+	// have a different file format, where each record is prefixed with its
+	// offset, and can't be appended to.
+	compacted bool
+	// headerSize is the size of the header at the start of the file.
+	headerSize uint64
+	// format is the encoding of the records in the segment. Legacy segments
+	// can only be read.
+	format recordFormat
+	// dataSize is the number of bytes of records in the segment, excluding
+	// the header. This is only used if the segment is compacted.
+	dataSize uint64
+
+	// compression is the codec used to compress the segment. If the segment
+	// is compressed, the records are split into compressed blocks, so reads
+	// decompress the blocks containing the requested records.
+	compression Compression
+	// blocks contains the compressed blocks in the segment. Empty if the
+	// segment isn't compressed.
+	blocks []block
+	// cache contains recently decompressed blocks. nil if the segment isn't
+	// compressed.
+	cache *blockCache
+
+	// size is the size of the segment. This is atomic so lookups don't have
+	// to lock the segment.
+	size atomic.Uint64
 
-	// Protects the below fields.
-	mu   sync.RWMutex
-	size uint64
+	// Protects the below fields. Note this also serializes appends.
+	mu sync.RWMutex
+	// modTime is the time the segment was last written to.
+	modTime time.Time
 }
 
-func NewFileSegment(file *os.File, offset uint64, size uint64) (Segment, error) {
-	return &FileSegment{
-		offset: offset,
-		file:   file,
-		size:   size,
-	}, nil
+// newFileSegment creates a segment from the given file and index. The file must
+// start with the given header, followed by dataSize bytes of records. If the
+// segment is compressed, blocks are the compressed blocks in the file.
+func newFileSegment(file *os.File, offset uint64, header segmentHeader, dataSize uint64, blocks []block, modTime time.Time, idx *index) *FileSegment {
+	size := dataSize
+	if header.Compacted {
+		size = header.CompactedSize
+	}
+
+	var cache *blockCache
+	if header.Compression != CompressionNone {
+		cache = newBlockCache()
+	}
+
+	s := &FileSegment{
+		offset:      offset,
+		file:        file,
+		index:       idx,
+		compacted:   header.Compacted,
+		headerSize:  header.Size(),
+		format:      header.Format(),
+		dataSize:    dataSize,
+		compression: header.Compression,
+		blocks:      blocks,
+		cache:       cache,
+		modTime:     modTime,
+	}
+	s.size.Store(size)
+	return s
+}
+
+// LoadFileSegment opens the segment with the given offset persisted in the
+// given directory.
+//
+// This verifies each record in the segment. If the segment ends with a partial
+// record, such as following a torn write, the segment is truncated after the
+// last complete record. Records whose checksum doesn't match are reported but
+// retained, as Lookup will refuse to return them. If a compressed block is
+// corrupt, the segment is truncated before the block as the following records
+// can't be read.
+//
+// Legacy segments, written before segments had a header, are loaded read-only
+// with their original record offsets.
+//
+// The segments index is loaded from '<offset>.index'. If the index is missing
+// or incomplete, such as if the segment was recovered from a write-ahead log,
+// the missing entries are rebuilt from the segment using the segments
+// modification time as the timestamp of the rebuilt entries.
+func LoadFileSegment(dir string, offset uint64, logger *zap.Logger) (Segment, error) {
+	path := fmt.Sprintf("%s/%d.data", dir, offset)
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header, err := readSegmentHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("segment %s: %w", path, err)
+	}
+
+	fileSize := uint64(info.Size())
+	// The size of the file up to the last complete record or block.
+	validFileSize := fileSize
+	dataSize := fileSize - header.Size()
+	blocks := []block{}
+	if header.Compression != CompressionNone {
+		blocks, validFileSize, err = loadBlocks(file, header.Size(), fileSize)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		dataSize = 0
+		for _, b := range blocks {
+			dataSize += b.Size
+		}
+	}
+
+	idx := loadIndex(indexPath(dir, offset), dataSize)
+	// Create the segment before scanning so the records are read from the
+	// decompressed blocks.
+	segment := newFileSegment(file, offset, header, dataSize, blocks, info.ModTime(), idx)
+	scanned, corrupt, err := scanSegmentFile(segment.reader(dataSize), dataSize, header.Compacted, header.Format(), idx, info.ModTime())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("segment %s: %w", path, err)
+	}
+	if corrupt > 0 {
+		corruptRecords.Add(int64(corrupt))
+		logger.Error(
+			"segment contains corrupt records",
+			zap.String("path", path),
+			zap.Int("records", corrupt),
+		)
+	}
+	if header.Compression == CompressionNone {
+		validFileSize = header.Size() + scanned
+	}
+	if scanned < dataSize || validFileSize < fileSize {
+		truncatedSegments.Add(1)
+		logger.Warn(
+			"truncating partial record from segment",
+			zap.String("path", path),
+			zap.Uint64("size", fileSize),
+			zap.Uint64("truncated-size", validFileSize),
+		)
+		if err := file.Truncate(int64(validFileSize)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return newFileSegment(file, offset, header, scanned, blocks, info.ModTime(), idx), nil
 }
 
-func (s *FileSegment) Append(b []byte) error {
-	if err := binary.Write(s.file, binary.BigEndian, uint32(len(b))); err != nil {
+func (s *FileSegment) Append(key []byte, value []byte) error {
+	if s.compacted {
+		return errors.New("cannot append to compacted segment")
+	}
+	if s.format == recordFormatLegacy {
+		return errors.New("cannot append to legacy segment")
+	}
+	if s.compression != CompressionNone {
+		return errors.New("cannot append to compressed segment")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	size := s.size.Load()
+	prefix := encodeRecordPrefix(key, value)
+	if _, err := s.file.WriteAt(prefix, int64(SegmentHeaderSize+size)); err != nil {
 		return err
 	}
-	if _, err := s.file.Write(b); err != nil {
+	if _, err := s.file.WriteAt(value, int64(SegmentHeaderSize+size+uint64(len(prefix)))); err != nil {
 		return err
 	}
 
+	s.index.MaybeAdd(size, size, now)
+	// Only update the size once the record is written so concurrent lookups
+	// never read a partial record.
+	s.size.Store(size + uint64(len(prefix)) + uint64(len(value)))
+	s.modTime = now
+	return nil
+}
+
+func (s *FileSegment) AppendBatch(records []Record) error {
+	if s.compacted {
+		return errors.New("cannot append to compacted segment")
+	}
+	if s.format == recordFormatLegacy {
+		return errors.New("cannot append to legacy segment")
+	}
+	if s.compression != CompressionNone {
+		return errors.New("cannot append to compressed segment")
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.size += PrefixSize
-	s.size += uint64(len(b))
+
+	now := time.Now()
+	size := s.size.Load()
+	b, positions := encodeRecords(records)
+	if _, err := s.file.WriteAt(b, int64(SegmentHeaderSize+size)); err != nil {
+		return err
+	}
+
+	for _, position := range positions {
+		s.index.MaybeAdd(size+position, size+position, now)
+	}
+	// Only update the size once the batch is written so concurrent lookups
+	// never read a partial batch.
+	s.size.Store(size + uint64(len(b)))
+	s.modTime = now
 	return nil
 }
 
-func (s *FileSegment) Lookup(offset uint64) ([]byte, error) {
-	if _, err := s.file.Seek(int64(offset), 0); err != nil {
-		if err == io.EOF {
-			return nil, ErrNotFound
-		}
-		return nil, err
+// Lookup returns the record at the given offset.
+//
+// Records are read with positional reads (pread) rather than seeking the
+// shared file, so concurrent lookups are safe without locking the segment.
+func (s *FileSegment) Lookup(offset uint64) (Record, error) {
+	if s.compacted {
+		return s.lookupCompacted(offset)
 	}
 
-	var size uint32
-	if err := binary.Read(s.file, binary.BigEndian, &size); err != nil {
-		if err == io.EOF {
-			return nil, ErrNotFound
-		}
-		return nil, err
+	size := s.Size()
+	prefixSize := s.format.PrefixSize()
+	if offset+prefixSize > size {
+		return Record{}, ErrNotFound
 	}
 
-	buf := make([]byte, size)
-	_, err := io.ReadFull(s.file, buf)
+	prefix := make([]byte, prefixSize)
+	if err := s.readAt(prefix, offset); err != nil {
+		return Record{}, err
+	}
+
+	// Check the payload size is within the segment before allocating the
+	// payload buffer, since if the prefix is corrupt the size could be huge.
+	payloadSize := s.format.DecodePrefix(prefix)
+	if offset+prefixSize+payloadSize > size {
+		return Record{}, ErrCorrupt
+	}
+
+	payload := make([]byte, payloadSize)
+	if err := s.readAt(payload, offset+prefixSize); err != nil {
+		return Record{}, err
+	}
+	key, value, err := s.format.DecodeRecord(prefix, payload)
 	if err != nil {
-		return nil, err
+		return Record{}, err
 	}
 
-	return buf, nil
+	return Record{
+		Key:        key,
+		Value:      value,
+		Offset:     offset,
+		NextOffset: offset + prefixSize + payloadSize,
+	}, nil
+}
+
+func (s *FileSegment) LookupTime(timestamp time.Time) (uint64, bool) {
+	return s.index.LookupTime(timestamp)
+}
+
+func (s *FileSegment) LookupLastN(n uint64) (uint64, uint64, error) {
+	if s.compacted {
+		return s.lookupLastNCompacted(n)
+	}
+
+	size := s.Size()
+	prefix := make([]byte, s.format.PrefixSize())
+	return lookupLastN(s.index, size, n, func(offset uint64) (uint64, error) {
+		if err := s.readAt(prefix, offset); err != nil {
+			return 0, err
+		}
+		return s.format.PrefixSize() + s.format.DecodePrefix(prefix), nil
+	})
+}
+
+// ValidateOffset scans the records from the nearest indexed record before the
+// offset to check the offset is the start of a record.
+//
+// Since compacted segments don't know the offsets of removed records, any
+// offset within a compacted segment is valid. This is safe as lookups in
+// compacted segments only return records at their stored offsets.
+func (s *FileSegment) ValidateOffset(offset uint64) error {
+	size := s.Size()
+	if offset > size {
+		return ErrInvalidOffset
+	}
+	if s.compacted {
+		return nil
+	}
+
+	prefix := make([]byte, s.format.PrefixSize())
+	pos := s.index.Floor(offset).Offset
+	for pos < offset {
+		if err := s.readAt(prefix, pos); err != nil {
+			return err
+		}
+		pos += s.format.PrefixSize() + s.format.DecodePrefix(prefix)
+	}
+	if pos != offset {
+		return ErrInvalidOffset
+	}
+	return nil
 }
 
 func (s *FileSegment) Offset() uint64 {
@@ -69,13 +334,422 @@ func (s *FileSegment) Offset() uint64 {
 }
 
 func (s *FileSegment) Size() uint64 {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.size.Load()
+}
+
+// Sync syncs the segment file to disk.
+func (s *FileSegment) Sync() error {
+	err := s.file.Sync()
+	// If the file is closed the segment has been removed by retention.
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// ModTime returns the time the segment was last written to, which is used to
+// determine when the segment expires.
+func (s *FileSegment) ModTime() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.modTime
+}
 
-	return s.size
+// Compacted returns whether the segment has been compacted.
+func (s *FileSegment) Compacted() bool {
+	return s.compacted
 }
 
-func (s *FileSegment) Persist(dir string) (Segment, error) {
+// Remove closes and deletes the segment file and its index. Any lookups after
+// the segment is removed will return ErrNotFound.
+func (s *FileSegment) Remove() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.file.Name()); err != nil {
+		return err
+	}
+	return removeIndexFile(strings.TrimSuffix(s.file.Name(), ".data") + ".index")
+}
+
+func (s *FileSegment) Persist(dir string, compression Compression) (Segment, error) {
 	// Already persisted so just return self.
 	return s, nil
 }
+
+// Compact rewrites the segment keeping only the records where keep returns
+// true, and returns the compacted segment and the number of records removed.
+// The offsets of the retained records are unchanged. If no records are removed
+// the segment isn't rewritten and returns nil.
+//
+// The compacted segment is written to a temporary file then renamed to replace
+// the segment file, so the existing segment can still be read until it is
+// closed.
+func (s *FileSegment) Compact(dir string, keep func(r Record) bool) (*FileSegment, int, error) {
+	// Legacy records have no keys so compaction never removes them.
+	if s.format == recordFormatLegacy {
+		return nil, 0, nil
+	}
+
+	path := fmt.Sprintf("%s/%d.data", dir, s.offset)
+	tmpPath := fmt.Sprintf("%s/%d.compacting", dir, s.offset)
+
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Keep the same compression as the existing segment.
+	size := s.Size()
+	header := segmentHeader{
+		Compacted:     true,
+		CompactedSize: size,
+		Compression:   s.compression,
+	}
+	bw := bufio.NewWriter(file)
+	if _, err := bw.Write(header.Encode()); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	w := newSegmentWriter(bw, s.compression, header.Size())
+
+	idx := newIndex()
+	dataSize := uint64(0)
+	removed := 0
+	offset := uint64(0)
+	for offset < size {
+		r, err := s.Lookup(offset)
+		if err == ErrNotFound {
+			break
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return nil, 0, err
+		}
+		offset = r.NextOffset
+
+		if !keep(r) {
+			removed++
+			continue
+		}
+
+		// Keep the timestamp of the nearest indexed record in the
+		// original segment.
+		idx.MaybeAdd(r.Offset, dataSize, time.UnixMilli(s.index.Floor(r.Offset).Timestamp))
+
+		b := make([]byte, compactedOffsetSize)
+		binary.BigEndian.PutUint64(b, r.Offset)
+		b = append(b, encodeRecordPrefix(r.Key, r.Value)...)
+		b = append(b, r.Value...)
+		if _, err := w.Write(b); err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return nil, 0, err
+		}
+		dataSize += uint64(len(b))
+	}
+
+	if removed == 0 {
+		file.Close()
+		return nil, 0, os.Remove(tmpPath)
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, 0, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, 0, err
+	}
+
+	// Remove the existing index before replacing the segment, since its
+	// positions don't match the compacted segment. If we crash before
+	// writing the new index, its rebuilt on recovery.
+	if err := removeIndexFile(indexPath(dir, s.offset)); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, 0, err
+	}
+	// Keep the modification time of the existing segment so compaction
+	// doesn't affect retention.
+	modTime := s.ModTime()
+	if err := os.Chtimes(tmpPath, modTime, modTime); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, 0, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, 0, err
+	}
+	if err := idx.Write(indexPath(dir, s.offset)); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	blocks := []block{}
+	if w, ok := w.(*blockWriter); ok {
+		blocks = w.Blocks()
+	}
+	return newFileSegment(file, s.offset, header, dataSize, blocks, modTime, idx), removed, nil
+}
+
+// Close closes the segment file without removing it, such as once the segment
+// has been replaced by a compacted segment. Any lookups after the segment is
+// closed will return ErrNotFound.
+func (s *FileSegment) Close() error {
+	return s.file.Close()
+}
+
+// lookupCompacted returns the first retained record at or after the given
+// offset in a compacted segment.
+func (s *FileSegment) lookupCompacted(offset uint64) (Record, error) {
+	if offset >= s.Size() {
+		return Record{}, ErrNotFound
+	}
+
+	pos := s.index.Floor(offset).Position
+	for pos < s.dataSize {
+		r, next, err := s.readCompactedRecord(pos)
+		if err != nil {
+			return Record{}, err
+		}
+		if r.Offset >= offset {
+			return r, nil
+		}
+		pos = next
+	}
+	// All records from the offset to the end of the segment have been
+	// removed.
+	return Record{}, ErrNotFound
+}
+
+// lookupLastNCompacted scans the retained records in a compacted segment to
+// find the nth last record.
+func (s *FileSegment) lookupLastNCompacted(n uint64) (uint64, uint64, error) {
+	if n == 0 {
+		return s.Size(), 0, nil
+	}
+
+	offsets := make([]uint64, 0, n)
+	for pos := uint64(0); pos < s.dataSize; {
+		r, next, err := s.readCompactedRecord(pos)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uint64(len(offsets)) == n {
+			offsets = offsets[1:]
+		}
+		offsets = append(offsets, r.Offset)
+		pos = next
+	}
+	if len(offsets) == 0 {
+		return 0, 0, nil
+	}
+	return offsets[0], uint64(len(offsets)), nil
+}
+
+// readCompactedRecord reads the record at the given position in a compacted
+// segment, and returns the record and the position of the next record.
+func (s *FileSegment) readCompactedRecord(pos uint64) (Record, uint64, error) {
+	header := make([]byte, compactedOffsetSize+PrefixSize)
+	if err := s.readAt(header, pos); err != nil {
+		return Record{}, 0, err
+	}
+	offset := binary.BigEndian.Uint64(header[0:compactedOffsetSize])
+	prefix := header[compactedOffsetSize:]
+
+	payloadSize, _ := decodeRecordPrefix(prefix)
+	next := pos + compactedOffsetSize + PrefixSize + payloadSize
+	if next > s.dataSize {
+		return Record{}, 0, ErrCorrupt
+	}
+
+	payload := make([]byte, payloadSize)
+	if err := s.readAt(payload, pos+compactedOffsetSize+PrefixSize); err != nil {
+		return Record{}, 0, err
+	}
+	key, value, err := decodeRecord(prefix, payload)
+	if err != nil {
+		return Record{}, 0, err
+	}
+
+	return Record{
+		Key:        key,
+		Value:      value,
+		Offset:     offset,
+		NextOffset: offset + PrefixSize + payloadSize,
+	}, next, nil
+}
+
+// readAt reads len(b) bytes from the given position in the records, excluding
+// the header. If the segment is compressed, this reads from the decompressed
+// blocks.
+//
+// Returns ErrNotFound if the segment file has been closed, such as if the
+// segment has been removed by retention.
+func (s *FileSegment) readAt(b []byte, pos uint64) error {
+	if s.compression == CompressionNone {
+		if _, err := s.file.ReadAt(b, int64(s.headerSize+pos)); err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return ErrNotFound
+			}
+			return err
+		}
+		return nil
+	}
+
+	for len(b) > 0 {
+		i, ok := findBlock(s.blocks, pos)
+		if !ok {
+			return ErrCorrupt
+		}
+		buf, err := s.readBlock(i)
+		if err != nil {
+			return err
+		}
+		n := copy(b, buf[pos-s.blocks[i].Position:])
+		b = b[n:]
+		pos += uint64(n)
+	}
+	return nil
+}
+
+// readBlock returns the decompressed block with the given index, using the
+// block cache if possible.
+func (s *FileSegment) readBlock(i int) ([]byte, error) {
+	if buf, ok := s.cache.Get(i); ok {
+		return buf, nil
+	}
+
+	buf, err := readBlock(s.file, s.blocks[i], s.compression)
+	if err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	s.cache.Add(i, buf)
+	return buf, nil
+}
+
+// reader returns a reader of the first size bytes of records in the segment.
+func (s *FileSegment) reader(size uint64) io.Reader {
+	return bufio.NewReaderSize(&segmentReader{
+		segment: s,
+		pos:     0,
+		size:    size,
+	}, compressionBlockSize)
+}
+
+// segmentReader reads the records in a segment sequentially.
+type segmentReader struct {
+	segment *FileSegment
+	pos     uint64
+	size    uint64
+}
+
+func (r *segmentReader) Read(b []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - r.pos; uint64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	if err := r.segment.readAt(b, r.pos); err != nil {
+		return 0, err
+	}
+	r.pos += uint64(len(b))
+	return len(b), nil
+}
+
+// readSegmentHeader reads and verifies the segment file header.
+func readSegmentHeader(file *os.File) (segmentHeader, error) {
+	b := make([]byte, SegmentHeaderSize+compactedHeaderSize+compressedHeaderSize)
+	n, err := file.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return segmentHeader{}, err
+	}
+	return decodeSegmentHeader(b[:n])
+}
+
+// scanSegmentFile reads each record from the given reader of the segments
+// records, returning the number of bytes of records up to the last complete
+// record, and the number of records with an invalid checksum. If a compressed
+// block is corrupt, the scan stops at the start of the block.
+//
+// Any records after the last entry in the given index are added to the index
+// with the given timestamp.
+func scanSegmentFile(r io.Reader, dataSize uint64, compacted bool, format recordFormat, idx *index, timestamp time.Time) (uint64, int, error) {
+	// Only records after the last indexed record need indexing. Note the
+	// index may have entries with a later timestamp than the modification
+	// time, so use the last entries timestamp if its later.
+	indexFrom := uint64(0)
+	if last, ok := idx.Last(); ok {
+		indexFrom = last.Position + 1
+		if ts := time.UnixMilli(last.Timestamp); ts.After(timestamp) {
+			timestamp = ts
+		}
+	}
+
+	// In compacted segments each record is prefixed with its offset.
+	recordHeaderSize := format.PrefixSize()
+	if compacted {
+		recordHeaderSize += compactedOffsetSize
+	}
+
+	pos := uint64(0)
+	corrupt := 0
+	header := make([]byte, recordHeaderSize)
+	for {
+		if pos+recordHeaderSize > dataSize {
+			return pos, corrupt, nil
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == ErrCorrupt {
+				return pos, corrupt + 1, nil
+			}
+			return 0, 0, err
+		}
+
+		offset := pos
+		prefix := header
+		if compacted {
+			offset = binary.BigEndian.Uint64(header[0:compactedOffsetSize])
+			prefix = header[compactedOffsetSize:]
+		}
+
+		payloadSize := format.DecodePrefix(prefix)
+		if pos+recordHeaderSize+payloadSize > dataSize {
+			return pos, corrupt, nil
+		}
+
+		payload := make([]byte, payloadSize)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == ErrCorrupt {
+				return pos, corrupt + 1, nil
+			}
+			return 0, 0, err
+		}
+		if _, _, err := format.DecodeRecord(prefix, payload); err != nil {
+			corrupt++
+		}
+		if pos >= indexFrom {
+			idx.MaybeAdd(offset, pos, timestamp)
+		}
+
+		pos += recordHeaderSize + payloadSize
+	}
+}
+
+// indexPath returns the path of the index file for the segment with the given
+// offset.
+func indexPath(dir string, offset uint64) string {
+	return fmt.Sprintf("%s/%d.index", dir, offset)
+}
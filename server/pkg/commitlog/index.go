@@ -0,0 +1,248 @@
+package commitlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// indexEntrySize is the size of each entry in the index file, containing
+	// the record offset, position and timestamp.
+	indexEntrySize = 24
+
+	// indexIntervalBytes is the maximum number of bytes between index entries.
+	indexIntervalBytes = 4096
+	// indexIntervalTime is the maximum time between index entries.
+	indexIntervalTime = time.Second
+
+	// indexMagic identifies figg index files ('FIDX').
+	indexMagic = uint32(0x46494458)
+	// indexVersion is the version of the index format.
+	//
+	// Version 2 added the record position.
+	indexVersion = uint32(2)
+)
+
+// indexEntry maps a record in the segment to its position in the segment and
+// the time it was appended.
+type indexEntry struct {
+	// Offset is the offset of the record relative to the start of the segment.
+	Offset uint64
+	// Position is the position of the record in the segment, excluding the
+	// segment header. This is the same as the offset unless the segment is
+	// compacted.
+	Position uint64
+	// Timestamp is the time the record was appended in unix milliseconds.
+	Timestamp int64
+}
+
+// index is a sparse index of the records in a segment. A record is indexed if
+// its the first record in the segment, or at least indexIntervalBytes or
+// indexIntervalTime have passed since the last indexed record.
+//
+// This means lookups only have to scan a bounded number of records from the
+// nearest entry to find a record boundary, and lookups by time are accurate to
+// within indexIntervalTime.
+type index struct {
+	// Protects the below fields.
+	mu      sync.RWMutex
+	entries []indexEntry
+}
+
+func newIndex() *index {
+	return &index{
+		mu:      sync.RWMutex{},
+		entries: []indexEntry{},
+	}
+}
+
+// loadIndex reads the index file at the given path. Entries whose position is
+// at or beyond size, such as if the segment was truncated on recovery, are
+// discarded. If the index file doesn't exist or is invalid returns an empty
+// index.
+func loadIndex(path string, size uint64) *index {
+	idx := newIndex()
+
+	b, err := os.ReadFile(path)
+	if err != nil || len(b) < SegmentHeaderSize {
+		return idx
+	}
+	if binary.BigEndian.Uint32(b[0:4]) != indexMagic || binary.BigEndian.Uint32(b[4:8]) != indexVersion {
+		return idx
+	}
+
+	// Ignore any partial entry at the end of the file.
+	for i := SegmentHeaderSize; i+indexEntrySize <= len(b); i += indexEntrySize {
+		entry := indexEntry{
+			Offset:    binary.BigEndian.Uint64(b[i : i+8]),
+			Position:  binary.BigEndian.Uint64(b[i+8 : i+16]),
+			Timestamp: int64(binary.BigEndian.Uint64(b[i+16 : i+24])),
+		}
+		if entry.Position >= size {
+			break
+		}
+		// Entries must be in order so stop at the first invalid entry.
+		if n := len(idx.entries); n > 0 && entry.Offset <= idx.entries[n-1].Offset {
+			break
+		}
+		idx.entries = append(idx.entries, entry)
+	}
+	return idx
+}
+
+// MaybeAdd indexes the record at the given offset and position if the record
+// is due to be indexed. Returns true if the record was indexed.
+func (idx *index) MaybeAdd(offset uint64, position uint64, timestamp time.Time) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	ts := timestamp.UnixMilli()
+	if n := len(idx.entries); n > 0 {
+		last := idx.entries[n-1]
+		if offset <= last.Offset {
+			return false
+		}
+		if position-last.Position < indexIntervalBytes && ts-last.Timestamp < indexIntervalTime.Milliseconds() {
+			return false
+		}
+	}
+
+	idx.entries = append(idx.entries, indexEntry{
+		Offset:    offset,
+		Position:  position,
+		Timestamp: ts,
+	})
+	return true
+}
+
+// Last returns the last entry in the index, or false if the index is empty.
+func (idx *index) Last() (indexEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if len(idx.entries) == 0 {
+		return indexEntry{}, false
+	}
+	return idx.entries[len(idx.entries)-1], true
+}
+
+// Floor returns the last indexed record at or before the given offset. If
+// there is no such record returns an entry for the start of the segment.
+func (idx *index) Floor(offset uint64) indexEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].Offset > offset
+	})
+	if i == 0 {
+		return indexEntry{}
+	}
+	return idx.entries[i-1]
+}
+
+// LookupTime returns the offset of the last indexed record appended before the
+// given time. Since records between index entries aren't indexed, the records
+// following this offset may have been appended at or after the given time.
+//
+// Returns false if no records were appended before the given time.
+func (idx *index) LookupTime(timestamp time.Time) (uint64, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	ts := timestamp.UnixMilli()
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].Timestamp >= ts
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return idx.entries[i-1].Offset, true
+}
+
+// Offsets returns the offsets of the indexed records.
+func (idx *index) Offsets() []uint64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	offsets := make([]uint64, 0, len(idx.entries))
+	for _, entry := range idx.entries {
+		offsets = append(offsets, entry.Offset)
+	}
+	return offsets
+}
+
+// Write writes the index to a file at the given path.
+func (idx *index) Write(path string) error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	b := make([]byte, SegmentHeaderSize, SegmentHeaderSize+len(idx.entries)*indexEntrySize)
+	binary.BigEndian.PutUint32(b[0:4], indexMagic)
+	binary.BigEndian.PutUint32(b[4:8], indexVersion)
+	for _, entry := range idx.entries {
+		b = binary.BigEndian.AppendUint64(b, entry.Offset)
+		b = binary.BigEndian.AppendUint64(b, entry.Position)
+		b = binary.BigEndian.AppendUint64(b, uint64(entry.Timestamp))
+	}
+
+	// Note the index isn't synced as if its lost or incomplete it is rebuilt
+	// from the segment.
+	return os.WriteFile(path, b, 0644)
+}
+
+// removeIndexFile removes the index file at the given path, ignoring the error
+// if it doesn't exist.
+func removeIndexFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// lookupLastN returns the offset of the nth last record in an uncompacted
+// segment with the given size and index, and the number of records found. If the segment has
+// fewer than n records, returns the offset of the first record and the number
+// of records in the segment.
+//
+// Since records can only be read forwards, this scans the records between
+// each indexed record, starting from the last indexed record, until n records
+// are found. readSize returns the size of the record at the given offset,
+// including its prefix.
+func lookupLastN(idx *index, size uint64, n uint64, readSize func(offset uint64) (uint64, error)) (uint64, uint64, error) {
+	if n == 0 || size == 0 {
+		return size, 0, nil
+	}
+
+	indexed := idx.Offsets()
+	// The first record is always indexed, though make sure to include it
+	// in case the index is incomplete.
+	if len(indexed) == 0 || indexed[0] != 0 {
+		indexed = append([]uint64{0}, indexed...)
+	}
+
+	found := uint64(0)
+	end := size
+	for i := len(indexed) - 1; i >= 0; i-- {
+		offsets := []uint64{}
+		for offset := indexed[i]; offset < end; {
+			offsets = append(offsets, offset)
+			recordSize, err := readSize(offset)
+			if err != nil {
+				return 0, 0, err
+			}
+			offset += recordSize
+		}
+
+		if found+uint64(len(offsets)) >= n {
+			return offsets[uint64(len(offsets))-(n-found)], n, nil
+		}
+		found += uint64(len(offsets))
+		end = indexed[i]
+	}
+	return 0, found, nil
+}
@@ -0,0 +1,72 @@
+package commitlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex_MaybeAdd(t *testing.T) {
+	idx := newIndex()
+	start := time.UnixMilli(1000000)
+
+	// The first record is always indexed.
+	assert.True(t, idx.MaybeAdd(0, 0, start))
+	// Records are only indexed once the byte or time interval has passed.
+	assert.False(t, idx.MaybeAdd(100, 100, start))
+	assert.True(t, idx.MaybeAdd(indexIntervalBytes, indexIntervalBytes, start))
+	assert.False(t, idx.MaybeAdd(indexIntervalBytes+100, indexIntervalBytes+100, start.Add(time.Millisecond)))
+	assert.True(t, idx.MaybeAdd(indexIntervalBytes+200, indexIntervalBytes+200, start.Add(indexIntervalTime)))
+
+	assert.Equal(t, uint64(0), idx.Floor(100).Offset)
+	assert.Equal(t, uint64(indexIntervalBytes), idx.Floor(indexIntervalBytes).Offset)
+	assert.Equal(t, uint64(indexIntervalBytes+200), idx.Floor(indexIntervalBytes+500).Offset)
+}
+
+func TestIndex_LookupTime(t *testing.T) {
+	idx := newIndex()
+	start := time.UnixMilli(1000000)
+	idx.MaybeAdd(0, 0, start)
+	idx.MaybeAdd(100, 100, start.Add(time.Second))
+	idx.MaybeAdd(200, 200, start.Add(2*time.Second))
+
+	_, ok := idx.LookupTime(start)
+	assert.False(t, ok)
+
+	offset, ok := idx.LookupTime(start.Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), offset)
+
+	offset, ok = idx.LookupTime(start.Add(1500 * time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(100), offset)
+
+	offset, ok = idx.LookupTime(start.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(200), offset)
+}
+
+func TestIndex_WriteThenLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	idx := newIndex()
+	start := time.UnixMilli(1000000)
+	idx.MaybeAdd(0, 0, start)
+	idx.MaybeAdd(100, 100, start.Add(time.Second))
+	idx.MaybeAdd(200, 200, start.Add(2*time.Second))
+
+	path := dir + "/0.index"
+	assert.Nil(t, idx.Write(path))
+
+	loaded := loadIndex(path, 1000)
+	assert.Equal(t, idx.entries, loaded.entries)
+
+	// Entries beyond the segment size are discarded.
+	loaded = loadIndex(path, 150)
+	assert.Equal(t, idx.entries[:2], loaded.entries)
+
+	// A missing index is empty.
+	loaded = loadIndex(dir+"/1.index", 1000)
+	assert.Equal(t, []indexEntry{}, loaded.entries)
+}
@@ -1,54 +1,239 @@
 package commitlog
 
 import (
-	"encoding/binary"
+	"bufio"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 )
 
 type InMemorySegment struct {
 	offset uint64
+	// segmentSize is the maximum capacity the buffer grows to, though the
+	// last record appended may exceed it.
+	segmentSize uint64
+
+	index *index
+
+	// memory is the budget the buffer capacity is reserved from. May be nil.
+	memory *MemoryBudget
 
 	// Protects the below fields.
 	mu  sync.RWMutex
 	buf []byte
+	// released indicates the buffer has been returned to the memory budget.
+	released bool
+
+	// walMu protects wal. Note this is separate from mu so syncing the
+	// write-ahead log doesn't block appends.
+	walMu sync.Mutex
+	// wal is an optional write-ahead log that each appended record is also
+	// written to, so the segment can be recovered if the server crashes
+	// before the segment is persisted. nil if the segment has no write-ahead
+	// log, or once the segment is persisted.
+	wal *os.File
 }
 
 func NewInMemorySegment(segmentSize uint64, offset uint64) Segment {
+	return newInMemorySegment(segmentSize, offset, nil, nil)
+}
+
+// NewInMemorySegmentWithWAL creates an in-memory segment with a write-ahead log
+// in the given directory named '<offset>.wal'.
+//
+// The write-ahead log uses the same format as a persisted segment file, so
+// it can be recovered as a persisted segment.
+func NewInMemorySegmentWithWAL(segmentSize uint64, offset uint64, dir string) (Segment, error) {
+	wal, err := openWAL(dir, offset)
+	if err != nil {
+		return nil, err
+	}
+	return newInMemorySegment(segmentSize, offset, wal, nil), nil
+}
+
+// newInMemorySegment creates an in-memory segment with an optional write-ahead
+// log, whose buffer is reserved from the given memory budget (which may be
+// nil).
+//
+// Rather than preallocating the full segment size, the buffer grows as
+// records are appended, so segments of quiet topics use little memory.
+func newInMemorySegment(segmentSize uint64, offset uint64, wal *os.File, memory *MemoryBudget) *InMemorySegment {
 	return &InMemorySegment{
-		offset: offset,
-		mu:     sync.RWMutex{},
-		// Preallocate capacity.
-		buf: make([]byte, 0, segmentSize),
+		offset:      offset,
+		segmentSize: segmentSize,
+		index:       newIndex(),
+		memory:      memory,
+		mu:          sync.RWMutex{},
+		buf:         nil,
+		wal:         wal,
 	}
 }
 
-func (s *InMemorySegment) Append(b []byte) error {
+// openWAL creates the write-ahead log for the segment with the given offset
+// and writes the segment header.
+func openWAL(dir string, offset uint64) (*os.File, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf("%s/%d.wal", dir, offset)
+	wal, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := wal.Write(segmentHeader{}.Encode()); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	return wal, nil
+}
+
+func (s *InMemorySegment) Append(key []byte, value []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	prefix := make([]byte, PrefixSize)
-	binary.BigEndian.PutUint32(prefix, uint32(len(b)))
+	prefix := encodeRecordPrefix(key, value)
+	// Write to the write-ahead log first so we never add a record to the
+	// segment that isn't in the log.
+	if s.wal != nil {
+		if _, err := s.wal.Write(append(prefix, value...)); err != nil {
+			return err
+		}
+	}
+
+	s.grow(uint64(len(prefix) + len(value)))
+	s.index.MaybeAdd(uint64(len(s.buf)), uint64(len(s.buf)), time.Now())
 	s.buf = append(s.buf, prefix...)
+	s.buf = append(s.buf, value...)
+	return nil
+}
+
+func (s *InMemorySegment) AppendBatch(records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, positions := encodeRecords(records)
+	// Write the batch with a single write so a partial batch is never
+	// recovered from the write-ahead log.
+	if s.wal != nil {
+		if _, err := s.wal.Write(b); err != nil {
+			return err
+		}
+	}
+
+	s.grow(uint64(len(b)))
+	now := time.Now()
+	for _, position := range positions {
+		position += uint64(len(s.buf))
+		s.index.MaybeAdd(position, position, now)
+	}
 	s.buf = append(s.buf, b...)
 	return nil
 }
 
-func (s *InMemorySegment) Lookup(offset uint64) ([]byte, error) {
+// grow ensures the buffer has capacity for n more bytes, doubling the
+// capacity up to the segment size. The caller must hold mu.
+//
+// Since readers may still reference the existing buffer, the records are
+// copied to a new buffer rather than modifying the existing one.
+func (s *InMemorySegment) grow(n uint64) {
+	size := uint64(len(s.buf)) + n
+	if size <= uint64(cap(s.buf)) {
+		return
+	}
+
+	capacity := uint64(cap(s.buf)) * 2
+	if capacity < minSegmentCapacity {
+		capacity = minSegmentCapacity
+	}
+	if capacity > s.segmentSize {
+		capacity = s.segmentSize
+	}
+	if capacity < size {
+		capacity = size
+	}
+
+	buf := make([]byte, len(s.buf), capacity)
+	copy(buf, s.buf)
+	s.memory.reserve(capacity - uint64(cap(s.buf)))
+	s.buf = buf
+}
+
+// release returns the buffer to the memory budget once the segment has been
+// removed from the log. Readers may still reference the buffer until they
+// complete.
+func (s *InMemorySegment) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	s.memory.release(uint64(cap(s.buf)))
+}
+
+func (s *InMemorySegment) Lookup(offset uint64) (Record, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	if offset+PrefixSize > uint64(len(s.buf)) {
-		return nil, ErrNotFound
+		return Record{}, ErrNotFound
 	}
 
-	payloadSize := uint64(binary.BigEndian.Uint32(s.buf[offset : offset+PrefixSize]))
+	prefix := s.buf[offset : offset+PrefixSize]
+	payloadSize, _ := decodeRecordPrefix(prefix)
 	if offset+PrefixSize+payloadSize > uint64(len(s.buf)) {
-		return nil, ErrNotFound
+		return Record{}, ErrNotFound
+	}
+
+	payload := s.buf[offset+PrefixSize : offset+PrefixSize+payloadSize]
+	key, value, err := decodeRecord(prefix, payload)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{
+		Key:        key,
+		Value:      value,
+		Offset:     offset,
+		NextOffset: offset + PrefixSize + payloadSize,
+	}, nil
+}
+
+func (s *InMemorySegment) LookupTime(timestamp time.Time) (uint64, bool) {
+	return s.index.LookupTime(timestamp)
+}
+
+func (s *InMemorySegment) LookupLastN(n uint64) (uint64, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return lookupLastN(s.index, uint64(len(s.buf)), n, func(offset uint64) (uint64, error) {
+		payloadSize, _ := decodeRecordPrefix(s.buf[offset : offset+PrefixSize])
+		return PrefixSize + payloadSize, nil
+	})
+}
+
+// ValidateOffset scans the records from the nearest indexed record before the
+// offset to check the offset is the start of a record.
+func (s *InMemorySegment) ValidateOffset(offset uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if offset > uint64(len(s.buf)) {
+		return ErrInvalidOffset
 	}
 
-	return s.buf[offset+PrefixSize : offset+PrefixSize+payloadSize], nil
+	pos := s.index.Floor(offset).Offset
+	for pos < offset {
+		payloadSize, _ := decodeRecordPrefix(s.buf[pos : pos+PrefixSize])
+		pos += PrefixSize + payloadSize
+	}
+	if pos != offset {
+		return ErrInvalidOffset
+	}
+	return nil
 }
 
 func (s *InMemorySegment) Offset() uint64 {
@@ -62,29 +247,156 @@ func (s *InMemorySegment) Size() uint64 {
 	return uint64(len(s.buf))
 }
 
-func (s *InMemorySegment) Persist(dir string) (Segment, error) {
+// Sync syncs the write-ahead log to disk. If the segment has no write-ahead
+// log this does nothing.
+func (s *InMemorySegment) Sync() error {
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+
+	// Note if the segment has been persisted the write-ahead log is removed,
+	// though the persisted segment is synced so theres nothing to do.
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Sync()
+}
+
+func (s *InMemorySegment) Persist(dir string, compression Compression) (Segment, error) {
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return nil, err
 	}
 
+	// As this point the segment should be immutable so read locking should
+	// have no contention.
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	path := fmt.Sprintf("%s/%d.data", dir, s.Offset())
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
+
+	s.walMu.Lock()
+	wal := s.wal
+	s.walMu.Unlock()
+
+	header := segmentHeader{
+		Compression: compression,
+	}
+	blocks := []block{}
+	// If the segment has a write-ahead log and isn't compressed, the
+	// write-ahead log has the same format as the persisted segment so can
+	// just be synced and renamed.
+	if wal != nil && compression == CompressionNone {
+		if err := s.persistWAL(path); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		blocks, err = s.persistBuf(path, header)
+		if err != nil {
+			return nil, err
+		}
+		// Only remove the write-ahead log once the persisted segment has
+		// been synced.
+		if wal != nil {
+			if err := s.removeWAL(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := s.index.Write(indexPath(dir, s.offset)); err != nil {
 		return nil, err
 	}
-	if _, err := file.Write(s.buf); err != nil {
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
 		return nil, err
 	}
+	return newFileSegment(file, s.offset, header, uint64(len(s.buf)), blocks, time.Now(), s.index), nil
+}
 
-	// As this point the segment should be immutable so read locking should
-	// have no contention.
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *InMemorySegment) persistWAL(path string) error {
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
 
-	// Just write the whole segment buffer to disk as for format is the same.
-	fileSegment, err := NewFileSegment(file, s.offset, uint64(len(s.buf)))
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.wal.Name(), path); err != nil {
+		return err
+	}
+	s.wal = nil
+	return nil
+}
+
+func (s *InMemorySegment) removeWAL() error {
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.wal.Name()); err != nil {
+		return err
+	}
+	s.wal = nil
+	return nil
+}
+
+// Close closes the write-ahead log, if the segment has one.
+func (s *InMemorySegment) Close() error {
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+
+	if s.wal == nil {
+		return nil
+	}
+	err := s.wal.Close()
+	s.wal = nil
+	return err
+}
+
+// discard closes and removes the write-ahead log, if the segment has one.
+func (s *InMemorySegment) discard() error {
+	s.walMu.Lock()
+	wal := s.wal
+	s.walMu.Unlock()
+
+	if wal == nil {
+		return nil
+	}
+	return s.removeWAL()
+}
+
+// persistBuf writes the segment buffer to a segment file with the given
+// header, and returns the compressed blocks written (if compressed).
+func (s *InMemorySegment) persistBuf(path string, header segmentHeader) ([]block, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return nil, err
 	}
-	return fileSegment, nil
+	defer file.Close()
+
+	// Write the whole segment buffer to disk after the segment header as
+	// the record format is the same. If compressed the buffer is split into
+	// compressed blocks.
+	bw := bufio.NewWriter(file)
+	if _, err := bw.Write(header.Encode()); err != nil {
+		return nil, err
+	}
+	w := newSegmentWriter(bw, header.Compression, header.Size())
+	if _, err := w.Write(s.buf); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	blocks := []block{}
+	if w, ok := w.(*blockWriter); ok {
+		blocks = w.Blocks()
+	}
+	return blocks, file.Sync()
 }
@@ -0,0 +1,77 @@
+package commitlog
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// minSegmentSize is the minimum size of an in-memory segment before its
+	// rolled early due to the memory budget being exceeded, to avoid creating
+	// many tiny segments.
+	minSegmentSize = 1 << 16
+
+	// minSegmentCapacity is the initial capacity of an in-memory segment
+	// buffer.
+	minSegmentCapacity = 1 << 12
+)
+
+// MemoryBudget tracks the memory used by in-memory segments across all commit
+// logs sharing the budget.
+//
+// The budget is a soft limit. When exceeded, commit logs roll their in-memory
+// segments early (so they're persisted sooner and new segments start small),
+// and commit logs that aren't persisted drop their oldest segments.
+type MemoryBudget struct {
+	limit uint64
+	// used is accessed atomically.
+	used uint64
+}
+
+// NewMemoryBudget returns a budget with the given limit in bytes. If the limit
+// is 0 the budget is unlimited, though usage is still tracked.
+func NewMemoryBudget(limit uint64) *MemoryBudget {
+	return &MemoryBudget{
+		limit: limit,
+	}
+}
+
+// Limit returns the budget limit in bytes, or 0 if unlimited.
+func (b *MemoryBudget) Limit() uint64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
+
+// Used returns the number of bytes allocated by in-memory segments using the
+// budget.
+func (b *MemoryBudget) Used() uint64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&b.used)
+}
+
+// Exceeded returns whether the memory used exceeds the limit. A nil or
+// unlimited budget is never exceeded.
+func (b *MemoryBudget) Exceeded() bool {
+	if b == nil || b.limit == 0 {
+		return false
+	}
+	return atomic.LoadUint64(&b.used) > b.limit
+}
+
+func (b *MemoryBudget) reserve(n uint64) {
+	inMemoryBytes.Add(int64(n))
+	if b != nil {
+		atomic.AddUint64(&b.used, n)
+	}
+}
+
+func (b *MemoryBudget) release(n uint64) {
+	inMemoryBytes.Add(-int64(n))
+	if b != nil {
+		// Adding the twos complement subtracts n.
+		atomic.AddUint64(&b.used, ^(n - 1))
+	}
+}
@@ -0,0 +1,29 @@
+package commitlog
+
+import (
+	"expvar"
+)
+
+var (
+	// corruptRecords is the number of records found with an invalid checksum
+	// or size.
+	corruptRecords = expvar.NewInt("commitlog.corrupt-records")
+	// truncatedSegments is the number of segments truncated on recovery due
+	// to ending with a partial record.
+	truncatedSegments = expvar.NewInt("commitlog.truncated-segments")
+	// corruptSegments is the number of segments that couldn't be loaded on
+	// recovery so were quarantined.
+	corruptSegments = expvar.NewInt("commitlog.corrupt-segments")
+	// offloadedSegments is the number of segments moved to tiered storage.
+	offloadedSegments = expvar.NewInt("commitlog.offloaded-segments")
+	// remoteFetches is the number of segments fetched from tiered storage
+	// into the local cache.
+	remoteFetches = expvar.NewInt("commitlog.remote-fetches")
+	// persistFailures is the number of failed attempts to persist a segment.
+	persistFailures = expvar.NewInt("commitlog.persist-failures")
+	// inMemoryBytes is the number of bytes allocated by in-memory segments.
+	inMemoryBytes = expvar.NewInt("commitlog.in-memory-bytes")
+	// droppedSegments is the number of in-memory segments dropped by commit
+	// logs that aren't persisted due to exceeding the memory budget.
+	droppedSegments = expvar.NewInt("commitlog.dropped-segments")
+)
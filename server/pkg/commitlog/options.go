@@ -0,0 +1,123 @@
+package commitlog
+
+import (
+	"fmt"
+	"time"
+)
+
+// Durability defines when appended entries are synced to disk.
+type Durability int
+
+const (
+	// DurabilityNone never syncs entries to disk. Entries are only written
+	// to disk once their segment is full, so may be lost if the server
+	// crashes.
+	DurabilityNone = Durability(iota)
+	// DurabilityInterval writes entries to a write-ahead log and syncs the
+	// log to disk at a fixed interval.
+	DurabilityInterval
+	// DurabilityAlways writes entries to a write-ahead log and syncs the log
+	// to disk as soon as possible after each append.
+	DurabilityAlways
+)
+
+// ParseDurability returns the durability with the given name.
+func ParseDurability(s string) (Durability, error) {
+	switch s {
+	case "none":
+		return DurabilityNone, nil
+	case "interval":
+		return DurabilityInterval, nil
+	case "always":
+		return DurabilityAlways, nil
+	default:
+		return DurabilityNone, fmt.Errorf("unknown durability: %s", s)
+	}
+}
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilityInterval:
+		return "interval"
+	case DurabilityAlways:
+		return "always"
+	default:
+		return "unknown"
+	}
+}
+
+// Compression defines the codec used to compress persisted segments.
+type Compression uint32
+
+const (
+	// CompressionNone persists segments uncompressed.
+	CompressionNone = Compression(iota)
+	// CompressionSnappy compresses persisted segments with snappy, which is
+	// fast but has a lower compression ratio than zstd.
+	CompressionSnappy
+	// CompressionZstd compresses persisted segments with zstd.
+	CompressionZstd
+)
+
+// ParseCompression returns the compression with the given name.
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "none":
+		return CompressionNone, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	case "zstd":
+		return CompressionZstd, nil
+	default:
+		return CompressionNone, fmt.Errorf("unknown compression: %s", s)
+	}
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return "unknown"
+	}
+}
+
+func (c Compression) valid() bool {
+	return c <= CompressionZstd
+}
+
+type Options struct {
+	// Persisted indicates the commit log segments should be persisted to disk.
+	Persisted bool
+
+	// SegmentSize is the size of the commit log segments to use.
+	SegmentSize uint64
+
+	// Durability defines when appended entries are synced to disk. This is
+	// only used if the commit log is persisted.
+	Durability Durability
+
+	// SyncInterval is the interval between syncing the write-ahead log to
+	// disk when using DurabilityInterval.
+	SyncInterval time.Duration
+
+	// Compression is the codec used to compress segments when they are
+	// persisted. Existing segments keep the codec they were persisted with.
+	Compression Compression
+
+	// Storage is the tiered storage backend persisted segments are offloaded
+	// to. If nil segments are never offloaded.
+	Storage Storage
+
+	// Memory is the budget shared by the in-memory segments of all commit
+	// logs. If the budget is exceeded, in-memory segments are rolled early
+	// and logs that aren't persisted drop their oldest segments. If nil the
+	// memory used is unlimited.
+	Memory *MemoryBudget
+}
@@ -0,0 +1,197 @@
+package commitlog
+
+const (
+	// readBatchSize is the number of bytes of records the reader reads from
+	// the commit log at once.
+	readBatchSize = 1 << 20
+)
+
+// Reader reads the records in the commit log sequentially, across segment
+// boundaries.
+//
+// Rather than looking up each record individually, the reader reads batches of
+// records at once, so persisted segments are read with a single large read per
+// batch instead of multiple reads (and allocations) per record.
+//
+// Reader is not safe for concurrent use, though multiple readers can read the
+// same commit log concurrently.
+type Reader struct {
+	log *CommitLog
+	// offset is the offset of the next record to read.
+	offset uint64
+	// records contains records that have been read from the log but not yet
+	// returned.
+	records []Record
+}
+
+func newReader(log *CommitLog, offset uint64) *Reader {
+	return &Reader{
+		log:     log,
+		offset:  offset,
+		records: nil,
+	}
+}
+
+// Offset returns the offset of the next record to read.
+func (r *Reader) Offset() uint64 {
+	return r.offset
+}
+
+// Seek moves the reader to the given offset.
+func (r *Reader) Seek(offset uint64) {
+	r.offset = offset
+	r.records = nil
+}
+
+// Next returns the next record in the log.
+//
+// If there are no more records in the log returns ErrNotFound, though the
+// reader can be retried once new records are appended. If the next record has
+// been removed by retention, also returns ErrNotFound, so the caller must Seek
+// to a retained offset. If the next record is corrupt returns ErrCorrupt.
+func (r *Reader) Next() (Record, error) {
+	if len(r.records) == 0 {
+		if err := r.fill(); err != nil {
+			return Record{}, err
+		}
+	}
+
+	record := r.records[0]
+	r.records = r.records[1:]
+	r.offset = record.NextOffset
+	return record, nil
+}
+
+// NextBatch returns the next batch of records in the log. The batch contains
+// at least one record. Returns the same errors as Next.
+//
+// The records in the batch may share the same underlying buffer so must not be
+// modified.
+func (r *Reader) NextBatch() ([]Record, error) {
+	if len(r.records) == 0 {
+		if err := r.fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	records := r.records
+	r.records = nil
+	r.offset = records[len(records)-1].NextOffset
+	return records, nil
+}
+
+// fill reads the next batch of records from the log.
+func (r *Reader) fill() error {
+	records, err := r.log.read(r.offset, readBatchSize)
+	if err != nil {
+		return err
+	}
+	r.records = records
+	return nil
+}
+
+// readSegment returns the records in the segment starting at the given offset,
+// up to roughly maxBytes of records. At least one record is returned, so if
+// maxBytes is 0 returns a single record.
+//
+// If the first record can't be read, such as if it is corrupt, returns the
+// error. Otherwise if a later record can't be read, returns the records before
+// it, so the error is returned when reading from that record.
+func readSegment(segment Segment, offset uint64, maxBytes uint64) ([]Record, error) {
+	// Uncompacted persisted segments are read with a single read for the
+	// whole batch. Other segments look up each record, which for in-memory
+	// segments is cheap as records aren't copied.
+	if s, ok := segment.(*FileSegment); ok && !s.Compacted() && maxBytes > 0 {
+		return s.readRecords(offset, maxBytes)
+	}
+	// Remote segments read from their local copy.
+	if s, ok := segment.(*RemoteSegment); ok {
+		return s.read(offset, maxBytes)
+	}
+
+	records := []Record{}
+	size := uint64(0)
+	for {
+		r, err := segment.Lookup(offset)
+		if err != nil {
+			if len(records) > 0 {
+				return records, nil
+			}
+			return nil, err
+		}
+		records = append(records, r)
+		size += r.NextOffset - r.Offset
+		offset = r.NextOffset
+
+		if size >= maxBytes {
+			return records, nil
+		}
+	}
+}
+
+// readRecords reads the records starting at the given offset, up to maxBytes
+// of records, with a single read. If the first record is larger than maxBytes
+// the whole record is read. The returned records share the same buffer.
+func (s *FileSegment) readRecords(offset uint64, maxBytes uint64) ([]Record, error) {
+	size := s.Size()
+	prefixSize := s.format.PrefixSize()
+	if offset+prefixSize > size {
+		return nil, ErrNotFound
+	}
+
+	// Always read at least the first records prefix.
+	n := size - offset
+	if n > maxBytes {
+		n = maxBytes
+	}
+	if n < prefixSize {
+		n = prefixSize
+	}
+	buf := make([]byte, n)
+	if err := s.readAt(buf, offset); err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	pos := uint64(0)
+	for pos+prefixSize <= uint64(len(buf)) {
+		prefix := buf[pos : pos+prefixSize]
+		payloadSize := s.format.DecodePrefix(prefix)
+		if offset+pos+prefixSize+payloadSize > size {
+			// If the first record is corrupt return the error, otherwise
+			// return it when reading from the corrupt record.
+			if len(records) == 0 {
+				return nil, ErrCorrupt
+			}
+			break
+		}
+		if pos+prefixSize+payloadSize > uint64(len(buf)) {
+			// If the first record doesn't fit in the buffer, read the
+			// whole record.
+			if len(records) == 0 {
+				buf = make([]byte, prefixSize+payloadSize)
+				if err := s.readAt(buf, offset); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			break
+		}
+
+		key, value, err := s.format.DecodeRecord(prefix, buf[pos+prefixSize:pos+prefixSize+payloadSize])
+		if err != nil {
+			if len(records) == 0 {
+				return nil, err
+			}
+			break
+		}
+		records = append(records, Record{
+			Key:        key,
+			Value:      value,
+			Offset:     offset + pos,
+			NextOffset: offset + pos + prefixSize + payloadSize,
+		})
+		pos += prefixSize + payloadSize
+	}
+	return records, nil
+}
@@ -0,0 +1,185 @@
+package commitlog
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestReader_ReadAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	// Persist the first two segments and keep the last in-memory.
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	defer log.Close()
+	log.Append(nil, []byte("foo"))
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("car"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("dar"))
+
+	reader := log.NewReader(0)
+	for i, value := range []string{"foo", "bar", "car", "dar"} {
+		r, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(value), r.Value)
+		assert.Equal(t, uint64(i*11), r.Offset)
+		assert.Equal(t, uint64((i+1)*11), reader.Offset())
+	}
+
+	_, err := reader.Next()
+	assert.Equal(t, ErrNotFound, err)
+
+	// Once a new record is appended the reader should continue.
+	log.Append(nil, []byte("ear"))
+	r, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ear"), r.Value)
+}
+
+func TestReader_NextBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	defer log.Close()
+	log.Append(nil, []byte("foo"))
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("car"))
+
+	reader := log.NewReader(11)
+
+	// Each batch only contains records from the same segment.
+	records, err := reader.NextBatch()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, []byte("bar"), records[0].Value)
+
+	records, err = reader.NextBatch()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, []byte("car"), records[0].Value)
+	assert.Equal(t, uint64(33), reader.Offset())
+
+	_, err = reader.NextBatch()
+	assert.Equal(t, ErrNotFound, err)
+
+	reader.Seek(0)
+	records, err = reader.NextBatch()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, []byte("foo"), records[0].Value)
+	assert.Equal(t, []byte("bar"), records[1].Value)
+}
+
+func TestReader_ReadRecordsCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+	assert.Nil(t, segment.Append(nil, []byte("car")))
+	_, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	// Flip a bit in the payload of the second record.
+	path := dir + "/0.data"
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[SegmentHeaderSize+11+PrefixSize] ^= 0x01
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+
+	loaded, err := LoadFileSegment(dir, 0, zap.NewNop())
+	assert.Nil(t, err)
+
+	// Reading should return the records before the corrupt record, then
+	// return an error when reading from the corrupt record.
+	records, err := readSegment(loaded, 0, readBatchSize)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, []byte("foo"), records[0].Value)
+
+	_, err = readSegment(loaded, 11, readBatchSize)
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func TestReader_ReadRecordsLargerThanBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+	persisted, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	// If the batch size is smaller than a record, should still read the
+	// whole record.
+	records, err := readSegment(persisted, 0, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, []byte("foo"), records[0].Value)
+}
+
+// benchmarkReplay benchmarks reading a persisted commit log from the start,
+// either using Lookup for each record or a Reader.
+func benchmarkReplay(b *testing.B, appends int, messageLen int, useReader bool) {
+	dir := b.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1 << 24,
+	}, zap.NewNop())
+	defer log.Close()
+
+	message := make([]byte, messageLen)
+	rand.Read(message)
+
+	for i := 0; i != appends; i++ {
+		log.Append(nil, message)
+	}
+	if err := log.Flush(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(appends * messageLen))
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		reader := log.NewReader(0)
+		offset := uint64(0)
+		for i := 0; i != appends; i++ {
+			var r Record
+			var err error
+			if useReader {
+				r, err = reader.Next()
+			} else {
+				r, err = log.Lookup(offset)
+			}
+			if err != nil {
+				panic(err)
+			}
+			if len(r.Value) != messageLen {
+				panic("invalid message")
+			}
+			offset = r.NextOffset
+		}
+	}
+}
+
+func BenchmarkReplay_Lookup_Append10000_M100(b *testing.B) {
+	benchmarkReplay(b, 10000, 100, false)
+}
+
+func BenchmarkReplay_Reader_Append10000_M100(b *testing.B) {
+	benchmarkReplay(b, 10000, 100, true)
+}
@@ -0,0 +1,390 @@
+package commitlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// remoteCacheDir is the directory in the commit log directory that remote
+	// segments are fetched into.
+	remoteCacheDir = "cache"
+	// remoteCacheSize is the maximum number of remote segments each commit log
+	// keeps in its local cache.
+	remoteCacheSize = 4
+)
+
+// RemoteSegment is a persisted segment that has been moved to tiered storage.
+//
+// The commit log directory keeps a small stub file '<offset>.remote' for each
+// remote segment, containing the segment size, whose modification time is the
+// time the segment was last written to.
+//
+// The segment is fetched from storage into a local cache on demand when it is
+// first read. The cache only keeps the most recently used remote segments, so
+// the segment may be fetched multiple times.
+type RemoteSegment struct {
+	offset  uint64
+	size    uint64
+	modTime time.Time
+
+	// dir is the commit log directory.
+	dir string
+	// name is the name of the segment in storage, excluding the extension.
+	name    string
+	storage Storage
+	cache   *remoteCache
+
+	// mu protects segment. Reads hold a read lock while using the local copy
+	// so its not removed from the cache while in use.
+	mu sync.RWMutex
+	// segment is the local copy of the segment, or nil if not fetched.
+	segment *FileSegment
+
+	logger *zap.Logger
+}
+
+func newRemoteSegment(dir string, offset uint64, size uint64, modTime time.Time, storage Storage, cache *remoteCache, logger *zap.Logger) *RemoteSegment {
+	return &RemoteSegment{
+		offset:  offset,
+		size:    size,
+		modTime: modTime,
+		dir:     dir,
+		name:    remoteName(dir, offset),
+		storage: storage,
+		cache:   cache,
+		mu:      sync.RWMutex{},
+		segment: nil,
+		logger:  logger,
+	}
+}
+
+// offloadSegment uploads the given persisted segment to storage and writes its
+// stub, then returns the remote segment. Note this doesn't remove the local
+// segment.
+func offloadSegment(dir string, segment *FileSegment, storage Storage, cache *remoteCache, logger *zap.Logger) (*RemoteSegment, error) {
+	name := remoteName(dir, segment.Offset())
+	if err := storage.Put(name+".data", segment.file.Name()); err != nil {
+		return nil, err
+	}
+	// The index is optional as its rebuilt if missing.
+	idxPath := indexPath(dir, segment.Offset())
+	if _, err := os.Stat(idxPath); err == nil {
+		if err := storage.Put(name+".index", idxPath); err != nil {
+			return nil, err
+		}
+	}
+
+	modTime := segment.ModTime()
+	if err := writeRemoteStub(remoteStubPath(dir, segment.Offset()), segment.Size(), modTime); err != nil {
+		return nil, err
+	}
+
+	offloadedSegments.Add(1)
+	return newRemoteSegment(dir, segment.Offset(), segment.Size(), modTime, storage, cache, logger), nil
+}
+
+// loadRemoteSegment loads the remote segment with the given offset from its
+// stub in the given directory.
+func loadRemoteSegment(dir string, offset uint64, storage Storage, cache *remoteCache, logger *zap.Logger) (*RemoteSegment, error) {
+	path := remoteStubPath(dir, offset)
+	if storage == nil {
+		return nil, fmt.Errorf("segment %s: no tiered storage configured", path)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 8 {
+		return nil, fmt.Errorf("segment %s: invalid remote segment", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint64(b)
+	return newRemoteSegment(dir, offset, size, info.ModTime(), storage, cache, logger), nil
+}
+
+func (s *RemoteSegment) Append(key []byte, value []byte) error {
+	return errors.New("cannot append to remote segment")
+}
+
+func (s *RemoteSegment) AppendBatch(records []Record) error {
+	return errors.New("cannot append to remote segment")
+}
+
+func (s *RemoteSegment) Lookup(offset uint64) (Record, error) {
+	var r Record
+	err := s.withSegment(func(segment *FileSegment) error {
+		var err error
+		r, err = segment.Lookup(offset)
+		return err
+	})
+	return r, err
+}
+
+func (s *RemoteSegment) LookupTime(timestamp time.Time) (uint64, bool) {
+	var offset uint64
+	var ok bool
+	err := s.withSegment(func(segment *FileSegment) error {
+		offset, ok = segment.LookupTime(timestamp)
+		return nil
+	})
+	if err != nil {
+		s.logger.Error(
+			"failed to fetch remote segment",
+			zap.String("name", s.name),
+			zap.Error(err),
+		)
+		return 0, false
+	}
+	return offset, ok
+}
+
+func (s *RemoteSegment) LookupLastN(n uint64) (uint64, uint64, error) {
+	var offset, count uint64
+	err := s.withSegment(func(segment *FileSegment) error {
+		var err error
+		offset, count, err = segment.LookupLastN(n)
+		return err
+	})
+	return offset, count, err
+}
+
+func (s *RemoteSegment) ValidateOffset(offset uint64) error {
+	return s.withSegment(func(segment *FileSegment) error {
+		return segment.ValidateOffset(offset)
+	})
+}
+
+func (s *RemoteSegment) Size() uint64 {
+	return s.size
+}
+
+func (s *RemoteSegment) Offset() uint64 {
+	return s.offset
+}
+
+// ModTime returns the time the segment was last written to, which is used to
+// determine when the segment expires.
+func (s *RemoteSegment) ModTime() time.Time {
+	return s.modTime
+}
+
+// Sync does nothing as the segment is already stored remotely.
+func (s *RemoteSegment) Sync() error {
+	return nil
+}
+
+func (s *RemoteSegment) Persist(dir string, compression Compression) (Segment, error) {
+	// Already persisted so just return self.
+	return s, nil
+}
+
+// Remove deletes the segment from storage, along with its stub and any local
+// copy.
+func (s *RemoteSegment) Remove() error {
+	s.cache.Remove(s)
+	if err := s.evict(); err != nil {
+		return err
+	}
+	if err := s.storage.Delete(s.name + ".data"); err != nil {
+		return err
+	}
+	if err := s.storage.Delete(s.name + ".index"); err != nil {
+		return err
+	}
+	return os.Remove(remoteStubPath(s.dir, s.offset))
+}
+
+// read returns the records starting at the given offset, up to roughly
+// maxBytes of records.
+func (s *RemoteSegment) read(offset uint64, maxBytes uint64) ([]Record, error) {
+	var records []Record
+	err := s.withSegment(func(segment *FileSegment) error {
+		var err error
+		records, err = readSegment(segment, offset, maxBytes)
+		return err
+	})
+	return records, err
+}
+
+// withSegment calls fn with the local copy of the segment, fetching the segment
+// from storage if needed.
+func (s *RemoteSegment) withSegment(fn func(segment *FileSegment) error) error {
+	for {
+		s.mu.RLock()
+		if s.segment != nil {
+			err := fn(s.segment)
+			s.mu.RUnlock()
+			s.use()
+			return err
+		}
+		s.mu.RUnlock()
+
+		if err := s.fetch(); err != nil {
+			return err
+		}
+		s.use()
+	}
+}
+
+// fetch downloads the segment from storage into the local cache directory, if
+// not already fetched.
+func (s *RemoteSegment) fetch() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment != nil {
+		return nil
+	}
+
+	dir := filepath.Join(s.dir, remoteCacheDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := s.storage.Get(s.name+".data", fmt.Sprintf("%s/%d.data", dir, s.offset)); err != nil {
+		return err
+	}
+	// If the index is missing its rebuilt when loading the segment.
+	if err := s.storage.Get(s.name+".index", indexPath(dir, s.offset)); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	segment, err := LoadFileSegment(dir, s.offset, s.logger)
+	if err != nil {
+		return err
+	}
+	s.segment = segment.(*FileSegment)
+
+	remoteFetches.Add(1)
+	s.logger.Debug(
+		"fetched remote segment",
+		zap.String("name", s.name),
+	)
+	return nil
+}
+
+// use marks the segment as recently used in the cache, and evicts the least
+// recently used segments if the cache is full.
+func (s *RemoteSegment) use() {
+	for _, evicted := range s.cache.Use(s) {
+		if err := evicted.evict(); err != nil {
+			s.logger.Error(
+				"failed to evict remote segment",
+				zap.String("name", evicted.name),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// evict removes the local copy of the segment, waiting for any reads in
+// progress to complete.
+func (s *RemoteSegment) evict() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment == nil {
+		return nil
+	}
+	segment := s.segment
+	s.segment = nil
+	return segment.Remove()
+}
+
+// remoteCache tracks the remote segments with a local copy, so the least
+// recently used segments can be evicted.
+type remoteCache struct {
+	// Protects the below fields.
+	mu   sync.Mutex
+	size int
+	// segments contains the cached segments, ordered from most to least
+	// recently used.
+	segments []*RemoteSegment
+}
+
+func newRemoteCache(size int) *remoteCache {
+	return &remoteCache{
+		mu:       sync.Mutex{},
+		size:     size,
+		segments: []*RemoteSegment{},
+	}
+}
+
+// Use marks the given segment as the most recently used segment, and returns
+// any segments that must be evicted.
+func (c *remoteCache) Use(segment *RemoteSegment) []*RemoteSegment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	segments := []*RemoteSegment{segment}
+	for _, s := range c.segments {
+		if s != segment {
+			segments = append(segments, s)
+		}
+	}
+
+	var evicted []*RemoteSegment
+	if len(segments) > c.size {
+		evicted = segments[c.size:]
+		segments = segments[:c.size]
+	}
+	c.segments = segments
+	return evicted
+}
+
+// Remove removes the given segment from the cache.
+func (c *remoteCache) Remove(segment *RemoteSegment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	segments := make([]*RemoteSegment, 0, len(c.segments))
+	for _, s := range c.segments {
+		if s != segment {
+			segments = append(segments, s)
+		}
+	}
+	c.segments = segments
+}
+
+// writeRemoteStub writes the stub of a remote segment with the given size and
+// modification time. The stub is written to a temporary file then renamed, so
+// is never partially written.
+func writeRemoteStub(path string, size uint64, modTime time.Time) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, size)
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmpPath, modTime, modTime); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// remoteName returns the name of the segment with the given offset in storage,
+// excluding the extension. Segments are named '<topic>/<offset>', where the
+// topic is the name of the commit log directory.
+func remoteName(dir string, offset uint64) string {
+	return fmt.Sprintf("%s/%d", filepath.Base(dir), offset)
+}
+
+// remoteStubPath returns the path of the stub of the remote segment with the
+// given offset.
+func remoteStubPath(dir string, offset uint64) string {
+	return fmt.Sprintf("%s/%d.remote", dir, offset)
+}
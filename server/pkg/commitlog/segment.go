@@ -1,16 +1,354 @@
 package commitlog
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
 const (
-	PrefixSize = 4
+	// PrefixSize is the size of the header prefixing each record, containing
+	// the payload size and checksum.
+	PrefixSize = 8
+	// legacyPrefixSize is the size of the header prefixing each record in
+	// legacy segments, containing only the payload size.
+	legacyPrefixSize = 4
+
+	// SegmentHeaderSize is the size of the header at the start of each
+	// persisted segment file, containing the magic number, flags and format
+	// version.
+	SegmentHeaderSize = 8
+
+	// compactedHeaderSize is the size of the header extension of compacted
+	// segment files, containing the size of the segment before compaction.
+	compactedHeaderSize = 8
+	// compactedOffsetSize is the size of the offset prefixing each record in
+	// compacted segment files.
+	compactedOffsetSize = 8
+	// compressedHeaderSize is the size of the header extension of compressed
+	// segment files, containing the compression codec and block size.
+	compressedHeaderSize = 8
+
+	// segmentMagic identifies figg segment files ('FIGG').
+	segmentMagic = uint32(0x46494747)
+	// segmentVersion is the version of the segment and record format.
+	//
+	// Version 1 added the segment header and record checksums, which grew
+	// the record prefix from 4 to 8 bytes. Segments written before the
+	// header was added have no magic number so are read as legacy segments.
+	//
+	// Version 2 added record keys. Since version 1 records never have the
+	// key flag set, version 1 segments can be read as version 2.
+	//
+	// Version 3 added compression. Uncompressed segments are unchanged so
+	// version 2 segments can be read as version 3.
+	segmentVersion = uint16(3)
+
+	// segmentFlagCompacted indicates the segment has been compacted.
+	segmentFlagCompacted = uint16(1)
+	// segmentFlagCompressed indicates the records in the segment are
+	// compressed.
+	segmentFlagCompressed = uint16(2)
+
+	// recordKeyFlag is set in the record size if the record has a key.
+	recordKeyFlag = uint32(1 << 31)
 )
 
+var (
+	ErrCorrupt       = errors.New("corrupt record")
+	ErrInvalidOffset = errors.New("invalid offset")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Record is an entry in the commit log.
+type Record struct {
+	// Key is the optional key of the record, used to compact the log. nil if
+	// the record has no key.
+	Key   []byte
+	Value []byte
+	// Offset is the offset of the record.
+	Offset uint64
+	// NextOffset is the offset following the record. Note in a compacted
+	// segment there may be no record at this offset, in which case lookups
+	// return the next retained record.
+	NextOffset uint64
+}
+
 type Segment interface {
-	Append(b []byte) error
-	Lookup(offset uint64) ([]byte, error)
+	Append(key []byte, value []byte) error
+	// AppendBatch appends the keys and values of the given records
+	// atomically, so either all records are added or none are.
+	AppendBatch(records []Record) error
+	// Lookup returns the record at the given offset. If the segment is
+	// compacted and the record at the offset has been removed, returns the
+	// next retained record.
+	Lookup(offset uint64) (Record, error)
 	// Size returns the number of bytes in the segment.
 	Size() uint64
 	// Offset returns the starting offset of the segment on the commit log.
 	Offset() uint64
-	// Persists the segment and returns the persisted segment.
-	Persist(dir string) (Segment, error)
+	// LookupTime returns the offset of the last indexed record appended
+	// before the given time, or false if no records were appended before
+	// the time.
+	LookupTime(timestamp time.Time) (uint64, bool)
+	// LookupLastN returns the offset of the nth last record in the segment
+	// and the number of records found. If the segment has fewer than n
+	// records, returns the offset of the first record and the number of
+	// records in the segment.
+	LookupLastN(n uint64) (uint64, uint64, error)
+	// ValidateOffset returns ErrInvalidOffset if the offset is not the start
+	// of a record in the segment. The end of the segment is a valid offset.
+	ValidateOffset(offset uint64) error
+	// Sync syncs any pending writes to disk.
+	Sync() error
+	// Persists the segment, compressing the records with the given
+	// compression, and returns the persisted segment.
+	Persist(dir string, compression Compression) (Segment, error)
+}
+
+// persistedSegment is a segment that has been persisted, either to local disk
+// or tiered storage.
+type persistedSegment interface {
+	Segment
+	// ModTime returns the time the segment was last written to.
+	ModTime() time.Time
+	// Remove deletes the segment.
+	Remove() error
+}
+
+// encodeRecords encodes the keys and values of the given records into a single
+// buffer, and returns the position of each record in the buffer.
+func encodeRecords(records []Record) ([]byte, []uint64) {
+	size := uint64(0)
+	for _, r := range records {
+		size += recordSize(r.Key, r.Value)
+	}
+
+	b := make([]byte, 0, size)
+	positions := make([]uint64, 0, len(records))
+	for _, r := range records {
+		positions = append(positions, uint64(len(b)))
+		b = append(b, encodeRecordPrefix(r.Key, r.Value)...)
+		b = append(b, r.Value...)
+	}
+	return b, positions
+}
+
+// recordSize returns the number of bytes the record with the given key and
+// value uses in a segment, including its prefix.
+func recordSize(key []byte, value []byte) uint64 {
+	if len(key) == 0 {
+		return uint64(PrefixSize + len(value))
+	}
+	return uint64(PrefixSize + 4 + len(key) + len(value))
+}
+
+// encodeRecordPrefix returns the bytes preceding the value of the record
+// with the given key and value.
+//
+// Each record is prefixed with a 32 bit payload size and a 32 bit CRC32C
+// checksum of the payload. If the record has a key, the top bit of the size is
+// set and the payload starts with the 32 bit key size followed by the key.
+// Otherwise the payload is just the value.
+func encodeRecordPrefix(key []byte, value []byte) []byte {
+	if len(key) == 0 {
+		prefix := make([]byte, PrefixSize)
+		binary.BigEndian.PutUint32(prefix[0:4], uint32(len(value)))
+		binary.BigEndian.PutUint32(prefix[4:8], crc32.Checksum(value, crcTable))
+		return prefix
+	}
+
+	prefix := make([]byte, PrefixSize+4+len(key))
+	binary.BigEndian.PutUint32(prefix[PrefixSize:PrefixSize+4], uint32(len(key)))
+	copy(prefix[PrefixSize+4:], key)
+
+	checksum := crc32.Checksum(prefix[PrefixSize:], crcTable)
+	checksum = crc32.Update(checksum, crcTable, value)
+
+	size := uint32(4 + len(key) + len(value))
+	binary.BigEndian.PutUint32(prefix[0:4], size|recordKeyFlag)
+	binary.BigEndian.PutUint32(prefix[4:8], checksum)
+	return prefix
+}
+
+// decodeRecordPrefix returns the payload size and checksum from the record
+// prefix.
+func decodeRecordPrefix(prefix []byte) (uint64, uint32) {
+	size := uint64(binary.BigEndian.Uint32(prefix[0:4]) &^ recordKeyFlag)
+	checksum := binary.BigEndian.Uint32(prefix[4:8])
+	return size, checksum
+}
+
+// decodeRecord verifies the payload matches the checksum from the record
+// prefix, then returns the key and value from the payload.
+func decodeRecord(prefix []byte, payload []byte) ([]byte, []byte, error) {
+	_, checksum := decodeRecordPrefix(prefix)
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, nil, ErrCorrupt
+	}
+
+	if binary.BigEndian.Uint32(prefix[0:4])&recordKeyFlag == 0 {
+		return nil, payload, nil
+	}
+
+	if len(payload) < 4 {
+		return nil, nil, ErrCorrupt
+	}
+	keySize := uint64(binary.BigEndian.Uint32(payload[0:4]))
+	if 4+keySize > uint64(len(payload)) {
+		return nil, nil, ErrCorrupt
+	}
+	return payload[4 : 4+keySize], payload[4+keySize:], nil
+}
+
+// recordFormat is the encoding of the records in a segment.
+type recordFormat int
+
+const (
+	// recordFormatChecksummed prefixes each record with its payload size
+	// and checksum, as encoded by encodeRecordPrefix.
+	recordFormatChecksummed = recordFormat(iota)
+	// recordFormatLegacy prefixes each record with only its 32 bit payload
+	// size. Legacy records have no checksum or key.
+	recordFormatLegacy
+)
+
+// PrefixSize returns the size of the prefix of each record.
+func (f recordFormat) PrefixSize() uint64 {
+	if f == recordFormatLegacy {
+		return legacyPrefixSize
+	}
+	return PrefixSize
+}
+
+// DecodePrefix returns the payload size from the record prefix.
+func (f recordFormat) DecodePrefix(prefix []byte) uint64 {
+	if f == recordFormatLegacy {
+		return uint64(binary.BigEndian.Uint32(prefix[0:legacyPrefixSize]))
+	}
+	size, _ := decodeRecordPrefix(prefix)
+	return size
+}
+
+// DecodeRecord returns the key and value from the record payload. Since legacy
+// records have no checksum they are never reported as corrupt.
+func (f recordFormat) DecodeRecord(prefix []byte, payload []byte) ([]byte, []byte, error) {
+	if f == recordFormatLegacy {
+		return nil, payload, nil
+	}
+	return decodeRecord(prefix, payload)
+}
+
+// segmentHeader is the header at the start of persisted segment files.
+//
+// The header starts with a 32 bit magic number, 16 bit flags and a 16 bit
+// format version. If the segment is compacted, this is followed by the 64 bit
+// size of the segment before compaction. If the segment is compressed, this is
+// followed by the 32 bit compression codec and 32 bit block size.
+//
+// Legacy segments, written before the header was added, have no header.
+type segmentHeader struct {
+	// Legacy indicates the segment has no header and its records use
+	// recordFormatLegacy.
+	Legacy bool
+	// Compacted indicates the segment has been compacted.
+	Compacted bool
+	// CompactedSize is the size of the segment before compaction. This is
+	// only used if the segment is compacted.
+	CompactedSize uint64
+	// Compression is the codec used to compress the records in the segment.
+	Compression Compression
+}
+
+// Size returns the size of the encoded header.
+func (h segmentHeader) Size() uint64 {
+	if h.Legacy {
+		return 0
+	}
+	size := uint64(SegmentHeaderSize)
+	if h.Compacted {
+		size += compactedHeaderSize
+	}
+	if h.Compression != CompressionNone {
+		size += compressedHeaderSize
+	}
+	return size
+}
+
+// Format returns the format of the records in the segment.
+func (h segmentHeader) Format() recordFormat {
+	if h.Legacy {
+		return recordFormatLegacy
+	}
+	return recordFormatChecksummed
+}
+
+func (h segmentHeader) Encode() []byte {
+	flags := uint16(0)
+	if h.Compacted {
+		flags |= segmentFlagCompacted
+	}
+	if h.Compression != CompressionNone {
+		flags |= segmentFlagCompressed
+	}
+
+	header := make([]byte, SegmentHeaderSize, h.Size())
+	binary.BigEndian.PutUint32(header[0:4], segmentMagic)
+	binary.BigEndian.PutUint16(header[4:6], flags)
+	binary.BigEndian.PutUint16(header[6:8], segmentVersion)
+	if h.Compacted {
+		header = binary.BigEndian.AppendUint64(header, h.CompactedSize)
+	}
+	if h.Compression != CompressionNone {
+		header = binary.BigEndian.AppendUint32(header, uint32(h.Compression))
+		header = binary.BigEndian.AppendUint32(header, compressionBlockSize)
+	}
+	return header
+}
+
+// decodeSegmentHeader checks the segment file header is a supported format and
+// decodes the header. b must contain at least the full header, which may be
+// followed by other data. Returns an error if the header is invalid or b is too
+// small.
+//
+// If b doesn't start with the magic number the segment is a legacy segment,
+// which has no header.
+func decodeSegmentHeader(b []byte) (segmentHeader, error) {
+	if len(b) < 4 || binary.BigEndian.Uint32(b[0:4]) != segmentMagic {
+		return segmentHeader{Legacy: true}, nil
+	}
+	if len(b) < SegmentHeaderSize {
+		return segmentHeader{}, errors.New("missing segment header")
+	}
+	if version := binary.BigEndian.Uint16(b[6:8]); version == 0 || version > segmentVersion {
+		return segmentHeader{}, errors.New("unsupported segment version")
+	}
+	flags := binary.BigEndian.Uint16(b[4:6])
+
+	h := segmentHeader{
+		Compacted:   flags&segmentFlagCompacted != 0,
+		Compression: CompressionNone,
+	}
+	if uint64(len(b)) < h.Size() {
+		return segmentHeader{}, errors.New("missing segment header")
+	}
+
+	pos := SegmentHeaderSize
+	if h.Compacted {
+		h.CompactedSize = binary.BigEndian.Uint64(b[pos : pos+compactedHeaderSize])
+		pos += compactedHeaderSize
+	}
+	if flags&segmentFlagCompressed != 0 {
+		h.Compression = Compression(binary.BigEndian.Uint32(b[pos : pos+4]))
+		if !h.Compression.valid() {
+			return segmentHeader{}, fmt.Errorf("unsupported compression: %d", h.Compression)
+		}
+		if uint64(len(b)) < h.Size() {
+			return segmentHeader{}, errors.New("missing segment header")
+		}
+	}
+	return h, nil
 }
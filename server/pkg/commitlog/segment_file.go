@@ -0,0 +1,331 @@
+package commitlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SegmentFile provides read-only access to a persisted segment file (or a
+// write-ahead log, which has the same format), used to inspect and repair
+// segments offline without a running server.
+//
+// Unlike LoadFileSegment, opening a segment file never modifies the file or
+// its index, so is safe to use on a segment that may be corrupt.
+type SegmentFile struct {
+	// Path is the path of the segment file.
+	Path string
+	// Offset is the offset of the segment in the commit log, taken from the
+	// file name.
+	Offset uint64
+	// Compacted indicates the segment has been compacted.
+	Compacted bool
+	// Compression is the codec the segment was persisted with.
+	Compression Compression
+	// FileSize is the size of the file in bytes, including the header.
+	FileSize uint64
+	// DataSize is the size of the records in bytes. If the segment is
+	// compressed this is the uncompressed size of the complete blocks.
+	DataSize uint64
+
+	segment *FileSegment
+}
+
+// SegmentFileRecord is a record read from a segment file.
+type SegmentFileRecord struct {
+	Record
+	// Position is the position of the record in the segments records,
+	// excluding the header. If the segment is compressed this is the
+	// position in the uncompressed records.
+	Position uint64
+	// Size is the size of the record in the segment, including its prefix.
+	Size uint64
+	// Err is ErrCorrupt if the record doesn't match its checksum, otherwise
+	// nil. The key and value of a corrupt record are not set.
+	Err error
+}
+
+// SegmentFileScan is the result of scanning a segment file.
+type SegmentFileScan struct {
+	// Records is the number of complete records.
+	Records int
+	// CorruptRecords is the number of complete records that don't match
+	// their checksum.
+	CorruptRecords int
+	// ValidSize is the size of the records before the first corrupt record,
+	// excluding the header.
+	ValidSize uint64
+	// ScannedSize is the size of the records up to the end of the last
+	// complete record, excluding the header.
+	ScannedSize uint64
+	// TrailingBytes is the number of bytes following the last complete
+	// record that can't be read, such as a partial record from a torn write
+	// or the records following a corrupt block.
+	TrailingBytes uint64
+	// CorruptBlock indicates the scan stopped at a compressed block that
+	// doesn't match its checksum or can't be decompressed.
+	CorruptBlock bool
+}
+
+// Valid returns whether the segment contains no corrupt or partial records.
+func (s SegmentFileScan) Valid() bool {
+	return s.CorruptRecords == 0 && s.TrailingBytes == 0 && !s.CorruptBlock
+}
+
+// OpenSegmentFile opens the segment file at the given path, which must be
+// named '<offset>.data' or '<offset>.wal'. Returns an error if the segment
+// header is invalid.
+func OpenSegmentFile(path string) (*SegmentFile, error) {
+	name := filepath.Base(path)
+	offset, err := strconv.ParseUint(strings.TrimSuffix(name, filepath.Ext(name)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid segment file: %s", name)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header, err := readSegmentHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("segment %s: %w", path, err)
+	}
+
+	fileSize := uint64(info.Size())
+	dataSize := fileSize - header.Size()
+	blocks := []block{}
+	if header.Compression != CompressionNone {
+		blocks, _, err = loadBlocks(file, header.Size(), fileSize)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		dataSize = 0
+		for _, b := range blocks {
+			dataSize += b.Size
+		}
+	}
+
+	return &SegmentFile{
+		Path:        path,
+		Offset:      offset,
+		Compacted:   header.Compacted,
+		Compression: header.Compression,
+		FileSize:    fileSize,
+		DataSize:    dataSize,
+		segment:     newFileSegment(file, offset, header, dataSize, blocks, info.ModTime(), newIndex()),
+	}, nil
+}
+
+// Scan reads each record in the segment in order, calling fn with each
+// complete record, and returns a summary of the segment. If fn returns an
+// error the scan stops and returns the error.
+//
+// Corrupt records are passed to fn with Err set, and the scan continues with
+// the following record. The scan stops at the first partial record or corrupt
+// compressed block, since the following record boundaries can't be trusted.
+func (f *SegmentFile) Scan(fn func(r SegmentFileRecord) error) (SegmentFileScan, error) {
+	// In compacted segments each record is prefixed with its offset.
+	prefixSize := f.segment.format.PrefixSize()
+	recordHeaderSize := prefixSize
+	if f.Compacted {
+		recordHeaderSize += compactedOffsetSize
+	}
+
+	scan := SegmentFileScan{}
+	r := f.segment.reader(f.DataSize)
+	header := make([]byte, recordHeaderSize)
+	pos := uint64(0)
+	for pos+recordHeaderSize <= f.DataSize {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == ErrCorrupt {
+				scan.CorruptBlock = true
+				break
+			}
+			return scan, err
+		}
+
+		offset := pos
+		prefix := header
+		if f.Compacted {
+			offset = binary.BigEndian.Uint64(header[0:compactedOffsetSize])
+			prefix = header[compactedOffsetSize:]
+		}
+
+		payloadSize := f.segment.format.DecodePrefix(prefix)
+		if pos+recordHeaderSize+payloadSize > f.DataSize {
+			break
+		}
+
+		payload := make([]byte, payloadSize)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == ErrCorrupt {
+				scan.CorruptBlock = true
+				break
+			}
+			return scan, err
+		}
+
+		record := SegmentFileRecord{
+			Record: Record{
+				Offset:     f.Offset + offset,
+				NextOffset: f.Offset + offset + prefixSize + payloadSize,
+			},
+			Position: pos,
+			Size:     recordHeaderSize + payloadSize,
+		}
+		key, value, err := f.segment.format.DecodeRecord(prefix, payload)
+		if err != nil {
+			record.Err = err
+			scan.CorruptRecords++
+		} else {
+			record.Key = key
+			record.Value = value
+		}
+
+		pos += recordHeaderSize + payloadSize
+		scan.Records++
+		scan.ScannedSize = pos
+		if scan.CorruptRecords == 0 {
+			scan.ValidSize = pos
+		}
+
+		if err := fn(record); err != nil {
+			return scan, err
+		}
+	}
+
+	scan.TrailingBytes = f.DataSize - scan.ScannedSize
+	if f.Compression != CompressionNone {
+		// Include any partial block at the end of the file.
+		scan.TrailingBytes += f.FileSize - f.blocksEnd()
+	}
+	return scan, nil
+}
+
+// Close closes the segment file.
+func (f *SegmentFile) Close() error {
+	return f.segment.Close()
+}
+
+// TruncateSegmentFile truncates the segment file at the given path after its
+// last valid record, removing any corrupt or partial records (and all records
+// following them). Returns the number of bytes removed, excluding the header,
+// where compressed records are counted by their uncompressed size.
+//
+// Uncompressed segments are truncated in place. Compressed segments are
+// rewritten to a temporary file with the valid records, which is synced and
+// renamed over the original file.
+func TruncateSegmentFile(path string) (uint64, error) {
+	f, err := OpenSegmentFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scan, err := f.Scan(func(r SegmentFileRecord) error {
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if scan.Valid() {
+		return 0, nil
+	}
+
+	removed := scan.ScannedSize + scan.TrailingBytes - scan.ValidSize
+	if f.Compression == CompressionNone {
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+
+		if err := file.Truncate(int64(f.segment.headerSize + scan.ValidSize)); err != nil {
+			return 0, err
+		}
+		return removed, file.Sync()
+	}
+
+	return removed, f.rewrite(scan.ValidSize)
+}
+
+// rewrite writes the first size bytes of records to a new segment file with
+// the same header, which replaces the existing file.
+func (f *SegmentFile) rewrite(size uint64) error {
+	header := segmentHeader{
+		Compacted:     f.Compacted,
+		CompactedSize: f.segment.Size(),
+		Compression:   f.Compression,
+	}
+
+	tmpPath := f.Path + ".truncating"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(file)
+	if _, err := bw.Write(header.Encode()); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	w := newSegmentWriter(bw, f.Compression, header.Size())
+	if _, err := io.Copy(w, f.segment.reader(size)); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, f.Path)
+}
+
+// blocksEnd returns the position in the file following the last complete
+// block in a compressed segment.
+func (f *SegmentFile) blocksEnd() uint64 {
+	if len(f.segment.blocks) == 0 {
+		return f.segment.headerSize
+	}
+	last := f.segment.blocks[len(f.segment.blocks)-1]
+	return last.FilePosition + blockHeaderSize + last.CompressedSize
+}
+
+// ListSegmentFiles returns the paths of the segment files in the given
+// directory in offset order.
+func ListSegmentFiles(dir string) ([]string, error) {
+	offsets, err := listFileOffsets(dir, ".data")
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(offsets))
+	for _, offset := range offsets {
+		paths = append(paths, fmt.Sprintf("%s/%d.data", dir, offset))
+	}
+	return paths, nil
+}
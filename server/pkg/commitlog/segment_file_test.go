@@ -0,0 +1,193 @@
+package commitlog
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestSegmentFile_Scan(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 100)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append([]byte("a"), []byte("bar")))
+	_, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	f, err := OpenSegmentFile(dir + "/100.data")
+	assert.Nil(t, err)
+	defer f.Close()
+
+	records := []SegmentFileRecord{}
+	scan, err := f.Scan(func(r SegmentFileRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, scan.Valid())
+	assert.Equal(t, 2, scan.Records)
+	assert.Equal(t, uint64(27), scan.ValidSize)
+
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, []byte("foo"), records[0].Value)
+	assert.Equal(t, uint64(100), records[0].Offset)
+	assert.Equal(t, []byte("a"), records[1].Key)
+	assert.Equal(t, []byte("bar"), records[1].Value)
+	assert.Equal(t, uint64(111), records[1].Offset)
+	assert.Equal(t, uint64(127), records[1].NextOffset)
+}
+
+func TestSegmentFile_TruncateCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+	assert.Nil(t, segment.Append(nil, []byte("car")))
+	_, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	// Flip a bit in the payload of the second record.
+	path := dir + "/0.data"
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[SegmentHeaderSize+11+PrefixSize] ^= 0x01
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+
+	f, err := OpenSegmentFile(path)
+	assert.Nil(t, err)
+	scan, err := f.Scan(func(r SegmentFileRecord) error {
+		if r.Offset == 11 {
+			assert.Equal(t, ErrCorrupt, r.Err)
+		} else {
+			assert.Nil(t, r.Err)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.False(t, scan.Valid())
+	assert.Equal(t, 3, scan.Records)
+	assert.Equal(t, 1, scan.CorruptRecords)
+	assert.Equal(t, uint64(11), scan.ValidSize)
+
+	// Truncating should remove the corrupt record and all following records.
+	removed, err := TruncateSegmentFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(22), removed)
+
+	loaded, err := LoadFileSegment(dir, 0, zap.NewNop())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(11), loaded.Size())
+	r, err := loaded.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+}
+
+func TestSegmentFile_TruncatePartialRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+	_, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	// Remove the last 2 bytes, as if the write was torn.
+	path := dir + "/0.data"
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, info.Size()-2))
+
+	f, err := OpenSegmentFile(path)
+	assert.Nil(t, err)
+	scan, err := f.Scan(func(r SegmentFileRecord) error {
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.False(t, scan.Valid())
+	assert.Equal(t, 1, scan.Records)
+	assert.Equal(t, uint64(9), scan.TrailingBytes)
+
+	removed, err := TruncateSegmentFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(9), removed)
+
+	// Truncating a valid segment does nothing.
+	removed, err = TruncateSegmentFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), removed)
+}
+
+func TestSegmentFile_TruncateCorruptCompressedBlock(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1<<20, 0)
+	value := []byte(strings.Repeat("foo", 10000))
+	for i := 0; i != 10; i++ {
+		assert.Nil(t, segment.Append(nil, value))
+	}
+	persistedSegment, err := segment.Persist(dir, CompressionZstd)
+	assert.Nil(t, err)
+	blocks := persistedSegment.(*FileSegment).blocks
+	assert.Greater(t, len(blocks), 2)
+
+	// Flip a bit in the second block.
+	path := dir + "/0.data"
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[blocks[1].FilePosition+blockHeaderSize] ^= 0x01
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+
+	f, err := OpenSegmentFile(path)
+	assert.Nil(t, err)
+	scan, err := f.Scan(func(r SegmentFileRecord) error {
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.True(t, scan.CorruptBlock)
+	assert.Less(t, scan.ValidSize, blocks[1].Position)
+
+	_, err = TruncateSegmentFile(path)
+	assert.Nil(t, err)
+
+	// The rewritten segment should only contain the valid records.
+	f, err = OpenSegmentFile(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	assert.Equal(t, CompressionZstd, f.Compression)
+	records := 0
+	scan, err = f.Scan(func(r SegmentFileRecord) error {
+		assert.Equal(t, value, r.Value)
+		records++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, scan.Valid())
+	assert.Greater(t, records, 0)
+	assert.Equal(t, records, scan.Records)
+}
+
+func TestListSegmentFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	log := NewCommitLog(dir, Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	defer log.Close()
+	log.Append(nil, []byte("foo"))
+	assert.Nil(t, log.Flush())
+	log.Append(nil, []byte("bar"))
+	assert.Nil(t, log.Flush())
+
+	paths, err := ListSegmentFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{dir + "/0.data", dir + "/11.data"}, paths)
+}
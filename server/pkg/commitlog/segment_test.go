@@ -1,87 +1,470 @@
 package commitlog
 
 import (
+	"encoding/binary"
+	"fmt"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 
-	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func TestSegment_AppendThenLookup(t *testing.T) {
 	segment := NewInMemorySegment(1024, 0)
-	assert.Nil(t, segment.Append([]byte("foo")))
-	assert.Nil(t, segment.Append([]byte("bar")))
-	assert.Nil(t, segment.Append([]byte("car")))
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+	assert.Nil(t, segment.Append(nil, []byte("car")))
 
-	b, err := segment.Lookup(0)
+	r, err := segment.Lookup(0)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("foo"), b)
+	assert.Equal(t, []byte("foo"), r.Value)
 
-	b, err = segment.Lookup(7)
+	r, err = segment.Lookup(11)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("bar"), b)
+	assert.Equal(t, []byte("bar"), r.Value)
 
-	b, err = segment.Lookup(14)
+	r, err = segment.Lookup(22)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("car"), b)
+	assert.Equal(t, []byte("car"), r.Value)
 
-	b, err = segment.Lookup(21)
+	r, err = segment.Lookup(33)
 	assert.Equal(t, ErrNotFound, err)
 }
 
+func TestSegment_AppendBatchThenLookup(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.AppendBatch([]Record{
+		{Key: nil, Value: []byte("bar")},
+		{Key: []byte("k"), Value: []byte("car")},
+	}))
+	assert.Equal(t, uint64(38), segment.Size())
+
+	persistedSegment, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+	// Append a batch to the persisted segment.
+	assert.Nil(t, persistedSegment.AppendBatch([]Record{
+		{Key: nil, Value: []byte("dar")},
+	}))
+	assert.Equal(t, uint64(49), persistedSegment.Size())
+
+	for _, s := range []Segment{segment, persistedSegment} {
+		r, err := s.Lookup(11)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("bar"), r.Value)
+
+		r, err = s.Lookup(22)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("k"), r.Key)
+		assert.Equal(t, []byte("car"), r.Value)
+	}
+
+	r, err := persistedSegment.Lookup(38)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("dar"), r.Value)
+}
+
 func TestSegment_Persist(t *testing.T) {
-	dir := "data/" + uuid.New().String()
-	defer os.Remove(dir)
+	dir := t.TempDir()
 
 	// Use a large segment size so all messages fit in the same segment.
 	segment := NewInMemorySegment(1024, 500)
-	assert.Nil(t, segment.Append([]byte("foo")))
-	assert.Nil(t, segment.Append([]byte("bar")))
-	assert.Nil(t, segment.Append([]byte("car")))
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+	assert.Nil(t, segment.Append(nil, []byte("car")))
 
-	persistedSegment, err := segment.Persist(dir)
+	persistedSegment, err := segment.Persist(dir, CompressionNone)
 	assert.Nil(t, err)
 
 	assert.Equal(t, uint64(500), persistedSegment.Offset())
-	assert.Equal(t, uint64(21), persistedSegment.Size())
+	assert.Equal(t, uint64(33), persistedSegment.Size())
+
+	r, err := persistedSegment.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+
+	r, err = persistedSegment.Lookup(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+
+	r, err = persistedSegment.Lookup(22)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("car"), r.Value)
+
+	r, err = persistedSegment.Lookup(33)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSegment_LookupCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+	_, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	// Flip a bit in the payload of the second record.
+	path := dir + "/0.data"
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[SegmentHeaderSize+11+PrefixSize] ^= 0x01
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+
+	loadedSegment, err := LoadFileSegment(dir, 0, zap.NewNop())
+	assert.Nil(t, err)
+	// The corrupt record should be retained but not returned.
+	assert.Equal(t, uint64(22), loadedSegment.Size())
+
+	r, err := loadedSegment.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), r.Value)
+
+	_, err = loadedSegment.Lookup(11)
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func TestSegment_LoadTruncatesPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+	_, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	// Remove the last byte of the second record as if the write was torn.
+	path := dir + "/0.data"
+	assert.Nil(t, os.Truncate(path, SegmentHeaderSize+21))
 
-	b, err := persistedSegment.Lookup(0)
+	loadedSegment, err := LoadFileSegment(dir, 0, zap.NewNop())
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("foo"), b)
+	assert.Equal(t, uint64(11), loadedSegment.Size())
 
-	b, err = persistedSegment.Lookup(7)
+	info, err := os.Stat(path)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("bar"), b)
+	assert.Equal(t, int64(SegmentHeaderSize+11), info.Size())
 
-	b, err = persistedSegment.Lookup(14)
+	r, err := loadedSegment.Lookup(0)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("car"), b)
+	assert.Equal(t, []byte("foo"), r.Value)
 
-	b, err = persistedSegment.Lookup(21)
+	_, err = loadedSegment.Lookup(11)
 	assert.Equal(t, ErrNotFound, err)
 }
 
-func benchmarkSegmentPersist(appends int, messageLen int) {
-	dir := "data/" + uuid.New().String()
-	defer os.RemoveAll(dir)
+func TestSegment_LoadInvalidHeader(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	// Write a header with the magic number but an unsupported version.
+	header := binary.BigEndian.AppendUint32(nil, segmentMagic)
+	header = append(header, 0x00, 0x00, 0xff, 0xff)
+	assert.Nil(t, os.WriteFile(dir+"/0.data", header, 0644))
+
+	_, err := LoadFileSegment(dir, 0, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func benchmarkSegmentPersist(b *testing.B, appends int, messageLen int) {
+	dir := b.TempDir()
 
 	message := make([]byte, messageLen)
 	rand.Read(message)
 
 	segment := NewInMemorySegment(1<<22, 0)
 	for i := 0; i != appends; i++ {
-		segment.Append(message)
+		segment.Append(nil, message)
 	}
 
-	if _, err := segment.Persist(dir); err != nil {
+	if _, err := segment.Persist(dir, CompressionNone); err != nil {
 		panic(err)
 	}
 }
 
 func BenchmarkSegment_Persist_Append1000_M1000(b *testing.B) {
 	for n := 0; n < b.N; n++ {
-		benchmarkSegmentPersist(1000, 1000)
+		benchmarkSegmentPersist(b, 1000, 1000)
+	}
+}
+
+func TestSegment_ValidateOffset(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+
+	persistedSegment, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	for _, s := range []Segment{segment, persistedSegment} {
+		assert.Nil(t, s.ValidateOffset(0))
+		assert.Nil(t, s.ValidateOffset(11))
+		// The end of the segment is valid.
+		assert.Nil(t, s.ValidateOffset(22))
+
+		assert.Equal(t, ErrInvalidOffset, s.ValidateOffset(5))
+		assert.Equal(t, ErrInvalidOffset, s.ValidateOffset(12))
+		assert.Equal(t, ErrInvalidOffset, s.ValidateOffset(23))
+	}
+}
+
+func TestSegment_LoadRebuildsMissingIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append(nil, []byte("foo")))
+	assert.Nil(t, segment.Append(nil, make([]byte, indexIntervalBytes)))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+	_, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.Remove(dir+"/0.index"))
+
+	loaded, err := LoadFileSegment(dir, 0, zap.NewNop())
+	assert.Nil(t, err)
+
+	fileSegment := loaded.(*FileSegment)
+	assert.Equal(t, []indexEntry{
+		{Offset: 0, Position: 0, Timestamp: fileSegment.ModTime().UnixMilli()},
+		{Offset: 11 + indexIntervalBytes + PrefixSize, Position: 11 + indexIntervalBytes + PrefixSize, Timestamp: fileSegment.ModTime().UnixMilli()},
+	}, fileSegment.index.entries)
+
+	assert.Nil(t, loaded.ValidateOffset(11))
+	assert.Equal(t, ErrInvalidOffset, loaded.ValidateOffset(12))
+}
+
+func TestSegment_LookupLastN(t *testing.T) {
+	dir := t.TempDir()
+
+	// Add enough records so the segment has multiple index entries.
+	segment := NewInMemorySegment(1<<16, 0)
+	for i := 0; i != 100; i++ {
+		assert.Nil(t, segment.Append(nil, make([]byte, 100)))
 	}
+
+	persistedSegment, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	for _, s := range []Segment{segment, persistedSegment} {
+		offset, count, err := s.LookupLastN(1)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(99*108), offset)
+		assert.Equal(t, uint64(1), count)
+
+		offset, count, err = s.LookupLastN(60)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(40*108), offset)
+		assert.Equal(t, uint64(60), count)
+
+		offset, count, err = s.LookupLastN(200)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(0), offset)
+		assert.Equal(t, uint64(100), count)
+	}
+}
+
+func TestSegment_AppendThenLookupWithKey(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append([]byte("a"), []byte("foo")))
+	assert.Nil(t, segment.Append(nil, []byte("bar")))
+
+	persistedSegment, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+
+	for _, s := range []Segment{segment, persistedSegment} {
+		// The keyed record includes the 4 byte key size and 1 byte key.
+		r, err := s.Lookup(0)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("a"), r.Key)
+		assert.Equal(t, []byte("foo"), r.Value)
+		assert.Equal(t, uint64(16), r.NextOffset)
+
+		r, err = s.Lookup(16)
+		assert.Nil(t, err)
+		assert.Nil(t, r.Key)
+		assert.Equal(t, []byte("bar"), r.Value)
+		assert.Equal(t, uint64(27), r.NextOffset)
+	}
+}
+
+func TestSegment_Compact(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append([]byte("a"), []byte("foo")))
+	assert.Nil(t, segment.Append([]byte("b"), []byte("bar")))
+	assert.Nil(t, segment.Append([]byte("a"), []byte("car")))
+
+	persisted, err := segment.Persist(dir, CompressionNone)
+	assert.Nil(t, err)
+	fileSegment := persisted.(*FileSegment)
+
+	compacted, removed, err := fileSegment.Compact(dir, func(r Record) bool {
+		return string(r.Value) != "foo"
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.True(t, compacted.Compacted())
+	// The compacted segment keeps the size of the original segment so
+	// offsets are unchanged.
+	assert.Equal(t, uint64(48), compacted.Size())
+
+	// Looking up a removed record returns the next retained record.
+	r, err := compacted.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(16), r.Offset)
+	assert.Equal(t, []byte("bar"), r.Value)
+
+	r, err = compacted.Lookup(r.NextOffset)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(32), r.Offset)
+	assert.Equal(t, []byte("car"), r.Value)
+
+	_, err = compacted.Lookup(r.NextOffset)
+	assert.Equal(t, ErrNotFound, err)
+
+	// Compacting again with nothing to remove leaves the segment unchanged.
+	unchanged, removed, err := compacted.Compact(dir, func(r Record) bool {
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+	assert.Nil(t, unchanged)
+
+	// Reloading the segment should keep the compacted records.
+	assert.Nil(t, compacted.Close())
+	loaded, err := LoadFileSegment(dir, 0, zap.NewNop())
+	assert.Nil(t, err)
+	assert.True(t, loaded.(*FileSegment).Compacted())
+	assert.Equal(t, uint64(48), loaded.Size())
+
+	r, err = loaded.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), r.Value)
+
+	offset, n, err := loaded.LookupLastN(5)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(16), offset)
+	assert.Equal(t, uint64(2), n)
+}
+
+func TestSegment_PersistCompressed(t *testing.T) {
+	for _, compression := range []Compression{CompressionSnappy, CompressionZstd} {
+		t.Run(compression.String(), func(t *testing.T) {
+			dir := t.TempDir()
+
+			// Use records larger than the block size so records span
+			// multiple blocks.
+			values := [][]byte{}
+			segment := NewInMemorySegment(1<<20, 0)
+			for i := 0; i != 5; i++ {
+				value := []byte(strings.Repeat(fmt.Sprintf(`{"id": %d}`, i), 3000))
+				values = append(values, value)
+				assert.Nil(t, segment.Append(nil, value))
+			}
+			size := segment.Size()
+
+			persistedSegment, err := segment.Persist(dir, compression)
+			assert.Nil(t, err)
+
+			// The segment file should be compressed.
+			info, err := os.Stat(dir + "/0.data")
+			assert.Nil(t, err)
+			assert.Less(t, uint64(info.Size()), size/2)
+
+			loadedSegment, err := LoadFileSegment(dir, 0, zap.NewNop())
+			assert.Nil(t, err)
+
+			for _, s := range []Segment{persistedSegment, loadedSegment} {
+				assert.Equal(t, size, s.Size())
+
+				offset := uint64(0)
+				for _, value := range values {
+					assert.Nil(t, s.ValidateOffset(offset))
+
+					r, err := s.Lookup(offset)
+					assert.Nil(t, err)
+					assert.Equal(t, value, r.Value)
+					offset = r.NextOffset
+				}
+				_, err = s.Lookup(offset)
+				assert.Equal(t, ErrNotFound, err)
+
+				offset, n, err := s.LookupLastN(2)
+				assert.Nil(t, err)
+				assert.Equal(t, uint64(2), n)
+				r, err := s.Lookup(offset)
+				assert.Nil(t, err)
+				assert.Equal(t, values[3], r.Value)
+			}
+		})
+	}
+}
+
+func TestSegment_LoadCorruptCompressedBlock(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1<<20, 0)
+	value := []byte(strings.Repeat("foo", 10000))
+	for i := 0; i != 10; i++ {
+		assert.Nil(t, segment.Append(nil, value))
+	}
+	persistedSegment, err := segment.Persist(dir, CompressionSnappy)
+	assert.Nil(t, err)
+	blocks := persistedSegment.(*FileSegment).blocks
+	assert.Greater(t, len(blocks), 2)
+
+	// Flip a bit in the second block.
+	path := dir + "/0.data"
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[blocks[1].FilePosition+blockHeaderSize] ^= 0x01
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+
+	// Records following the corrupt block can't be read so are truncated.
+	loadedSegment, err := LoadFileSegment(dir, 0, zap.NewNop())
+	assert.Nil(t, err)
+	assert.Less(t, loadedSegment.Size(), blocks[1].Position)
+
+	r, err := loadedSegment.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, value, r.Value)
+}
+
+func TestSegment_CompactCompressed(t *testing.T) {
+	dir := t.TempDir()
+
+	segment := NewInMemorySegment(1024, 0)
+	assert.Nil(t, segment.Append([]byte("a"), []byte("foo")))
+	assert.Nil(t, segment.Append([]byte("a"), []byte("bar")))
+
+	persisted, err := segment.Persist(dir, CompressionZstd)
+	assert.Nil(t, err)
+
+	compacted, removed, err := persisted.(*FileSegment).Compact(dir, func(r Record) bool {
+		return string(r.Value) == "bar"
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Nil(t, compacted.Close())
+
+	// The compacted segment should keep the segments compression.
+	loaded, err := LoadFileSegment(dir, 0, zap.NewNop())
+	assert.Nil(t, err)
+	assert.True(t, loaded.(*FileSegment).Compacted())
+	assert.Equal(t, CompressionZstd, loaded.(*FileSegment).compression)
+
+	r, err := loaded.Lookup(0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(16), r.Offset)
+	assert.Equal(t, []byte("bar"), r.Value)
 }
@@ -39,6 +39,32 @@ func (s *Segments) Get(offset uint64) Segment {
 	return nil
 }
 
+// Next returns the first segment starting after the given offset, or nil if
+// there are no later segments.
+func (s *Segments) Next(offset uint64) Segment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i, off := range s.offsets {
+		if off > offset {
+			return s.segments[i]
+		}
+	}
+	return nil
+}
+
+// First returns the segment with the smallest offset, or nil if there are no
+// segments.
+func (s *Segments) First() Segment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[0]
+}
+
 func (s *Segments) Last() Segment {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -57,6 +83,30 @@ func (s *Segments) Add(offset uint64, segment Segment) {
 	s.segments = append(s.segments, segment)
 }
 
+// All returns a copy of the segments ordered by offset.
+func (s *Segments) All() []Segment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	segments := make([]Segment, len(s.segments))
+	copy(segments, s.segments)
+	return segments
+}
+
+// Remove removes the segment with the given offset.
+func (s *Segments) Remove(offset uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, off := range s.offsets {
+		if off == offset {
+			s.offsets = append(s.offsets[:i], s.offsets[i+1:]...)
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			return
+		}
+	}
+}
+
 func (s *Segments) Swap(newSegment Segment) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,90 @@
+package commitlog
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Storage is a backend for storing persisted segments outside of the servers
+// local disk, such as an object store. Objects are identified by a name, which
+// may contain '/' separators.
+type Storage interface {
+	// Put uploads the file at the given local path as the object with the
+	// given name, replacing any existing object.
+	Put(name string, path string) error
+	// Get downloads the object with the given name to the given local path.
+	// Returns ErrNotFound if the object doesn't exist.
+	Get(name string, path string) error
+	// Delete removes the object with the given name. Deleting an object that
+	// doesn't exist is not an error.
+	Delete(name string) error
+}
+
+// LocalStorage is a Storage backend that stores objects as files in a local
+// directory. This is mostly a stand-in for an object store such as S3, though
+// could be used with a directory on a cheaper disk or network file system.
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{
+		dir: dir,
+	}
+}
+
+func (s *LocalStorage) Put(name string, path string) error {
+	return copyFile(path, filepath.Join(s.dir, name))
+}
+
+func (s *LocalStorage) Get(name string, path string) error {
+	err := copyFile(filepath.Join(s.dir, name), path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// copyFile copies the file at src to dst. The file is written to a temporary
+// file and synced before being renamed, so dst is never partially written.
+func copyFile(src string, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmpPath := dst + ".tmp"
+	dstFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dstFile.Sync(); err != nil {
+		dstFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dstFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, dst)
+}
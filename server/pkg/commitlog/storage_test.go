@@ -0,0 +1,48 @@
+package commitlog
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalStorage_PutThenGet(t *testing.T) {
+	dir := t.TempDir()
+
+	src := dir + "/src"
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	assert.Nil(t, os.WriteFile(src, []byte("foo"), 0644))
+
+	storage := NewLocalStorage(dir + "/storage")
+	assert.Nil(t, storage.Put("topic/0.data", src))
+
+	dst := dir + "/dst"
+	assert.Nil(t, storage.Get("topic/0.data", dst))
+	b, err := os.ReadFile(dst)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), b)
+}
+
+func TestLocalStorage_GetNotFound(t *testing.T) {
+	dir := t.TempDir()
+
+	storage := NewLocalStorage(dir)
+	assert.Equal(t, ErrNotFound, storage.Get("topic/0.data", dir+"/dst"))
+}
+
+func TestLocalStorage_Delete(t *testing.T) {
+	dir := t.TempDir()
+
+	src := dir + "/src"
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	assert.Nil(t, os.WriteFile(src, []byte("foo"), 0644))
+
+	storage := NewLocalStorage(dir + "/storage")
+	assert.Nil(t, storage.Put("topic/0.data", src))
+	assert.Nil(t, storage.Delete("topic/0.data"))
+	assert.Equal(t, ErrNotFound, storage.Get("topic/0.data", dir+"/dst"))
+
+	// Deleting a missing object is not an error.
+	assert.Nil(t, storage.Delete("topic/0.data"))
+}
@@ -0,0 +1,164 @@
+package commitlog
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed = errors.New("closed")
+)
+
+type syncWaiter struct {
+	offset uint64
+	cb     func(err error)
+}
+
+// syncer syncs the commit log to disk according to the durability policy, and
+// notifies waiters once the entries they are waiting for are durable.
+//
+// Syncs are batched (group commit), so all entries appended while a sync is in
+// progress are covered by the following sync, rather than syncing once per
+// entry. When using DurabilityInterval the syncer also waits for the interval
+// before syncing, to batch all entries appended in that interval.
+type syncer struct {
+	durability Durability
+	interval   time.Duration
+	// sync syncs all entries after the given offset to disk, and returns the
+	// offset entries have been synced up to.
+	sync func(from uint64) (uint64, error)
+
+	// mu is a mutex protecting the below fields.
+	mu *sync.Mutex
+	// cv is a condition variable to wake the sync loop when there are
+	// waiters.
+	cv      *sync.Cond
+	synced  uint64
+	waiters []syncWaiter
+	closed  bool
+
+	// done is closed to interrupt waiting for the sync interval.
+	done chan interface{}
+	wg   sync.WaitGroup
+}
+
+func newSyncer(durability Durability, interval time.Duration, synced uint64, syncFn func(from uint64) (uint64, error)) *syncer {
+	mu := &sync.Mutex{}
+	s := &syncer{
+		durability: durability,
+		interval:   interval,
+		sync:       syncFn,
+		mu:         mu,
+		cv:         sync.NewCond(mu),
+		synced:     synced,
+		waiters:    []syncWaiter{},
+		closed:     false,
+		done:       make(chan interface{}),
+		wg:         sync.WaitGroup{},
+	}
+	s.wg.Add(1)
+	go s.syncLoop()
+	return s
+}
+
+// Wait calls cb once all entries up to the given offset are synced to disk.
+// If the sync fails cb is called with the error.
+func (s *syncer) Wait(offset uint64, cb func(err error)) {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		cb(ErrClosed)
+		return
+	}
+	if offset <= s.synced {
+		s.mu.Unlock()
+		cb(nil)
+		return
+	}
+
+	s.waiters = append(s.waiters, syncWaiter{
+		offset: offset,
+		cb:     cb,
+	})
+	s.cv.Signal()
+	s.mu.Unlock()
+}
+
+// Close stops the sync loop, after syncing any remaining entries.
+func (s *syncer) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cv.Signal()
+	s.mu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+}
+
+func (s *syncer) syncLoop() {
+	defer s.wg.Done()
+
+	for {
+		s.mu.Lock()
+		for len(s.waiters) == 0 && !s.closed {
+			s.cv.Wait()
+		}
+		closed := s.closed
+		synced := s.synced
+		s.mu.Unlock()
+
+		if s.durability == DurabilityInterval && !closed {
+			// Wait for the interval before syncing so all entries appended
+			// during the interval are batched.
+			select {
+			case <-time.After(s.interval):
+			case <-s.done:
+				closed = true
+			}
+		}
+
+		offset, err := s.sync(synced)
+		s.onSynced(offset, err)
+
+		if closed {
+			// Notify any remaining waiters we are closed.
+			s.onSynced(offset, ErrClosed)
+			return
+		}
+	}
+}
+
+// onSynced notifies the waiters that are now synced. If the sync failed all
+// waiters are notified with the error.
+func (s *syncer) onSynced(offset uint64, err error) {
+	s.mu.Lock()
+
+	var notify []syncWaiter
+	if err != nil {
+		notify = s.waiters
+		s.waiters = []syncWaiter{}
+	} else {
+		if offset > s.synced {
+			s.synced = offset
+		}
+
+		waiters := []syncWaiter{}
+		for _, w := range s.waiters {
+			if w.offset <= s.synced {
+				notify = append(notify, w)
+			} else {
+				waiters = append(waiters, w)
+			}
+		}
+		s.waiters = waiters
+	}
+
+	s.mu.Unlock()
+
+	// Call the callbacks without holding the mutex so they can call Wait.
+	for _, w := range notify {
+		w.cb(err)
+	}
+}
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"strings"
+	"time"
+
 	flags "github.com/jessevdk/go-flags"
 	"go.uber.org/zap/zapcore"
 )
@@ -10,19 +13,59 @@ type Config struct {
 
 	AdminAddr string `long:"admin-addr" description:"Listen address for admin endpoints" default:"127.0.0.1:8229"`
 
+	NodeID string `long:"node-id" description:"Unique ID of the node sent to clients when they connect, or empty to generate a random ID"`
+
+	MessagingMaxPayloadSize int `long:"messaging.max-payload-size" description:"The maximum payload size in bytes of a message from a client, after which the client is sent an error and disconnected, or 0 for unlimited (default 16MB)" default:"16777216"`
+
+	MessagingSendQueueLimit       int    `long:"messaging.send-queue-limit" description:"The maximum number of bytes of messages queued to send to a client, after which the slow subscriber policy is applied, or 0 for unlimited (default 64MB)" default:"67108864"`
+	MessagingSlowSubscriberPolicy string `long:"messaging.slow-subscriber-policy" description:"How to handle a client that exceeds the send queue limit, either 'disconnect' (close the connection) or 'demote' (resume the subscription from the commit log as the client catches up)" choice:"disconnect" choice:"demote" default:"demote"`
+
 	CommitLogInMemory    bool   `long:"commitlog.inmemory" description:"Whether the commit log should be in-memory only"`
 	CommitLogDir         string `long:"commitlog.dir" description:"The directory to store the commit log segments if persisted" default:"./data"`
 	CommitLogSegmentSize uint64 `long:"commitlog.segment-size" description:"The size of the commit log segments to use (default 128MB)" default:"134217728"`
 
+	CommitLogMemoryBudget uint64 `long:"commitlog.memory-budget" description:"The maximum memory in bytes used by in-memory commit log segments across all topics, after which segments are persisted early (or with --commitlog.inmemory the oldest segments are dropped), or 0 for unlimited (default 1GB)" default:"1073741824"`
+
+	CommitLogDurability   string        `long:"commitlog.durability" description:"When published messages are synced to disk before being acknowledged, either 'none' (never synced), 'interval' (synced every sync interval) or 'always' (synced immediately)" choice:"none" choice:"interval" choice:"always" default:"none"`
+	CommitLogSyncInterval time.Duration `long:"commitlog.sync-interval" description:"The interval between syncing messages to disk when using 'interval' durability" default:"100ms"`
+
+	CommitLogCompression string `long:"commitlog.compression" description:"The codec used to compress commit log segments when they are persisted, either 'none', 'snappy' or 'zstd'" choice:"none" choice:"snappy" choice:"zstd" default:"none"`
+
+	CommitLogRetentionAge  time.Duration `long:"commitlog.retention-age" description:"The maximum age of persisted commit log segments before they are deleted, or 0 to retain forever" default:"0"`
+	CommitLogRetentionSize uint64        `long:"commitlog.retention-size" description:"The maximum size in bytes of each topics commit log before the oldest segments are deleted, or 0 for unlimited" default:"0"`
+
+	CommitLogCompactedTopics []string `long:"commitlog.compacted-topic" description:"A topic whose persisted commit log is compacted to retain only the latest message with each key (can be repeated)"`
+
+	CommitLogTieredStorageDir string        `long:"commitlog.tiered-storage-dir" description:"The directory to offload old persisted commit log segments to, or empty to keep all segments on local disk"`
+	CommitLogTieredStorageAge time.Duration `long:"commitlog.tiered-storage-age" description:"The age of persisted commit log segments before they are offloaded to tiered storage" default:"1h"`
+
+	TopicIdleTimeout    time.Duration `long:"topic.idle-timeout" description:"The duration a persisted topic with no subscribers or publishes is kept in memory before being evicted, or 0 to never evict" default:"1h"`
+	TopicProducerExpiry time.Duration `long:"topic.producer-expiry" description:"The duration an idempotent producer must not publish to a topic before its publishes are no longer tracked, or 0 to never expire" default:"1h"`
+
 	Verbose bool `short:"v" long:"verbose" description:"Show verbose debug information"`
 }
 
 func (c Config) MarshalLogObject(e zapcore.ObjectEncoder) error {
 	e.AddString("addr", c.Addr)
+	e.AddString("node-id", c.NodeID)
+	e.AddInt("messaging.max-payload-size", c.MessagingMaxPayloadSize)
+	e.AddInt("messaging.send-queue-limit", c.MessagingSendQueueLimit)
+	e.AddString("messaging.slow-subscriber-policy", c.MessagingSlowSubscriberPolicy)
 
 	e.AddBool("commitlog.inmemory", c.CommitLogInMemory)
 	e.AddString("commitlog.dir", c.CommitLogDir)
 	e.AddUint64("commitlog.segment-size", c.CommitLogSegmentSize)
+	e.AddUint64("commitlog.memory-budget", c.CommitLogMemoryBudget)
+	e.AddString("commitlog.durability", c.CommitLogDurability)
+	e.AddDuration("commitlog.sync-interval", c.CommitLogSyncInterval)
+	e.AddString("commitlog.compression", c.CommitLogCompression)
+	e.AddDuration("commitlog.retention-age", c.CommitLogRetentionAge)
+	e.AddUint64("commitlog.retention-size", c.CommitLogRetentionSize)
+	e.AddString("commitlog.compacted-topics", strings.Join(c.CommitLogCompactedTopics, ","))
+	e.AddString("commitlog.tiered-storage-dir", c.CommitLogTieredStorageDir)
+	e.AddDuration("commitlog.tiered-storage-age", c.CommitLogTieredStorageAge)
+	e.AddDuration("topic.idle-timeout", c.TopicIdleTimeout)
+	e.AddDuration("topic.producer-expiry", c.TopicProducerExpiry)
 
 	e.AddBool("verbose", c.Verbose)
 	return nil
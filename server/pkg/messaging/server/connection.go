@@ -1,13 +1,30 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/andydunstall/figg/server/pkg/commitlog"
 	"github.com/andydunstall/figg/server/pkg/topic"
 	"github.com/andydunstall/figg/utils"
 	"go.uber.org/zap"
 )
 
+var (
+	// ErrUnexpectedMessage is returned when the client sends CONNECT once
+	// already connected.
+	ErrUnexpectedMessage = errors.New("unexpected message")
+)
+
 const (
 	readBufferLen = 1 << 15 // 32 KB
+
+	// closeDrainTimeout is the maximum time to wait for queued messages to
+	// be sent when closing the connection.
+	closeDrainTimeout = time.Second
 )
 
 // Connection represents an application level connection to the client.
@@ -20,6 +37,31 @@ type Connection struct {
 
 	broker        *topic.Broker
 	subscriptions *topic.Subscriptions
+	// acks contains publishes waiting to be durable before they are
+	// acknowledged. Created once connected since the ACKs sent depend on the
+	// agreed features.
+	acks *pendingACKs
+	// maxPayloadLen is the maximum payload size of a message from the
+	// client, or 0 if unlimited.
+	maxPayloadLen int
+	// nodeID identifies the node to the client.
+	nodeID string
+	// slowSubscriberPolicy is how to handle the client not reading fast
+	// enough, so its send queue is full.
+	slowSubscriberPolicy SlowSubscriberPolicy
+	// slowDisconnected is set once the connection is being closed due to
+	// the client not reading fast enough, so its only logged once.
+	slowDisconnected int32
+
+	// connected is true once the client has sent CONNECT, or sent another
+	// message first as clients from before CONNECT was added do.
+	connected bool
+	// features are the optional protocol features agreed with the client
+	// when connecting.
+	features utils.Features
+	// producerID identifies the client when publishing idempotently, or is
+	// empty if the client doesn't support idempotent publishing.
+	producerID string
 
 	logger *zap.Logger
 }
@@ -27,108 +69,580 @@ type Connection struct {
 func NewConnection(
 	conn utils.NetworkConnection,
 	broker *topic.Broker,
+	nodeID string,
+	maxPayloadLen int,
+	sendQueueLimit int,
+	slowSubscriberPolicy SlowSubscriberPolicy,
 	logger *zap.Logger,
 ) *Connection {
 	c := &Connection{
-		conn:   conn,
-		reader: utils.NewBufferedReader(conn, readBufferLen),
-		writer: utils.NewBufferedWriter(conn),
-		broker: broker,
-		logger: logger,
+		conn:                 conn,
+		reader:               utils.NewBufferedReader(conn, readBufferLen, maxPayloadLen),
+		writer:               utils.NewBufferedWriter(conn, sendQueueLimit),
+		broker:               broker,
+		maxPayloadLen:        maxPayloadLen,
+		nodeID:               nodeID,
+		slowSubscriberPolicy: slowSubscriberPolicy,
+		connected:            false,
+		features:             0,
+		logger:               logger,
 	}
 	c.subscriptions = topic.NewSubscriptions(broker, NewConnectionAttachment(c))
 	return c
 }
 
 // Recv reads from the network connection and handles the request.
+//
+// If the request is malformed or exceeds the maximum payload size, sends an
+// ERROR to the client and returns an error, which will close the connection.
 func (c *Connection) Recv() error {
 	messageType, payload, err := c.reader.Read()
+	if err == utils.ErrPayloadTooLarge {
+		c.logger.Warn("payload too large", zap.Int("max-payload-len", c.maxPayloadLen))
+		c.writer.Write(utils.EncodeErrorMessage(
+			utils.ErrorCodePayloadTooLarge,
+			fmt.Sprintf("payload exceeds %d bytes", c.maxPayloadLen),
+		))
+		return err
+	}
+	if err == utils.ErrUnsupportedVersion {
+		c.logger.Warn("unsupported protocol version")
+		c.writer.Write(utils.EncodeErrorMessage(
+			utils.ErrorCodeUnsupportedVersion,
+			fmt.Sprintf(
+				"server supports protocol versions %d-%d",
+				utils.MinProtocolVersion, utils.ProtocolVersion,
+			),
+		))
+		return err
+	}
 	if err != nil {
 		return err
 	}
 
-	c.onMessage(messageType, payload)
-	return nil
+	return c.onMessage(messageType, payload)
 }
 
-func (c *Connection) SendDataMessage(m topic.Message) {
+// SendDataMessage queues a DATA message to send to the client.
+//
+// If ctx is nil, such as sending to a live subscriber, the message must not
+// block, so if the send queue is full the slow subscriber policy is applied.
+// Otherwise waits for space in the send queue until ctx is done.
+func (c *Connection) SendDataMessage(ctx context.Context, m topic.Message) error {
+	// Use the shared prefix if the topic has already encoded it. Note the
+	// prefix is shared with other subscribers so must not be modified.
+	prefix := m.Prefix
+	if prefix == nil {
+		prefix = utils.EncodeDataMessagePrefix(m.Topic, m.Offset, m.Message)
+	}
 	// Avoid copying m.Message into another buffer, so send the prefix
 	// separately.
-	c.writer.Write(
-		utils.EncodeDataMessagePrefix(m.Topic, m.Offset, m.Message),
-		m.Message,
+	if ctx != nil {
+		return c.writer.WriteWait(ctx, prefix, m.Message)
+	}
+	if err := c.writer.TryWrite(prefix, m.Message); err != utils.ErrQueueFull {
+		return err
+	}
+	return c.onSlowSubscriber(m)
+}
+
+// onSlowSubscriber handles the client not reading messages fast enough, so
+// the send queue is full when sending m. Note this is called with the topic
+// mutex held so must not block.
+func (c *Connection) onSlowSubscriber(m topic.Message) error {
+	if c.slowSubscriberPolicy == SlowSubscriberDemote {
+		c.logger.Warn(
+			"slow subscriber; demoting subscription",
+			zap.String("topic", m.Topic),
+			zap.Uint64("offset", m.Offset),
+		)
+		slowSubscriberDemotions.Add(1)
+		return topic.ErrSlowSubscriber
+	}
+
+	// Once closing drop any further messages.
+	if !atomic.CompareAndSwapInt32(&c.slowDisconnected, 0, 1) {
+		return utils.ErrQueueFull
+	}
+	c.logger.Warn(
+		"slow subscriber; closing connection",
+		zap.String("topic", m.Topic),
+		zap.Uint64("offset", m.Offset),
 	)
+	slowSubscriberDisconnects.Add(1)
+	// Tell the client why it is being disconnected. Write ignores the queue
+	// limit so the ERROR is queued behind the messages already queued.
+	c.writer.Write(utils.EncodeErrorMessage(
+		utils.ErrorCodeSlowSubscriber,
+		"client not reading messages fast enough",
+	))
+	// Close in the background since Close unsubscribes from topics, which
+	// would deadlock with the topic mutex held. Only the writer and network
+	// connection are closed, so Recv then fails and the server closes the
+	// connection.
+	go func() {
+		c.writer.Close()
+		// Give the client a chance to read the ERROR, though it may never
+		// read it if it has stopped reading altogether.
+		c.writer.Drain(closeDrainTimeout)
+		c.conn.Close()
+	}()
+	return utils.ErrQueueFull
 }
 
 func (c *Connection) Close() error {
 	c.writer.Close()
 	c.subscriptions.UnsubscribeAll()
+	// Wait for any queued messages to be sent, such as an ERROR describing
+	// why the connection is being closed.
+	c.writer.Drain(closeDrainTimeout)
 	return c.conn.Close()
 }
 
-func (c *Connection) onMessage(messageType utils.MessageType, b []byte) {
-	offset := 0
+func (c *Connection) onMessage(messageType utils.MessageType, b []byte) error {
+	// Clients from before CONNECT was added send other messages first, so
+	// are treated as connected with version 1 and no features.
+	if !c.connected && messageType != utils.TypeConnect {
+		c.connectLegacy()
+	}
+	// The client must only send CONNECT once, before any other message.
+	if c.connected && messageType == utils.TypeConnect {
+		return c.onUnexpectedMessage(messageType)
+	}
+
 	switch messageType {
+	case utils.TypeConnect:
+		m, err := utils.DecodeConnectMessage(b)
+		if err != nil {
+			return c.onDecodeError(messageType, err)
+		}
+
+		c.logger.Debug(
+			"on message",
+			zap.String("message-type", messageType.String()),
+			zap.String("client-id", m.ClientID),
+			zap.Uint16("min-version", m.MinVersion),
+			zap.Uint16("max-version", m.MaxVersion),
+			zap.String("features", m.Features.String()),
+		)
+
+		return c.onConnect(m)
 	case utils.TypeAttach:
-		flags, offset := utils.DecodeUint16(b, offset)
-		topicLen, offset := utils.DecodeUint32(b, offset)
-		topicName := string(b[offset : offset+int(topicLen)])
-		offset += int(topicLen)
-		topicOffset, offset := utils.DecodeUint64(b, offset)
+		m, err := utils.DecodeAttachMessage(b)
+		if err != nil {
+			return c.onDecodeError(messageType, err)
+		}
 
 		c.logger.Debug(
 			"on message",
 			zap.String("message-type", messageType.String()),
-			zap.String("topic", topicName),
-			zap.Uint64("offset", topicOffset),
-			zap.Uint16("flags", flags),
+			zap.String("topic", m.Topic),
+			zap.Uint64("offset", m.Offset),
+			zap.Uint64("timestamp", m.Timestamp),
+			zap.Uint64("last-n", m.LastN),
+			zap.Uint16("flags", m.Flags),
 		)
 
-		if flags&utils.FlagUseOffset > 0 {
-			c.onAttachFromOffset(topicName, topicOffset)
-		} else {
-			c.onAttach(topicName)
+		if m.Flags&utils.FlagUseOffset > 0 {
+			return c.onAttachFromOffset(m.Topic, m.Offset)
+		} else if m.Flags&utils.FlagUseTimestamp > 0 {
+			return c.onAttachFromTime(m.Topic, time.UnixMilli(int64(m.Timestamp)))
+		} else if m.Flags&utils.FlagUseLastN > 0 {
+			return c.onAttachLastN(m.Topic, m.LastN)
+		}
+		return c.onAttach(m.Topic)
+	case utils.TypeDetach:
+		m, err := utils.DecodeDetachMessage(b)
+		if err != nil {
+			return c.onDecodeError(messageType, err)
 		}
+
+		c.logger.Debug(
+			"on message",
+			zap.String("message-type", messageType.String()),
+			zap.String("topic", m.Topic),
+		)
+
+		c.onDetach(m.Topic)
 	case utils.TypePublish:
-		topicLen, offset := utils.DecodeUint32(b, offset)
-		topicName := string(b[offset : offset+int(topicLen)])
-		offset += int(topicLen)
-		seqNum, offset := utils.DecodeUint64(b, offset)
-		dataLen, offset := utils.DecodeUint32(b, offset)
-		data := b[offset : offset+int(dataLen)]
-		offset += int(dataLen)
+		m, err := utils.DecodePublishMessage(b)
+		if err != nil {
+			return c.onDecodeError(messageType, err)
+		}
 
 		c.logger.Debug(
 			"on message",
 			zap.String("message-type", messageType.String()),
-			zap.String("topic", topicName),
-			zap.Uint64("seq-num", seqNum),
-			zap.Int("data-len", len(data)),
+			zap.String("topic", m.Topic),
+			zap.Uint64("seq-num", m.SeqNum),
+			zap.Int("key-len", len(m.Key)),
+			zap.Int("data-len", len(m.Data)),
 		)
 
-		topic := c.broker.GetTopic(topicName)
-		topic.Publish(data)
+		return c.onPublish(m.Topic, m.SeqNum, m.Key, m.Data)
+	case utils.TypePublishBatch:
+		m, err := utils.DecodePublishBatchMessage(b)
+		if err != nil {
+			return c.onDecodeError(messageType, err)
+		}
 
-		c.writer.Write(utils.EncodeACKMessage(seqNum))
+		c.logger.Debug(
+			"on message",
+			zap.String("message-type", messageType.String()),
+			zap.String("topic", m.Topic),
+			zap.Uint64("seq-num", m.SeqNum),
+			zap.Int("messages", len(m.Messages)),
+		)
+
+		return c.onPublishBatch(m.Topic, m.SeqNum, m.Messages)
 	case utils.TypePing:
-		timestamp, _ := utils.DecodeUint64(b, offset)
+		m, err := utils.DecodePingMessage(b)
+		if err != nil {
+			return c.onDecodeError(messageType, err)
+		}
 
 		c.logger.Debug(
 			"on message",
 			zap.String("message-type", messageType.String()),
-			zap.Uint64("timestamp", timestamp),
+			zap.Uint64("timestamp", m.Timestamp),
 		)
 
-		c.writer.Write(utils.EncodePongMessage(timestamp))
+		c.writer.Write(utils.EncodePongMessage(m.Timestamp))
 	}
+	return nil
 }
 
-func (c *Connection) onAttach(name string) {
-	offset := c.subscriptions.AddSubscription(name)
-	c.writer.Write(utils.EncodeAttachedMessage(name, offset))
+// onConnect agrees the protocol version and features with the client and
+// responds with CONNECTED. Uses the latest version supported by both the
+// client and server. If there is no common version, sends an ERROR and
+// returns an error, which will close the connection.
+func (c *Connection) onConnect(m utils.ConnectMessage) error {
+	version := utils.ProtocolVersion
+	if m.MaxVersion < version {
+		version = m.MaxVersion
+	}
+	if version < m.MinVersion || version < utils.MinProtocolVersion {
+		c.logger.Warn(
+			"unsupported protocol version",
+			zap.String("client-id", m.ClientID),
+			zap.Uint16("min-version", m.MinVersion),
+			zap.Uint16("max-version", m.MaxVersion),
+		)
+		c.writer.Write(utils.EncodeErrorMessage(
+			utils.ErrorCodeUnsupportedVersion,
+			fmt.Sprintf(
+				"client supports protocol versions %d-%d, server supports %d-%d",
+				m.MinVersion, m.MaxVersion,
+				utils.MinProtocolVersion, utils.ProtocolVersion,
+			),
+		))
+		return utils.ErrUnsupportedVersion
+	}
+
+	c.connected = true
+	c.features = m.Features & utils.SupportedFeatures
+	// If the client supports ACKs with offsets, each publish must be
+	// acknowledged separately to include its offset.
+	c.acks = newPendingACKs(c.features.Has(utils.FeatureACKOffset), c.sendACK, c.sendNACK)
+	if c.features.Has(utils.FeatureIdempotentPublish) {
+		c.producerID = m.ProducerID
+	}
+	c.logger = c.logger.With(zap.String("client-id", m.ClientID))
+
+	c.logger.Info(
+		"client connected",
+		zap.String("sdk-name", m.SDKName),
+		zap.String("sdk-version", m.SDKVersion),
+		zap.Uint16("version", version),
+		zap.String("features", c.features.String()),
+		zap.String("producer-id", c.producerID),
+	)
+
+	c.writer.Write(utils.EncodeConnectedMessage(version, c.features, c.nodeID))
+	return nil
+}
+
+// connectLegacy connects a client that didn't send CONNECT, using protocol
+// version 1 with no optional features. The server doesn't respond with
+// CONNECTED since the client isn't expecting it.
+func (c *Connection) connectLegacy() {
+	c.connected = true
+	c.features = 0
+	c.acks = newPendingACKs(false, c.sendACK, c.sendNACK)
+
+	c.logger.Info(
+		"client connected without CONNECT",
+		zap.Uint16("version", 1),
+	)
+}
+
+// onUnexpectedMessage sends an ERROR to the client and returns an error,
+// which will close the connection. The only unexpected message is CONNECT
+// once already connected.
+func (c *Connection) onUnexpectedMessage(messageType utils.MessageType) error {
+	c.logger.Warn(
+		"unexpected message",
+		zap.String("message-type", messageType.String()),
+	)
+
+	c.writer.Write(utils.EncodeErrorMessage(utils.ErrorCodeUnexpectedMessage, "already connected"))
+	return ErrUnexpectedMessage
+}
+
+// onDecodeError sends an ERROR to the client and returns the error, which
+// will close the connection.
+func (c *Connection) onDecodeError(messageType utils.MessageType, err error) error {
+	c.logger.Warn(
+		"failed to decode message",
+		zap.String("message-type", messageType.String()),
+		zap.Error(err),
+	)
+	c.writer.Write(utils.EncodeErrorMessage(utils.ErrorCodeMalformedMessage, err.Error()))
+	return err
+}
+
+// onPublish publishes the data with the optional key to the topic, and
+// acknowledges the publish once its durable according to the topics durability
+// policy.
+//
+// If the client publishes idempotently and the publish was already added to
+// the topic, such as the client resending after reconnecting, the publish
+// isn't added again but is still acknowledged.
+//
+// If the topic is degraded the publish is rejected with a NACK. Otherwise if
+// the publish fails returns an error, which will close the connection. Since
+// the publish isn't acknowledged the client will resend it when it reconnects.
+func (c *Connection) onPublish(name string, seqNum uint64, key []byte, data []byte) error {
+	return c.handlePublish(name, seqNum, nil, func(t *topic.Topic) (uint64, bool, error) {
+		if c.producerID == "" {
+			offset, err := t.Publish(key, data)
+			return offset, false, err
+		}
+		return t.PublishIdempotent(c.producerID, seqNum, key, data)
+	})
+}
+
+// onPublishBatch publishes the batch of messages to the topic atomically, and
+// acknowledges the batch with a single ACK once durable. Otherwise the batch
+// is handled the same as onPublish.
+func (c *Connection) onPublishBatch(name string, seqNum uint64, messages []utils.BatchMessage) error {
+	records := make([]commitlog.Record, 0, len(messages))
+	for _, m := range messages {
+		records = append(records, commitlog.Record{
+			Key:   m.Key,
+			Value: m.Data,
+		})
+	}
+
+	return c.handlePublish(name, seqNum, records, func(t *topic.Topic) (uint64, bool, error) {
+		if c.producerID == "" {
+			offset, err := t.PublishBatch(records)
+			return offset, false, err
+		}
+		return t.PublishBatchIdempotent(c.producerID, seqNum, records)
+	})
+}
+
+// handlePublish publishes with the given publish function and acknowledges
+// the publish once durable. records contains the published records if the
+// publish is a batch, or is nil otherwise.
+func (c *Connection) handlePublish(
+	name string,
+	seqNum uint64,
+	records []commitlog.Record,
+	publishFn func(t *topic.Topic) (uint64, bool, error),
+) error {
+	// Register the pending ACK before publishing so ACKs are sent in order.
+	ack := c.acks.Add(seqNum)
+
+	t, offset, duplicate, err := c.publish(name, publishFn)
+	if errors.Is(err, topic.ErrTopicDegraded) ||
+		errors.Is(err, topic.ErrDuplicateOffsetUnknown) {
+		c.logger.Warn(
+			"publish rejected",
+			zap.String("topic", name),
+			zap.Uint64("seq-num", seqNum),
+			zap.Error(err),
+		)
+		c.acks.Reject(ack, err)
+		return nil
+	}
+	if err != nil {
+		c.logger.Error(
+			"publish failed",
+			zap.String("topic", name),
+			zap.Uint64("seq-num", seqNum),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	var offsets []uint64
+	if duplicate {
+		c.logger.Debug(
+			"discarded duplicate publish",
+			zap.String("topic", name),
+			zap.Uint64("seq-num", seqNum),
+			zap.Uint64("offset", offset),
+		)
+	} else if records != nil {
+		// The offsets of a retried batch are unknown so are only included
+		// if the batch was added.
+		offsets = make([]uint64, 0, len(records))
+		for _, r := range records {
+			offsets = append(offsets, r.NextOffset)
+		}
+	}
+
+	t.OnDurable(offset, func(err error) {
+		if err != nil {
+			c.logger.Error(
+				"publish failed to sync",
+				zap.String("topic", name),
+				zap.Uint64("seq-num", seqNum),
+				zap.Error(err),
+			)
+			// Close the connection so the client resends all unacknowledged
+			// publishes when it reconnects.
+			c.conn.Close()
+			return
+		}
+		if records == nil {
+			c.acks.Done(ack, offset)
+			return
+		}
+		c.acks.DoneBatch(ack, offset, offsets)
+	})
+	return nil
+}
+
+// sendACK acknowledges the publish with the given sequence number, including
+// the topic offset of the message, or of each message in a batch, if the
+// client supports it.
+func (c *Connection) sendACK(seqNum uint64, offset uint64, offsets []uint64) {
+	if c.features.Has(utils.FeatureACKOffset) {
+		if offsets != nil {
+			c.writer.Write(utils.EncodeACKMessageWithOffsets(seqNum, offsets))
+			return
+		}
+		c.writer.Write(utils.EncodeACKMessageWithOffset(seqNum, offset))
+		return
+	}
+	c.writer.Write(utils.EncodeACKMessage(seqNum))
 }
 
-func (c *Connection) onAttachFromOffset(name string, offset uint64) {
-	offset = c.subscriptions.AddSubscriptionFromOffset(name, offset)
+func (c *Connection) sendNACK(seqNum uint64, err error) {
+	c.writer.Write(utils.EncodeNACKMessage(seqNum, nackErrorCode(err), err.Error()))
+}
+
+// publish publishes to the topic with the given name using the given publish
+// function. If the topic is deleted or evicted after being fetched from the
+// broker, retries with the new topic.
+//
+// Returns the offset of the publish and whether the publish was a retry that
+// was discarded.
+func (c *Connection) publish(
+	name string,
+	publishFn func(t *topic.Topic) (uint64, bool, error),
+) (*topic.Topic, uint64, bool, error) {
+	for {
+		t, err := c.broker.GetTopic(name)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		offset, duplicate, err := publishFn(t)
+		if err == topic.ErrTopicClosed {
+			continue
+		}
+		return t, offset, duplicate, err
+	}
+}
+
+// onAttach subscribes to the topic. If the topic can't be loaded returns an
+// error, which will close the connection.
+func (c *Connection) onAttach(name string) error {
+	offset, err := c.subscriptions.AddSubscription(name)
+	return c.onAttached(name, offset, err)
+}
+
+func (c *Connection) onAttachFromOffset(name string, offset uint64) error {
+	offset, err := c.subscriptions.AddSubscriptionFromOffset(name, offset)
+	return c.onAttached(name, offset, err)
+}
+
+func (c *Connection) onAttachFromTime(name string, timestamp time.Time) error {
+	offset, err := c.subscriptions.AddSubscriptionFromTime(name, timestamp)
+	return c.onAttached(name, offset, err)
+}
+
+func (c *Connection) onAttachLastN(name string, n uint64) error {
+	offset, err := c.subscriptions.AddSubscriptionLastN(name, n)
+	return c.onAttached(name, offset, err)
+}
+
+// onDetach unsubscribes from the topic and responds with DETACHED. DETACHED is
+// sent even if the connection isn't attached to the topic, such as if the
+// client resent DETACH after reconnecting, so the client can clear its state.
+//
+// Since the subscription is shut down before sending DETACHED, the client
+// won't receive any messages on the topic after DETACHED.
+func (c *Connection) onDetach(name string) {
+	c.subscriptions.RemoveSubscription(name)
+	c.writer.Write(utils.EncodeDetachedMessage(name))
+}
+
+// onDetached sends DETACHED with the reason the server detached the
+// subscription, such as if the topic was deleted. If the client has since
+// detached or re-attached the topic, the client isn't notified.
+func (c *Connection) onDetached(s *topic.Subscription, reason error) {
+	if !c.subscriptions.RemoveDetached(s) {
+		return
+	}
+
+	code := detachedErrorCode(reason)
+	c.logger.Info(
+		"detached subscription",
+		zap.String("topic", s.TopicName()),
+		zap.String("code", code.String()),
+		zap.Error(reason),
+	)
+	// Only include the reason if the client supports it.
+	if !c.features.Has(utils.FeatureDetachReason) {
+		c.writer.Write(utils.EncodeDetachedMessage(s.TopicName()))
+		return
+	}
+	c.writer.Write(utils.EncodeDetachedMessageWithReason(s.TopicName(), code, reason.Error()))
+}
+
+// onAttached sends ATTACHED once subscribed to the topic at the given offset.
+// If subscribing failed returns the error.
+func (c *Connection) onAttached(name string, offset uint64, err error) error {
+	if err != nil {
+		c.logger.Error(
+			"attach failed",
+			zap.String("topic", name),
+			zap.Error(err),
+		)
+		return err
+	}
 	c.writer.Write(utils.EncodeAttachedMessage(name, offset))
+	return nil
+}
+
+// nackErrorCode returns the error code sent to the client when the publish
+// was rejected with the given error.
+func nackErrorCode(err error) utils.ErrorCode {
+	if errors.Is(err, topic.ErrDuplicateOffsetUnknown) {
+		return utils.ErrorCodeDuplicateOffsetUnknown
+	}
+	return utils.ErrorCodeUnavailable
+}
+
+// detachedErrorCode returns the error code sent to the client when the
+// subscription was detached with the given reason.
+func detachedErrorCode(reason error) utils.ErrorCode {
+	if errors.Is(reason, topic.ErrTopicDeleted) {
+		return utils.ErrorCodeTopicDeleted
+	}
+	return utils.ErrorCodeUnavailable
 }
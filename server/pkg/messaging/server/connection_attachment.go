@@ -18,6 +18,10 @@ func NewConnectionAttachment(conn *Connection) topic.Attachment {
 	}
 }
 
-func (c *ConnectionAttachment) Send(ctx context.Context, m topic.Message) {
-	c.conn.SendDataMessage(m)
+func (c *ConnectionAttachment) Send(ctx context.Context, m topic.Message) error {
+	return c.conn.SendDataMessage(ctx, m)
+}
+
+func (c *ConnectionAttachment) Detached(s *topic.Subscription, reason error) {
+	c.conn.onDetached(s, reason)
 }
@@ -1,14 +1,110 @@
 package server
 
 import (
+	"fmt"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/andydunstall/figg/server/pkg/commitlog"
 	"github.com/andydunstall/figg/server/pkg/topic"
 	"github.com/andydunstall/figg/utils"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
 
+func TestConnection_Connect(t *testing.T) {
+	conn, fakeConn := newUnconnectedFakeConnection(topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop()))
+	defer conn.Close()
+
+	// Include an unknown feature which should be ignored.
+	fakeConn.Push(utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion + 1,
+		Features:   utils.FeatureDetachReason | utils.FeatureAttachLastN | utils.Features(1<<31),
+		ClientID:   "test-client",
+		SDKName:    "figg-go",
+		SDKVersion: "1.2.3",
+	}))
+
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeConnectedMessage(
+		utils.ProtocolVersion, utils.FeatureDetachReason|utils.FeatureAttachLastN, "test-node",
+	))
+}
+
+func TestConnection_ConnectUnsupportedVersion(t *testing.T) {
+	conn, fakeConn := newUnconnectedFakeConnection(topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop()))
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.ProtocolVersion + 1,
+		MaxVersion: utils.ProtocolVersion + 2,
+		ClientID:   "test-client",
+	}))
+
+	assert.Equal(t, utils.ErrUnsupportedVersion, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeErrorMessage(
+		utils.ErrorCodeUnsupportedVersion,
+		fmt.Sprintf(
+			"client supports protocol versions %d-%d, server supports %d-%d",
+			utils.ProtocolVersion+1, utils.ProtocolVersion+2,
+			utils.MinProtocolVersion, utils.ProtocolVersion,
+		),
+	))
+}
+
+func TestConnection_MessageWithoutConnect(t *testing.T) {
+	conn, fakeConn := newUnconnectedFakeConnection(topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop()))
+	defer conn.Close()
+
+	// Clients that don't send CONNECT are connected with no features.
+	fakeConn.Push(utils.EncodeAttachMessage("foo"))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0))
+
+	fakeConn.Push(utils.EncodePublishMessage("bar", 0, []byte("A")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessage(0))
+
+	// CONNECT can't be sent once connected.
+	fakeConn.Push(utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion,
+		ClientID:   "test-client",
+	}))
+	assert.Equal(t, ErrUnexpectedMessage, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeErrorMessage(
+		utils.ErrorCodeUnexpectedMessage, "already connected",
+	))
+}
+
+func TestConnection_ConnectTwice(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion,
+		ClientID:   "test-client",
+	}))
+
+	assert.Equal(t, ErrUnexpectedMessage, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeErrorMessage(
+		utils.ErrorCodeUnexpectedMessage, "already connected",
+	))
+}
+
 func TestConnection_Attach(t *testing.T) {
 	conn, fakeConn := newFakeConnection()
 	defer conn.Close()
@@ -25,8 +121,44 @@ func TestConnection_AttachFromOffset(t *testing.T) {
 
 	fakeConn.Push(utils.EncodeAttachFromOffsetMessage("foo", 0xff))
 
+	// The offset is beyond the end of the topic so is invalid, so expect to
+	// attach from the latest offset.
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0))
+}
+
+func TestConnection_AttachLastN(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	for seqNum := uint64(0); seqNum != 3; seqNum++ {
+		fakeConn.Push(utils.EncodePublishMessage("foo", seqNum, []byte("bar")))
+		assert.Nil(t, conn.Recv())
+		assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(seqNum, (seqNum+1)*11))
+	}
+
+	fakeConn.Push(utils.EncodeAttachLastNMessage("foo", 2))
+
+	// Expect to attach from the second message.
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachedMessage("foo", 11))
+}
+
+func TestConnection_AttachFromTime(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodePublishMessage("foo", 0, []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(0, 11))
+
+	// Attaching from before the message was published should attach from
+	// the first message.
+	timestamp := uint64(time.Now().Add(-time.Minute).UnixMilli())
+	fakeConn.Push(utils.EncodeAttachFromTimestampMessage("foo", timestamp))
+
 	assert.Nil(t, conn.Recv())
-	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0xff))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0))
 }
 
 func TestConnection_Publish(t *testing.T) {
@@ -37,15 +169,292 @@ func TestConnection_Publish(t *testing.T) {
 	for seqNum := uint64(0); seqNum != 10; seqNum++ {
 		fakeConn.Push(utils.EncodePublishMessage("foo", seqNum, []byte("bar")))
 		assert.Nil(t, conn.Recv())
-		assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessage(seqNum))
+		assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(seqNum, (seqNum+1)*11))
 	}
 }
 
-func TestConnection_PublishSendMessagesToAttached(t *testing.T) {
+func TestConnection_PublishWithoutACKOffsetFeature(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	// The client doesn't support ACKs with offsets.
+	conn, fakeConn := newFakeConnectionWithFeatures(broker, 0)
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodePublishMessage("foo", 0, []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessage(0))
+}
+
+func TestConnection_PublishIdempotent(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	connect := utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion,
+		Features:   utils.SupportedFeatures,
+		ClientID:   "test-client",
+		ProducerID: "test-producer",
+	}
+
+	conn, fakeConn := newUnconnectedFakeConnection(broker)
+	fakeConn.Push(utils.EncodeConnectMessage(connect))
+	assert.Nil(t, conn.Recv())
+	fakeConn.NextWritten()
+
+	fakeConn.Push(utils.EncodePublishMessage("foo", 0, []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(0, 11))
+	conn.Close()
+
+	// Reconnect with the same producer ID and resend the publish, which
+	// should be acknowledged with the original offset but not added again.
+	conn, fakeConn = newUnconnectedFakeConnection(broker)
+	defer conn.Close()
+	fakeConn.Push(utils.EncodeConnectMessage(connect))
+	assert.Nil(t, conn.Recv())
+	fakeConn.NextWritten()
+
+	fakeConn.Push(utils.EncodePublishMessage("foo", 0, []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(0, 11))
+
+	fakeConn.Push(utils.EncodePublishMessage("foo", 1, []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(1, 22))
+
+	foo, err := broker.GetTopic("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(22), foo.Offset())
+}
+
+// Tests a retried publish that is too old for the server to know its offset
+// is rejected rather than acknowledged with the wrong offset.
+func TestConnection_PublishIdempotentOffsetUnknown(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1 << 20,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	conn, fakeConn := newUnconnectedFakeConnection(broker)
+	defer conn.Close()
+	fakeConn.Push(utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion,
+		Features:   utils.SupportedFeatures,
+		ClientID:   "test-client",
+		ProducerID: "test-producer",
+	}))
+	assert.Nil(t, conn.Recv())
+	fakeConn.NextWritten()
+
+	// Publish enough messages that the producers first publish is no longer
+	// tracked.
+	foo, err := broker.GetTopic("foo")
+	assert.Nil(t, err)
+	for seqNum := uint64(0); seqNum != 5000; seqNum++ {
+		_, _, err := foo.PublishIdempotent("test-producer", seqNum, nil, []byte("bar"))
+		assert.Nil(t, err)
+	}
+	offset := foo.Offset()
+
+	fakeConn.Push(utils.EncodePublishMessage("foo", 0, []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeNACKMessage(
+		0, utils.ErrorCodeDuplicateOffsetUnknown, topic.ErrDuplicateOffsetUnknown.Error(),
+	))
+	assert.Equal(t, offset, foo.Offset())
+}
+
+func TestConnection_PublishBatch(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	conn, fakeConn := newFakeConnectionWithBroker(broker)
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodePublishMessage("foo", 0, []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(0, 11))
+
+	// The batch should be acknowledged with a single ACK including the
+	// offset of each message.
+	fakeConn.Push(utils.EncodePublishBatchMessage("foo", 1, []utils.BatchMessage{
+		{Key: nil, Data: []byte("bar")},
+		{Key: []byte("k"), Data: []byte("car")},
+		{Key: nil, Data: []byte("dar")},
+	}))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffsets(1, []uint64{22, 38, 49}))
+
+	foo, err := broker.GetTopic("foo")
+	assert.Nil(t, err)
+	m, err := foo.GetMessage(22)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("k"), m.Key)
+	assert.Equal(t, []byte("car"), m.Value)
+}
+
+func TestConnection_PublishBatchWithoutACKOffsetFeature(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	conn, fakeConn := newFakeConnectionWithFeatures(broker, utils.FeaturePublishBatch)
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodePublishBatchMessage("foo", 0, []utils.BatchMessage{
+		{Key: nil, Data: []byte("bar")},
+		{Key: nil, Data: []byte("car")},
+	}))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessage(0))
+}
+
+func TestConnection_PublishBatchIdempotent(t *testing.T) {
 	broker := topic.NewBroker(topic.Options{
 		Persisted:   false,
 		SegmentSize: 1000,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	conn, fakeConn := newUnconnectedFakeConnection(broker)
+	defer conn.Close()
+	fakeConn.Push(utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion,
+		Features:   utils.SupportedFeatures,
+		ClientID:   "test-client",
+		ProducerID: "test-producer",
+	}))
+	assert.Nil(t, conn.Recv())
+	fakeConn.NextWritten()
+
+	batch := utils.EncodePublishBatchMessage("foo", 0, []utils.BatchMessage{
+		{Key: nil, Data: []byte("bar")},
+		{Key: nil, Data: []byte("car")},
 	})
+	fakeConn.Push(batch)
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffsets(0, []uint64{11, 22}))
+
+	// Resending the batch is acknowledged with the offset of the last
+	// message, but without the offsets of each message.
+	fakeConn.Push(batch)
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(0, 22))
+
+	foo, err := broker.GetTopic("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(22), foo.Offset())
+}
+
+func TestConnection_PublishBatchMalformed(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	// An empty batch is malformed.
+	fakeConn.Push(utils.EncodePublishBatchMessage("foo", 0, nil))
+	assert.Equal(t, utils.ErrMalformedMessage, conn.Recv())
+	m, err := utils.DecodeErrorMessage(fakeConn.NextWritten()[utils.HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, utils.ErrorCodeMalformedMessage, m.Code)
+}
+
+func TestConnection_PublishWithKey(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	conn, fakeConn := newFakeConnectionWithBroker(broker)
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodePublishMessageWithKey("foo", 0, []byte("k"), []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(0, 16))
+
+	foo, err := broker.GetTopic("foo")
+	assert.Nil(t, err)
+	m, err := foo.GetMessage(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("k"), m.Key)
+	assert.Equal(t, []byte("bar"), m.Value)
+}
+
+func TestConnection_PublishDurable(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   true,
+		Dir:         dir,
+		SegmentSize: 1000,
+		Durability:  commitlog.DurabilityAlways,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	conn, fakeConn := newFakeConnectionWithBroker(broker)
+	defer conn.Close()
+
+	// Publish a message and expect to be ACK'ed once synced.
+	for seqNum := uint64(0); seqNum != 10; seqNum++ {
+		fakeConn.Push(utils.EncodePublishMessage("foo", seqNum, []byte("bar")))
+		assert.Nil(t, conn.Recv())
+		assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(seqNum, (seqNum+1)*11))
+	}
+}
+
+func TestConnection_PublishDegradedTopic(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   true,
+		Dir:         dir,
+		SegmentSize: 10,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	conn, fakeConn := newFakeConnectionWithBroker(broker)
+	defer conn.Close()
+
+	// Create a directory at the segment file path so persisting fails.
+	assert.Nil(t, os.MkdirAll(dir+"/foo/0.data", os.ModePerm))
+	fakeConn.Push(utils.EncodePublishMessage("foo", 0, []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeACKMessageWithOffset(0, 11))
+
+	foo, err := broker.GetTopic("foo")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return foo.Health() != nil
+	}, time.Second, time.Millisecond*10)
+
+	// Publishing to the degraded topic should be rejected with a NACK
+	// without closing the connection.
+	fakeConn.Push(utils.EncodePublishMessage("foo", 1, []byte("bar")))
+	assert.Nil(t, conn.Recv())
+	message := fmt.Sprintf("%s: %s", topic.ErrTopicDegraded, foo.Health())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeNACKMessage(1, utils.ErrorCodeUnavailable, message))
+}
+
+func TestConnection_PublishSendMessagesToAttached(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
 
 	// Add a connection subscribing to the topic.
 	subConn, subFakeConn := newFakeConnectionWithBroker(broker)
@@ -61,10 +470,191 @@ func TestConnection_PublishSendMessagesToAttached(t *testing.T) {
 	assert.Nil(t, pubConn.Recv())
 
 	// Check the subscriber connection receives the message.
-	assert.Equal(t, subFakeConn.NextWritten(), utils.EncodeDataMessagePrefix("foo", 7, []byte("bar")))
+	assert.Equal(t, subFakeConn.NextWritten(), utils.EncodeDataMessagePrefix("foo", 11, []byte("bar")))
 	assert.Equal(t, subFakeConn.NextWritten(), []byte("bar"))
 }
 
+// Tests a live subscriber that isn't reading fast enough is demoted to
+// resuming, so receives all messages once it catches up.
+func TestConnection_SlowSubscriberDemote(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	conn, blockingConn := newBlockingFakeConnection(broker, SlowSubscriberDemote)
+	defer conn.Close()
+	blockingConn.Push(utils.EncodeAttachMessage("foo"))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, blockingConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0))
+
+	topic, err := broker.GetTopic("foo")
+	assert.Nil(t, err)
+
+	// Block writes as if the client isn't reading, so the second publish
+	// exceeds the send queue limit.
+	demotions := slowSubscriberDemotions.Value()
+	blockingConn.Block()
+	topic.Publish(nil, []byte("A"))
+	topic.Publish(nil, []byte("B"))
+	assert.Equal(t, demotions+1, slowSubscriberDemotions.Value())
+	blockingConn.Unblock()
+
+	topic.Publish(nil, []byte("C"))
+
+	assert.Equal(t, blockingConn.NextWritten(), utils.EncodeDataMessagePrefix("foo", 9, []byte("A")))
+	assert.Equal(t, blockingConn.NextWritten(), []byte("A"))
+	assert.Equal(t, blockingConn.NextWritten(), utils.EncodeDataMessagePrefix("foo", 18, []byte("B")))
+	assert.Equal(t, blockingConn.NextWritten(), []byte("B"))
+	assert.Equal(t, blockingConn.NextWritten(), utils.EncodeDataMessagePrefix("foo", 27, []byte("C")))
+	assert.Equal(t, blockingConn.NextWritten(), []byte("C"))
+}
+
+// Tests a live subscriber that isn't reading fast enough is disconnected.
+func TestConnection_SlowSubscriberDisconnect(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	conn, blockingConn := newBlockingFakeConnection(broker, SlowSubscriberDisconnect)
+	defer conn.Close()
+	blockingConn.Push(utils.EncodeAttachMessage("foo"))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, blockingConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0))
+
+	topic, err := broker.GetTopic("foo")
+	assert.Nil(t, err)
+
+	disconnects := slowSubscriberDisconnects.Value()
+	blockingConn.Block()
+	topic.Publish(nil, []byte("A"))
+	topic.Publish(nil, []byte("B"))
+	topic.Publish(nil, []byte("C"))
+	blockingConn.Unblock()
+
+	// Expect the messages already queued to be sent, followed by an ERROR
+	// describing why the connection is being closed.
+	assert.Equal(t, blockingConn.NextWritten(), utils.EncodeDataMessagePrefix("foo", 9, []byte("A")))
+	assert.Equal(t, blockingConn.NextWritten(), []byte("A"))
+	assert.Equal(t, blockingConn.NextWritten(), utils.EncodeErrorMessage(
+		utils.ErrorCodeSlowSubscriber, "client not reading messages fast enough",
+	))
+
+	select {
+	case <-blockingConn.Closed:
+	case <-time.After(time.Second):
+		t.Error("expected connection to be closed")
+	}
+	// Expect the disconnect to only be counted once.
+	assert.Equal(t, disconnects+1, slowSubscriberDisconnects.Value())
+}
+
+func TestConnection_Detach(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	subConn, subFakeConn := newFakeConnectionWithBroker(broker)
+	defer subConn.Close()
+	subFakeConn.Push(utils.EncodeAttachMessage("foo"))
+	assert.Nil(t, subConn.Recv())
+	assert.Equal(t, subFakeConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0))
+
+	subFakeConn.Push(utils.EncodeDetachMessage("foo"))
+	assert.Nil(t, subConn.Recv())
+	assert.Equal(t, subFakeConn.NextWritten(), utils.EncodeDetachedMessage("foo"))
+
+	pubConn, pubFakeConn := newFakeConnectionWithBroker(broker)
+	defer pubConn.Close()
+	pubFakeConn.Push(utils.EncodePublishMessage("foo", 0, []byte("bar")))
+	assert.Nil(t, pubConn.Recv())
+
+	// Ping the subscriber connection and check the PONG is received without
+	// first receiving the published message.
+	subFakeConn.Push(utils.EncodePingMessage(12345))
+	assert.Nil(t, subConn.Recv())
+	assert.Equal(t, subFakeConn.NextWritten(), utils.EncodePongMessage(12345))
+}
+
+func TestConnection_DetachNotAttached(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodeDetachMessage("foo"))
+
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeDetachedMessage("foo"))
+}
+
+func TestConnection_DetachedOnTopicDeleted(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	conn, fakeConn := newFakeConnectionWithBroker(broker)
+	defer conn.Close()
+	fakeConn.Push(utils.EncodeAttachMessage("foo"))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0))
+
+	assert.Nil(t, broker.DeleteTopic("foo"))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeDetachedMessageWithReason(
+		"foo", utils.ErrorCodeTopicDeleted, topic.ErrTopicDeleted.Error(),
+	))
+
+	// Attaching again should subscribe to the new topic.
+	fakeConn.Push(utils.EncodeAttachMessage("foo"))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0))
+}
+
+func TestConnection_DetachedWithoutReasonFeature(t *testing.T) {
+	broker := topic.NewBroker(topic.Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	// The client doesn't support DETACHED with a reason.
+	conn, fakeConn := newFakeConnectionWithFeatures(broker, 0)
+	defer conn.Close()
+	fakeConn.Push(utils.EncodeAttachMessage("foo"))
+	assert.Nil(t, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeAttachedMessage("foo", 0))
+
+	assert.Nil(t, broker.DeleteTopic("foo"))
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeDetachedMessage("foo"))
+}
+
+func TestConnection_MalformedMessage(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	// Set the topic length to exceed the payload.
+	b := utils.EncodePublishMessage("foo", 0, []byte("bar"))
+	utils.EncodeUint32(b, utils.HeaderLen, 0xffff)
+	fakeConn.Push(b)
+
+	assert.Equal(t, utils.ErrMalformedMessage, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeErrorMessage(
+		utils.ErrorCodeMalformedMessage, utils.ErrMalformedMessage.Error(),
+	))
+}
+
+func TestConnection_PayloadTooLarge(t *testing.T) {
+	conn, fakeConn := newFakeConnection()
+	defer conn.Close()
+
+	fakeConn.Push(utils.EncodePublishMessage("foo", 0, make([]byte, 2000)))
+
+	assert.Equal(t, utils.ErrPayloadTooLarge, conn.Recv())
+	assert.Equal(t, fakeConn.NextWritten(), utils.EncodeErrorMessage(
+		utils.ErrorCodePayloadTooLarge, "payload exceeds 1024 bytes",
+	))
+}
+
 func TestConnection_Ping(t *testing.T) {
 	conn, fakeConn := newFakeConnection()
 	defer conn.Close()
@@ -75,17 +665,112 @@ func TestConnection_Ping(t *testing.T) {
 	assert.Equal(t, fakeConn.NextWritten(), utils.EncodePongMessage(12345))
 }
 
+// blockingConn is a fake connection whose writes block while blocked, such as
+// if the client isn't reading.
+type blockingConn struct {
+	*utils.FakeConn
+
+	// Closed is closed once the connection is closed.
+	Closed    chan interface{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	// unblocked is closed once writes are unblocked, or nil if not
+	// blocked.
+	unblocked chan interface{}
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{
+		FakeConn: utils.NewFakeConn(),
+		Closed:   make(chan interface{}),
+	}
+}
+
+func (c *blockingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	unblocked := c.unblocked
+	c.mu.Unlock()
+
+	if unblocked != nil {
+		<-unblocked
+	}
+	return c.FakeConn.Write(b)
+}
+
+func (c *blockingConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.Closed)
+	})
+	return nil
+}
+
+// Block blocks writes until Unblock is called.
+func (c *blockingConn) Block() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.unblocked = make(chan interface{})
+}
+
+// Unblock unblocks writes.
+func (c *blockingConn) Unblock() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.unblocked != nil {
+		close(c.unblocked)
+		c.unblocked = nil
+	}
+}
+
+// newBlockingFakeConnection returns a connected connection using a
+// blockingConn, with a send queue limit that fits a single small DATA
+// message.
+func newBlockingFakeConnection(broker *topic.Broker, policy SlowSubscriberPolicy) (*Connection, *blockingConn) {
+	blockingConn := newBlockingConn()
+	conn := NewConnection(blockingConn, broker, "test-node", 1<<10, 32, policy, zap.NewNop())
+	blockingConn.Push(utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion,
+		Features:   utils.SupportedFeatures,
+		ClientID:   "test-client",
+	}))
+	conn.Recv()
+	// Discard CONNECTED.
+	blockingConn.NextWritten()
+	return conn, blockingConn
+}
+
 func newFakeConnection() (*Connection, *utils.FakeConn) {
-	fakeConn := utils.NewFakeConn()
-	conn := NewConnection(fakeConn, topic.NewBroker(topic.Options{
+	return newFakeConnectionWithBroker(topic.NewBroker(topic.Options{
 		Persisted:   false,
 		SegmentSize: 1000,
-	}), zap.NewNop())
-	return conn, fakeConn
+	}, zap.NewNop()))
 }
 
 func newFakeConnectionWithBroker(broker *topic.Broker) (*Connection, *utils.FakeConn) {
+	return newFakeConnectionWithFeatures(broker, utils.SupportedFeatures)
+}
+
+// newFakeConnectionWithFeatures returns a connection that has completed the
+// handshake with the given client features.
+func newFakeConnectionWithFeatures(broker *topic.Broker, features utils.Features) (*Connection, *utils.FakeConn) {
+	conn, fakeConn := newUnconnectedFakeConnection(broker)
+	fakeConn.Push(utils.EncodeConnectMessage(utils.ConnectMessage{
+		MinVersion: utils.MinProtocolVersion,
+		MaxVersion: utils.ProtocolVersion,
+		Features:   features,
+		ClientID:   "test-client",
+	}))
+	conn.Recv()
+	// Discard CONNECTED.
+	fakeConn.NextWritten()
+	return conn, fakeConn
+}
+
+func newUnconnectedFakeConnection(broker *topic.Broker) (*Connection, *utils.FakeConn) {
 	fakeConn := utils.NewFakeConn()
-	conn := NewConnection(fakeConn, broker, zap.NewNop())
+	conn := NewConnection(fakeConn, broker, "test-node", 1<<10, 0, SlowSubscriberDisconnect, zap.NewNop())
 	return conn, fakeConn
 }
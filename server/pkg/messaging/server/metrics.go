@@ -0,0 +1,14 @@
+package server
+
+import (
+	"expvar"
+)
+
+var (
+	// slowSubscriberDisconnects is the number of connections closed since
+	// the client wasn't reading fast enough.
+	slowSubscriberDisconnects = expvar.NewInt("messaging.slow-subscriber-disconnects")
+	// slowSubscriberDemotions is the number of live subscriptions demoted to
+	// resuming since the client wasn't reading fast enough.
+	slowSubscriberDemotions = expvar.NewInt("messaging.slow-subscriber-demotions")
+)
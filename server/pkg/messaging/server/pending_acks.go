@@ -0,0 +1,140 @@
+package server
+
+import (
+	"sync"
+)
+
+type pendingACK struct {
+	seqNum uint64
+	// offset is the topic offset of the published message, or the last
+	// message if the publish was a batch.
+	offset uint64
+	// offsets contains the topic offset of each message if the publish was a
+	// batch, or nil otherwise.
+	offsets []uint64
+	done    bool
+	// err is the reason the publish was rejected, or nil if the publish
+	// succeeded.
+	err error
+}
+
+// pendingACKs tracks publishes waiting to be durable before they can be
+// acknowledged.
+//
+// Since an ACK acknowledges all messages with a smaller sequence number, ACKs
+// must be sent in order. Though publishes to different topics may become
+// durable out of order, so the ACK for a publish is only sent once all
+// earlier publishes are also durable.
+//
+// If ackEach is set, an ACK is sent for every publish instead, so each ACK
+// can include the offset of the published message, or the offsets of each
+// message in a batch.
+//
+// Rejected publishes are sent a NACK instead. Since a later ACK would also
+// acknowledge the rejected publish, the NACK is sent in order too, after
+// acknowledging all earlier publishes.
+type pendingACKs struct {
+	// ackEach is true if every publish is acknowledged separately.
+	ackEach bool
+	// sendACK sends an ACK for the given sequence number and topic offset,
+	// along with the offsets of each message if the publish was a batch.
+	// This is called with the mutex held to ensure ACKs are sent in order, so
+	// must not block.
+	sendACK func(seqNum uint64, offset uint64, offsets []uint64)
+	// sendNACK sends a NACK rejecting the publish with the given sequence
+	// number. As with sendACK this must not block.
+	sendNACK func(seqNum uint64, err error)
+
+	// mu is a mutex protecting the below fields.
+	mu      sync.Mutex
+	pending []*pendingACK
+}
+
+func newPendingACKs(ackEach bool, sendACK func(seqNum uint64, offset uint64, offsets []uint64), sendNACK func(seqNum uint64, err error)) *pendingACKs {
+	return &pendingACKs{
+		ackEach:  ackEach,
+		sendACK:  sendACK,
+		sendNACK: sendNACK,
+		mu:       sync.Mutex{},
+		pending:  []*pendingACK{},
+	}
+}
+
+// Add adds a publish with the given sequence number that is waiting to be
+// acknowledged. Must be called in sequence number order.
+func (a *pendingACKs) Add(seqNum uint64) *pendingACK {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ack := &pendingACK{
+		seqNum: seqNum,
+		done:   false,
+	}
+	a.pending = append(a.pending, ack)
+	return ack
+}
+
+// Done marks the given publish, which was published at the given topic offset,
+// as ready to be acknowledged. If all earlier publishes are also ready, sends
+// an ACK for the latest ready publish.
+func (a *pendingACKs) Done(ack *pendingACK, offset uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ack.done = true
+	ack.offset = offset
+	a.flush()
+}
+
+// DoneBatch is the same as Done except the publish was a batch, whose
+// messages were published at the given topic offsets. The offsets are nil if
+// unknown, such as if the batch was a retry.
+func (a *pendingACKs) DoneBatch(ack *pendingACK, offset uint64, offsets []uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ack.done = true
+	ack.offset = offset
+	ack.offsets = offsets
+	a.flush()
+}
+
+// Reject marks the given publish as rejected with the given error. Once all
+// earlier publishes are ready, sends a NACK for the publish.
+func (a *pendingACKs) Reject(ack *pendingACK, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ack.done = true
+	ack.err = err
+	a.flush()
+}
+
+// flush sends ACKs and NACKs for the ready publishes at the start of the
+// pending list. The mutex must be held.
+func (a *pendingACKs) flush() {
+	i := 0
+	for i < len(a.pending) && a.pending[i].done {
+		if err := a.pending[i].err; err != nil {
+			// ACK the earlier publishes before rejecting, otherwise the
+			// ACK would also acknowledge the rejected publish.
+			if !a.ackEach && i > 0 && a.pending[i-1].err == nil {
+				a.sendACK(a.pending[i-1].seqNum, a.pending[i-1].offset, nil)
+			}
+			a.sendNACK(a.pending[i].seqNum, err)
+		} else if a.ackEach {
+			a.sendACK(a.pending[i].seqNum, a.pending[i].offset, a.pending[i].offsets)
+		}
+		i++
+	}
+	if i == 0 {
+		return
+	}
+
+	// Only need to ACK the last publish as this acknowledges all earlier
+	// publishes.
+	if !a.ackEach && a.pending[i-1].err == nil {
+		a.sendACK(a.pending[i-1].seqNum, a.pending[i-1].offset, nil)
+	}
+	a.pending = a.pending[i:]
+}
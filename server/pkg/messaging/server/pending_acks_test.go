@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingACKs_ACKInOrder(t *testing.T) {
+	acked := []uint64{}
+	acks := newPendingACKs(false, func(seqNum uint64, offset uint64, offsets []uint64) {
+		acked = append(acked, seqNum)
+	}, func(seqNum uint64, err error) {
+		t.Fatal("unexpected nack")
+	})
+
+	ack0 := acks.Add(0)
+	ack1 := acks.Add(1)
+	ack2 := acks.Add(2)
+
+	// Completing the later publishes first must not ACK, as that would
+	// acknowledge the earlier publish.
+	acks.Done(ack2, 30)
+	acks.Done(ack1, 20)
+	assert.Equal(t, []uint64{}, acked)
+
+	// Once the first publish completes, all three can be acknowledged with a
+	// single ACK.
+	acks.Done(ack0, 10)
+	assert.Equal(t, []uint64{2}, acked)
+
+	ack3 := acks.Add(3)
+	acks.Done(ack3, 40)
+	assert.Equal(t, []uint64{2, 3}, acked)
+}
+
+func TestPendingACKs_NACKInOrder(t *testing.T) {
+	sent := []string{}
+	acks := newPendingACKs(false, func(seqNum uint64, offset uint64, offsets []uint64) {
+		sent = append(sent, fmt.Sprintf("ack-%d", seqNum))
+	}, func(seqNum uint64, err error) {
+		sent = append(sent, fmt.Sprintf("nack-%d", seqNum))
+	})
+
+	ack0 := acks.Add(0)
+	ack1 := acks.Add(1)
+	ack2 := acks.Add(2)
+	ack3 := acks.Add(3)
+
+	// Rejecting a later publish must wait for the earlier publishes.
+	acks.Reject(ack2, errors.New("rejected"))
+	assert.Equal(t, []string{}, sent)
+
+	acks.Done(ack3, 40)
+	acks.Done(ack1, 20)
+	acks.Done(ack0, 10)
+	// The earlier publishes must be acknowledged before the NACK, and the
+	// publish following the NACK is acknowledged separately.
+	assert.Equal(t, []string{"ack-1", "nack-2", "ack-3"}, sent)
+}
+
+func TestPendingACKs_ACKEach(t *testing.T) {
+	sent := []string{}
+	acks := newPendingACKs(true, func(seqNum uint64, offset uint64, offsets []uint64) {
+		sent = append(sent, fmt.Sprintf("ack-%d-%d", seqNum, offset))
+	}, func(seqNum uint64, err error) {
+		sent = append(sent, fmt.Sprintf("nack-%d", seqNum))
+	})
+
+	ack0 := acks.Add(0)
+	ack1 := acks.Add(1)
+	ack2 := acks.Add(2)
+	ack3 := acks.Add(3)
+
+	acks.Done(ack1, 20)
+	acks.Reject(ack2, errors.New("rejected"))
+	assert.Equal(t, []string{}, sent)
+
+	// Each publish is acknowledged separately with its offset, still in
+	// order.
+	acks.Done(ack0, 10)
+	acks.Done(ack3, 30)
+	assert.Equal(t, []string{"ack-0-10", "ack-1-20", "nack-2", "ack-3-30"}, sent)
+}
+
+func TestPendingACKs_DoneBatch(t *testing.T) {
+	sent := []string{}
+	acks := newPendingACKs(true, func(seqNum uint64, offset uint64, offsets []uint64) {
+		sent = append(sent, fmt.Sprintf("ack-%d-%d-%v", seqNum, offset, offsets))
+	}, func(seqNum uint64, err error) {
+		sent = append(sent, fmt.Sprintf("nack-%d", seqNum))
+	})
+
+	ack0 := acks.Add(0)
+	ack1 := acks.Add(1)
+
+	acks.DoneBatch(ack1, 40, []uint64{30, 40})
+	acks.Done(ack0, 10)
+	assert.Equal(t, []string{"ack-0-10-[]", "ack-1-40-[30 40]"}, sent)
+}
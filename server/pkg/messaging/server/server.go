@@ -9,13 +9,35 @@ import (
 
 type Server struct {
 	broker *topic.Broker
-	logger *zap.Logger
+	// nodeID identifies the node to clients.
+	nodeID string
+	// maxPayloadLen is the maximum payload size of a message from a client,
+	// or 0 if unlimited.
+	maxPayloadLen int
+	// sendQueueLimit is the maximum number of bytes of messages queued to
+	// send to a client, or 0 if unlimited.
+	sendQueueLimit int
+	// slowSubscriberPolicy is how to handle clients that exceed the send
+	// queue limit.
+	slowSubscriberPolicy SlowSubscriberPolicy
+	logger               *zap.Logger
 }
 
-func NewServer(broker *topic.Broker, logger *zap.Logger) *Server {
+func NewServer(
+	broker *topic.Broker,
+	nodeID string,
+	maxPayloadLen int,
+	sendQueueLimit int,
+	slowSubscriberPolicy SlowSubscriberPolicy,
+	logger *zap.Logger,
+) *Server {
 	s := &Server{
-		broker: broker,
-		logger: logger,
+		broker:               broker,
+		nodeID:               nodeID,
+		maxPayloadLen:        maxPayloadLen,
+		sendQueueLimit:       sendQueueLimit,
+		slowSubscriberPolicy: slowSubscriberPolicy,
+		logger:               logger,
 	}
 	return s
 }
@@ -27,9 +49,17 @@ func (s *Server) Serve(lis net.Listener) error {
 			return err
 		}
 		go s.stream(
-			NewConnection(conn, s.broker, s.logger.With(
-				zap.String("client-addr", conn.RemoteAddr().String()),
-			)),
+			NewConnection(
+				conn,
+				s.broker,
+				s.nodeID,
+				s.maxPayloadLen,
+				s.sendQueueLimit,
+				s.slowSubscriberPolicy,
+				s.logger.With(
+					zap.String("client-addr", conn.RemoteAddr().String()),
+				),
+			),
 			conn.RemoteAddr().String(),
 		)
 	}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+)
+
+// SlowSubscriberPolicy defines how the server handles a client that isn't
+// reading fast enough, so its queue of messages waiting to be sent exceeds
+// the limit.
+type SlowSubscriberPolicy int
+
+const (
+	// SlowSubscriberDisconnect closes the clients connection. The client
+	// reconnects and resumes its subscriptions from the last message it
+	// received.
+	SlowSubscriberDisconnect = SlowSubscriberPolicy(iota)
+	// SlowSubscriberDemote reverts the subscription that couldn't send to
+	// resuming from the commit log at the last message sent, so the backlog
+	// is read from the commit log as the client catches up rather than
+	// buffered in memory.
+	SlowSubscriberDemote
+)
+
+// ParseSlowSubscriberPolicy returns the slow subscriber policy with the given
+// name.
+func ParseSlowSubscriberPolicy(s string) (SlowSubscriberPolicy, error) {
+	switch s {
+	case "disconnect":
+		return SlowSubscriberDisconnect, nil
+	case "demote":
+		return SlowSubscriberDemote, nil
+	default:
+		return SlowSubscriberDisconnect, fmt.Errorf("unknown slow subscriber policy: %s", s)
+	}
+}
+
+func (p SlowSubscriberPolicy) String() string {
+	switch p {
+	case SlowSubscriberDisconnect:
+		return "disconnect"
+	case SlowSubscriberDemote:
+		return "demote"
+	default:
+		return "unknown"
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"net"
 	"sync"
 
+	"github.com/andydunstall/figg/server/pkg/commitlog"
 	"github.com/andydunstall/figg/server/pkg/config"
 	"github.com/andydunstall/figg/server/pkg/messaging/server"
 	"github.com/andydunstall/figg/server/pkg/topic"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
@@ -17,7 +19,10 @@ type MessagingService struct {
 	// lis is the services network listener. nil if the service is not
 	// running.
 	lis net.Listener
-	wg  sync.WaitGroup
+	// broker manages the topics on the node. nil if the service is not
+	// running.
+	broker *topic.Broker
+	wg     sync.WaitGroup
 }
 
 func NewMessagingService(config config.Config, logger *zap.Logger) *MessagingService {
@@ -35,14 +40,67 @@ func NewMessagingService(config config.Config, logger *zap.Logger) *MessagingSer
 func (s *MessagingService) Serve() (string, error) {
 	s.logger.Info("starting messaging service")
 
-	server := server.NewServer(topic.NewBroker(topic.Options{
-		Persisted:   !s.config.CommitLogInMemory,
-		Dir:         s.config.CommitLogDir,
-		SegmentSize: s.config.CommitLogSegmentSize,
-	}), s.logger)
+	durability, err := commitlog.ParseDurability(s.config.CommitLogDurability)
+	if err != nil {
+		return "", err
+	}
+	compression, err := commitlog.ParseCompression(s.config.CommitLogCompression)
+	if err != nil {
+		return "", err
+	}
+	slowSubscriberPolicy, err := server.ParseSlowSubscriberPolicy(s.config.MessagingSlowSubscriberPolicy)
+	if err != nil {
+		return "", err
+	}
+
+	// Tiered storage is only used if configured.
+	var storage commitlog.Storage
+	if s.config.CommitLogTieredStorageDir != "" {
+		storage = commitlog.NewLocalStorage(s.config.CommitLogTieredStorageDir)
+	}
+
+	broker := topic.NewBroker(topic.Options{
+		Persisted:       !s.config.CommitLogInMemory,
+		Dir:             s.config.CommitLogDir,
+		SegmentSize:     s.config.CommitLogSegmentSize,
+		RetentionAge:    s.config.CommitLogRetentionAge,
+		RetentionSize:   s.config.CommitLogRetentionSize,
+		CompactedTopics: s.config.CommitLogCompactedTopics,
+		Durability:      durability,
+		SyncInterval:    s.config.CommitLogSyncInterval,
+		Compression:     compression,
+		Storage:         storage,
+		OffloadAge:      s.config.CommitLogTieredStorageAge,
+		IdleTimeout:     s.config.TopicIdleTimeout,
+		ProducerExpiry:  s.config.TopicProducerExpiry,
+		MemoryBudget:    s.config.CommitLogMemoryBudget,
+	}, s.logger)
+	// Recover any topics persisted before the node restarted prior to
+	// accepting connections.
+	if err := broker.Recover(); err != nil {
+		broker.Close()
+		return "", err
+	}
+
+	// If the node ID isn't configured generate a random ID.
+	nodeID := s.config.NodeID
+	if nodeID == "" {
+		nodeID = uuid.New().String()
+	}
+	s.logger.Info("node id", zap.String("node-id", nodeID))
+
+	server := server.NewServer(
+		broker,
+		nodeID,
+		s.config.MessagingMaxPayloadSize,
+		s.config.MessagingSendQueueLimit,
+		slowSubscriberPolicy,
+		s.logger,
+	)
 
 	lis, err := net.Listen("tcp", s.config.Addr)
 	if err != nil {
+		broker.Close()
 		return "", err
 	}
 
@@ -53,12 +111,20 @@ func (s *MessagingService) Serve() (string, error) {
 	}()
 
 	s.lis = lis
+	s.broker = broker
 	return lis.Addr().String(), nil
 }
 
+// Broker returns the broker managing the topics on the node. nil if the
+// service is not running.
+func (s *MessagingService) Broker() *topic.Broker {
+	return s.broker
+}
+
 // Close stops the server and wait for them to exit.
 func (s *MessagingService) Close() {
 	// Close the listener which will cause the server goroutine to exit.
 	s.lis.Close()
 	s.wg.Wait()
+	s.broker.Close()
 }
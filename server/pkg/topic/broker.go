@@ -1,7 +1,37 @@
 package topic
 
 import (
+	"errors"
+	"os"
 	"sync"
+	"time"
+
+	"github.com/andydunstall/figg/server/pkg/commitlog"
+	"go.uber.org/zap"
+)
+
+const (
+	// retentionInterval is the interval between checking for expired
+	// segments.
+	retentionInterval = time.Minute
+
+	// compactionInterval is the interval between compacting topics.
+	compactionInterval = time.Minute
+
+	// offloadInterval is the interval between checking for segments to
+	// offload to tiered storage.
+	offloadInterval = time.Minute
+
+	// evictionInterval is the interval between checking for idle topics.
+	evictionInterval = time.Minute
+
+	// producerExpiryInterval is the interval between checking for expired
+	// idempotent producers.
+	producerExpiryInterval = time.Minute
+)
+
+var (
+	ErrTopicNotFound = errors.New("topic not found")
 )
 
 // Broker manages the set of topics active on this node.
@@ -11,26 +41,394 @@ type Broker struct {
 
 	topics  map[string]*Topic
 	options Options
+	// evicting contains the topics currently being evicted, mapped to a
+	// channel that is closed once the topic is unloaded. The topic must not
+	// be reloaded until its unloaded.
+	evicting map[string]chan interface{}
+
+	// done is closed to stop the retention, compaction, offload, eviction
+	// and producer expiry loops.
+	done chan interface{}
+	wg   sync.WaitGroup
+
+	logger *zap.Logger
+}
+
+func NewBroker(options Options, logger *zap.Logger) *Broker {
+	// All topics share the same memory budget.
+	options.memory = commitlog.NewMemoryBudget(options.MemoryBudget)
+
+	b := &Broker{
+		mu:       sync.Mutex{},
+		topics:   map[string]*Topic{},
+		options:  options,
+		evicting: map[string]chan interface{}{},
+		done:     make(chan interface{}),
+		wg:       sync.WaitGroup{},
+		logger:   logger,
+	}
+
+	// Only persisted segments are removed by retention so if not persisted
+	// or retention is unlimited theres nothing to do.
+	if options.Persisted && (options.RetentionAge != 0 || options.RetentionSize != 0) {
+		b.runPeriodic(retentionInterval, b.retain)
+	}
+
+	// Only persisted segments are compacted.
+	if options.Persisted && len(options.CompactedTopics) > 0 {
+		b.runPeriodic(compactionInterval, b.compact)
+	}
+
+	// Only persisted segments are offloaded.
+	if options.Persisted && options.Storage != nil {
+		b.runPeriodic(offloadInterval, b.offload)
+	}
+
+	// Only persisted topics are evicted, since in-memory topics can't be
+	// reloaded.
+	if options.Persisted && options.IdleTimeout != 0 {
+		b.runPeriodic(evictionInterval, b.evictIdle)
+	}
+
+	if options.ProducerExpiry != 0 {
+		b.runPeriodic(producerExpiryInterval, b.expireProducers)
+	}
+
+	return b
+}
+
+// MemoryUsed returns the memory in bytes used by the in-memory segments across
+// all topics.
+func (b *Broker) MemoryUsed() uint64 {
+	return b.options.memory.Used()
 }
 
-func NewBroker(options Options) *Broker {
-	return &Broker{
-		mu:      sync.Mutex{},
-		topics:  map[string]*Topic{},
-		options: options,
+// DegradedTopics returns the active topics that are degraded, mapped to the
+// reason the topic is degraded.
+func (b *Broker) DegradedTopics() map[string]error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	degraded := map[string]error{}
+	for name, topic := range b.topics {
+		if err := topic.Health(); err != nil {
+			degraded[name] = err
+		}
 	}
+	return degraded
+}
+
+// Recover loads the topics persisted in the configured directory, so topics
+// that existed before the node restarted are active with their commit logs
+// restored. Each topic is stored in its own sub-directory named after the
+// topic.
+//
+// Topics that fail to load are logged and skipped, so they are loaded again
+// when next requested.
+//
+// If the topics aren't persisted this does nothing.
+func (b *Broker) Recover() error {
+	if !b.options.Persisted {
+		return nil
+	}
+
+	entries, err := os.ReadDir(b.options.Dir)
+	if err != nil {
+		// If the directory doesn't exist there is nothing to recover.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		topic, err := LoadTopic(entry.Name(), b.options.topicOptions(entry.Name()), b.logger)
+		if err != nil {
+			// Skip topics that can't be loaded rather than failing to
+			// recover every other topic.
+			b.logger.Error(
+				"failed to recover topic",
+				zap.String("topic", entry.Name()),
+				zap.Error(err),
+			)
+			continue
+		}
+		b.topics[topic.Name()] = topic
+
+		b.logger.Info(
+			"recovered topic",
+			zap.String("topic", topic.Name()),
+			zap.Uint64("offset", topic.Offset()),
+		)
+	}
+
+	return nil
 }
 
 // GetTopic returns the topic with the given name. If the topic is not active it
-// is activated and returned.
-func (b *Broker) GetTopic(name string) *Topic {
+// is activated and returned, where persisted topics are loaded from disk, such
+// as if the topic was evicted.
+func (b *Broker) GetTopic(name string) (*Topic, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	b.waitForEviction(name)
+
 	if topic, ok := b.topics[name]; ok {
-		return topic
+		topic.touch()
+		return topic, nil
+	}
+
+	topic, err := b.loadTopic(name)
+	if err != nil {
+		return nil, err
 	}
-	topic := NewTopic(name, b.options)
 	b.topics[name] = topic
-	return topic
+	return topic, nil
+}
+
+// DeleteTopic detaches all subscribers from the topic with the given name and
+// removes the topics messages, including any persisted segments. Returns
+// ErrTopicNotFound if the topic doesn't exist.
+//
+// If the topic is used again after being deleted, it is recreated as a new
+// empty topic.
+func (b *Broker) DeleteTopic(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.waitForEviction(name)
+
+	topic, ok := b.topics[name]
+	if !ok {
+		// If the topic isn't active it may still be persisted, such as if
+		// it was evicted, so load it to remove its segments.
+		if !b.options.Persisted {
+			return ErrTopicNotFound
+		}
+		if _, err := os.Stat(b.options.Dir + "/" + name); os.IsNotExist(err) {
+			return ErrTopicNotFound
+		}
+		var err error
+		topic, err = b.loadTopic(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Note the broker lock is held while removing the topic so it can't be
+	// recreated until its segments are removed.
+	delete(b.topics, name)
+	if err := topic.Delete(); err != nil {
+		return err
+	}
+
+	b.logger.Info(
+		"deleted topic",
+		zap.String("topic", name),
+	)
+	return nil
+}
+
+// Close stops the brokers background goroutines and waits for them to exit,
+// then closes all topics.
+func (b *Broker) Close() {
+	close(b.done)
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, topic := range b.topics {
+		topic.Close()
+	}
+}
+
+// evictIdle evicts all topics that have no subscribers and haven't been used
+// for the idle timeout. Each evicted topic is unloaded, persisting its
+// in-memory segment, so it can be reloaded when its next used.
+func (b *Broker) evictIdle() {
+	for _, topic := range b.topicsSnapshot() {
+		// Hold the broker lock while checking if the topic is idle and
+		// removing it, so the topic can't be fetched in between. Note the
+		// topic is unloaded without the lock so other topics aren't
+		// blocked, though the topic can't be reloaded until its unloaded.
+		b.mu.Lock()
+		if !topic.closeIfIdle(b.options.IdleTimeout) {
+			b.mu.Unlock()
+			continue
+		}
+		unloaded := make(chan interface{})
+		delete(b.topics, topic.Name())
+		b.evicting[topic.Name()] = unloaded
+		b.mu.Unlock()
+
+		err := topic.unload()
+
+		b.mu.Lock()
+		delete(b.evicting, topic.Name())
+		close(unloaded)
+		b.mu.Unlock()
+
+		if err != nil {
+			b.logger.Error(
+				"failed to evict topic",
+				zap.String("topic", topic.Name()),
+				zap.Error(err),
+			)
+			continue
+		}
+		b.logger.Debug(
+			"evicted idle topic",
+			zap.String("topic", topic.Name()),
+		)
+	}
+}
+
+// expireProducers removes the idempotent producers that haven't published to
+// each topic within the producer expiry.
+func (b *Broker) expireProducers() {
+	for _, topic := range b.topicsSnapshot() {
+		if removed := topic.ExpireProducers(b.options.ProducerExpiry); removed > 0 {
+			b.logger.Debug(
+				"expired producers",
+				zap.String("topic", topic.Name()),
+				zap.Int("removed", removed),
+			)
+		}
+	}
+}
+
+// waitForEviction waits for the topic with the given name to be unloaded if
+// its being evicted. The broker lock must be held, though is released while
+// waiting.
+func (b *Broker) waitForEviction(name string) {
+	for {
+		unloaded, ok := b.evicting[name]
+		if !ok {
+			return
+		}
+
+		b.mu.Unlock()
+		<-unloaded
+		b.mu.Lock()
+	}
+}
+
+// loadTopic creates the topic with the given name. If the topic is persisted
+// its loaded from disk.
+func (b *Broker) loadTopic(name string) (*Topic, error) {
+	options := b.options.topicOptions(name)
+	if !b.options.Persisted {
+		return NewTopic(name, options, b.logger), nil
+	}
+	return LoadTopic(name, options, b.logger)
+}
+
+// retain removes expired segments from all topics.
+func (b *Broker) retain() {
+	for _, topic := range b.topicsSnapshot() {
+		removed, err := topic.Retain()
+		if err != nil {
+			b.logger.Error(
+				"failed to remove expired segments",
+				zap.String("topic", topic.Name()),
+				zap.Error(err),
+			)
+			continue
+		}
+		if removed > 0 {
+			b.logger.Debug(
+				"removed expired segments",
+				zap.String("topic", topic.Name()),
+				zap.Int("segments", removed),
+				zap.Uint64("earliest-offset", topic.EarliestOffset()),
+			)
+		}
+	}
+}
+
+// compact compacts all compacted topics.
+func (b *Broker) compact() {
+	for _, topic := range b.topicsSnapshot() {
+		removed, err := topic.Compact()
+		if err != nil {
+			b.logger.Error(
+				"failed to compact topic",
+				zap.String("topic", topic.Name()),
+				zap.Error(err),
+			)
+			continue
+		}
+		if removed > 0 {
+			b.logger.Debug(
+				"compacted topic",
+				zap.String("topic", topic.Name()),
+				zap.Int("messages", removed),
+			)
+		}
+	}
+}
+
+// offload moves old segments in all topics to tiered storage.
+func (b *Broker) offload() {
+	for _, topic := range b.topicsSnapshot() {
+		offloaded, err := topic.Offload()
+		if err != nil {
+			b.logger.Error(
+				"failed to offload segments",
+				zap.String("topic", topic.Name()),
+				zap.Error(err),
+			)
+			continue
+		}
+		if offloaded > 0 {
+			b.logger.Debug(
+				"offloaded segments",
+				zap.String("topic", topic.Name()),
+				zap.Int("segments", offloaded),
+			)
+		}
+	}
+}
+
+// topicsSnapshot returns a copy of the active topics, so they can be iterated
+// without holding the broker lock.
+func (b *Broker) topicsSnapshot() []*Topic {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topics := make([]*Topic, 0, len(b.topics))
+	for _, topic := range b.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// runPeriodic runs fn every interval in a background goroutine until the
+// broker is closed.
+func (b *Broker) runPeriodic(interval time.Duration, fn func()) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-b.done:
+				return
+			}
+		}
+	}()
 }
@@ -0,0 +1,273 @@
+package topic
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andydunstall/figg/server/pkg/commitlog"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBroker_RecoverPersistedTopics(t *testing.T) {
+	dir := t.TempDir()
+
+	options := Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Dir:         dir,
+	}
+
+	broker := NewBroker(options, zap.NewNop())
+	topic, err := broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	topic.Publish(nil, []byte("foo"))
+	topic.Publish(nil, []byte("bar"))
+	assert.Nil(t, topic.log.Flush())
+
+	// Create a new broker using the same directory, as if the node restarted.
+	broker.Close()
+	broker = NewBroker(options, zap.NewNop())
+	defer broker.Close()
+	assert.Nil(t, broker.Recover())
+
+	topic, err = broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(22), topic.Offset())
+
+	b, err := topic.GetMessage(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), b.Value)
+
+	b, err = topic.GetMessage(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), b.Value)
+}
+
+func TestBroker_RecoverOffloadedTopics(t *testing.T) {
+	dir := t.TempDir()
+
+	options := Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Dir:         dir + "/topics",
+		Storage:     commitlog.NewLocalStorage(dir + "/storage"),
+	}
+
+	broker := NewBroker(options, zap.NewNop())
+	topic, err := broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	topic.Publish(nil, []byte("foo"))
+	assert.Nil(t, topic.log.Flush())
+	topic.Publish(nil, []byte("bar"))
+
+	offloaded, err := topic.Offload()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, offloaded)
+	assert.Nil(t, topic.log.Flush())
+
+	// Create a new broker using the same directory, as if the node restarted.
+	broker.Close()
+	broker = NewBroker(options, zap.NewNop())
+	defer broker.Close()
+	assert.Nil(t, broker.Recover())
+
+	topic, err = broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(22), topic.Offset())
+
+	b, err := topic.GetMessage(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), b.Value)
+
+	b, err = topic.GetMessage(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), b.Value)
+}
+
+func TestBroker_RecoverMissingDir(t *testing.T) {
+	broker := NewBroker(Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Dir:         t.TempDir(),
+	}, zap.NewNop())
+	defer broker.Close()
+	assert.Nil(t, broker.Recover())
+
+	topic, err := broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), topic.Offset())
+}
+
+func TestBroker_DeleteTopic(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := NewBroker(Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Dir:         dir,
+	}, zap.NewNop())
+	defer broker.Close()
+	topic, err := broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	topic.Publish(nil, []byte("foo"))
+	assert.Nil(t, topic.log.Flush())
+
+	attachment := newFakeAttachment()
+	sub, _, err := NewSubscription(attachment, topic)
+	assert.Nil(t, err)
+
+	assert.Nil(t, broker.DeleteTopic("mytopic"))
+
+	// The subscriber should be detached and the topics data removed.
+	assert.Equal(t, int32(1), sub.shutdown)
+	assert.Equal(t, ErrTopicDeleted, <-attachment.DetachedCh)
+	_, err = os.Stat(dir + "/mytopic")
+	assert.True(t, os.IsNotExist(err))
+	_, err = topic.Publish(nil, []byte("bar"))
+	assert.Equal(t, ErrTopicClosed, err)
+
+	// Using the topic again should create a new empty topic.
+	topic, err = broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), topic.Offset())
+
+	assert.Equal(t, ErrTopicNotFound, broker.DeleteTopic("unknown"))
+}
+
+func TestBroker_EvictIdleTopic(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := NewBroker(Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Dir:         dir,
+		IdleTimeout: time.Millisecond,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	topic, err := broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	topic.Publish(nil, []byte("foo"))
+	topic.Publish(nil, []byte("bar"))
+
+	// Topics with subscribers should never be evicted.
+	sub, _, err := NewSubscription(newFakeAttachment(), topic)
+	assert.Nil(t, err)
+	<-time.After(time.Millisecond * 5)
+	broker.evictIdle()
+	assert.False(t, topic.Closed())
+
+	sub.Shutdown()
+	<-time.After(time.Millisecond * 5)
+	broker.evictIdle()
+	assert.True(t, topic.Closed())
+
+	// Publishing to the evicted topic should fail.
+	_, err = topic.Publish(nil, []byte("car"))
+	assert.Equal(t, ErrTopicClosed, err)
+
+	// Fetching the topic again should reload it from disk.
+	reloaded, err := broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	assert.NotEqual(t, topic, reloaded)
+	assert.Equal(t, uint64(22), reloaded.Offset())
+
+	m, err := reloaded.GetMessage(11)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), m.Value)
+}
+
+func TestBroker_DeleteEvictedTopic(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := NewBroker(Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Dir:         dir,
+		IdleTimeout: time.Millisecond,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	topic, err := broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+	topic.Publish(nil, []byte("foo"))
+
+	<-time.After(time.Millisecond * 5)
+	broker.evictIdle()
+	assert.True(t, topic.Closed())
+
+	// Deleting the evicted topic should remove it from disk.
+	assert.Nil(t, broker.DeleteTopic("mytopic"))
+	_, err = os.Stat(dir + "/mytopic")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBroker_MemoryBudgetInMemory(t *testing.T) {
+	broker := NewBroker(Options{
+		Persisted:    false,
+		SegmentSize:  1000,
+		MemoryBudget: 10000,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	foo, err := broker.GetTopic("foo")
+	assert.Nil(t, err)
+	bar, err := broker.GetTopic("bar")
+	assert.Nil(t, err)
+
+	value := make([]byte, 100)
+	for i := 0; i != 500; i++ {
+		_, err := foo.Publish(nil, value)
+		assert.Nil(t, err)
+		_, err = bar.Publish(nil, value)
+		assert.Nil(t, err)
+	}
+
+	// The memory used across both topics should stay within the budget, so
+	// the oldest messages in each topic are dropped.
+	assert.LessOrEqual(t, broker.MemoryUsed(), uint64(10000))
+	assert.Greater(t, broker.MemoryUsed(), uint64(0))
+	_, err = foo.GetMessage(0)
+	assert.NotNil(t, err)
+	_, err = bar.GetMessage(0)
+	assert.NotNil(t, err)
+}
+
+func TestBroker_DegradedTopic(t *testing.T) {
+	dir := t.TempDir()
+
+	broker := NewBroker(Options{
+		Persisted:   true,
+		SegmentSize: 10,
+		Dir:         dir,
+	}, zap.NewNop())
+	defer broker.Close()
+
+	topic, err := broker.GetTopic("mytopic")
+	assert.Nil(t, err)
+
+	// Create a directory at the segment file path so persisting fails.
+	assert.Nil(t, os.MkdirAll(dir+"/mytopic/0.data", os.ModePerm))
+	_, err = topic.Publish(nil, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return topic.Health() != nil
+	}, time.Second, time.Millisecond*10)
+
+	// Publishes should be refused while degraded.
+	_, err = topic.Publish(nil, []byte("bar"))
+	assert.ErrorIs(t, err, ErrTopicDegraded)
+	_, ok := broker.DegradedTopics()["mytopic"]
+	assert.True(t, ok)
+
+	// Once the segment is persisted the topic should accept publishes.
+	assert.Nil(t, os.Remove(dir+"/mytopic/0.data"))
+	assert.Eventually(t, func() bool {
+		return topic.Health() == nil
+	}, time.Second*2, time.Millisecond*10)
+	_, err = topic.Publish(nil, []byte("bar"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(broker.DegradedTopics()))
+}
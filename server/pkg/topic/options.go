@@ -1,5 +1,11 @@
 package topic
 
+import (
+	"time"
+
+	"github.com/andydunstall/figg/server/pkg/commitlog"
+)
+
 type Options struct {
 	// Persisted indicates the commit log segments should be persisted to disk.
 	Persisted bool
@@ -9,4 +15,86 @@ type Options struct {
 
 	// SegmentSize is the size of the commit log segments to use.
 	SegmentSize uint64
+
+	// RetentionAge is the maximum age of persisted commit log segments before
+	// they are deleted. If 0 segments are never expired.
+	RetentionAge time.Duration
+
+	// RetentionSize is the maximum size of each topics commit log in bytes.
+	// If exceeded the oldest persisted segments are deleted. If 0 the size is
+	// unlimited.
+	RetentionSize uint64
+
+	// Durability defines when published messages are synced to disk. This is
+	// only used if Persisted is true.
+	Durability commitlog.Durability
+
+	// SyncInterval is the interval between syncing messages to disk when
+	// using commitlog.DurabilityInterval.
+	SyncInterval time.Duration
+
+	// Compression is the codec used to compress segments when they are
+	// persisted.
+	Compression commitlog.Compression
+
+	// Compaction indicates the topic is compacted, so only the latest
+	// message with each key is retained. This is only used if Persisted is
+	// true.
+	Compaction bool
+
+	// CompactedTopics is the names of the topics to compact. This is used by
+	// the broker to set Compaction for each topic.
+	CompactedTopics []string
+
+	// Storage is the tiered storage backend persisted segments are offloaded
+	// to. If nil segments are never offloaded.
+	Storage commitlog.Storage
+
+	// OffloadAge is the age of persisted commit log segments before they are
+	// offloaded to Storage.
+	OffloadAge time.Duration
+
+	// IdleTimeout is the duration a topic must have no subscribers and no
+	// publishes before its evicted from memory. Evicted topics are reloaded
+	// from disk when next used. This is only used if Persisted is true. If 0
+	// topics are never evicted.
+	IdleTimeout time.Duration
+
+	// ProducerExpiry is the duration an idempotent producer must not publish
+	// to a topic before the topic stops tracking its publishes. Retries from
+	// the producer after it expires may be added again. If 0 producers never
+	// expire.
+	ProducerExpiry time.Duration
+
+	// MemoryBudget is the maximum memory in bytes used by the in-memory
+	// segments across all topics. If exceeded, in-memory segments are
+	// persisted early, or if not Persisted the oldest segments are dropped.
+	// If 0 the memory used is unlimited.
+	MemoryBudget uint64
+
+	// memory tracks the memory used by the in-memory segments across all
+	// topics. This is set by the broker.
+	memory *commitlog.MemoryBudget
+}
+
+// topicOptions returns the options for the topic with the given name.
+func (o Options) topicOptions(name string) Options {
+	for _, compacted := range o.CompactedTopics {
+		if compacted == name {
+			o.Compaction = true
+		}
+	}
+	return o
+}
+
+func (o Options) commitLogOptions() commitlog.Options {
+	return commitlog.Options{
+		Persisted:    o.Persisted,
+		SegmentSize:  o.SegmentSize,
+		Durability:   o.Durability,
+		SyncInterval: o.SyncInterval,
+		Compression:  o.Compression,
+		Storage:      o.Storage,
+		Memory:       o.memory,
+	}
 }
@@ -0,0 +1,72 @@
+package topic
+
+import (
+	"time"
+)
+
+const (
+	// producerHistoryLen is the number of recent publishes tracked for each
+	// producer, to find the offset of a retried publish.
+	producerHistoryLen = 1024
+)
+
+type producerPublish struct {
+	seqNum uint64
+	offset uint64
+}
+
+// producer tracks the recent publishes from a producer to a topic, to detect
+// retried publishes.
+//
+// Producers assign increasing sequence numbers to their publishes, so a
+// publish with a sequence number less than or equal to the last sequence
+// number published is a retry.
+type producer struct {
+	// lastSeqNum is the sequence number of the latest publish.
+	lastSeqNum uint64
+	// recent contains the most recent publishes in sequence number order.
+	recent []producerPublish
+	// lastUsed is the last time the producer published to the topic.
+	lastUsed time.Time
+}
+
+func newProducer() *producer {
+	return &producer{
+		recent:   []producerPublish{},
+		lastUsed: time.Now(),
+	}
+}
+
+// IsDuplicate returns whether the publish with the given sequence number has
+// already been added to the topic.
+func (p *producer) IsDuplicate(seqNum uint64) bool {
+	return len(p.recent) > 0 && seqNum <= p.lastSeqNum
+}
+
+// Offset returns the offset of the publish with the given sequence number.
+// Returns false if the publish is no longer tracked.
+func (p *producer) Offset(seqNum uint64) (uint64, bool) {
+	for i := len(p.recent) - 1; i >= 0; i-- {
+		if p.recent[i].seqNum == seqNum {
+			return p.recent[i].offset, true
+		}
+	}
+	return 0, false
+}
+
+// Add records the publish with the given sequence number was added to the
+// topic at the given offset.
+func (p *producer) Add(seqNum uint64, offset uint64) {
+	p.lastSeqNum = seqNum
+	p.lastUsed = time.Now()
+
+	// Avoid copying on every publish by only truncating once the history
+	// doubles in length.
+	if len(p.recent) == producerHistoryLen*2 {
+		p.recent = append(p.recent[:0], p.recent[producerHistoryLen:]...)
+	}
+	p.recent = append(p.recent, producerPublish{
+		seqNum: seqNum,
+		offset: offset,
+	})
+}
@@ -9,24 +9,49 @@ import (
 )
 
 type Attachment interface {
-	Send(ctx context.Context, m Message)
+	// Send sends the message to the subscriber.
+	//
+	// Live subscriptions send with a nil context while holding the topic
+	// lock, so Send must not block. If the subscriber isn't keeping up, Send
+	// returns ErrSlowSubscriber and the subscription is demoted to resuming
+	// from the commit log. Any other error drops the message, such as if the
+	// connection is closing.
+	//
+	// Resuming subscriptions send with a context that is cancelled on
+	// shutdown, so Send may block until the subscriber has caught up. If Send
+	// returns an error the subscription stops resuming.
+	Send(ctx context.Context, m Message) error
+	// Detached notifies the attachment that the server detached the
+	// subscription, such as if the topic was deleted, with the reason why.
+	Detached(s *Subscription, reason error)
 }
 
 // Subscription reads messages from the topic and sends to the connection.
 type Subscription struct {
 	topic *Topic
-	// offset is the offset of the next message to fetch in the topic.
-	// This is only set if the subscriber is resuming.
+	// offset is the offset of the next message to fetch in the topic. This
+	// is updated with the topic mutex held when the resume loop goes live
+	// and as live messages are sent, so if the subscription is demoted it
+	// resumes from the last message sent.
 	offset uint64
 
 	attachment Attachment
 
 	shutdown int32
+	// ctx is cancelled on shutdown to wake the resume loop if it is waiting
+	// for new messages or for the attachment to catch up.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// resumed is closed once the resume loop exits, or immediately if the
+	// subscription is not resuming. Replaced with the topic mutex held if
+	// the subscription is demoted.
+	resumed chan interface{}
 }
 
 // NewSubscription creates a subscription to the given topic starting from the
-// next message in the topic.
-func NewSubscription(attachment Attachment, topic *Topic) (*Subscription, uint64) {
+// next message in the topic. Returns ErrTopicClosed if the topic has been
+// deleted or evicted.
+func NewSubscription(attachment Attachment, topic *Topic) (*Subscription, uint64, error) {
 	// Use the offset of the last message in the topic.
 	return NewSubscriptionFromOffset(attachment, topic, topic.Offset())
 }
@@ -34,56 +59,188 @@ func NewSubscription(attachment Attachment, topic *Topic) (*Subscription, uint64
 // NewSubscriptionFromOffset creates a subscription to the given topic, starting
 // at the next message after the given offset. If the offset is less than the
 // earliest message retained by the topic, will subscribe from that earliest
-// retained message.
-func NewSubscriptionFromOffset(attachment Attachment, topic *Topic, offset uint64) (*Subscription, uint64) {
+// retained message. If the offset is not the offset of a message in the topic,
+// such as it is beyond the end of the topic or in the middle of a message,
+// will subscribe from the latest message.
+//
+// Returns ErrTopicClosed if the topic has been deleted or evicted, in which
+// case the caller should get the topic from the broker again.
+func NewSubscriptionFromOffset(attachment Attachment, topic *Topic, offset uint64) (*Subscription, uint64, error) {
+	// If the offset has expired round up to the earliest retained message.
+	if earliest := topic.EarliestOffset(); offset < earliest {
+		offset = earliest
+	}
+	// Never read from an invalid offset or we'd misread the bytes in the
+	// middle of a message as a message.
+	if err := topic.ValidateOffset(offset); err == commitlog.ErrInvalidOffset {
+		offset = topic.Offset()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &Subscription{
 		topic:      topic,
 		offset:     offset,
 		attachment: attachment,
+		ctx:        ctx,
+		cancel:     cancel,
+		resumed:    make(chan interface{}),
+	}
+	if err := topic.attach(); err != nil {
+		return nil, 0, err
 	}
 	// If we are not up to date with the topic run resume to send the backlog.
 	if offset == topic.Offset() {
+		// Close resumed before subscribing, since once subscribed the
+		// subscription may be demoted which replaces resumed.
+		close(s.resumed)
 		topic.Subscribe(s)
+		// If the topic was deleted before subscribing, Delete won't have
+		// detached the subscription.
+		if topic.Closed() {
+			go s.Detach(ErrTopicDeleted)
+		}
 	} else {
 		go s.resumeLoop()
 	}
-	return s, offset
+	return s, offset, nil
 }
 
-// Notify notifys the subscriber about a new message.
-func (s *Subscription) Notify(m Message) {
-	s.attachment.Send(nil, m)
+// TopicName returns the name of the topic subscribed to.
+func (s *Subscription) TopicName() string {
+	return s.topic.Name()
 }
 
-// Shutdown unsubscribes and stops the send loop.
+// Notify notifys the subscriber about a new message. Returns false if the
+// subscriber isn't keeping up so must be demoted. The topic mutex must be
+// held.
+func (s *Subscription) Notify(m Message) bool {
+	if err := s.attachment.Send(nil, m); err == ErrSlowSubscriber {
+		return false
+	}
+	s.offset = m.Offset
+	return true
+}
+
+// Shutdown unsubscribes and stops the send loop. Once Shutdown returns no more
+// messages are sent to the attachment. Shutting down a subscription that is
+// already shutdown does nothing.
 func (s *Subscription) Shutdown() {
-	s.topic.Unsubscribe(s)
+	s.close()
+}
+
+// Detach shuts down the subscription then notifies the attachment with the
+// reason the subscription was detached, such as the topic was deleted.
+// Detaching a subscription that is already shutdown does nothing.
+func (s *Subscription) Detach(reason error) {
+	if s.close() {
+		s.attachment.Detached(s, reason)
+	}
+}
 
+// close unsubscribes and stops the send loop. Returns false if the
+// subscription was already shutdown.
+func (s *Subscription) close() bool {
 	// Notify the send loop to stop (must signal it to wake up to check the
 	// shutdown flag).
-	atomic.StoreInt32(&s.shutdown, 1)
+	if !atomic.CompareAndSwapInt32(&s.shutdown, 0, 1) {
+		return false
+	}
+	s.cancel()
+
+	s.topic.Unsubscribe(s)
+	// Wait for the resume loop to exit so it doesn't send the rest of its
+	// batch after shutdown.
+	<-s.resumed
+	s.topic.detach()
+	return true
+}
+
+// demote reverts a live subscription that isn't keeping up to resuming from
+// the last message sent, so the backlog is read from the commit log rather
+// than buffered by the attachment. The topic mutex must be held and the
+// subscription must already be removed from the topics subscribers.
+func (s *Subscription) demote() {
+	s.resumed = make(chan interface{})
+	go s.resumeLoop()
+}
+
+func (s *Subscription) isShutdown() bool {
+	return atomic.LoadInt32(&s.shutdown) != 0
 }
 
 // resumeLoop iterates though the topics history until the subscriber is up
 // to date, then registers for new messages.
+//
+// The history is read in batches using a commit log reader, so resuming from
+// persisted segments doesn't need a lookup per message.
+//
+// If the reader reaches the end of the commit log but the topic has moved on,
+// such as a publish racing with the resume loop, the loop retries once. If
+// there is still nothing new to read it waits for the next publish rather than
+// spinning.
 func (s *Subscription) resumeLoop() {
+	defer close(s.resumed)
+
+	reader := s.topic.NewReader(s.offset)
+	// published is closed once there has been a publish since the last
+	// attempt to subscribe, or nil if the last read succeeded.
+	var published <-chan interface{}
 	for {
-		if s := atomic.LoadInt32(&s.shutdown); s != 0 {
+		if s.isShutdown() {
+			return
+		}
+		// If the topic has been deleted stop resuming. Note detaching
+		// waits for the resume loop to exit so must be done in the
+		// background.
+		if s.topic.Closed() {
+			go s.Detach(ErrTopicDeleted)
 			return
 		}
 
 		// Note if there is no message with offset, will round up to the
 		// earliest message on the topic.
-		m, err := s.topic.GetMessage(s.offset)
+		messages, err := reader.NextBatch()
 		if err == commitlog.ErrNotFound {
+			// If the message has been removed by retention (either before
+			// or while resuming), skip to the earliest retained message.
+			if earliest := s.topic.EarliestOffset(); reader.Offset() < earliest {
+				reader.Seek(earliest)
+				continue
+			}
+
 			// If we are up to date, register with the topic for the latest
 			// messages. Note checking if we are up to date and registering
 			// must be atomic to avoid missing messages.
-			if s.topic.SubscribeIfLatest(s.offset, s) {
+			subscribed, next := s.topic.SubscribeIfLatest(reader.Offset(), s)
+			if subscribed {
+				// If the topic was deleted before subscribing, Delete
+				// won't have detached the subscription.
+				if s.topic.Closed() {
+					go s.Detach(ErrTopicDeleted)
+				}
 				return
 			}
-			// If theres been a new message since we last checked just try
-			// again.
+			// If this is the first attempt since reading, theres been a
+			// new message since we last checked so just try again.
+			// Otherwise wait until there has been a publish since the
+			// last attempt, which returns immediately if there already
+			// has been.
+			if published != nil {
+				select {
+				case <-published:
+				case <-s.ctx.Done():
+					return
+				}
+			}
+			published = next
+			continue
+		} else if err == commitlog.ErrCorrupt {
+			// Never send corrupt messages to the subscriber. Since the
+			// record boundaries following a corrupt record can't be
+			// trusted, skip to the next segment. Note the commit log
+			// reports the corruption.
+			reader.Seek(s.topic.NextSegmentOffset(reader.Offset()))
+			published = nil
 			continue
 		} else if err != nil {
 			// TODO(AD) conn closed?
@@ -91,13 +248,23 @@ func (s *Subscription) resumeLoop() {
 			return
 		}
 
-		s.offset += commitlog.PrefixSize
-		s.offset += uint64(len(m))
-
-		s.attachment.Send(nil, Message{
-			Topic:   s.topic.Name(),
-			Message: m,
-			Offset:  s.offset,
-		})
+		published = nil
+		for _, m := range messages {
+			if s.isShutdown() {
+				return
+			}
+			// Note if the topic is compacted there may be no message at
+			// the next offset, in which case the reader returns the
+			// following message.
+			// Wait for the attachment to catch up rather than
+			// buffering the backlog.
+			if err := s.attachment.Send(s.ctx, Message{
+				Topic:   s.topic.Name(),
+				Message: m.Value,
+				Offset:  m.NextOffset,
+			}); err != nil {
+				return
+			}
+		}
 	}
 }
@@ -2,52 +2,90 @@ package topic
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/andydunstall/figg/utils"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 type fakeAttachment struct {
-	Ch chan Message
+	Ch         chan Message
+	DetachedCh chan error
 }
 
 func newFakeAttachment() *fakeAttachment {
 	return &fakeAttachment{
+		Ch:         make(chan Message, 64),
+		DetachedCh: make(chan error, 1),
+	}
+}
+
+func (a *fakeAttachment) Send(ctx context.Context, m Message) error {
+	a.Ch <- m
+	return nil
+}
+
+func (a *fakeAttachment) Detached(s *Subscription, reason error) {
+	a.DetachedCh <- reason
+}
+
+// slowAttachment rejects live sends as if the subscriber isn't keeping up
+// while slow is set.
+type slowAttachment struct {
+	Ch   chan Message
+	slow int32
+}
+
+func newSlowAttachment() *slowAttachment {
+	return &slowAttachment{
 		Ch: make(chan Message, 64),
 	}
 }
 
-func (a *fakeAttachment) Send(ctx context.Context, m Message) {
+func (a *slowAttachment) Send(ctx context.Context, m Message) error {
+	if ctx == nil && atomic.LoadInt32(&a.slow) != 0 {
+		return ErrSlowSubscriber
+	}
 	a.Ch <- m
+	return nil
 }
 
+func (a *slowAttachment) Detached(s *Subscription, reason error) {}
+
 func TestSubscription_SubscribeLatest(t *testing.T) {
 	topic := NewTopic("mytopic", Options{
 		Persisted:   false,
 		SegmentSize: 1000,
-	})
+	}, zap.NewNop())
 	attachment := newFakeAttachment()
-	sub, _ := NewSubscription(attachment, topic)
+	sub, _, err := NewSubscription(attachment, topic)
+	assert.Nil(t, err)
 	defer sub.Shutdown()
 
-	topic.Publish([]byte("foo"))
-	topic.Publish([]byte("bar"))
-	topic.Publish([]byte("car"))
+	topic.Publish(nil, []byte("foo"))
+	topic.Publish(nil, []byte("bar"))
+	topic.Publish(nil, []byte("car"))
 
 	assert.Equal(t, Message{
 		Topic:   "mytopic",
-		Offset:  7,
+		Offset:  11,
 		Message: []byte("foo"),
+		Prefix:  utils.EncodeDataMessagePrefix("mytopic", 11, []byte("foo")),
 	}, <-attachment.Ch)
 	assert.Equal(t, Message{
 		Topic:   "mytopic",
-		Offset:  14,
+		Offset:  22,
 		Message: []byte("bar"),
+		Prefix:  utils.EncodeDataMessagePrefix("mytopic", 22, []byte("bar")),
 	}, <-attachment.Ch)
 	assert.Equal(t, Message{
 		Topic:   "mytopic",
-		Offset:  21,
+		Offset:  33,
 		Message: []byte("car"),
+		Prefix:  utils.EncodeDataMessagePrefix("mytopic", 33, []byte("car")),
 	}, <-attachment.Ch)
 }
 
@@ -55,38 +93,252 @@ func TestSubscription_SubscribeRecover(t *testing.T) {
 	topic := NewTopic("mytopic", Options{
 		Persisted:   false,
 		SegmentSize: 1000,
-	})
+	}, zap.NewNop())
 
 	// Publish 2 messages prior to subscribing.
-	topic.Publish([]byte("foo"))
-	topic.Publish([]byte("bar"))
+	topic.Publish(nil, []byte("foo"))
+	topic.Publish(nil, []byte("bar"))
 
 	attachment := newFakeAttachment()
-	sub, _ := NewSubscriptionFromOffset(attachment, topic, 0)
+	sub, _, err := NewSubscriptionFromOffset(attachment, topic, 0)
+	assert.Nil(t, err)
 	defer sub.Shutdown()
 
 	// Publish 2 messages prior after subscribing.
-	topic.Publish([]byte("baz"))
-	topic.Publish([]byte("car"))
+	topic.Publish(nil, []byte("baz"))
+	topic.Publish(nil, []byte("car"))
 
 	assert.Equal(t, Message{
 		Topic:   "mytopic",
-		Offset:  7,
+		Offset:  11,
 		Message: []byte("foo"),
 	}, <-attachment.Ch)
 	assert.Equal(t, Message{
 		Topic:   "mytopic",
-		Offset:  14,
+		Offset:  22,
 		Message: []byte("bar"),
 	}, <-attachment.Ch)
 	assert.Equal(t, Message{
 		Topic:   "mytopic",
-		Offset:  21,
+		Offset:  33,
 		Message: []byte("baz"),
 	}, <-attachment.Ch)
 	assert.Equal(t, Message{
 		Topic:   "mytopic",
-		Offset:  28,
+		Offset:  44,
 		Message: []byte("car"),
 	}, <-attachment.Ch)
 }
+
+// Tests subscribing from an offset that has been removed by retention resumes
+// from the earliest retained message.
+func TestSubscription_SubscribeFromExpiredOffset(t *testing.T) {
+	dir := t.TempDir()
+
+	topic := NewTopic("mytopic", Options{
+		Persisted:     true,
+		SegmentSize:   1000,
+		Dir:           dir,
+		RetentionSize: 11,
+	}, zap.NewNop())
+	defer topic.Close()
+
+	topic.Publish(nil, []byte("foo"))
+	assert.Nil(t, topic.log.Flush())
+	topic.Publish(nil, []byte("bar"))
+	assert.Nil(t, topic.log.Flush())
+
+	removed, err := topic.Retain()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+
+	attachment := newFakeAttachment()
+	sub, offset, err := NewSubscriptionFromOffset(attachment, topic, 0)
+	assert.Nil(t, err)
+	defer sub.Shutdown()
+
+	assert.Equal(t, uint64(11), offset)
+	assert.Equal(t, Message{
+		Topic:   "mytopic",
+		Offset:  22,
+		Message: []byte("bar"),
+	}, <-attachment.Ch)
+}
+
+func TestSubscription_SubscribeFromInvalidOffset(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	topic.Publish(nil, []byte("foo"))
+	topic.Publish(nil, []byte("bar"))
+
+	// Subscribing from the middle of a message or beyond the end of the
+	// topic should subscribe from the latest message.
+	for _, offset := range []uint64{5, 100} {
+		attachment := newFakeAttachment()
+		sub, resolvedOffset, err := NewSubscriptionFromOffset(attachment, topic, offset)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(22), resolvedOffset)
+		sub.Shutdown()
+	}
+}
+
+func TestSubscription_Shutdown(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	attachment1 := newFakeAttachment()
+	sub1, _, err := NewSubscription(attachment1, topic)
+	assert.Nil(t, err)
+	attachment2 := newFakeAttachment()
+	sub2, _, err := NewSubscription(attachment2, topic)
+	assert.Nil(t, err)
+	defer sub2.Shutdown()
+
+	sub1.Shutdown()
+	topic.Publish(nil, []byte("foo"))
+
+	// Only the subscription that wasn't shut down should receive the message.
+	assert.Equal(t, Message{
+		Topic:   "mytopic",
+		Offset:  11,
+		Message: []byte("foo"),
+		Prefix:  utils.EncodeDataMessagePrefix("mytopic", 11, []byte("foo")),
+	}, <-attachment2.Ch)
+	assert.Equal(t, 0, len(attachment1.Ch))
+}
+
+func TestSubscription_ShutdownWhileResuming(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	for i := 0; i != 10; i++ {
+		topic.Publish(nil, []byte("foo"))
+	}
+
+	attachment := newFakeAttachment()
+	sub, _, err := NewSubscriptionFromOffset(attachment, topic, 0)
+	assert.Nil(t, err)
+	sub.Shutdown()
+
+	// Once shut down no more messages should be sent, including new
+	// messages published to the topic.
+	received := len(attachment.Ch)
+	topic.Publish(nil, []byte("bar"))
+	assert.Equal(t, received, len(attachment.Ch))
+	assert.Equal(t, 0, len(topic.subscribers))
+}
+
+func TestSubscription_DetachResumingOnDelete(t *testing.T) {
+	dir := t.TempDir()
+
+	topic := NewTopic("mytopic", Options{
+		Persisted:   true,
+		SegmentSize: 1000,
+		Dir:         dir,
+	}, zap.NewNop())
+
+	for i := 0; i != 10; i++ {
+		topic.Publish(nil, []byte("foo"))
+	}
+
+	// Use an attachment that blocks after the first message so the
+	// subscription is still resuming when the topic is deleted.
+	attachment := &fakeAttachment{
+		Ch:         make(chan Message),
+		DetachedCh: make(chan error, 1),
+	}
+	sub, _, err := NewSubscriptionFromOffset(attachment, topic, 0)
+	assert.Nil(t, err)
+	<-attachment.Ch
+
+	assert.Nil(t, topic.Delete())
+	// Unblock the resume loop.
+	go func() {
+		for range attachment.Ch {
+		}
+	}()
+
+	assert.Equal(t, ErrTopicDeleted, <-attachment.DetachedCh)
+	assert.Equal(t, int32(1), sub.shutdown)
+}
+
+// Tests a live subscriber that isn't keeping up is demoted to resuming from
+// the last message sent, then becomes live again once caught up, without
+// missing messages.
+func TestSubscription_DemoteSlowSubscriber(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	attachment := newSlowAttachment()
+	sub, _, err := NewSubscription(attachment, topic)
+	assert.Nil(t, err)
+	defer sub.Shutdown()
+
+	topic.Publish(nil, []byte("foo"))
+	assert.Equal(t, []byte("foo"), (<-attachment.Ch).Message)
+
+	// Reject the live send so the subscription is demoted. The resumed
+	// subscription sends the rejected message from the commit log.
+	atomic.StoreInt32(&attachment.slow, 1)
+	topic.Publish(nil, []byte("bar"))
+	atomic.StoreInt32(&attachment.slow, 0)
+
+	m := <-attachment.Ch
+	assert.Equal(t, []byte("bar"), m.Message)
+	assert.Equal(t, uint64(22), m.Offset)
+
+	// Wait for the subscription to become live again.
+	assert.Eventually(t, func() bool {
+		topic.mu.Lock()
+		defer topic.mu.Unlock()
+		return len(topic.subscribers) == 1
+	}, time.Second, time.Millisecond)
+
+	topic.Publish(nil, []byte("car"))
+	m = <-attachment.Ch
+	assert.Equal(t, []byte("car"), m.Message)
+	assert.Equal(t, uint64(33), m.Offset)
+}
+
+// Tests a subscription that resumed from an old offset then went live is
+// demoted to resume from the last message sent, rather than resending the
+// backlog it already resumed.
+func TestSubscription_DemoteResumedSubscriber(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	topic.Publish(nil, []byte("foo"))
+	topic.Publish(nil, []byte("bar"))
+
+	attachment := newSlowAttachment()
+	sub, _, err := NewSubscriptionFromOffset(attachment, topic, 0)
+	assert.Nil(t, err)
+	defer sub.Shutdown()
+
+	assert.Equal(t, []byte("foo"), (<-attachment.Ch).Message)
+	assert.Equal(t, []byte("bar"), (<-attachment.Ch).Message)
+
+	// Wait for the subscription to become live.
+	assert.Eventually(t, func() bool {
+		topic.mu.Lock()
+		defer topic.mu.Unlock()
+		return len(topic.subscribers) == 1
+	}, time.Second, time.Millisecond)
+
+	atomic.StoreInt32(&attachment.slow, 1)
+	topic.Publish(nil, []byte("car"))
+	atomic.StoreInt32(&attachment.slow, 0)
+
+	m := <-attachment.Ch
+	assert.Equal(t, []byte("car"), m.Message)
+	assert.Equal(t, uint64(33), m.Offset)
+}
@@ -1,35 +1,143 @@
 package topic
 
+import (
+	"sync"
+	"time"
+)
+
+// Subscriptions contains the subscriptions for a connection, with at most one
+// subscription per topic.
 type Subscriptions struct {
-	broker        *Broker
-	attachment    Attachment
-	subscriptions map[*Subscription]interface{}
+	broker     *Broker
+	attachment Attachment
+
+	// mu protects the below fields.
+	mu sync.Mutex
+	// subscriptions contains the subscriptions indexed by topic name.
+	subscriptions map[string]*Subscription
 }
 
 func NewSubscriptions(broker *Broker, attachment Attachment) *Subscriptions {
 	return &Subscriptions{
 		broker:        broker,
 		attachment:    attachment,
-		subscriptions: make(map[*Subscription]interface{}),
+		subscriptions: make(map[string]*Subscription),
 	}
 }
 
-func (s *Subscriptions) AddSubscription(topicName string) uint64 {
-	topic := s.broker.GetTopic(topicName)
-	sub, offset := NewSubscription(s.attachment, topic)
-	s.subscriptions[sub] = struct{}{}
-	return offset
+func (s *Subscriptions) AddSubscription(topicName string) (uint64, error) {
+	return s.addSubscription(topicName, func(topic *Topic) uint64 {
+		return topic.Offset()
+	})
+}
+
+func (s *Subscriptions) AddSubscriptionFromOffset(topicName string, lastOffset uint64) (uint64, error) {
+	return s.addSubscription(topicName, func(topic *Topic) uint64 {
+		return lastOffset
+	})
+}
+
+// AddSubscriptionFromTime subscribes to the topic starting from the messages
+// published at or after the given time. Returns the offset the subscription
+// starts from.
+func (s *Subscriptions) AddSubscriptionFromTime(topicName string, timestamp time.Time) (uint64, error) {
+	return s.addSubscription(topicName, func(topic *Topic) uint64 {
+		return topic.LookupByTime(timestamp)
+	})
 }
 
-func (s *Subscriptions) AddSubscriptionFromOffset(topicName string, lastOffset uint64) uint64 {
-	topic := s.broker.GetTopic(topicName)
-	sub, offset := NewSubscriptionFromOffset(s.attachment, topic, lastOffset)
-	s.subscriptions[sub] = struct{}{}
-	return offset
+// AddSubscriptionLastN subscribes to the topic starting from the last n
+// messages published to the topic. Returns the offset the subscription starts
+// from.
+func (s *Subscriptions) AddSubscriptionLastN(topicName string, n uint64) (uint64, error) {
+	return s.addSubscription(topicName, func(topic *Topic) uint64 {
+		offset, err := topic.LookupLastN(n)
+		if err != nil {
+			// If we can't find the last n messages, such as the segment
+			// was removed by retention while scanning, fallback to the
+			// earliest retained message.
+			offset = topic.EarliestOffset()
+		}
+		return offset
+	})
+}
+
+// RemoveSubscription shuts down the subscription to the topic with the given
+// name. Returns false if there is no subscription to the topic.
+func (s *Subscriptions) RemoveSubscription(topicName string) bool {
+	s.mu.Lock()
+	sub, ok := s.subscriptions[topicName]
+	delete(s.subscriptions, topicName)
+	s.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	sub.Shutdown()
+	return true
+}
+
+// RemoveDetached removes a subscription that was detached by the server.
+// Returns false if the subscription has already been removed or replaced,
+// such as if the client detached or re-attached the topic, in which case the
+// client must not be notified.
+func (s *Subscriptions) RemoveDetached(sub *Subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subscriptions[sub.TopicName()] != sub {
+		return false
+	}
+	delete(s.subscriptions, sub.TopicName())
+	return true
 }
 
 func (s *Subscriptions) UnsubscribeAll() {
-	for sub, _ := range s.subscriptions {
+	s.mu.Lock()
+	subscriptions := s.subscriptions
+	s.subscriptions = make(map[string]*Subscription)
+	s.mu.Unlock()
+
+	for _, sub := range subscriptions {
 		sub.Shutdown()
 	}
 }
+
+// addSubscription subscribes to the topic starting from the offset returned
+// by lookupOffset. If there is an existing subscription to the topic, such as
+// the client re-attached, it is replaced and shut down.
+//
+// If the topic is deleted or evicted after being fetched from the broker,
+// retries with the new topic.
+func (s *Subscriptions) addSubscription(topicName string, lookupOffset func(topic *Topic) uint64) (uint64, error) {
+	s.mu.Lock()
+	existing, ok := s.subscriptions[topicName]
+	delete(s.subscriptions, topicName)
+	s.mu.Unlock()
+
+	if ok {
+		existing.Shutdown()
+	}
+
+	for {
+		topic, err := s.broker.GetTopic(topicName)
+		if err != nil {
+			return 0, err
+		}
+		// Hold the lock while creating the subscription so if it is
+		// detached immediately, RemoveDetached waits until its added.
+		s.mu.Lock()
+		sub, offset, err := NewSubscriptionFromOffset(s.attachment, topic, lookupOffset(topic))
+		if err == ErrTopicClosed {
+			s.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+		s.subscriptions[topicName] = sub
+		s.mu.Unlock()
+		return offset, nil
+	}
+}
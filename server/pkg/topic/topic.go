@@ -1,20 +1,53 @@
 package topic
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/andydunstall/figg/server/pkg/commitlog"
+	"github.com/andydunstall/figg/utils"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrTopicClosed is returned when publishing to a topic that has been
+	// deleted or evicted. The caller should get the topic from the broker
+	// again.
+	ErrTopicClosed = errors.New("topic closed")
+	// ErrTopicDegraded is returned when publishing to a topic that is failing
+	// to persist its commit log. The publish may succeed once the topic
+	// recovers.
+	ErrTopicDegraded = errors.New("topic degraded")
+	// ErrDuplicateOffsetUnknown is returned when publishing idempotently
+	// and the publish is a retry of a publish already added to the topic, but
+	// the offset of the original publish is no longer known.
+	ErrDuplicateOffsetUnknown = errors.New("duplicate publish, offset unknown")
+	// ErrTopicDeleted is the reason subscriptions are detached when their
+	// topic is deleted.
+	ErrTopicDeleted = errors.New("topic deleted")
+	// ErrSlowSubscriber is returned by an attachment when a live subscriber
+	// isn't keeping up, in which case the subscription is demoted to resuming
+	// from the commit log.
+	ErrSlowSubscriber = errors.New("slow subscriber")
 )
 
 type Message struct {
 	Topic   string
 	Message []byte
 	Offset  uint64
+	// Prefix is the encoded DATA message prefix for the message. When
+	// publishing, the prefix is encoded once and shared by all subscribers,
+	// so it must never be modified. If nil the attachment must encode the
+	// prefix itself.
+	Prefix []byte
 }
 
 type Topic struct {
-	name string
-	log  *commitlog.CommitLog
+	name    string
+	log     *commitlog.CommitLog
+	options Options
 
 	// Mutex protecting the below fields.
 	mu sync.Mutex
@@ -26,23 +59,69 @@ type Topic struct {
 	// expecting the number of subscribers to be relatively smallk
 	subscribers []*Subscription
 	offset      uint64
+	// published is closed the next time the topic offset changes, to wake
+	// resuming subscriptions waiting for new messages. It is created lazily so
+	// publishing doesn't allocate a channel unless a subscription is waiting.
+	published chan interface{}
+
+	// attached is the number of subscriptions to the topic, including
+	// subscriptions that are still resuming so aren't in subscribers.
+	attached int
+	// lastUsed is the last time the topic was published to or fetched from
+	// the broker, used to find idle topics.
+	lastUsed time.Time
+	// closed indicates the topic has been deleted or evicted, so must not be
+	// used.
+	closed bool
+
+	// producers contains the recent publishes of each idempotent producer,
+	// keyed by producer ID. Note this is only kept in memory, so is lost if
+	// the topic is evicted or the node restarts.
+	producers map[string]*producer
 }
 
-func NewTopic(name string, options Options) *Topic {
+func NewTopic(name string, options Options, logger *zap.Logger) *Topic {
 	log := commitlog.NewCommitLog(
-		options.Persisted,
-		options.SegmentSize,
 		options.Dir+"/"+name,
+		options.commitLogOptions(),
+		logger,
 	)
 	return &Topic{
 		name:        name,
 		log:         log,
+		options:     options,
 		mu:          sync.Mutex{},
 		subscribers: []*Subscription{},
 		offset:      0,
+		lastUsed:    time.Now(),
+		producers:   map[string]*producer{},
 	}
 }
 
+// LoadTopic creates a topic whose commit log is recovered from the segments
+// persisted in the topics directory. The topic offset is restored to the end
+// of the recovered commit log.
+func LoadTopic(name string, options Options, logger *zap.Logger) (*Topic, error) {
+	log, err := commitlog.LoadCommitLog(
+		options.Dir+"/"+name,
+		options.commitLogOptions(),
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Topic{
+		name:        name,
+		log:         log,
+		options:     options,
+		mu:          sync.Mutex{},
+		subscribers: []*Subscription{},
+		offset:      log.Offset(),
+		lastUsed:    time.Now(),
+		producers:   map[string]*producer{},
+	}, nil
+}
+
 func (t *Topic) Name() string {
 	return t.name
 }
@@ -55,63 +134,432 @@ func (t *Topic) Offset() uint64 {
 	return t.offset
 }
 
-// GetMessage returns the message with the given offset. If the offset is
-// less than the earliest message, will round up to the next message.
-func (t *Topic) GetMessage(offset uint64) ([]byte, error) {
-	b, err := t.log.Lookup(offset)
-	if err != nil {
-		return nil, err
-	}
-	return b, nil
+// EarliestOffset returns the offset of the earliest message retained by the
+// topic.
+func (t *Topic) EarliestOffset() uint64 {
+	return t.log.EarliestOffset()
 }
 
-func (t *Topic) Publish(b []byte) {
-	// Add to the commit log before sending to subscribers.
-	t.log.Append(b)
+// NextSegmentOffset returns the offset of the commit log segment following the
+// segment containing the given offset.
+func (t *Topic) NextSegmentOffset(offset uint64) uint64 {
+	return t.log.NextSegmentOffset(offset)
+}
+
+// LookupByTime returns the offset to resume from to receive all messages
+// published at or after the given time. This may include some messages
+// published shortly before the given time.
+func (t *Topic) LookupByTime(timestamp time.Time) uint64 {
+	return t.log.LookupByTime(timestamp)
+}
+
+// LookupLastN returns the offset to resume from to receive the last n messages
+// published to the topic. If the topic has fewer than n messages returns the
+// earliest offset.
+func (t *Topic) LookupLastN(n uint64) (uint64, error) {
+	return t.log.LookupLastN(n)
+}
+
+// ValidateOffset checks the given offset is the offset of a message in the
+// topic, or the end of the topic. Returns commitlog.ErrInvalidOffset if not.
+func (t *Topic) ValidateOffset(offset uint64) error {
+	return t.log.ValidateOffset(offset)
+}
+
+// Retain removes expired messages from the topics commit log, according to the
+// configured retention options. Returns the number of segments removed.
+func (t *Topic) Retain() (int, error) {
+	return t.log.Retain(t.options.RetentionAge, t.options.RetentionSize)
+}
 
+// GetMessage returns the message with the given offset. If the message has
+// been removed by compaction, returns the next retained message.
+func (t *Topic) GetMessage(offset uint64) (commitlog.Record, error) {
+	return t.log.Lookup(offset)
+}
+
+// NewReader returns a reader that reads the topics messages sequentially
+// starting at the given offset.
+func (t *Topic) NewReader(offset uint64) *commitlog.Reader {
+	return t.log.NewReader(offset)
+}
+
+// Publish adds the message to the topic and sends it to all attached
+// subscribers. Returns the offset of the topic after the message was added.
+//
+// The key is optional (nil if the message has no key). If the topic is
+// compacted, only the latest message with each key is retained.
+//
+// Note the message may not be durable when Publish returns, so use OnDurable
+// to wait for the message to be synced.
+//
+// If the topic has been deleted or evicted returns ErrTopicClosed. If the topic
+// is degraded returns an error wrapping ErrTopicDegraded.
+func (t *Topic) Publish(key []byte, b []byte) (uint64, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	t.offset += uint64(len(b) + 4)
+	return t.publishLocked(key, b)
+}
+
+// PublishIdempotent is the same as Publish except if the producer with the
+// given ID has already published the message with the given sequence number,
+// the message isn't added again. This lets producers safely retry publishes
+// that may have been added, such as after reconnecting.
+//
+// Returns the offset of the message and whether the publish was a retry. If
+// the publish was a retry but is too old to find its offset, returns
+// ErrDuplicateOffsetUnknown.
+func (t *Topic) PublishIdempotent(producerID string, seqNum uint64, key []byte, b []byte) (uint64, bool, error) {
+	return t.publishIdempotent(producerID, seqNum, func() (uint64, error) {
+		return t.publishLocked(key, b)
+	})
+}
+
+// PublishBatch adds the keys and values of the given records to the topic
+// atomically, and returns the offset of the end of the batch. Once published
+// the Offset and NextOffset of each record are set, where NextOffset matches
+// the offset subscribers receive with the message.
+func (t *Topic) PublishBatch(records []commitlog.Record) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.publishBatchLocked(records)
+}
+
+// PublishBatchIdempotent is the same as PublishBatch except, as with
+// PublishIdempotent, if the producer has already published the batch with the
+// given sequence number the batch isn't added again.
+//
+// Returns the offset of the end of the batch and whether the publish was a
+// retry. If the publish was a retry the offsets of the records aren't set,
+// and if the retry is too old to find its offset returns
+// ErrDuplicateOffsetUnknown.
+func (t *Topic) PublishBatchIdempotent(producerID string, seqNum uint64, records []commitlog.Record) (uint64, bool, error) {
+	return t.publishIdempotent(producerID, seqNum, func() (uint64, error) {
+		return t.publishBatchLocked(records)
+	})
+}
+
+// ExpireProducers removes the idempotent producers that haven't published to
+// the topic within the given age. Returns the number of producers removed.
+func (t *Topic) ExpireProducers(age time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := 0
+	for id, p := range t.producers {
+		if time.Since(p.lastUsed) > age {
+			delete(t.producers, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// publishIdempotent publishes using the given publish function, which is
+// called with the topic mutex held, unless the producer has already published
+// the given sequence number.
+func (t *Topic) publishIdempotent(producerID string, seqNum uint64, publish func() (uint64, error)) (uint64, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, false, ErrTopicClosed
+	}
+
+	p, ok := t.producers[producerID]
+	if ok && p.IsDuplicate(seqNum) {
+		p.lastUsed = time.Now()
+		offset, ok := p.Offset(seqNum)
+		if !ok {
+			return 0, true, ErrDuplicateOffsetUnknown
+		}
+		return offset, true, nil
+	}
+
+	offset, err := publish()
+	if err != nil {
+		return 0, false, err
+	}
+	if !ok {
+		p = newProducer()
+		t.producers[producerID] = p
+	}
+	p.Add(seqNum, offset)
+	return offset, false, nil
+}
+
+// publishLocked adds the message to the topic. The topic mutex must be held.
+func (t *Topic) publishLocked(key []byte, b []byte) (uint64, error) {
+	if t.closed {
+		return 0, ErrTopicClosed
+	}
+	// Refuse publishes while the commit log is failing to persist, rather
+	// than growing the in-memory segments without bound.
+	if err := t.log.PersistErr(); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrTopicDegraded, err)
+	}
+	t.lastUsed = time.Now()
+
+	// Add to the commit log before sending to subscribers. Note the lock is
+	// held while appending so the subscribers receive messages in the same
+	// order as the commit log.
+	offset, err := t.log.Append(key, b)
+	if err != nil {
+		return 0, err
+	}
+	t.offset = offset
+	t.notifyPublishedLocked()
 
 	// Notify all subscribers to wake up and send the latest message.
+	t.notifyLocked(b, offset)
+
+	return offset, nil
+}
+
+// publishBatchLocked adds the records to the topic. The topic mutex must be
+// held.
+func (t *Topic) publishBatchLocked(records []commitlog.Record) (uint64, error) {
+	if t.closed {
+		return 0, ErrTopicClosed
+	}
+	if err := t.log.PersistErr(); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrTopicDegraded, err)
+	}
+	t.lastUsed = time.Now()
+
+	offset, err := t.log.AppendBatch(records)
+	if err != nil {
+		return 0, err
+	}
+	t.offset = offset
+	t.notifyPublishedLocked()
+
+	for _, r := range records {
+		t.notifyLocked(r.Value, r.NextOffset)
+	}
+
+	return offset, nil
+}
+
+// notifyLocked sends the message to all subscribers. The topic mutex must be
+// held.
+//
+// Rather than each subscriber encoding the same DATA prefix, the prefix is
+// encoded once and shared by all subscribers, which dominates the cost of
+// publishing to topics with many subscribers.
+func (t *Topic) notifyLocked(b []byte, offset uint64) {
+	if len(t.subscribers) == 0 {
+		return
+	}
+
 	m := Message{
 		Topic:   t.name,
 		Message: b,
-		Offset:  t.offset,
+		Offset:  offset,
+		Prefix:  utils.EncodeDataMessagePrefix(t.name, offset, b),
 	}
+	var demoted []*Subscription
 	for _, sub := range t.subscribers {
-		sub.Notify(m)
+		if !sub.Notify(m) {
+			demoted = append(demoted, sub)
+		}
+	}
+	// Subscribers that aren't keeping up revert to resuming from the commit
+	// log, which reads the message they failed to send.
+	for _, sub := range demoted {
+		t.unsubscribeLocked(sub)
+		sub.demote()
+	}
+}
+
+// notifyPublishedLocked wakes any resuming subscriptions waiting for new
+// messages. The topic mutex must be held.
+func (t *Topic) notifyPublishedLocked() {
+	if t.published != nil {
+		close(t.published)
+		t.published = nil
+	}
+}
+
+// Offload moves commit log segments older than the configured offload age to
+// tiered storage. Returns the number of segments offloaded. If no storage is
+// configured this does nothing.
+func (t *Topic) Offload() (int, error) {
+	return t.log.Offload(t.options.OffloadAge)
+}
+
+// Compact removes messages from the topics commit log that have been replaced
+// by a later message with the same key. Returns the number of messages
+// removed. If the topic isn't compacted this does nothing.
+func (t *Topic) Compact() (int, error) {
+	if !t.options.Compaction {
+		return 0, nil
+	}
+	return t.log.Compact()
+}
+
+// OnDurable calls cb once all messages up to the given offset are durable
+// according to the topics durability policy.
+func (t *Topic) OnDurable(offset uint64, cb func(err error)) {
+	t.log.OnDurable(offset, cb)
+}
+
+// Close closes the topics commit log.
+func (t *Topic) Close() {
+	t.log.Close()
+}
+
+// Delete detaches all subscribers then removes the topics commit log, including
+// its persisted segments.
+func (t *Topic) Delete() error {
+	t.mu.Lock()
+	t.closed = true
+	subscribers := t.subscribers
+	t.subscribers = nil
+	// Wake any resuming subscriptions so they see the topic is closed.
+	t.notifyPublishedLocked()
+	t.mu.Unlock()
+
+	// Note subscriptions that are still resuming detach once they see the
+	// topic is closed.
+	for _, sub := range subscribers {
+		sub.Detach(ErrTopicDeleted)
+	}
+	return t.log.Remove()
+}
+
+// Health returns an error if the topic is degraded, such as if its failing to
+// persist its commit log, or nil if the topic is healthy.
+func (t *Topic) Health() error {
+	return t.log.PersistErr()
+}
+
+// Closed returns whether the topic has been deleted or evicted.
+func (t *Topic) Closed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.closed
+}
+
+// closeIfIdle closes the topic if it has no subscriptions and hasn't been used
+// for the given timeout. Returns true if the topic was closed, in which case
+// it must be unloaded.
+func (t *Topic) closeIfIdle(timeout time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed || t.attached > 0 || time.Since(t.lastUsed) < timeout {
+		return false
+	}
+	// Degraded topics may fail to unload, so keep them until they recover.
+	if t.log.PersistErr() != nil {
+		return false
+	}
+	t.closed = true
+	return true
+}
+
+// unload persists the topics commit log and closes it, so the topic can be
+// reloaded from disk.
+func (t *Topic) unload() error {
+	return t.log.Unload()
+}
+
+// touch marks the topic as used, so it isn't evicted.
+func (t *Topic) touch() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastUsed = time.Now()
+}
+
+// attach registers a new subscription to the topic. Returns ErrTopicClosed
+// if the topic has been deleted or evicted.
+func (t *Topic) attach() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return ErrTopicClosed
 	}
+	t.attached++
+	t.lastUsed = time.Now()
+	return nil
+}
+
+// detach unregisters a subscription from the topic.
+func (t *Topic) detach() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.attached--
+	t.lastUsed = time.Now()
 }
 
 func (t *Topic) Subscribe(s *Subscription) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	// If the topic is closed theres nothing to subscribe to.
+	if t.closed {
+		return
+	}
 	t.subscribers = append(t.subscribers, s)
 }
 
-func (t *Topic) SubscribeIfLatest(offset uint64, s *Subscription) bool {
+// SubscribeIfLatest subscribes s to new messages if offset is the latest
+// offset in the topic, so checking the subscription is up to date and
+// subscribing is atomic. Returns true if the subscription no longer needs to
+// resume, either since it was subscribed or the topic is closed.
+//
+// Otherwise returns false along with a channel that is closed the next time
+// the topic offset changes, so a subscription that can't yet read the latest
+// messages can wait for a publish rather than polling.
+func (t *Topic) SubscribeIfLatest(offset uint64, s *Subscription) (bool, <-chan interface{}) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	// If the topic is closed theres nothing to subscribe to, so stop
+	// resuming.
+	if t.closed {
+		return true, nil
+	}
 	if offset != t.offset {
-		return false
+		if t.published == nil {
+			t.published = make(chan interface{})
+		}
+		return false, t.published
+	}
+	// If the subscription was shut down while resuming it must not be
+	// subscribed, since Shutdown may have already unsubscribed.
+	if s.isShutdown() {
+		return true, nil
 	}
 
+	// Update the offset the resume loop reached, so if the subscription is
+	// later demoted it resumes from here rather than where it started.
+	s.offset = offset
 	t.subscribers = append(t.subscribers, s)
-	return true
+	return true, nil
 }
 
 func (t *Topic) Unsubscribe(s *Subscription) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	t.unsubscribeLocked(s)
+}
+
+// unsubscribeLocked removes the subscription from the topics subscribers. The
+// topic mutex must be held.
+func (t *Topic) unsubscribeLocked(s *Subscription) {
 	subscribers := make([]*Subscription, 0, len(t.subscribers))
 	for _, sub := range t.subscribers {
 		if s != sub {
-			subscribers = append(subscribers, s)
+			subscribers = append(subscribers, sub)
 		}
 	}
 	t.subscribers = subscribers
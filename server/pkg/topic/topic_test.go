@@ -3,13 +3,15 @@ package topic
 import (
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
-	"os"
 	"testing"
+	"time"
 
 	"github.com/andydunstall/figg/server/pkg/commitlog"
-	"github.com/google/uuid"
+	"github.com/andydunstall/figg/utils"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 type nopAttachment struct {
@@ -26,36 +28,65 @@ func newNopAttachment(expected int) *nopAttachment {
 	}
 }
 
-func (a *nopAttachment) Send(ctx context.Context, m Message) {
+func (a *nopAttachment) Send(ctx context.Context, m Message) error {
 	a.received++
 	if a.expected == a.received {
 		close(a.DoneCh)
 	}
+	return nil
 }
 
+func (a *nopAttachment) Detached(s *Subscription, reason error) {}
+
+// writerAttachment writes messages to a buffered writer, the same as a
+// connection, to benchmark fanning out messages to subscribers.
+type writerAttachment struct {
+	writer *utils.BufferedWriter
+	// sharedPrefix indicates whether to use the prefix encoded by the topic,
+	// otherwise the attachment encodes its own prefix for each message.
+	sharedPrefix bool
+}
+
+func newWriterAttachment(sharedPrefix bool) *writerAttachment {
+	return &writerAttachment{
+		writer:       utils.NewBufferedWriter(io.Discard, 0),
+		sharedPrefix: sharedPrefix,
+	}
+}
+
+func (a *writerAttachment) Send(ctx context.Context, m Message) error {
+	prefix := m.Prefix
+	if !a.sharedPrefix || prefix == nil {
+		prefix = utils.EncodeDataMessagePrefix(m.Topic, m.Offset, m.Message)
+	}
+	return a.writer.Write(prefix, m.Message)
+}
+
+func (a *writerAttachment) Detached(s *Subscription, reason error) {}
+
 func TestTopic_PublishMultipleMessages(t *testing.T) {
 	topic := NewTopic("mytopic", Options{
 		Persisted:   false,
 		SegmentSize: 1000,
-	})
+	}, zap.NewNop())
 
-	topic.Publish([]byte("foo"))
-	topic.Publish([]byte("bar"))
-	topic.Publish([]byte("car"))
+	topic.Publish(nil, []byte("foo"))
+	topic.Publish(nil, []byte("bar"))
+	topic.Publish(nil, []byte("car"))
 
 	b, err := topic.GetMessage(0)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("foo"), b)
+	assert.Equal(t, []byte("foo"), b.Value)
 
-	b, err = topic.GetMessage(7)
+	b, err = topic.GetMessage(11)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("bar"), b)
+	assert.Equal(t, []byte("bar"), b.Value)
 
-	b, err = topic.GetMessage(14)
+	b, err = topic.GetMessage(22)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("car"), b)
+	assert.Equal(t, []byte("car"), b.Value)
 
-	_, err = topic.GetMessage(21)
+	_, err = topic.GetMessage(33)
 	assert.Equal(t, commitlog.ErrNotFound, err)
 }
 
@@ -63,34 +94,243 @@ func TestTopic_PublishOneMessage(t *testing.T) {
 	topic := NewTopic("mytopic", Options{
 		Persisted:   false,
 		SegmentSize: 1000,
-	})
+	}, zap.NewNop())
 
-	topic.Publish([]byte("foo"))
+	topic.Publish(nil, []byte("foo"))
 
 	b, err := topic.GetMessage(0)
 	assert.Nil(t, err)
-	assert.Equal(t, []byte("foo"), b)
+	assert.Equal(t, []byte("foo"), b.Value)
 }
 
-func TestTopic_GetInitialMessage(t *testing.T) {
+// Tests subscribers share the DATA prefix encoded by the topic rather than
+// each encoding their own.
+func TestTopic_PublishSharesPrefix(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	attachment1 := newFakeAttachment()
+	sub1, _, err := NewSubscription(attachment1, topic)
+	assert.Nil(t, err)
+	defer sub1.Shutdown()
+
+	attachment2 := newFakeAttachment()
+	sub2, _, err := NewSubscription(attachment2, topic)
+	assert.Nil(t, err)
+	defer sub2.Shutdown()
+
+	topic.Publish(nil, []byte("foo"))
+
+	m1 := <-attachment1.Ch
+	m2 := <-attachment2.Ch
+	assert.Equal(t, utils.EncodeDataMessagePrefix("mytopic", 11, []byte("foo")), m1.Prefix)
+	assert.Same(t, &m1.Prefix[0], &m2.Prefix[0])
+}
+
+func TestTopic_PublishBatch(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	attachment := newFakeAttachment()
+	sub, _, err := NewSubscription(attachment, topic)
+	assert.Nil(t, err)
+	defer sub.Shutdown()
+
+	records := []commitlog.Record{
+		{Key: nil, Value: []byte("foo")},
+		{Key: nil, Value: []byte("bar")},
+	}
+	offset, err := topic.PublishBatch(records)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(22), offset)
+	assert.Equal(t, uint64(11), records[0].NextOffset)
+	assert.Equal(t, uint64(22), records[1].NextOffset)
+
+	// Subscribers should receive each message in the batch.
+	assert.Equal(t, Message{
+		Topic:   "mytopic",
+		Offset:  11,
+		Message: []byte("foo"),
+		Prefix:  utils.EncodeDataMessagePrefix("mytopic", 11, []byte("foo")),
+	}, <-attachment.Ch)
+	assert.Equal(t, Message{
+		Topic:   "mytopic",
+		Offset:  22,
+		Message: []byte("bar"),
+		Prefix:  utils.EncodeDataMessagePrefix("mytopic", 22, []byte("bar")),
+	}, <-attachment.Ch)
+}
+
+func TestTopic_PublishBatchIdempotent(t *testing.T) {
 	topic := NewTopic("mytopic", Options{
 		Persisted:   false,
 		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	offset, duplicate, err := topic.PublishBatchIdempotent("producer-1", 0, []commitlog.Record{
+		{Key: nil, Value: []byte("foo")},
+		{Key: nil, Value: []byte("bar")},
 	})
+	assert.Nil(t, err)
+	assert.False(t, duplicate)
+	assert.Equal(t, uint64(22), offset)
+
+	// Retrying the batch should return the original offset without adding
+	// the batch again.
+	offset, duplicate, err = topic.PublishBatchIdempotent("producer-1", 0, []commitlog.Record{
+		{Key: nil, Value: []byte("foo")},
+		{Key: nil, Value: []byte("bar")},
+	})
+	assert.Nil(t, err)
+	assert.True(t, duplicate)
+	assert.Equal(t, uint64(22), offset)
+	assert.Equal(t, uint64(22), topic.Offset())
+}
+
+// Tests SubscribeIfLatest returns a channel that is closed on the next publish
+// when the subscription isn't up to date.
+func TestTopic_SubscribeIfLatestWaitForPublish(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+	topic.Publish(nil, []byte("foo"))
+
+	sub := &Subscription{topic: topic}
+	subscribed, published := topic.SubscribeIfLatest(0, sub)
+	assert.False(t, subscribed)
+
+	select {
+	case <-published:
+		t.Error("expected to wait for publish")
+	default:
+	}
+
+	topic.Publish(nil, []byte("bar"))
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Error("expected publish to wake waiter")
+	}
+
+	subscribed, _ = topic.SubscribeIfLatest(22, sub)
+	assert.True(t, subscribed)
+}
+
+// Tests deleting the topic wakes subscriptions waiting for a publish.
+func TestTopic_SubscribeIfLatestWakeOnDelete(t *testing.T) {
+	dir := t.TempDir()
+
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+		Dir:         dir,
+	}, zap.NewNop())
+	topic.Publish(nil, []byte("foo"))
+
+	_, published := topic.SubscribeIfLatest(0, &Subscription{topic: topic})
+	assert.Nil(t, topic.Delete())
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Error("expected delete to wake waiter")
+	}
+}
+
+func TestTopic_GetInitialMessage(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
 
 	_, err := topic.GetMessage(topic.Offset())
 	assert.Equal(t, commitlog.ErrNotFound, err)
 }
 
-func benchmarkTopicPublish(topicName string, publishes int, subscribers int, messageLen int) {
-	dir := "data/" + uuid.New().String()
-	defer os.RemoveAll(dir)
+func TestTopic_PublishIdempotent(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	offset0, duplicate, err := topic.PublishIdempotent("producer-1", 0, nil, []byte("foo"))
+	assert.Nil(t, err)
+	assert.False(t, duplicate)
+	offset1, duplicate, err := topic.PublishIdempotent("producer-1", 1, nil, []byte("bar"))
+	assert.Nil(t, err)
+	assert.False(t, duplicate)
+
+	// Retrying the publishes should return the original offsets without
+	// adding the messages again.
+	offset, duplicate, err := topic.PublishIdempotent("producer-1", 0, nil, []byte("foo"))
+	assert.Nil(t, err)
+	assert.True(t, duplicate)
+	assert.Equal(t, offset0, offset)
+	offset, duplicate, err = topic.PublishIdempotent("producer-1", 1, nil, []byte("bar"))
+	assert.Nil(t, err)
+	assert.True(t, duplicate)
+	assert.Equal(t, offset1, offset)
+	assert.Equal(t, offset1, topic.Offset())
+
+	// Another producer with the same sequence number is added.
+	offset, duplicate, err = topic.PublishIdempotent("producer-2", 0, nil, []byte("car"))
+	assert.Nil(t, err)
+	assert.False(t, duplicate)
+	assert.Equal(t, topic.Offset(), offset)
+	assert.NotEqual(t, offset1, offset)
+}
+
+func TestTopic_PublishIdempotentRetryNotTracked(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1 << 20,
+	}, zap.NewNop())
+
+	for seqNum := uint64(0); seqNum != producerHistoryLen*2+1; seqNum++ {
+		_, _, err := topic.PublishIdempotent("producer-1", seqNum, nil, []byte("foo"))
+		assert.Nil(t, err)
+	}
+
+	// The first publish is no longer tracked so its offset is unknown,
+	// though it must still not be added again.
+	offset := topic.Offset()
+	retryOffset, duplicate, err := topic.PublishIdempotent("producer-1", 0, nil, []byte("foo"))
+	assert.Equal(t, ErrDuplicateOffsetUnknown, err)
+	assert.True(t, duplicate)
+	assert.Equal(t, uint64(0), retryOffset)
+	assert.Equal(t, offset, topic.Offset())
+}
+
+func TestTopic_ExpireProducers(t *testing.T) {
+	topic := NewTopic("mytopic", Options{
+		Persisted:   false,
+		SegmentSize: 1000,
+	}, zap.NewNop())
+
+	_, _, err := topic.PublishIdempotent("producer-1", 0, nil, []byte("foo"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, 0, topic.ExpireProducers(time.Hour))
+	assert.Equal(t, 1, topic.ExpireProducers(0))
+
+	// Once expired a retry is added again.
+	_, duplicate, err := topic.PublishIdempotent("producer-1", 0, nil, []byte("foo"))
+	assert.Nil(t, err)
+	assert.False(t, duplicate)
+}
 
+func benchmarkTopicPublish(b *testing.B, topicName string, publishes int, subscribers int, messageLen int) {
 	broker := NewBroker(Options{
 		Persisted:   true,
 		SegmentSize: 1 << 22,
-		Dir:         dir,
-	})
+		Dir:         b.TempDir(),
+	}, zap.NewNop())
+	defer broker.Close()
 
 	message := make([]byte, messageLen)
 	rand.Read(message)
@@ -101,32 +341,30 @@ func benchmarkTopicPublish(topicName string, publishes int, subscribers int, mes
 		subscriptions.AddSubscription(topicName)
 	}
 
-	topic := broker.GetTopic(topicName)
+	topic, _ := broker.GetTopic(topicName)
 	for i := 0; i != publishes; i++ {
-		topic.Publish(message)
+		topic.Publish(nil, message)
 	}
 
 	<-attachment.DoneCh
 }
 
-func benchmarkTopicResume(topicName string, publishes int, messageLen int) {
-	dir := "data/" + uuid.New().String()
-	defer os.RemoveAll(dir)
-
+func benchmarkTopicResume(b *testing.B, topicName string, publishes int, messageLen int) {
 	broker := NewBroker(Options{
 		Persisted:   true,
 		SegmentSize: 1 << 22,
-		Dir:         dir,
-	})
+		Dir:         b.TempDir(),
+	}, zap.NewNop())
+	defer broker.Close()
 
 	message := make([]byte, messageLen)
 	rand.Read(message)
 
 	attachment := newNopAttachment(publishes)
 
-	topic := broker.GetTopic(topicName)
+	topic, _ := broker.GetTopic(topicName)
 	for i := 0; i != publishes; i++ {
-		topic.Publish(message)
+		topic.Publish(nil, message)
 	}
 
 	subscriptions := NewSubscriptions(broker, attachment)
@@ -138,41 +376,89 @@ func benchmarkTopicResume(topicName string, publishes int, messageLen int) {
 func BenchmarkTopicPublish_Pub1000_Sub1_M1K(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		topicName := fmt.Sprintf("bench-topic-%d", n)
-		benchmarkTopicPublish(topicName, 1000, 1, 1<<10)
+		benchmarkTopicPublish(b, topicName, 1000, 1, 1<<10)
 	}
 }
 
 func BenchmarkTopicPublish_Pub1000_Sub1000_M1K(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		topicName := fmt.Sprintf("bench-topic-%d", n)
-		benchmarkTopicPublish(topicName, 1000, 1000, 1<<10)
+		benchmarkTopicPublish(b, topicName, 1000, 1000, 1<<10)
 	}
 }
 
 func BenchmarkTopicPublish_Pub1000_Sub1_M256KB(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		topicName := fmt.Sprintf("bench-topic-%d", n)
-		benchmarkTopicPublish(topicName, 1000, 1, 256000)
+		benchmarkTopicPublish(b, topicName, 1000, 1, 256000)
 	}
 }
 
 func BenchmarkTopicPublish_Pub1000_Sub1000_M256KB(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		topicName := fmt.Sprintf("bench-topic-%d", n)
-		benchmarkTopicPublish(topicName, 1000, 1000, 256000)
+		benchmarkTopicPublish(b, topicName, 1000, 1000, 256000)
 	}
 }
 
 func BenchmarkTopicResume_Pub100_M10(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		topicName := fmt.Sprintf("bench-topic-%d", n)
-		benchmarkTopicResume(topicName, 100, 10)
+		benchmarkTopicResume(b, topicName, 100, 10)
 	}
 }
 
 func BenchmarkTopicResume_Pub100_M256KB(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		topicName := fmt.Sprintf("bench-topic-%d", n)
-		benchmarkTopicResume(topicName, 100, 256000)
+		benchmarkTopicResume(b, topicName, 100, 256000)
+	}
+}
+
+func benchmarkTopicFanOut(b *testing.B, subscribers int, messageLen int, sharedPrefix bool) {
+	topic := NewTopic("bench-topic", Options{
+		Persisted:   false,
+		SegmentSize: 1 << 22,
+	}, zap.NewNop())
+
+	message := make([]byte, messageLen)
+	rand.Read(message)
+
+	for i := 0; i != subscribers; i++ {
+		attachment := newWriterAttachment(sharedPrefix)
+		defer attachment.writer.Close()
+
+		sub, _, err := NewSubscription(attachment, topic)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer sub.Shutdown()
 	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		topic.Publish(nil, message)
+	}
+}
+
+// Benchmarks publishing to a topic with many subscribers, where each
+// subscriber shares the DATA prefix encoded by the topic.
+func BenchmarkTopicFanOut_Sub1000_M1K_SharedPrefix(b *testing.B) {
+	benchmarkTopicFanOut(b, 1000, 1<<10, true)
+}
+
+// Benchmarks publishing to a topic with many subscribers, where each
+// subscriber encodes its own DATA prefix, for comparison with
+// BenchmarkTopicFanOut_Sub1000_M1K_SharedPrefix.
+func BenchmarkTopicFanOut_Sub1000_M1K_PrefixPerSubscriber(b *testing.B) {
+	benchmarkTopicFanOut(b, 1000, 1<<10, false)
+}
+
+func BenchmarkTopicFanOut_Sub10_M1K_SharedPrefix(b *testing.B) {
+	benchmarkTopicFanOut(b, 10, 1<<10, true)
+}
+
+func BenchmarkTopicFanOut_Sub10_M1K_PrefixPerSubscriber(b *testing.B) {
+	benchmarkTopicFanOut(b, 10, 1<<10, false)
 }
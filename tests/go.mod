@@ -31,7 +31,10 @@ require (
 
 replace github.com/andydunstall/figg/utils v0.0.0 => ../utils
 
-require github.com/andydunstall/figg/server v0.0.0 // indirect
+require (
+	github.com/andydunstall/figg/server v0.0.0 // indirect
+	github.com/klauspost/compress v1.17.0 // indirect
+)
 
 replace github.com/andydunstall/figg/server v0.0.0 => ../server
 
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -10,6 +11,76 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// Tests the offset returned when publishing matches the offset of the message
+// received by subscribers.
+func TestPublish_ACKOffset(t *testing.T) {
+	node, err := fcm.NewNode(setupLogger())
+	assert.Nil(t, err)
+	defer node.Shutdown()
+
+	subClient, err := figg.Connect(node.Addr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer subClient.Close()
+
+	pubClient, err := figg.Connect(node.Addr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer pubClient.Close()
+
+	messagesCh := make(chan *figg.Message, 10)
+	assert.Nil(t, subClient.Subscribe("foo", func(m *figg.Message) {
+		messagesCh <- m
+	}))
+
+	for i := 0; i != 10; i++ {
+		offset, err := pubClient.PublishWaitForACK("foo", []byte(fmt.Sprintf("message-%d", i)))
+		assert.Nil(t, err)
+
+		m := <-messagesCh
+		assert.Equal(t, fmt.Sprintf("message-%d", i), string(m.Data))
+		assert.Equal(t, m.Offset, offset)
+	}
+}
+
+// Tests publishing a batch, where subscribers receive each message in the
+// batch with the offsets returned to the publisher.
+func TestPublish_PublishBatch(t *testing.T) {
+	node, err := fcm.NewNode(setupLogger())
+	assert.Nil(t, err)
+	defer node.Shutdown()
+
+	subClient, err := figg.Connect(node.Addr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer subClient.Close()
+
+	pubClient, err := figg.Connect(node.Addr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer pubClient.Close()
+
+	messagesCh := make(chan *figg.Message, 10)
+	assert.Nil(t, subClient.Subscribe("foo", func(m *figg.Message) {
+		messagesCh <- m
+	}))
+
+	batch := []figg.BatchMessage{}
+	for i := 0; i != 10; i++ {
+		batch = append(batch, figg.BatchMessage{
+			Data: []byte(fmt.Sprintf("message-%d", i)),
+		})
+	}
+	offsetsCh := make(chan []uint64, 1)
+	assert.Nil(t, pubClient.PublishBatch("foo", batch, func(offsets []uint64) {
+		offsetsCh <- offsets
+	}))
+
+	offsets := <-offsetsCh
+	assert.Equal(t, 10, len(offsets))
+	for i := 0; i != 10; i++ {
+		m := <-messagesCh
+		assert.Equal(t, fmt.Sprintf("message-%d", i), string(m.Data))
+		assert.Equal(t, offsets[i], m.Offset)
+	}
+}
+
 // Tests the publisher resends messages when it reconnects to the server
 // following a disconnect.
 func TestPublish_ResendAfterDisconnect(t *testing.T) {
@@ -52,3 +123,73 @@ func TestPublish_ResendAfterDisconnect(t *testing.T) {
 		assert.Equal(t, fmt.Sprintf("message-%d", i), string(m.Data))
 	}
 }
+
+// Tests messages resent by the publisher after reconnecting are only added
+// to the topic once, even if the server added them before the connection
+// dropped.
+func TestPublish_NoDuplicatesAfterDisconnect(t *testing.T) {
+	node, err := fcm.NewNode(setupLogger())
+	assert.Nil(t, err)
+	defer node.Shutdown()
+
+	// Note the publisher uses the proxy address (which is dropped), but the
+	// subscriber uses the nodes address (which is not dropped).
+
+	subClient, err := figg.Connect(node.Addr)
+	assert.Nil(t, err)
+	defer subClient.Close()
+
+	pubClient, err := figg.Connect(node.ProxyAddr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer pubClient.Close()
+
+	messagesCh := make(chan *figg.Message, 1<<20)
+	assert.Nil(t, subClient.Subscribe("foo", func(m *figg.Message) {
+		messagesCh <- m
+	}))
+
+	// Publish continuously until the connection has been dropped, so there
+	// are unacknowledged messages that the server may have already added
+	// which are resent after reconnecting.
+	var acked int64
+	published := 0
+	done := make(chan interface{})
+	publishDone := make(chan interface{})
+	go func() {
+		defer close(publishDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			pubClient.Publish("foo", []byte(fmt.Sprintf("message-%d", published)), func(offset uint64) {
+				atomic.AddInt64(&acked, 1)
+			})
+			published++
+		}
+	}()
+
+	node.DropActive()
+	<-time.After(time.Millisecond * 100)
+	close(done)
+	<-publishDone
+
+	for i := 0; i != published; i++ {
+		m := <-messagesCh
+		assert.Equal(t, fmt.Sprintf("message-%d", i), string(m.Data))
+	}
+	// Wait for all messages to be acknowledged.
+	for i := 0; i != 50 && atomic.LoadInt64(&acked) != int64(published); i++ {
+		<-time.After(time.Millisecond * 100)
+	}
+	assert.Equal(t, int64(published), atomic.LoadInt64(&acked))
+
+	// Check no duplicate messages are received.
+	select {
+	case m := <-messagesCh:
+		t.Errorf("unexpected message: %s", string(m.Data))
+	case <-time.After(time.Millisecond * 500):
+	}
+}
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	fcm "github.com/andydunstall/figg/fcm/lib"
+	figg "github.com/andydunstall/figg/sdk/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests unsubscribing then resubscribing to a topic only receives each
+// message once, so the original subscription was removed.
+func TestUnsubscribe_Resubscribe(t *testing.T) {
+	node, err := fcm.NewNode(setupLogger())
+	assert.Nil(t, err)
+	defer node.Shutdown()
+
+	subClient, err := figg.Connect(node.Addr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer subClient.Close()
+
+	pubClient, err := figg.Connect(node.Addr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer pubClient.Close()
+
+	// Add a buffer so the subscribe callback doesn't block.
+	messagesCh := make(chan *figg.Message, 20)
+	assert.Nil(t, subClient.Subscribe("foo", func(m *figg.Message) {
+		messagesCh <- m
+	}))
+	_, err = pubClient.PublishWaitForACK("foo", []byte("message-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "message-0", string((<-messagesCh).Data))
+
+	subClient.Unsubscribe("foo")
+	assert.Nil(t, subClient.Subscribe("foo", func(m *figg.Message) {
+		messagesCh <- m
+	}))
+
+	for i := 1; i != 10; i++ {
+		_, err := pubClient.PublishWaitForACK("foo", []byte(fmt.Sprintf("message-%d", i)))
+		assert.Nil(t, err)
+	}
+
+	// If the server didn't remove the original subscription each message
+	// would be received twice.
+	for i := 1; i != 10; i++ {
+		m := <-messagesCh
+		assert.Equal(t, fmt.Sprintf("message-%d", i), string(m.Data))
+	}
+}
+
+// Tests when one subscriber unsubscribes from a topic, the other subscribers
+// to the topic still receive messages.
+func TestUnsubscribe_OtherSubscribersUnaffected(t *testing.T) {
+	node, err := fcm.NewNode(setupLogger())
+	assert.Nil(t, err)
+	defer node.Shutdown()
+
+	subClient1, err := figg.Connect(node.Addr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer subClient1.Close()
+
+	subClient2, err := figg.Connect(node.Addr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer subClient2.Close()
+
+	pubClient, err := figg.Connect(node.Addr, figg.WithLogger(setupLogger()))
+	assert.Nil(t, err)
+	defer pubClient.Close()
+
+	// Add a buffer so the subscribe callback doesn't block.
+	messagesCh1 := make(chan *figg.Message, 10)
+	assert.Nil(t, subClient1.Subscribe("foo", func(m *figg.Message) {
+		messagesCh1 <- m
+	}))
+	messagesCh2 := make(chan *figg.Message, 10)
+	assert.Nil(t, subClient2.Subscribe("foo", func(m *figg.Message) {
+		messagesCh2 <- m
+	}))
+
+	// Wait for both subscribers to receive a message so we know the first
+	// subscriber is attached before unsubscribing.
+	_, err = pubClient.PublishWaitForACK("foo", []byte("message-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "message-0", string((<-messagesCh1).Data))
+	assert.Equal(t, "message-0", string((<-messagesCh2).Data))
+
+	subClient1.Unsubscribe("foo")
+
+	for i := 1; i != 10; i++ {
+		_, err := pubClient.PublishWaitForACK("foo", []byte(fmt.Sprintf("message-%d", i)))
+		assert.Nil(t, err)
+	}
+	for i := 1; i != 10; i++ {
+		m := <-messagesCh2
+		assert.Equal(t, fmt.Sprintf("message-%d", i), string(m.Data))
+	}
+}
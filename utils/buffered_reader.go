@@ -1,9 +1,19 @@
 package utils
 
 import (
+	"errors"
 	"io"
 )
 
+var (
+	// ErrPayloadTooLarge is returned when reading a message whose payload
+	// exceeds the maximum payload size.
+	ErrPayloadTooLarge = errors.New("payload too large")
+	// ErrUnsupportedVersion is returned when reading a message whose header
+	// has a protocol version that isn't supported.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
 // BufferedReader reads full protocol messages from the given reader.
 //
 // This is NOT thread safe.
@@ -13,24 +23,38 @@ type BufferedReader struct {
 	buf []byte
 	// pending is a buffer containing partial messages yet to be processed.
 	pending []byte
+	// maxPayloadLen is the maximum payload size of a message, or 0 if
+	// unlimited.
+	maxPayloadLen int
 }
 
-func NewBufferedReader(r io.Reader, bufLen int) *BufferedReader {
+// NewBufferedReader returns a reader that reads messages with a payload of
+// at most maxPayloadLen bytes, or unlimited if maxPayloadLen is 0.
+func NewBufferedReader(r io.Reader, bufLen int, maxPayloadLen int) *BufferedReader {
 	return &BufferedReader{
-		r:       r,
-		buf:     make([]byte, bufLen),
-		pending: []byte{},
+		r:             r,
+		buf:           make([]byte, bufLen),
+		pending:       []byte{},
+		maxPayloadLen: maxPayloadLen,
 	}
 }
 
 // Read reads a protocol message from the underlying reader, returning the
 // message type and payload. This keeps reading more until it has a full
 // protocol message.
+//
+// If the message payload exceeds the maximum payload size returns
+// ErrPayloadTooLarge without reading the payload, or if the message has an
+// unsupported protocol version returns ErrUnsupportedVersion. Since the reader
+// can't skip the payload, the connection must be closed.
 func (r *BufferedReader) Read() (MessageType, []byte, error) {
 	for {
 		// If there are pending bytes to process we must process them first.
 		if len(r.pending) != 0 {
-			messageType, data, ok := r.processBuffer(r.pending, len(r.pending))
+			messageType, data, ok, err := r.processBuffer(r.pending, len(r.pending))
+			if err != nil {
+				return MessageType(0), nil, err
+			}
 			if ok {
 				r.pending = r.pending[HeaderLen+len(data):]
 				return messageType, data, nil
@@ -54,7 +78,10 @@ func (r *BufferedReader) Read() (MessageType, []byte, error) {
 		// If we don't already have pending bytes, try to process buf directly,
 		// since if it contains a full protocol message this avoids an extra
 		// copy to pending. Though if we don't append and process next loop.
-		messageType, data, ok := r.processBuffer(r.buf, n)
+		messageType, data, ok, err := r.processBuffer(r.buf, n)
+		if err != nil {
+			return MessageType(0), nil, err
+		}
 		if !ok {
 			r.pending = append(r.pending, r.buf[:n]...)
 			continue
@@ -67,16 +94,24 @@ func (r *BufferedReader) Read() (MessageType, []byte, error) {
 	}
 }
 
-func (r *BufferedReader) processBuffer(buf []byte, bufLen int) (MessageType, []byte, bool) {
+func (r *BufferedReader) processBuffer(buf []byte, bufLen int) (MessageType, []byte, bool, error) {
 	// If the buffer does not contain a full message, it must be a partial so
 	// keep reading.
-	messageType, payloadLen, ok := DecodeHeader(buf[:bufLen])
+	messageType, version, payloadLen, ok := DecodeHeader(buf[:bufLen])
 	if !ok {
-		return MessageType(0), nil, false
+		return MessageType(0), nil, false, nil
+	}
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return MessageType(0), nil, false, ErrUnsupportedVersion
+	}
+	// Check the payload size before buffering the payload, so a peer can't
+	// make us buffer an unbounded amount of data.
+	if r.maxPayloadLen > 0 && payloadLen > r.maxPayloadLen {
+		return MessageType(0), nil, false, ErrPayloadTooLarge
 	}
 	if HeaderLen+payloadLen > bufLen {
-		return MessageType(0), nil, false
+		return MessageType(0), nil, false, nil
 	}
 
-	return messageType, buf[HeaderLen : HeaderLen+payloadLen], true
+	return messageType, buf[HeaderLen : HeaderLen+payloadLen], true, nil
 }
@@ -10,7 +10,7 @@ import (
 // Tests reading where a network read contains a single message.
 func TestBufferedReader_ReadOneToOneMessage(t *testing.T) {
 	buf := encodeProtocolMessage(TypeData, []byte("foo"))
-	reader := NewBufferedReader(bytes.NewReader(buf), 12)
+	reader := NewBufferedReader(bytes.NewReader(buf), 12, 0)
 
 	messageType, data, err := reader.Read()
 	assert.Equal(t, TypeData, messageType)
@@ -30,7 +30,7 @@ func TestBufferedReader_ReadFragmentedMessages(t *testing.T) {
 		buf = append(buf, encodeProtocolMessage(TypeAttach, []byte("bar"))...)
 		buf = append(buf, encodeProtocolMessage(TypeAttached, []byte("car"))...)
 
-		reader := NewBufferedReader(bytes.NewReader(buf), i)
+		reader := NewBufferedReader(bytes.NewReader(buf), i, 0)
 
 		messageType, data, err := reader.Read()
 		assert.Equal(t, TypeData, messageType)
@@ -49,6 +49,54 @@ func TestBufferedReader_ReadFragmentedMessages(t *testing.T) {
 	}
 }
 
+func TestBufferedReader_ReadPayloadTooLarge(t *testing.T) {
+	buf := encodeProtocolMessage(TypeData, []byte("foo"))
+	buf = append(buf, encodeProtocolMessage(TypeData, []byte("foobar"))...)
+	reader := NewBufferedReader(bytes.NewReader(buf), 12, 4)
+
+	messageType, data, err := reader.Read()
+	assert.Equal(t, TypeData, messageType)
+	assert.Equal(t, []byte("foo"), data)
+	assert.Nil(t, err)
+
+	_, _, err = reader.Read()
+	assert.Equal(t, ErrPayloadTooLarge, err)
+}
+
+func TestBufferedReader_ReadUnsupportedVersion(t *testing.T) {
+	buf := encodeProtocolMessage(TypeData, []byte("foo"))
+	// Overwrite the protocol version with a future version.
+	EncodeUint16(buf, 2, ProtocolVersion+1)
+	reader := NewBufferedReader(bytes.NewReader(buf), 12, 0)
+
+	_, _, err := reader.Read()
+	assert.Equal(t, ErrUnsupportedVersion, err)
+}
+
+func FuzzBufferedReader_Read(f *testing.F) {
+	f.Add(encodeProtocolMessage(TypeData, []byte("foo")), 12)
+	f.Add(append(
+		encodeProtocolMessage(TypeData, []byte("foo")),
+		encodeProtocolMessage(TypeAttach, []byte("bar"))...,
+	), 5)
+	f.Fuzz(func(t *testing.T, b []byte, bufLen int) {
+		if bufLen <= 0 || bufLen > 1<<16 {
+			return
+		}
+		reader := NewBufferedReader(bytes.NewReader(b), bufLen, 1<<10)
+		// Read until the reader returns an error, which must happen once
+		// the input is consumed.
+		for i := 0; i <= len(b); i++ {
+			_, data, err := reader.Read()
+			if err != nil {
+				return
+			}
+			assert.LessOrEqual(t, len(data), 1<<10)
+		}
+		t.Fatal("expected read to fail once input consumed")
+	})
+}
+
 func encodeProtocolMessage(messageType MessageType, payload []byte) []byte {
 	header := make([]byte, HeaderLen)
 	EncodeHeader(header, 0, messageType, uint32(len(payload)))
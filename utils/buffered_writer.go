@@ -1,54 +1,119 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when writing to a BufferedWriter whose queue
+	// has reached its limit, such as if the peer isn't reading fast enough.
+	ErrQueueFull = errors.New("write queue full")
 )
 
 // BufferedWriter handles writing to the writer in a background thread to avoid
 // blocking Write.
 type BufferedWriter struct {
+	// limit is the maximum number of bytes queued by TryWrite and WriteWait,
+	// or 0 if unlimited.
+	limit int
+
 	// mu is a mutex protecting the below fields.
 	mu *sync.Mutex
 	w  io.Writer
 	// queue contains the messages queued to be sent.
 	buf [][]byte
+	// queued is the number of bytes queued that haven't yet been written,
+	// including those being written by the write loop.
+	queued int
 	// cv is a condition variable to wait the write loop when there is pending
 	// data to write.
-	cv     *sync.Cond
-	wg     sync.WaitGroup
-	closed bool
+	cv *sync.Cond
+	// written is closed once the write loop writes queued messages, to wake
+	// writers waiting for space in the queue. Created lazily so is nil if
+	// no writers are waiting.
+	written chan interface{}
+	wg      sync.WaitGroup
+	closed  bool
 }
 
-func NewBufferedWriter(w io.Writer) *BufferedWriter {
+// NewBufferedWriter returns a writer that writes to w in the background. limit
+// is the maximum number of bytes queued by TryWrite and WriteWait, or 0 if
+// unlimited.
+func NewBufferedWriter(w io.Writer, limit int) *BufferedWriter {
 	mu := &sync.Mutex{}
 	writer := &BufferedWriter{
-		mu:     mu,
-		w:      w,
-		buf:    [][]byte{},
-		cv:     sync.NewCond(mu),
-		wg:     sync.WaitGroup{},
-		closed: false,
+		limit:   limit,
+		mu:      mu,
+		w:       w,
+		buf:     [][]byte{},
+		queued:  0,
+		cv:      sync.NewCond(mu),
+		written: nil,
+		wg:      sync.WaitGroup{},
+		closed:  false,
 	}
 	writer.wg.Add(1)
 	go writer.writeLoop()
 	return writer
 }
 
+// Write queues the buffers to be written regardless of the queue limit.
 func (w *BufferedWriter) Write(bufs ...[]byte) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if w.closed {
-		return nil
-	}
+	w.queueLocked(bufs)
+	return nil
+}
 
-	w.buf = append(w.buf, bufs...)
-	w.cv.Signal()
+// TryWrite queues the buffers to be written if they fit within the queue
+// limit, otherwise returns ErrQueueFull without blocking. If the queue is
+// empty the buffers are always queued, even if they exceed the limit.
+func (w *BufferedWriter) TryWrite(bufs ...[]byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.hasSpaceLocked(buffersLen(bufs)) {
+		return ErrQueueFull
+	}
+	w.queueLocked(bufs)
 	return nil
 }
 
+// WriteWait queues the buffers to be written, waiting until they fit within
+// the queue limit. Returns the context error if the context is done before
+// there is space.
+func (w *BufferedWriter) WriteWait(ctx context.Context, bufs ...[]byte) error {
+	n := buffersLen(bufs)
+	for {
+		w.mu.Lock()
+		if w.hasSpaceLocked(n) {
+			w.queueLocked(bufs)
+			w.mu.Unlock()
+			return nil
+		}
+		if w.written == nil {
+			w.written = make(chan interface{})
+		}
+		written := w.written
+		w.mu.Unlock()
+
+		select {
+		case <-written:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops accepting new messages. The write loop writes any messages
+// already queued before exiting, so use Drain to wait for them to be written
+// before closing the underlying writer.
 func (w *BufferedWriter) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -56,9 +121,58 @@ func (w *BufferedWriter) Close() error {
 	w.closed = true
 	// Signal the write loop so it closes.
 	w.cv.Signal()
+	// Wake any waiting writers, which discard their messages once closed.
+	w.notifyWrittenLocked()
 	return nil
 }
 
+// Drain waits for the write loop to write the queued messages and exit after
+// Close, such as to ensure a final message is sent before closing the
+// connection. Returns false if the timeout expires first, such as if the peer
+// isn't reading.
+func (w *BufferedWriter) Drain(timeout time.Duration) bool {
+	done := make(chan interface{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// queueLocked adds the buffers to the queue. Once closed the buffers are
+// discarded. The mutex must be held.
+func (w *BufferedWriter) queueLocked(bufs [][]byte) {
+	if w.closed {
+		return
+	}
+
+	w.buf = append(w.buf, bufs...)
+	w.queued += buffersLen(bufs)
+	w.cv.Signal()
+}
+
+// hasSpaceLocked returns whether n bytes can be queued without exceeding the
+// limit. Once closed there is always space since writes are discarded. The
+// mutex must be held.
+func (w *BufferedWriter) hasSpaceLocked(n int) bool {
+	return w.limit == 0 || w.closed || w.queued == 0 || w.queued+n <= w.limit
+}
+
+// notifyWrittenLocked wakes any writers waiting for space in the queue. The
+// mutex must be held.
+func (w *BufferedWriter) notifyWrittenLocked() {
+	if w.written != nil {
+		close(w.written)
+		w.written = nil
+	}
+}
+
 func (w *BufferedWriter) writeLoop() {
 	defer w.wg.Done()
 
@@ -68,7 +182,15 @@ func (w *BufferedWriter) writeLoop() {
 			return
 		}
 
-		if _, err := buf.WriteTo(w.w); err != nil {
+		n := buffersLen(buf)
+		_, err := buf.WriteTo(w.w)
+
+		w.mu.Lock()
+		w.queued -= n
+		w.notifyWrittenLocked()
+		w.mu.Unlock()
+
+		if err != nil {
 			// If we get a write error, expect the server/client will close the
 			// connection so exit.
 			return
@@ -80,17 +202,25 @@ func (w *BufferedWriter) nextBuf() (net.Buffers, bool) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if w.closed {
-		return nil, false
-	}
-
 	// Since we can miss signals when processing the buffer, must only
 	// block if buf is empty.
-	if len(w.buf) == 0 {
+	if len(w.buf) == 0 && !w.closed {
 		w.cv.Wait()
 	}
+	// Once closed, only exit once all queued messages have been written.
+	if len(w.buf) == 0 && w.closed {
+		return nil, false
+	}
 
 	buf := net.Buffers(w.buf)
 	w.buf = [][]byte{}
 	return buf, true
 }
+
+func buffersLen(bufs [][]byte) int {
+	n := 0
+	for _, b := range bufs {
+		n += len(b)
+	}
+	return n
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests TryWrite rejects writes that exceed the limit while the peer isn't
+// reading, and accepts writes again once the queue is written.
+func TestBufferedWriter_TryWriteLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	writer := NewBufferedWriter(client, 5)
+	defer writer.Close()
+
+	// Since the queue is empty the write is accepted even though it exceeds
+	// the limit.
+	assert.Nil(t, writer.TryWrite([]byte("foo"), []byte("bar")))
+	assert.Equal(t, ErrQueueFull, writer.TryWrite([]byte("car")))
+	// Write ignores the limit.
+	assert.Nil(t, writer.Write([]byte("!")))
+
+	buf := make([]byte, 7)
+	_, err := io.ReadFull(server, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foobar!"), buf)
+
+	// Wait for the write loop to see the queue is written.
+	assert.Eventually(t, func() bool {
+		return writer.TryWrite([]byte("car")) == nil
+	}, time.Second, time.Millisecond)
+
+	_, err = io.ReadFull(server, buf[:3])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("car"), buf[:3])
+}
+
+// Tests WriteWait blocks until there is space in the queue.
+func TestBufferedWriter_WriteWait(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	writer := NewBufferedWriter(client, 5)
+	defer writer.Close()
+
+	assert.Nil(t, writer.WriteWait(context.Background(), []byte("foobar")))
+
+	written := make(chan error)
+	go func() {
+		written <- writer.WriteWait(context.Background(), []byte("car"))
+	}()
+
+	select {
+	case <-written:
+		t.Error("expected write to wait for space")
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	buf := make([]byte, 9)
+	_, err := io.ReadFull(server, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foobarcar"), buf)
+	assert.Nil(t, <-written)
+}
+
+// Tests WriteWait returns once the context is cancelled.
+func TestBufferedWriter_WriteWaitCancelled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	writer := NewBufferedWriter(client, 5)
+	defer writer.Close()
+
+	assert.Nil(t, writer.WriteWait(context.Background(), []byte("foobar")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, writer.WriteWait(ctx, []byte("car")))
+}
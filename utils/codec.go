@@ -2,6 +2,13 @@ package utils
 
 import (
 	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrMalformedMessage is returned when decoding a message that is
+	// truncated or has invalid field lengths.
+	ErrMalformedMessage = errors.New("malformed message")
 )
 
 const (
@@ -13,10 +20,19 @@ const (
 
 	uint32Max = 0xffffffff
 
-	protocolVersion = uint16(1)
+	// ProtocolVersion is the latest protocol version supported.
+	ProtocolVersion = uint16(1)
+	// MinProtocolVersion is the oldest protocol version supported.
+	MinProtocolVersion = uint16(1)
 
-	FlagNone      = uint16(0)
-	FlagUseOffset = uint16(1 << 15)
+	FlagNone         = uint16(0)
+	FlagUseOffset    = uint16(1 << 15)
+	FlagUseTimestamp = uint16(1 << 14)
+	FlagUseLastN     = uint16(1 << 13)
+
+	// attachPayloadLen is the length of the ATTACH payload excluding the
+	// topic name.
+	attachPayloadLen = uint16Len + uint32Len + uint64Len + uint64Len + uint64Len
 )
 
 func EncodeUint16(buf []byte, offset int, n uint16) int {
@@ -28,13 +44,16 @@ func EncodeUint16(buf []byte, offset int, n uint16) int {
 	return offset + uint16Len
 }
 
-func DecodeUint16(buf []byte, offset int) (uint16, int) {
-	if len(buf) < offset+uint16Len {
-		panic("buf too small; cannot encode uint16")
+// DecodeUint16 decodes a uint16 at the given offset, returning the decoded
+// value and the offset following it. Returns ErrMalformedMessage if buf is too
+// small.
+func DecodeUint16(buf []byte, offset int) (uint16, int, error) {
+	if offset < 0 || len(buf)-offset < uint16Len {
+		return 0, offset, ErrMalformedMessage
 	}
 
 	n := binary.BigEndian.Uint16(buf[offset : offset+uint16Len])
-	return n, offset + uint16Len
+	return n, offset + uint16Len, nil
 }
 
 func EncodeUint32(buf []byte, offset int, n uint32) int {
@@ -46,13 +65,16 @@ func EncodeUint32(buf []byte, offset int, n uint32) int {
 	return offset + uint32Len
 }
 
-func DecodeUint32(buf []byte, offset int) (uint32, int) {
-	if len(buf) < offset+uint32Len {
-		panic("buf too small; cannot encode uint32")
+// DecodeUint32 decodes a uint32 at the given offset, returning the decoded
+// value and the offset following it. Returns ErrMalformedMessage if buf is too
+// small.
+func DecodeUint32(buf []byte, offset int) (uint32, int, error) {
+	if offset < 0 || len(buf)-offset < uint32Len {
+		return 0, offset, ErrMalformedMessage
 	}
 
 	n := binary.BigEndian.Uint32(buf[offset : offset+uint32Len])
-	return n, offset + uint32Len
+	return n, offset + uint32Len, nil
 }
 
 func EncodeUint64(buf []byte, offset int, n uint64) int {
@@ -64,22 +86,25 @@ func EncodeUint64(buf []byte, offset int, n uint64) int {
 	return offset + uint64Len
 }
 
-func DecodeUint64(buf []byte, offset int) (uint64, int) {
-	if len(buf) < offset+uint64Len {
-		panic("buf too small; cannot encode uint64")
+// DecodeUint64 decodes a uint64 at the given offset, returning the decoded
+// value and the offset following it. Returns ErrMalformedMessage if buf is too
+// small.
+func DecodeUint64(buf []byte, offset int) (uint64, int, error) {
+	if offset < 0 || len(buf)-offset < uint64Len {
+		return 0, offset, ErrMalformedMessage
 	}
 
 	n := binary.BigEndian.Uint64(buf[offset : offset+uint64Len])
-	return n, offset + uint64Len
+	return n, offset + uint64Len, nil
 }
 
 func EncodeMessageType(buf []byte, offset int, t MessageType) int {
 	return EncodeUint16(buf, offset, uint16(t))
 }
 
-func DecodeMessageType(buf []byte, offset int) (MessageType, int) {
-	n, offset := DecodeUint16(buf, offset)
-	return MessageType(n), offset
+func DecodeMessageType(buf []byte, offset int) (MessageType, int, error) {
+	n, offset, err := DecodeUint16(buf, offset)
+	return MessageType(n), offset, err
 }
 
 func EncodeBytes(buf []byte, offset int, b []byte) int {
@@ -95,60 +120,84 @@ func EncodeBytes(buf []byte, offset int, b []byte) int {
 	return offset
 }
 
+// DecodeBytes decodes a byte slice prefixed by its uint32 length at the given
+// offset, returning the bytes and the offset following them. The returned
+// slice references buf rather than being copied. Returns ErrMalformedMessage
+// if buf is too small.
+func DecodeBytes(buf []byte, offset int) ([]byte, int, error) {
+	n, offset, err := DecodeUint32(buf, offset)
+	if err != nil {
+		return nil, offset, err
+	}
+	if uint64(len(buf)-offset) < uint64(n) {
+		return nil, offset, ErrMalformedMessage
+	}
+	return buf[offset : offset+int(n)], offset + int(n), nil
+}
+
 func EncodeHeader(buf []byte, offset int, messageType MessageType, payloadLen uint32) int {
 	if len(buf) < HeaderLen {
 		panic("buf too small; cannot encode header")
 	}
 
 	offset = EncodeUint16(buf, offset, uint16(messageType))
-	offset = EncodeUint16(buf, offset, protocolVersion)
+	offset = EncodeUint16(buf, offset, ProtocolVersion)
 	offset = EncodeUint32(buf, offset, payloadLen)
 	return offset
 }
 
-func DecodeHeader(buf []byte) (MessageType, int, bool) {
+// DecodeHeader decodes the message header, returning the message type,
+// protocol version and payload length. Returns false if buf doesn't contain
+// a full header.
+func DecodeHeader(buf []byte) (MessageType, uint16, int, bool) {
 	if len(buf) < HeaderLen {
-		return MessageType(0), 0, false
+		return MessageType(0), 0, 0, false
 	}
 
-	messageType, offset := DecodeMessageType(buf, 0)
-	// Protocol version is currently unused.
-	_, offset = DecodeUint16(buf, offset)
-	payloadLen, offset := DecodeUint32(buf, offset)
+	// Note the length is checked above so decoding can't fail.
+	messageType, offset, _ := DecodeMessageType(buf, 0)
+	version, offset, _ := DecodeUint16(buf, offset)
+	payloadLen, _, _ := DecodeUint32(buf, offset)
 
-	return messageType, int(payloadLen), true
+	return messageType, version, int(payloadLen), true
 }
 
 func EncodeAttachMessage(topic string) []byte {
-	payloadLen := uint16Len + uint32Len + len(topic) + uint64Len
+	return encodeAttachMessage(topic, FlagNone, 0, 0, 0)
+}
 
-	buf := make([]byte, HeaderLen+payloadLen)
-	offset := EncodeHeader(buf, 0, TypeAttach, uint32(payloadLen))
+func EncodeAttachFromOffsetMessage(topic string, topicOffset uint64) []byte {
+	return encodeAttachMessage(topic, FlagUseOffset, topicOffset, 0, 0)
+}
 
-	// Flags.
-	flags := FlagNone
-	offset = EncodeUint16(buf, offset, flags)
-	// Topic.
-	offset = EncodeBytes(buf, offset, []byte(topic))
-	// Offset (unused as flag not set).
-	offset = EncodeUint64(buf, offset, 0)
+// EncodeAttachFromTimestampMessage encodes an ATTACH requesting messages
+// published at or after the given timestamp in unix milliseconds.
+func EncodeAttachFromTimestampMessage(topic string, timestamp uint64) []byte {
+	return encodeAttachMessage(topic, FlagUseTimestamp, 0, timestamp, 0)
+}
 
-	return buf
+// EncodeAttachLastNMessage encodes an ATTACH requesting the last n messages
+// published to the topic.
+func EncodeAttachLastNMessage(topic string, n uint64) []byte {
+	return encodeAttachMessage(topic, FlagUseLastN, 0, 0, n)
 }
 
-func EncodeAttachFromOffsetMessage(topic string, topicOffset uint64) []byte {
-	payloadLen := uint16Len + uint32Len + len(topic) + uint64Len
+func encodeAttachMessage(topic string, flags uint16, topicOffset uint64, timestamp uint64, n uint64) []byte {
+	payloadLen := attachPayloadLen + len(topic)
 
 	buf := make([]byte, HeaderLen+payloadLen)
 	offset := EncodeHeader(buf, 0, TypeAttach, uint32(payloadLen))
 
 	// Flags.
-	flags := FlagUseOffset
 	offset = EncodeUint16(buf, offset, flags)
 	// Topic.
 	offset = EncodeBytes(buf, offset, []byte(topic))
-	// Offset.
+	// Offset (unused unless FlagUseOffset is set).
 	offset = EncodeUint64(buf, offset, topicOffset)
+	// Timestamp (unused unless FlagUseTimestamp is set).
+	offset = EncodeUint64(buf, offset, timestamp)
+	// Last N (unused unless FlagUseLastN is set).
+	EncodeUint64(buf, offset, n)
 
 	return buf
 }
@@ -191,23 +240,50 @@ func EncodeDetachedMessage(topic string) []byte {
 	return buf
 }
 
-func EncodePublishMessage(topic string, seqNum uint64, data []byte) []byte {
-	payloadLen := uint32Len + len(topic) + uint64Len + uint32Len + len(data)
+// EncodeDetachedMessageWithReason encodes a DETACHED message sent when the
+// server detaches the topic without the client requesting it, including an
+// error code and message describing why.
+func EncodeDetachedMessageWithReason(topic string, code ErrorCode, message string) []byte {
+	payloadLen := uint32Len + len(topic) + uint16Len + uint32Len + len(message)
 
 	buf := make([]byte, HeaderLen+payloadLen)
-	offset := EncodeHeader(buf, 0, TypePublish, uint32(payloadLen))
+	offset := EncodeHeader(buf, 0, TypeDetached, uint32(payloadLen))
 
+	// Topic.
 	offset = EncodeBytes(buf, offset, []byte(topic))
-	offset = EncodeUint64(buf, offset, seqNum)
-	offset = EncodeBytes(buf, offset, data)
+	// Code.
+	offset = EncodeUint16(buf, offset, uint16(code))
+	// Message.
+	EncodeBytes(buf, offset, []byte(message))
 
 	return buf
 }
 
-func EncodePublishMessagePrefix(topic string, seqNum uint64, data []byte) []byte {
-	payloadLen := uint32Len + len(topic) + uint64Len + uint32Len + len(data)
+func EncodePublishMessage(topic string, seqNum uint64, data []byte) []byte {
+	return EncodePublishMessageWithKey(topic, seqNum, nil, data)
+}
 
-	buf := make([]byte, HeaderLen+payloadLen-len(data))
+// EncodePublishMessageWithKey encodes a PUBLISH message with the given key.
+// The key is optional, so if empty the message has no key and is encoded the
+// same as EncodePublishMessage.
+func EncodePublishMessageWithKey(topic string, seqNum uint64, key []byte, data []byte) []byte {
+	prefix := EncodePublishMessagePrefix(topic, seqNum, key, data)
+	suffix := EncodePublishMessageSuffix(key)
+
+	buf := make([]byte, 0, len(prefix)+len(data)+len(suffix))
+	buf = append(buf, prefix...)
+	buf = append(buf, data...)
+	buf = append(buf, suffix...)
+	return buf
+}
+
+// EncodePublishMessagePrefix encodes the PUBLISH message up to the data, so
+// the data can be written without copying followed by
+// EncodePublishMessageSuffix.
+func EncodePublishMessagePrefix(topic string, seqNum uint64, key []byte, data []byte) []byte {
+	payloadLen := uint32Len + len(topic) + uint64Len + uint32Len + len(data) + publishSuffixLen(key)
+
+	buf := make([]byte, HeaderLen+payloadLen-len(data)-publishSuffixLen(key))
 	offset := EncodeHeader(buf, 0, TypePublish, uint32(payloadLen))
 
 	offset = EncodeBytes(buf, offset, []byte(topic))
@@ -217,6 +293,50 @@ func EncodePublishMessagePrefix(topic string, seqNum uint64, data []byte) []byte
 	return buf
 }
 
+// EncodePublishMessageSuffix encodes the PUBLISH message fields following the
+// data. The key is only included if not empty, so PUBLISH messages without a
+// key are unchanged for servers that don't support keys. Returns nil if there
+// is no key.
+func EncodePublishMessageSuffix(key []byte) []byte {
+	if len(key) == 0 {
+		return nil
+	}
+
+	buf := make([]byte, publishSuffixLen(key))
+	EncodeBytes(buf, 0, key)
+	return buf
+}
+
+func publishSuffixLen(key []byte) int {
+	if len(key) == 0 {
+		return 0
+	}
+	return uint32Len + len(key)
+}
+
+// EncodePublishBatchMessage encodes a PUBLISH_BATCH containing the given
+// messages, which are all published to the topic with a single sequence
+// number.
+func EncodePublishBatchMessage(topic string, seqNum uint64, messages []BatchMessage) []byte {
+	payloadLen := uint32Len + len(topic) + uint64Len + uint32Len
+	for _, m := range messages {
+		payloadLen += uint32Len + len(m.Key) + uint32Len + len(m.Data)
+	}
+
+	buf := make([]byte, HeaderLen+payloadLen)
+	offset := EncodeHeader(buf, 0, TypePublishBatch, uint32(payloadLen))
+
+	offset = EncodeBytes(buf, offset, []byte(topic))
+	offset = EncodeUint64(buf, offset, seqNum)
+	offset = EncodeUint32(buf, offset, uint32(len(messages)))
+	for _, m := range messages {
+		offset = EncodeBytes(buf, offset, m.Key)
+		offset = EncodeBytes(buf, offset, m.Data)
+	}
+
+	return buf
+}
+
 func EncodeACKMessage(seqNum uint64) []byte {
 	payloadLen := uint64Len
 
@@ -228,6 +348,59 @@ func EncodeACKMessage(seqNum uint64) []byte {
 	return buf
 }
 
+// EncodeACKMessageWithOffset encodes an ACK including the topic offset of the
+// acknowledged message. The offset is only included if the client supports
+// FeatureACKOffset.
+func EncodeACKMessageWithOffset(seqNum uint64, topicOffset uint64) []byte {
+	payloadLen := uint64Len + uint64Len
+
+	buf := make([]byte, HeaderLen+payloadLen)
+	offset := EncodeHeader(buf, 0, TypeACK, uint32(payloadLen))
+
+	offset = EncodeUint64(buf, offset, seqNum)
+	EncodeUint64(buf, offset, topicOffset)
+
+	return buf
+}
+
+// EncodeACKMessageWithOffsets encodes an ACK for a PUBLISH_BATCH including the
+// topic offset of each message in the batch. The offset field contains the
+// offset of the last message.
+func EncodeACKMessageWithOffsets(seqNum uint64, topicOffsets []uint64) []byte {
+	payloadLen := uint64Len + uint64Len + uint32Len + uint64Len*len(topicOffsets)
+
+	buf := make([]byte, HeaderLen+payloadLen)
+	offset := EncodeHeader(buf, 0, TypeACK, uint32(payloadLen))
+
+	offset = EncodeUint64(buf, offset, seqNum)
+	if len(topicOffsets) > 0 {
+		offset = EncodeUint64(buf, offset, topicOffsets[len(topicOffsets)-1])
+	} else {
+		offset = EncodeUint64(buf, offset, 0)
+	}
+	offset = EncodeUint32(buf, offset, uint32(len(topicOffsets)))
+	for _, topicOffset := range topicOffsets {
+		offset = EncodeUint64(buf, offset, topicOffset)
+	}
+
+	return buf
+}
+
+// EncodeNACKMessage encodes a NACK rejecting the publish with the given
+// sequence number.
+func EncodeNACKMessage(seqNum uint64, code ErrorCode, message string) []byte {
+	payloadLen := uint64Len + uint16Len + uint32Len + len(message)
+
+	buf := make([]byte, HeaderLen+payloadLen)
+	offset := EncodeHeader(buf, 0, TypeNACK, uint32(payloadLen))
+
+	offset = EncodeUint64(buf, offset, seqNum)
+	offset = EncodeUint16(buf, offset, uint16(code))
+	EncodeBytes(buf, offset, []byte(message))
+
+	return buf
+}
+
 // Note avoid using, should use EncodeDataMessagePrefix instead to avoid
 // copying data.
 func EncodeDataMessage(topic string, topicOffset uint64, data []byte) []byte {
@@ -279,3 +452,55 @@ func EncodePongMessage(timestamp uint64) []byte {
 
 	return buf
 }
+
+// EncodeErrorMessage encodes an ERROR message, sent by the server before
+// closing the connection due to a protocol error.
+func EncodeErrorMessage(code ErrorCode, message string) []byte {
+	payloadLen := uint16Len + uint32Len + len(message)
+
+	buf := make([]byte, HeaderLen+payloadLen)
+	offset := EncodeHeader(buf, 0, TypeError, uint32(payloadLen))
+
+	offset = EncodeUint16(buf, offset, uint16(code))
+	EncodeBytes(buf, offset, []byte(message))
+
+	return buf
+}
+
+// EncodeConnectMessage encodes a CONNECT message, sent by the client to
+// start the handshake.
+func EncodeConnectMessage(m ConnectMessage) []byte {
+	payloadLen := uint16Len + uint16Len + uint32Len +
+		uint32Len + len(m.ClientID) +
+		uint32Len + len(m.SDKName) +
+		uint32Len + len(m.SDKVersion) +
+		uint32Len + len(m.ProducerID)
+
+	buf := make([]byte, HeaderLen+payloadLen)
+	offset := EncodeHeader(buf, 0, TypeConnect, uint32(payloadLen))
+
+	offset = EncodeUint16(buf, offset, m.MinVersion)
+	offset = EncodeUint16(buf, offset, m.MaxVersion)
+	offset = EncodeUint32(buf, offset, uint32(m.Features))
+	offset = EncodeBytes(buf, offset, []byte(m.ClientID))
+	offset = EncodeBytes(buf, offset, []byte(m.SDKName))
+	offset = EncodeBytes(buf, offset, []byte(m.SDKVersion))
+	EncodeBytes(buf, offset, []byte(m.ProducerID))
+
+	return buf
+}
+
+// EncodeConnectedMessage encodes a CONNECTED message, sent by the server to
+// complete the handshake with the agreed protocol version and features.
+func EncodeConnectedMessage(version uint16, features Features, nodeID string) []byte {
+	payloadLen := uint16Len + uint32Len + uint32Len + len(nodeID)
+
+	buf := make([]byte, HeaderLen+payloadLen)
+	offset := EncodeHeader(buf, 0, TypeConnected, uint32(payloadLen))
+
+	offset = EncodeUint16(buf, offset, version)
+	offset = EncodeUint32(buf, offset, uint32(features))
+	EncodeBytes(buf, offset, []byte(nodeID))
+
+	return buf
+}
@@ -0,0 +1,60 @@
+package utils
+
+// ErrorCode identifies why the server rejected a request.
+type ErrorCode uint16
+
+const (
+	// ErrorCodeUnavailable indicates the server can't currently accept
+	// publishes to the topic, such as if its failing to persist the topic to
+	// disk. The publish may succeed if retried later.
+	ErrorCodeUnavailable = ErrorCode(1)
+	// ErrorCodeTopicDeleted indicates the topic was deleted, so the server
+	// detached its subscribers. Attaching to the topic again subscribes to
+	// a new empty topic.
+	ErrorCodeTopicDeleted = ErrorCode(2)
+	// ErrorCodeMalformedMessage indicates the server received a message it
+	// couldn't decode, so closed the connection.
+	ErrorCodeMalformedMessage = ErrorCode(3)
+	// ErrorCodePayloadTooLarge indicates the server received a message
+	// whose payload exceeds the maximum payload size, so closed the
+	// connection.
+	ErrorCodePayloadTooLarge = ErrorCode(4)
+	// ErrorCodeUnsupportedVersion indicates the client and server don't
+	// support a common protocol version, so the server closed the
+	// connection.
+	ErrorCodeUnsupportedVersion = ErrorCode(5)
+	// ErrorCodeUnexpectedMessage indicates the server received a message it
+	// didn't expect, such as CONNECT sent more than once, so closed the
+	// connection.
+	ErrorCodeUnexpectedMessage = ErrorCode(6)
+	// ErrorCodeDuplicateOffsetUnknown indicates the server discarded a
+	// retried publish since it was already added to the topic, but no longer
+	// knows the offset it was added at.
+	ErrorCodeDuplicateOffsetUnknown = ErrorCode(7)
+	// ErrorCodeSlowSubscriber indicates the client isn't reading messages
+	// fast enough to keep up with its subscriptions.
+	ErrorCodeSlowSubscriber = ErrorCode(8)
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeUnavailable:
+		return "UNAVAILABLE"
+	case ErrorCodeTopicDeleted:
+		return "TOPIC_DELETED"
+	case ErrorCodeMalformedMessage:
+		return "MALFORMED_MESSAGE"
+	case ErrorCodePayloadTooLarge:
+		return "PAYLOAD_TOO_LARGE"
+	case ErrorCodeUnsupportedVersion:
+		return "UNSUPPORTED_VERSION"
+	case ErrorCodeUnexpectedMessage:
+		return "UNEXPECTED_MESSAGE"
+	case ErrorCodeDuplicateOffsetUnknown:
+		return "DUPLICATE_OFFSET_UNKNOWN"
+	case ErrorCodeSlowSubscriber:
+		return "SLOW_SUBSCRIBER"
+	default:
+		return "UNKNOWN"
+	}
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"strings"
+)
+
+// Features is a set of optional protocol features. The client and server
+// agree on the features they both support when connecting, which controls
+// which optional fields are used.
+type Features uint32
+
+const (
+	// FeatureDetachReason indicates the server includes the error code and
+	// message in DETACHED when it detaches a topic without the client
+	// requesting it.
+	FeatureDetachReason = Features(1 << 0)
+	// FeatureAttachFromTime indicates the server supports the ATTACH
+	// timestamp field, to attach from a time.
+	FeatureAttachFromTime = Features(1 << 1)
+	// FeatureACKOffset indicates the server includes the topic offset of the
+	// acknowledged message in ACK, and sends an ACK for each message rather
+	// than acknowledging multiple messages at once.
+	FeatureACKOffset = Features(1 << 2)
+	// FeatureIdempotentPublish indicates the server discards publishes it has
+	// already added to the topic, identified by the CONNECT producer ID and
+	// the PUBLISH sequence number, so retried publishes are only added once.
+	FeatureIdempotentPublish = Features(1 << 3)
+	// FeaturePublishBatch indicates the server accepts PUBLISH_BATCH, and
+	// includes the offset of each message in the batch in ACK if
+	// FeatureACKOffset is also agreed.
+	FeaturePublishBatch = Features(1 << 4)
+	// FeatureAttachLastN indicates the server supports the ATTACH last_n
+	// field, to attach from the last N messages.
+	FeatureAttachLastN = Features(1 << 5)
+
+	// SupportedFeatures contains all features supported by this version.
+	SupportedFeatures = FeatureDetachReason | FeatureAttachFromTime | FeatureACKOffset |
+		FeatureIdempotentPublish | FeaturePublishBatch | FeatureAttachLastN
+)
+
+// Has returns whether f contains all of the given features.
+func (f Features) Has(features Features) bool {
+	return f&features == features
+}
+
+func (f Features) String() string {
+	names := []string{}
+	if f.Has(FeatureDetachReason) {
+		names = append(names, "DETACH_REASON")
+	}
+	if f.Has(FeatureAttachFromTime) {
+		names = append(names, "ATTACH_FROM_TIME")
+	}
+	if f.Has(FeatureACKOffset) {
+		names = append(names, "ACK_OFFSET")
+	}
+	if f.Has(FeatureIdempotentPublish) {
+		names = append(names, "IDEMPOTENT_PUBLISH")
+	}
+	if f.Has(FeaturePublishBatch) {
+		names = append(names, "PUBLISH_BATCH")
+	}
+	if f.Has(FeatureAttachLastN) {
+		names = append(names, "ATTACH_LAST_N")
+	}
+	return strings.Join(names, "|")
+}
@@ -3,15 +3,21 @@ package utils
 type MessageType uint16
 
 const (
-	TypeAttach   = MessageType(1)
-	TypeAttached = MessageType(2)
-	TypeDetach   = MessageType(3)
-	TypeDetached = MessageType(4)
-	TypePublish  = MessageType(5)
-	TypeACK      = MessageType(6)
-	TypeData     = MessageType(7)
-	TypePing     = MessageType(8)
-	TypePong     = MessageType(9)
+	TypeAttach    = MessageType(1)
+	TypeAttached  = MessageType(2)
+	TypeDetach    = MessageType(3)
+	TypeDetached  = MessageType(4)
+	TypePublish   = MessageType(5)
+	TypeACK       = MessageType(6)
+	TypeData      = MessageType(7)
+	TypePing      = MessageType(8)
+	TypePong      = MessageType(9)
+	TypeNACK      = MessageType(10)
+	TypeError     = MessageType(11)
+	TypeConnect   = MessageType(12)
+	TypeConnected = MessageType(13)
+	// TypePublishBatch is only sent if FeaturePublishBatch is agreed.
+	TypePublishBatch = MessageType(14)
 )
 
 func (t MessageType) String() string {
@@ -34,6 +40,16 @@ func (t MessageType) String() string {
 		return "PING"
 	case TypePong:
 		return "PONG"
+	case TypeNACK:
+		return "NACK"
+	case TypeError:
+		return "ERROR"
+	case TypeConnect:
+		return "CONNECT"
+	case TypeConnected:
+		return "CONNECTED"
+	case TypePublishBatch:
+		return "PUBLISH_BATCH"
 	default:
 		return "UNKNOWN"
 	}
@@ -0,0 +1,381 @@
+package utils
+
+// The decoded protocol messages. Decoding never copies []byte fields, so they
+// reference the payload buffer, which may be reused by the next read.
+//
+// All decoders check the bounds of each field, returning ErrMalformedMessage
+// if the payload is truncated or a field length exceeds the payload. Any
+// trailing bytes following the known fields are ignored, so fields can be
+// added to the end of a message without breaking older peers.
+
+type ConnectMessage struct {
+	// MinVersion and MaxVersion are the range of protocol versions the
+	// client supports.
+	MinVersion uint16
+	MaxVersion uint16
+	// Features are the optional features the client supports.
+	Features Features
+	// ClientID identifies the client.
+	ClientID   string
+	SDKName    string
+	SDKVersion string
+	// ProducerID identifies the client when publishing with
+	// FeatureIdempotentPublish. Unlike ClientID it is kept across
+	// reconnects, so the server can detect retried publishes.
+	ProducerID string
+}
+
+type ConnectedMessage struct {
+	// Version is the agreed protocol version.
+	Version uint16
+	// Features are the optional features supported by both the client and
+	// server.
+	Features Features
+	// NodeID identifies the server node.
+	NodeID string
+}
+
+type AttachMessage struct {
+	Flags uint16
+	Topic string
+	// Offset is only used if FlagUseOffset is set.
+	Offset uint64
+	// Timestamp is in unix milliseconds and only used if FlagUseTimestamp
+	// is set.
+	Timestamp uint64
+	// LastN is only used if FlagUseLastN is set.
+	LastN uint64
+}
+
+type AttachedMessage struct {
+	Topic  string
+	Offset uint64
+}
+
+type DetachMessage struct {
+	Topic string
+}
+
+type DetachedMessage struct {
+	Topic string
+	// Code is the reason the server detached the topic, or 0 if the client
+	// requested to detach.
+	Code    ErrorCode
+	Message string
+}
+
+type PublishMessage struct {
+	Topic  string
+	SeqNum uint64
+	// Key is nil if the message has no key.
+	Key  []byte
+	Data []byte
+}
+
+type BatchMessage struct {
+	// Key is nil if the message has no key.
+	Key  []byte
+	Data []byte
+}
+
+type PublishBatchMessage struct {
+	Topic  string
+	SeqNum uint64
+	// Messages contains at least one message.
+	Messages []BatchMessage
+}
+
+type ACKMessage struct {
+	SeqNum uint64
+	// Offset is the topic offset of the acknowledged message, or 0 if the
+	// server didn't include it. If acknowledging a batch this is the offset
+	// of the last message in the batch.
+	Offset uint64
+	// Offsets contains the topic offset of each message when acknowledging a
+	// batch, or nil if the server didn't include them.
+	Offsets []uint64
+}
+
+type NACKMessage struct {
+	SeqNum  uint64
+	Code    ErrorCode
+	Message string
+}
+
+type DataMessage struct {
+	Topic  string
+	Offset uint64
+	Data   []byte
+}
+
+type PingMessage struct {
+	Timestamp uint64
+}
+
+type PongMessage struct {
+	Timestamp uint64
+}
+
+type ErrorMessage struct {
+	Code    ErrorCode
+	Message string
+}
+
+func DecodeConnectMessage(b []byte) (ConnectMessage, error) {
+	d := decoder{buf: b}
+	m := ConnectMessage{
+		MinVersion: d.readUint16(),
+		MaxVersion: d.readUint16(),
+		Features:   Features(d.readUint32()),
+		ClientID:   d.readString(),
+		SDKName:    d.readString(),
+		SDKVersion: d.readString(),
+	}
+	// The producer ID was added after the SDK version so may be missing
+	// from older clients.
+	if d.remaining() > 0 {
+		m.ProducerID = d.readString()
+	}
+	return m, d.err
+}
+
+func DecodeConnectedMessage(b []byte) (ConnectedMessage, error) {
+	d := decoder{buf: b}
+	m := ConnectedMessage{
+		Version:  d.readUint16(),
+		Features: Features(d.readUint32()),
+		NodeID:   d.readString(),
+	}
+	return m, d.err
+}
+
+func DecodeAttachMessage(b []byte) (AttachMessage, error) {
+	d := decoder{buf: b}
+	m := AttachMessage{
+		Flags:  d.readUint16(),
+		Topic:  d.readString(),
+		Offset: d.readUint64(),
+	}
+	// The timestamp and last N fields were added after the offset so may be
+	// missing from older clients.
+	if d.remaining() > 0 {
+		m.Timestamp = d.readUint64()
+		m.LastN = d.readUint64()
+	}
+	return m, d.err
+}
+
+func DecodeAttachedMessage(b []byte) (AttachedMessage, error) {
+	d := decoder{buf: b}
+	m := AttachedMessage{
+		Topic:  d.readString(),
+		Offset: d.readUint64(),
+	}
+	return m, d.err
+}
+
+func DecodeDetachMessage(b []byte) (DetachMessage, error) {
+	d := decoder{buf: b}
+	m := DetachMessage{
+		Topic: d.readString(),
+	}
+	return m, d.err
+}
+
+func DecodeDetachedMessage(b []byte) (DetachedMessage, error) {
+	d := decoder{buf: b}
+	m := DetachedMessage{
+		Topic: d.readString(),
+	}
+	// The reason is only included if the server detached the topic.
+	if d.remaining() > 0 {
+		m.Code = ErrorCode(d.readUint16())
+		m.Message = d.readString()
+	}
+	return m, d.err
+}
+
+func DecodePublishMessage(b []byte) (PublishMessage, error) {
+	d := decoder{buf: b}
+	m := PublishMessage{
+		Topic:  d.readString(),
+		SeqNum: d.readUint64(),
+		Data:   d.readBytes(),
+	}
+	// The key follows the data and is only included if the message has a
+	// key, so PUBLISH messages from clients that don't support keys are
+	// unchanged.
+	if d.remaining() > 0 {
+		m.Key = d.readBytes()
+	}
+	// The key is optional so if empty use nil.
+	if len(m.Key) == 0 {
+		m.Key = nil
+	}
+	return m, d.err
+}
+
+func DecodePublishBatchMessage(b []byte) (PublishBatchMessage, error) {
+	d := decoder{buf: b}
+	m := PublishBatchMessage{
+		Topic:  d.readString(),
+		SeqNum: d.readUint64(),
+	}
+	// Each message has at least the key and data lengths, so check the count
+	// against the remaining bytes before allocating.
+	count := d.readCount(uint32Len + uint32Len)
+	if count == 0 && d.err == nil {
+		d.err = ErrMalformedMessage
+	}
+	m.Messages = make([]BatchMessage, 0, count)
+	for i := 0; i != count; i++ {
+		bm := BatchMessage{
+			Key:  d.readBytes(),
+			Data: d.readBytes(),
+		}
+		// The key is optional so if empty use nil.
+		if len(bm.Key) == 0 {
+			bm.Key = nil
+		}
+		m.Messages = append(m.Messages, bm)
+	}
+	return m, d.err
+}
+
+func DecodeACKMessage(b []byte) (ACKMessage, error) {
+	d := decoder{buf: b}
+	m := ACKMessage{
+		SeqNum: d.readUint64(),
+	}
+	// The offset is only included if FeatureACKOffset is agreed.
+	if d.remaining() > 0 {
+		m.Offset = d.readUint64()
+	}
+	// The offsets are only included when acknowledging a batch.
+	if d.remaining() > 0 {
+		count := d.readCount(uint64Len)
+		m.Offsets = make([]uint64, 0, count)
+		for i := 0; i != count; i++ {
+			m.Offsets = append(m.Offsets, d.readUint64())
+		}
+	}
+	return m, d.err
+}
+
+func DecodeNACKMessage(b []byte) (NACKMessage, error) {
+	d := decoder{buf: b}
+	m := NACKMessage{
+		SeqNum:  d.readUint64(),
+		Code:    ErrorCode(d.readUint16()),
+		Message: d.readString(),
+	}
+	return m, d.err
+}
+
+func DecodeDataMessage(b []byte) (DataMessage, error) {
+	d := decoder{buf: b}
+	m := DataMessage{
+		Topic:  d.readString(),
+		Offset: d.readUint64(),
+		Data:   d.readBytes(),
+	}
+	return m, d.err
+}
+
+func DecodePingMessage(b []byte) (PingMessage, error) {
+	d := decoder{buf: b}
+	m := PingMessage{
+		Timestamp: d.readUint64(),
+	}
+	return m, d.err
+}
+
+func DecodePongMessage(b []byte) (PongMessage, error) {
+	d := decoder{buf: b}
+	m := PongMessage{
+		Timestamp: d.readUint64(),
+	}
+	return m, d.err
+}
+
+func DecodeErrorMessage(b []byte) (ErrorMessage, error) {
+	d := decoder{buf: b}
+	m := ErrorMessage{
+		Code:    ErrorCode(d.readUint16()),
+		Message: d.readString(),
+	}
+	return m, d.err
+}
+
+// decoder decodes fields from a message payload in order. Once a field fails
+// to decode the error is kept and all following fields decode as zero values,
+// so the error only needs to be checked once all fields are decoded.
+type decoder struct {
+	buf    []byte
+	offset int
+	err    error
+}
+
+func (d *decoder) readUint16() uint16 {
+	if d.err != nil {
+		return 0
+	}
+	var n uint16
+	n, d.offset, d.err = DecodeUint16(d.buf, d.offset)
+	return n
+}
+
+func (d *decoder) readUint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	var n uint32
+	n, d.offset, d.err = DecodeUint32(d.buf, d.offset)
+	return n
+}
+
+func (d *decoder) readUint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var n uint64
+	n, d.offset, d.err = DecodeUint64(d.buf, d.offset)
+	return n
+}
+
+func (d *decoder) readBytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	var b []byte
+	b, d.offset, d.err = DecodeBytes(d.buf, d.offset)
+	return b
+}
+
+// readCount reads the number of elements in a list, where each element
+// is at least minLen bytes. If the remaining bytes can't contain that many
+// elements the message is malformed, which avoids allocating a large list
+// for an invalid count.
+func (d *decoder) readCount(minLen int) int {
+	n := d.readUint32()
+	if d.err != nil {
+		return 0
+	}
+	if uint64(n)*uint64(minLen) > uint64(d.remaining()) {
+		d.err = ErrMalformedMessage
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) readString() string {
+	return string(d.readBytes())
+}
+
+// remaining returns the number of bytes left to decode.
+func (d *decoder) remaining() int {
+	if d.err != nil {
+		return 0
+	}
+	return len(d.buf) - d.offset
+}
@@ -0,0 +1,321 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeAttachMessage(t *testing.T) {
+	m, err := DecodeAttachMessage(EncodeAttachLastNMessage("foo", 10)[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, AttachMessage{
+		Flags: FlagUseLastN,
+		Topic: "foo",
+		LastN: 10,
+	}, m)
+}
+
+// Tests decoding an ATTACH from an older client without the timestamp and
+// last N fields.
+func TestDecodeAttachMessage_WithoutTimestamp(t *testing.T) {
+	b := EncodeAttachFromOffsetMessage("foo", 20)
+	m, err := DecodeAttachMessage(b[HeaderLen : len(b)-16])
+	assert.Nil(t, err)
+	assert.Equal(t, AttachMessage{
+		Flags:  FlagUseOffset,
+		Topic:  "foo",
+		Offset: 20,
+	}, m)
+}
+
+func TestDecodeDetachedMessage(t *testing.T) {
+	m, err := DecodeDetachedMessage(EncodeDetachedMessage("foo")[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, DetachedMessage{
+		Topic: "foo",
+	}, m)
+
+	m, err = DecodeDetachedMessage(EncodeDetachedMessageWithReason("foo", ErrorCodeTopicDeleted, "deleted")[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, DetachedMessage{
+		Topic:   "foo",
+		Code:    ErrorCodeTopicDeleted,
+		Message: "deleted",
+	}, m)
+}
+
+func TestDecodePublishMessage(t *testing.T) {
+	m, err := DecodePublishMessage(EncodePublishMessageWithKey("foo", 10, []byte("key"), []byte("bar"))[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, PublishMessage{
+		Topic:  "foo",
+		SeqNum: 10,
+		Key:    []byte("key"),
+		Data:   []byte("bar"),
+	}, m)
+
+	m, err = DecodePublishMessage(EncodePublishMessage("foo", 10, []byte("bar"))[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Nil(t, m.Key)
+
+	// Messages without a key must still be decoded from clients that don't
+	// support keys, which encode the data as the last field.
+	buf := make([]byte, uint32Len+3+uint64Len+uint32Len+3)
+	offset := EncodeBytes(buf, 0, []byte("foo"))
+	offset = EncodeUint64(buf, offset, 10)
+	EncodeBytes(buf, offset, []byte("bar"))
+	m, err = DecodePublishMessage(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, PublishMessage{
+		Topic:  "foo",
+		SeqNum: 10,
+		Data:   []byte("bar"),
+	}, m)
+}
+
+// Tests decoding a truncated message or a message with a field length
+// exceeding the payload returns an error rather than panicking.
+func TestDecodePublishMessage_Malformed(t *testing.T) {
+	b := EncodePublishMessage("foo", 10, []byte("bar"))[HeaderLen:]
+	for i := 0; i != len(b); i++ {
+		_, err := DecodePublishMessage(b[:i])
+		assert.Equal(t, ErrMalformedMessage, err)
+	}
+
+	// Set the topic length to the max uint32.
+	b = EncodePublishMessage("foo", 10, []byte("bar"))[HeaderLen:]
+	EncodeUint32(b, 0, uint32Max)
+	_, err := DecodePublishMessage(b)
+	assert.Equal(t, ErrMalformedMessage, err)
+}
+
+func TestDecodePublishBatchMessage(t *testing.T) {
+	messages := []BatchMessage{
+		{Key: []byte("key"), Data: []byte("bar")},
+		{Key: nil, Data: []byte("car")},
+	}
+	m, err := DecodePublishBatchMessage(EncodePublishBatchMessage("foo", 10, messages)[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, PublishBatchMessage{
+		Topic:    "foo",
+		SeqNum:   10,
+		Messages: messages,
+	}, m)
+}
+
+func TestDecodePublishBatchMessage_Malformed(t *testing.T) {
+	b := EncodePublishBatchMessage("foo", 10, []BatchMessage{
+		{Key: []byte("key"), Data: []byte("bar")},
+	})[HeaderLen:]
+	for i := 0; i != len(b); i++ {
+		_, err := DecodePublishBatchMessage(b[:i])
+		assert.Equal(t, ErrMalformedMessage, err)
+	}
+
+	// Set the message count to the max uint32.
+	EncodeUint32(b, uint32Len+len("foo")+uint64Len, uint32Max)
+	_, err := DecodePublishBatchMessage(b)
+	assert.Equal(t, ErrMalformedMessage, err)
+
+	// A batch must contain at least one message.
+	_, err = DecodePublishBatchMessage(EncodePublishBatchMessage("foo", 10, nil)[HeaderLen:])
+	assert.Equal(t, ErrMalformedMessage, err)
+}
+
+func TestDecodeACKMessage(t *testing.T) {
+	m, err := DecodeACKMessage(EncodeACKMessageWithOffset(10, 0xff)[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, ACKMessage{
+		SeqNum: 10,
+		Offset: 0xff,
+	}, m)
+}
+
+func TestDecodeACKMessage_WithOffsets(t *testing.T) {
+	m, err := DecodeACKMessage(EncodeACKMessageWithOffsets(10, []uint64{0xa, 0xf, 0xff})[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, ACKMessage{
+		SeqNum:  10,
+		Offset:  0xff,
+		Offsets: []uint64{0xa, 0xf, 0xff},
+	}, m)
+}
+
+func TestDecodeACKMessage_WithoutOffset(t *testing.T) {
+	m, err := DecodeACKMessage(EncodeACKMessage(10)[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, ACKMessage{
+		SeqNum: 10,
+	}, m)
+}
+
+func TestDecodeErrorMessage(t *testing.T) {
+	m, err := DecodeErrorMessage(EncodeErrorMessage(ErrorCodeMalformedMessage, "bad")[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, ErrorMessage{
+		Code:    ErrorCodeMalformedMessage,
+		Message: "bad",
+	}, m)
+}
+
+func TestDecodeConnectMessage(t *testing.T) {
+	connect := ConnectMessage{
+		MinVersion: 1,
+		MaxVersion: 3,
+		Features:   FeatureDetachReason,
+		ClientID:   "a1b2c3",
+		SDKName:    "figg-go",
+		SDKVersion: "1.2.3",
+		ProducerID: "d4e5f6",
+	}
+	m, err := DecodeConnectMessage(EncodeConnectMessage(connect)[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, connect, m)
+}
+
+func TestDecodeConnectMessage_WithoutProducerID(t *testing.T) {
+	// Encode the message without the producer ID field, as sent by older
+	// clients.
+	b := EncodeConnectMessage(ConnectMessage{
+		MinVersion: 1,
+		MaxVersion: 1,
+		ClientID:   "a1b2c3",
+		SDKName:    "figg-go",
+		SDKVersion: "1.2.3",
+	})[HeaderLen:]
+	b = b[:len(b)-uint32Len]
+
+	m, err := DecodeConnectMessage(b)
+	assert.Nil(t, err)
+	assert.Equal(t, ConnectMessage{
+		MinVersion: 1,
+		MaxVersion: 1,
+		ClientID:   "a1b2c3",
+		SDKName:    "figg-go",
+		SDKVersion: "1.2.3",
+	}, m)
+}
+
+func TestDecodeConnectedMessage(t *testing.T) {
+	m, err := DecodeConnectedMessage(EncodeConnectedMessage(2, SupportedFeatures, "node-1")[HeaderLen:])
+	assert.Nil(t, err)
+	assert.Equal(t, ConnectedMessage{
+		Version:  2,
+		Features: SupportedFeatures,
+		NodeID:   "node-1",
+	}, m)
+}
+
+func FuzzDecodeConnectMessage(f *testing.F) {
+	f.Add(EncodeConnectMessage(ConnectMessage{
+		MinVersion: 1,
+		MaxVersion: 1,
+		Features:   SupportedFeatures,
+		ClientID:   "a1b2c3",
+		SDKName:    "figg-go",
+		SDKVersion: "1.2.3",
+	})[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeConnectMessage(b)
+	})
+}
+
+func FuzzDecodeConnectedMessage(f *testing.F) {
+	f.Add(EncodeConnectedMessage(1, SupportedFeatures, "node-1")[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeConnectedMessage(b)
+	})
+}
+
+func FuzzDecodeAttachMessage(f *testing.F) {
+	f.Add(EncodeAttachMessage("foo")[HeaderLen:])
+	f.Add(EncodeAttachFromOffsetMessage("foo", 10)[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeAttachMessage(b)
+	})
+}
+
+func FuzzDecodeAttachedMessage(f *testing.F) {
+	f.Add(EncodeAttachedMessage("foo", 10)[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeAttachedMessage(b)
+	})
+}
+
+func FuzzDecodeDetachMessage(f *testing.F) {
+	f.Add(EncodeDetachMessage("foo")[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeDetachMessage(b)
+	})
+}
+
+func FuzzDecodeDetachedMessage(f *testing.F) {
+	f.Add(EncodeDetachedMessage("foo")[HeaderLen:])
+	f.Add(EncodeDetachedMessageWithReason("foo", ErrorCodeTopicDeleted, "deleted")[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeDetachedMessage(b)
+	})
+}
+
+func FuzzDecodePublishMessage(f *testing.F) {
+	f.Add(EncodePublishMessage("foo", 10, []byte("bar"))[HeaderLen:])
+	f.Add(EncodePublishMessageWithKey("foo", 10, []byte("key"), []byte("bar"))[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodePublishMessage(b)
+	})
+}
+
+func FuzzDecodePublishBatchMessage(f *testing.F) {
+	f.Add(EncodePublishBatchMessage("foo", 10, []BatchMessage{
+		{Key: []byte("key"), Data: []byte("bar")},
+		{Key: nil, Data: []byte("car")},
+	})[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodePublishBatchMessage(b)
+	})
+}
+
+func FuzzDecodeACKMessage(f *testing.F) {
+	f.Add(EncodeACKMessage(10)[HeaderLen:])
+	f.Add(EncodeACKMessageWithOffset(10, 0xff)[HeaderLen:])
+	f.Add(EncodeACKMessageWithOffsets(10, []uint64{0xa, 0xff})[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeACKMessage(b)
+	})
+}
+
+func FuzzDecodeNACKMessage(f *testing.F) {
+	f.Add(EncodeNACKMessage(10, ErrorCodeUnavailable, "degraded")[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeNACKMessage(b)
+	})
+}
+
+func FuzzDecodeDataMessage(f *testing.F) {
+	f.Add(EncodeDataMessage("foo", 10, []byte("bar"))[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeDataMessage(b)
+	})
+}
+
+func FuzzDecodePingMessage(f *testing.F) {
+	f.Add(EncodePingMessage(10)[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodePingMessage(b)
+	})
+}
+
+func FuzzDecodePongMessage(f *testing.F) {
+	f.Add(EncodePongMessage(10)[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodePongMessage(b)
+	})
+}
+
+func FuzzDecodeErrorMessage(f *testing.F) {
+	f.Add(EncodeErrorMessage(ErrorCodeMalformedMessage, "bad")[HeaderLen:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		DecodeErrorMessage(b)
+	})
+}